@@ -2,39 +2,60 @@
 package builtin
 
 import (
+	"github.com/paulsonkoly/calc/types/bytecode"
 	"github.com/paulsonkoly/calc/types/compresult"
+	"github.com/paulsonkoly/calc/types/dbginfo"
 	"github.com/paulsonkoly/calc/types/node"
+	"github.com/paulsonkoly/calc/types/value"
 )
 
-// Load compiles the built in functions and adds them to cr.
+// Load compiles the built in functions, including the registered native
+// functions, and adds them to cr.
 func Load(cr compresult.Type) {
 	for _, fun := range all {
 		fNode := fun.STRewrite(node.SymTbl{})
 		node.ByteCodeNoStck(fNode, cr)
 	}
+	for _, fun := range natives {
+		fNode := fun.STRewrite(node.SymTbl{})
+		node.ByteCodeNoStck(fNode, cr)
+	}
+}
+
+// Size is the length of the code Load compiles, the code of the builtin
+// functions at the start of the code segment.
+func Size() int {
+	cs := []bytecode.Type{}
+	ds := []value.Type{}
+	dbg := make(dbginfo.Type)
+	lines := dbginfo.Lines{}
+	scopes := dbginfo.Scopes{}
+	modules := make(map[string]bool)
+	Load(compresult.Type{CS: &cs, DS: &ds, Dbg: &dbg, Lines: &lines, Scopes: &scopes, Modules: &modules})
+	return len(cs)
 }
 
 var all = [...]node.Assign{
 	readF,
 	writeF,
-	atonF,
-	toaF,
 	exitF,
 	fromToF,
 	indicesF,
 	elemsF,
+	keysF,
+	valuesF,
+	entriesF,
+	errorF,
 }
 
 var readF = node.Assign{VarRef: node.Name("read"), Value: node.Function{Parameters: node.List{Elems: []node.Type{}}, Body: node.Read{}}}
 
 var writeF = node.Assign{VarRef: node.Name("write"), Value: node.Function{Parameters: node.List{Elems: []node.Type{v}}, Body: node.Write{Value: v}}}
 
-var atonF = node.Assign{VarRef: node.Name("aton"), Value: node.Function{Parameters: node.List{Elems: []node.Type{v}}, Body: node.Aton{Value: v}}}
-
-var toaF = node.Assign{VarRef: node.Name("toa"), Value: node.Function{Parameters: node.List{Elems: []node.Type{v}}, Body: node.Toa{Value: v}}}
-
 var exitF = node.Assign{VarRef: node.Name("exit"), Value: node.Function{Parameters: node.List{Elems: []node.Type{v}}, Body: node.Exit{Value: v}}}
 
+var errorF = node.Assign{VarRef: node.Name("error"), Value: node.Function{Parameters: node.List{Elems: []node.Type{v}}, Body: node.Error{Value: v}}}
+
 var fromToF = node.Assign{
 	VarRef: node.Name("fromto"),
 	Value: node.Function{
@@ -93,6 +114,41 @@ var elemsF = node.Assign{
 	},
 }
 
+var keysF = mapIterator("keys", node.IndexAt{Ary: k, At: i})
+
+var valuesF = mapIterator("values", node.IndexAt{Ary: a, At: node.IndexAt{Ary: k, At: i}})
+
+var entriesF = mapIterator("entries",
+	node.List{Elems: []node.Type{node.IndexAt{Ary: k, At: i}, node.IndexAt{Ary: a, At: node.IndexAt{Ary: k, At: i}}}})
+
+// mapIterator defines an iterator named name over the map a, yielding the
+// value target for each key k[i].
+func mapIterator(name string, target node.Type) node.Assign {
+	return node.Assign{
+		VarRef: node.Name(name),
+		Value: node.Function{
+			Parameters: node.List{Elems: []node.Type{a}},
+			Body: node.Block{
+				Body: []node.Type{
+					node.Assign{VarRef: k, Value: node.Keys{Value: a}},
+					node.Assign{VarRef: i, Value: node.Int(0)},
+					node.While{
+						Condition: node.BinOp{Op: "<", Left: i, Right: node.UnOp{Op: "#", Target: k}},
+						Body: node.Block{
+							Body: []node.Type{
+								node.Yield{Target: target},
+								node.Assign{VarRef: i, Value: node.BinOp{Op: "+", Left: i, Right: node.Int(1)}},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
 var v = node.Name("v")
 var a = node.Name("a")
 var b = node.Name("b")
+var i = node.Name("i")
+var k = node.Name("k")
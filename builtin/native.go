@@ -0,0 +1,84 @@
+package builtin
+
+import (
+	"math/big"
+	"strconv"
+
+	"github.com/paulsonkoly/calc/types/node"
+	"github.com/paulsonkoly/calc/types/value"
+	"github.com/paulsonkoly/calc/vm"
+)
+
+// natives are the registered native functions.
+var natives []node.Assign
+
+// Register registers the native function fn named name with arity number of
+// parameters.
+//
+// Load defines registered functions in the global scope as regular function
+// values, thus they have to be registered before Load. Registering a name
+// again overrides the earlier registration. Register is not safe for
+// concurrent use.
+func Register(name string, arity int, fn value.NativeFunc) {
+	natives = append(natives, node.Assign{VarRef: node.Name(name), Value: node.Native{Value: value.NewNative(name, arity, fn)}})
+}
+
+// Native is the registered native function named name.
+func Native(name string) (value.Type, bool) {
+	for i := len(natives) - 1; i >= 0; i-- {
+		if natives[i].VarRef == node.Name(name) {
+			return natives[i].Value.(node.Native).Value, true
+		}
+	}
+	return value.Nil, false
+}
+
+func init() {
+	Register("aton", 1, aton)
+	Register("toa", 1, toa)
+	Register("kind", 1, errorField(func(e value.ErrorData) value.Type { return value.NewString(e.Kind) }))
+	Register("message", 1, errorField(func(e value.ErrorData) value.Type { return value.NewString(e.Message) }))
+	Register("payload", 1, errorField(func(e value.ErrorData) value.Type { return e.Payload }))
+}
+
+// aton converts a string to an int or a float.
+func aton(args []value.Type) (value.Type, error) {
+	s, ok := args[0].ToString()
+	if !ok {
+		return value.Nil, value.ErrType
+	}
+
+	if v, err := strconv.Atoi(s); err == nil {
+		return value.NewInt(v), nil
+	}
+
+	if v, ok := new(big.Int).SetString(s, 10); ok {
+		return value.NewBigInt(v), nil
+	}
+
+	if v, err := strconv.ParseFloat(s, 64); err == nil {
+		return value.NewFloat(v), nil
+	}
+
+	return value.Nil, vm.ErrConversion
+}
+
+// toa converts any value to a string.
+func toa(args []value.Type) (value.Type, error) {
+	return value.NewString(args[0].String()), nil
+}
+
+// errorField is a native function returning field of an error value.
+func errorField(field func(value.ErrorData) value.Type) value.NativeFunc {
+	return func(args []value.Type) (value.Type, error) {
+		if args[0].IsNil() {
+			return value.Nil, value.ErrNil
+		}
+
+		e, ok := args[0].ToError()
+		if !ok {
+			return value.Nil, value.ErrType
+		}
+		return field(e), nil
+	}
+}
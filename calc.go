@@ -0,0 +1,150 @@
+// Package calc embeds the calc interpreter in Go programs.
+//
+//	i := calc.New()
+//
+//	v, err := i.Eval("1 + 2")
+//	if err != nil {
+//	  // lexer, parser or runtime error
+//	}
+//
+//	i.SetGlobal("x", value.NewInt(3))
+//	f, _ := i.Eval("(y) -> x * y")
+//	v, err = i.Call(f, value.NewInt(2))
+//
+// ToValue and FromValue convert between Go values and calc values.
+//
+// WithLimits and EvalContext limit the resources used by untrusted code.
+//
+// The interpreter doesn't depend on the command line flags of the calc command
+// and doesn't report errors to stdout, errors are returned to the caller. The
+// read and write builtins use the streams set by WithIn and WithOut, by
+// default read sees end of input and write discards its output.
+//
+// exit stops the evaluation, Eval returns a *vm.ExitError with the exit status
+// instead of ending the Go program.
+package calc
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/paulsonkoly/calc/builtin"
+	"github.com/paulsonkoly/calc/memory"
+	"github.com/paulsonkoly/calc/parser"
+	"github.com/paulsonkoly/calc/types/bytecode"
+	"github.com/paulsonkoly/calc/types/compresult"
+	"github.com/paulsonkoly/calc/types/dbginfo"
+	"github.com/paulsonkoly/calc/types/node"
+	"github.com/paulsonkoly/calc/types/value"
+	"github.com/paulsonkoly/calc/vm"
+)
+
+// Interpreter is a calc interpreter. The state of the interpreter, such as the
+// global variables, is kept between evaluations.
+//
+// An Interpreter is not safe for concurrent use.
+type Interpreter struct {
+	m      *memory.Type
+	vm     *vm.Type
+	dir    string
+	vmOpts []vm.Option
+}
+
+// Option is an interpreter option.
+type Option func(*Interpreter)
+
+// WithDir sets the directory imports are relative to. The default is the
+// current working directory.
+func WithDir(dir string) Option { return func(i *Interpreter) { i.dir = dir } }
+
+// WithIn sets the reader the read builtin reads from.
+func WithIn(r io.Reader) Option {
+	return func(i *Interpreter) { i.vmOpts = append(i.vmOpts, vm.WithIn(r)) }
+}
+
+// WithOut sets the writer the write builtin writes to.
+func WithOut(w io.Writer) Option {
+	return func(i *Interpreter) { i.vmOpts = append(i.vmOpts, vm.WithOut(w)) }
+}
+
+// WithErrOut sets the writer errors are reported to, in the format of the calc
+// command.
+func WithErrOut(w io.Writer) Option {
+	return func(i *Interpreter) { i.vmOpts = append(i.vmOpts, vm.WithErrOut(w)) }
+}
+
+// WithHook adds a hook called before executing each instruction, such as a
+// debugger.
+func WithHook(h vm.Hook) Option {
+	return func(i *Interpreter) { i.vmOpts = append(i.vmOpts, vm.WithHook(h)) }
+}
+
+// WithTrace logs the executed instructions selected by filter to w.
+func WithTrace(w io.Writer, filter vm.TraceFilter) Option {
+	return func(i *Interpreter) { i.vmOpts = append(i.vmOpts, vm.WithTrace(w, filter)) }
+}
+
+// WithLimits sets the execution limits for running untrusted code. Exceeding a
+// limit is a runtime error.
+func WithLimits(l vm.Limits) Option {
+	return func(i *Interpreter) { i.vmOpts = append(i.vmOpts, vm.WithLimits(l)) }
+}
+
+// New creates a new interpreter with the builtin functions loaded.
+func New(opts ...Option) *Interpreter {
+	cs := []bytecode.Type{}
+	ds := []value.Type{}
+	dbg := make(dbginfo.Type)
+	lines := dbginfo.Lines{}
+	scopes := dbginfo.Scopes{}
+	modules := make(map[string]bool)
+	cr := compresult.Type{CS: &cs, DS: &ds, Dbg: &dbg, Lines: &lines, Scopes: &scopes, Modules: &modules}
+
+	builtin.Load(cr)
+
+	i := &Interpreter{
+		m:      memory.New(),
+		dir:    ".",
+		vmOpts: []vm.Option{vm.WithIn(strings.NewReader("")), vm.WithOut(io.Discard), vm.WithErrOut(io.Discard)},
+	}
+
+	for _, opt := range opts {
+		opt(i)
+	}
+
+	i.vm = vm.New(i.m, cr, i.vmOpts...)
+
+	// define the builtin functions
+	if _, err := i.vm.Run(false); err != nil {
+		panic(err)
+	}
+
+	return i
+}
+
+// Eval evaluates the calc source code src. It returns the result of the last
+// statement, or the first error. src is parsed as a whole, if it doesn't parse
+// nothing of it runs.
+func (i *Interpreter) Eval(src string) (value.Type, error) {
+	return node.Eval(src, i.dir, parser.Type{}, i.vm)
+}
+
+// EvalContext is Eval stopping the evaluation with an error when ctx is done.
+func (i *Interpreter) EvalContext(ctx context.Context, src string) (value.Type, error) {
+	i.vm.SetContext(ctx)
+	defer i.vm.SetContext(context.Background())
+
+	return i.Eval(src)
+}
+
+// SetGlobal sets the global variable name to v.
+func (i *Interpreter) SetGlobal(name string, v value.Type) { i.m.SetGlobal(name, v) }
+
+// GetGlobal is the value of the global variable name, nil if it's not defined.
+func (i *Interpreter) GetGlobal(name string) value.Type { return i.m.LookUpGlobal(name) }
+
+// Call calls the calc function fn with args, and returns its result.
+func (i *Interpreter) Call(fn value.Type, args ...value.Type) (value.Type, error) {
+	return i.vm.Call(fn, args...)
+}
@@ -0,0 +1,416 @@
+package calc_test
+
+import (
+	"context"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paulsonkoly/calc"
+	"github.com/paulsonkoly/calc/memory"
+	"github.com/paulsonkoly/calc/types/bytecode"
+	"github.com/paulsonkoly/calc/types/dbginfo"
+	"github.com/paulsonkoly/calc/types/node"
+	"github.com/paulsonkoly/calc/types/value"
+	"github.com/paulsonkoly/calc/vm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEval(t *testing.T) {
+	i := calc.New()
+
+	v, err := i.Eval("x = 3\nf = (a) -> {\n  a * x\n}\nf(2)")
+	require.NoError(t, err)
+	assert.Equal(t, value.NewInt(6), v)
+
+	v, err = i.Eval("f(x)")
+	require.NoError(t, err)
+	assert.Equal(t, value.NewInt(9), v)
+}
+
+func TestEvalErrors(t *testing.T) {
+	i := calc.New()
+
+	_, err := i.Eval("1 +")
+	require.Error(t, err)
+
+	_, err = i.Eval("1 / 0")
+	require.Error(t, err)
+
+	v, err := i.Eval("1 + 1")
+	require.NoError(t, err)
+	assert.Equal(t, value.NewInt(2), v)
+}
+
+func TestEvalParseErrors(t *testing.T) {
+	for _, src := range []string{"w = ]", "x = [1,", `"abc`, "{", "y = }", "x = 1\nw = ]"} {
+		t.Run(src, func(t *testing.T) {
+			var errOut strings.Builder
+			i := calc.New(calc.WithErrOut(&errOut))
+
+			_, err := i.Eval(src)
+			require.Error(t, err)
+			assert.Contains(t, errOut.String(), "\nat ")
+			// nothing runs if the source doesn't parse
+			assert.Equal(t, value.Nil, i.GetGlobal("x"))
+		})
+	}
+}
+
+func TestRuntimeError(t *testing.T) {
+	var errOut strings.Builder
+
+	i := calc.New(calc.WithErrOut(&errOut))
+
+	_, err := i.Eval("f = (a, b) -> a / b\ng = (x) -> f(x, 0) + 1\ng(3)")
+	require.Error(t, err)
+
+	var rErr *vm.RuntimeError
+	require.ErrorAs(t, err, &rErr)
+	assert.ErrorIs(t, err, value.ErrZeroDiv)
+	assert.Equal(t, "zero division", rErr.Kind)
+	assert.Equal(t, bytecode.DIV, rErr.Instr.OpCode())
+	assert.Equal(t, []value.Type{value.NewInt(3), value.NewInt(0)}, rErr.Values)
+
+	require.Len(t, rErr.Contexts, 1)
+	calls := rErr.Contexts[0].Calls
+	require.Len(t, calls, 2)
+	assert.Equal(t, "f", calls[0].Name)
+	assert.Equal(t, []value.Type{value.NewInt(3), value.NewInt(0)}, calls[0].Args)
+	assert.Equal(t, "g", calls[1].Name)
+
+	require.NotNil(t, rErr.Loc)
+	assert.Equal(t, dbginfo.Pos{Line: 1, Col: 15}, rErr.Loc.Pos)
+	assert.Equal(t, "f = (a, b) -> a / b", rErr.Loc.Text)
+	assert.Equal(t, "              ^~~~^", rErr.Loc.Caret())
+	require.NotNil(t, calls[0].Loc)
+	assert.Equal(t, dbginfo.Pos{Line: 2, Col: 12}, calls[0].Loc.Pos)
+	require.NotNil(t, calls[1].Loc)
+	assert.Equal(t, dbginfo.Pos{Line: 3, Col: 1}, calls[1].Loc.Pos)
+	assert.EqualError(t, err, "1:15: division by zero")
+
+	var dump strings.Builder
+	rErr.Dump(&dump)
+	assert.Equal(t, dump.String(), errOut.String())
+	assert.Contains(t, dump.String(), "RUNTIME ERROR : division by zero")
+}
+
+func TestTailCall(t *testing.T) {
+	var errOut strings.Builder
+
+	i := calc.New(calc.WithErrOut(&errOut), calc.WithLimits(vm.Limits{Depth: 10}))
+
+	v, err := i.Eval("f = (n, acc) -> if n <= 0 acc else f(n - 1, acc + n)\nf(1000, 0)")
+	require.NoError(t, err)
+	assert.Equal(t, value.NewInt(500500), v)
+
+	_, err = i.Eval("g = (n) -> if n <= 0 1 / n else g(n - 1)\nh = (n) -> 1 + g(n)\nh(5)")
+	var rErr *vm.RuntimeError
+	require.ErrorAs(t, err, &rErr)
+
+	require.Len(t, rErr.Contexts, 1)
+	calls := rErr.Contexts[0].Calls
+	require.Len(t, calls, 2)
+	assert.Equal(t, "g", calls[0].Name)
+	assert.Equal(t, []value.Type{value.NewInt(0)}, calls[0].Args)
+	assert.Equal(t, 5, calls[0].Elided)
+	require.NotNil(t, calls[0].Loc)
+	assert.Equal(t, dbginfo.Pos{Line: 1, Col: 33}, calls[0].Loc.Pos)
+	assert.Equal(t, "h", calls[1].Name)
+	assert.Equal(t, 0, calls[1].Elided)
+	assert.Contains(t, errOut.String(), "... tail calls elided: 5\n")
+
+	errOut.Reset()
+	_, err = i.Eval("h(1)")
+	require.Error(t, err)
+	assert.Contains(t, errOut.String(), "... tail calls elided: 1\n")
+}
+
+func TestExit(t *testing.T) {
+	var out strings.Builder
+	i := calc.New(calc.WithOut(&out), calc.WithLimits(vm.Limits{Instructions: 1000}))
+
+	_, err := i.Eval("write(\"a\")\ntry exit(3) catch e 1\nwrite(\"b\")")
+	var exit *vm.ExitError
+	require.ErrorAs(t, err, &exit)
+	assert.Equal(t, 3, exit.Status)
+	assert.ErrorIs(t, err, vm.ErrStopped)
+	assert.Equal(t, "a", out.String())
+
+	v, err := i.Eval("1 + 1")
+	require.NoError(t, err)
+	assert.Equal(t, value.NewInt(2), v)
+}
+
+func TestGlobals(t *testing.T) {
+	i := calc.New()
+
+	i.SetGlobal("x", value.NewInt(4))
+	v, err := i.Eval("y = x * 2")
+	require.NoError(t, err)
+	assert.Equal(t, value.NewInt(8), v)
+
+	assert.Equal(t, value.NewInt(8), i.GetGlobal("y"))
+	assert.Equal(t, value.Nil, i.GetGlobal("z"))
+}
+
+func TestCall(t *testing.T) {
+	i := calc.New()
+
+	f, err := i.Eval("(a, b) -> a - b")
+	require.NoError(t, err)
+
+	v, err := i.Call(f, value.NewInt(5), value.NewInt(3))
+	require.NoError(t, err)
+	assert.Equal(t, value.NewInt(2), v)
+
+	v, err = i.Call(f, value.NewInt(1), value.NewInt(1))
+	require.NoError(t, err)
+	assert.Equal(t, value.NewInt(0), v)
+
+	_, err = i.Call(f, value.NewInt(1))
+	assert.ErrorIs(t, err, vm.ErrArity)
+
+	_, err = i.Call(value.NewInt(1))
+	assert.ErrorIs(t, err, value.ErrType)
+
+	v, err = i.Call(i.GetGlobal("toa"), value.NewInt(12))
+	require.NoError(t, err)
+	assert.Equal(t, "12", calc.FromValue(v))
+
+	v, err = i.Eval("x = 1")
+	require.NoError(t, err)
+	assert.Equal(t, value.NewInt(1), v)
+}
+
+func TestImport(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "lib.calc"), []byte("double = (n) -> n * 2\n"), 0o600))
+
+	i := calc.New(calc.WithDir(dir))
+	_, err := i.Eval("import \"lib.calc\"")
+	require.NoError(t, err)
+
+	v, err := i.Eval("lib.double(21)")
+	require.NoError(t, err)
+	assert.Equal(t, value.NewInt(42), v)
+}
+
+func TestImportCanceled(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "lib.calc"), []byte("double = (n) -> n * 2\n"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "loop.calc"), []byte("x = 1\nwhile true 1\n"), 0o600))
+
+	i := calc.New(calc.WithDir(dir))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := i.EvalContext(ctx, "import \"lib.calc\"")
+	assert.ErrorIs(t, err, node.ErrModuleFailed)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = i.EvalContext(ctx, "import \"loop.calc\"")
+	assert.ErrorIs(t, err, node.ErrModuleFailed)
+
+	// the module frames are popped, the globals are the main program's
+	_, err = i.Eval("x = 2\nimport \"lib.calc\"")
+	require.NoError(t, err)
+	assert.Equal(t, value.NewInt(2), i.GetGlobal("x"))
+
+	v, err := i.Eval("lib.double(21)")
+	require.NoError(t, err)
+	assert.Equal(t, value.NewInt(42), v)
+}
+
+func TestImportUnreadable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read the module")
+	}
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "lib.calc"), []byte("x = 1\n"), 0o000))
+
+	i := calc.New(calc.WithDir(dir))
+	_, err := i.Eval("import \"lib.calc\"")
+	assert.ErrorIs(t, err, node.ErrModuleFailed)
+	assert.ErrorIs(t, err, os.ErrPermission)
+}
+
+func TestToValue(t *testing.T) {
+	huge, _ := new(big.Int).SetString("100000000000000000000", 10)
+
+	tests := []struct {
+		name  string
+		input any
+		want  value.Type
+	}{
+		{"nil", nil, value.Nil},
+		{"bool", true, value.NewBool(true)},
+		{"int", 3, value.NewInt(3)},
+		{"int8", int8(-3), value.NewInt(-3)},
+		{"uint64", uint64(1 << 63), value.NewBigInt(new(big.Int).SetUint64(1 << 63))},
+		{"float", 1.5, value.NewFloat(1.5)},
+		{"string", "abc", value.NewString("abc")},
+		{"big", huge, value.NewBigInt(huge)},
+		{"small big", big.NewInt(5), value.NewInt(5)},
+		{"value", value.NewInt(7), value.NewInt(7)},
+		{"slice", []any{1, "a"}, value.NewArray([]value.Type{value.NewInt(1), value.NewString("a")})},
+		{"array", [2]int{1, 2}, value.NewArray([]value.Type{value.NewInt(1), value.NewInt(2)})},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v, err := calc.ToValue(test.input)
+			require.NoError(t, err)
+			assert.True(t, test.want.StrictEq(v), "expected %v got %v", test.want, v)
+		})
+	}
+
+	m, err := calc.ToValue(map[string]int{"a": 1})
+	require.NoError(t, err)
+	e, err := m.Index(value.NewString("a"))
+	require.NoError(t, err)
+	assert.Equal(t, value.NewInt(1), e)
+
+	_, err = calc.ToValue(struct{}{})
+	assert.ErrorIs(t, err, calc.ErrConversion)
+
+	_, err = calc.ToValue(map[any]int{nil: 1})
+	assert.Error(t, err)
+}
+
+func TestFromValue(t *testing.T) {
+	i := calc.New()
+
+	v, err := i.Eval("[1, 2.5, true, \"s\", nil, [1], 100000000000000000000]")
+	require.NoError(t, err)
+
+	huge, _ := new(big.Int).SetString("100000000000000000000", 10)
+	assert.Equal(t, []any{1, 2.5, true, "s", nil, []any{1}, huge}, calc.FromValue(v))
+
+	v, err = i.Eval("{\"a\": 1, 2: \"b\"}")
+	require.NoError(t, err)
+	assert.Equal(t, map[any]any{"a": 1, 2: "b"}, calc.FromValue(v))
+
+	v, err = i.Eval("error(\"m\")")
+	require.NoError(t, err)
+	e, ok := calc.FromValue(v).(value.ErrorData)
+	require.True(t, ok)
+	assert.Equal(t, "error", e.Kind)
+	assert.Equal(t, "m", e.Message)
+
+	f, err := i.Eval("() -> 1")
+	require.NoError(t, err)
+	assert.Equal(t, f, calc.FromValue(f))
+}
+
+func TestIO(t *testing.T) {
+	var out, errOut strings.Builder
+
+	i := calc.New(calc.WithIn(strings.NewReader("alice\nbob\n")), calc.WithOut(&out), calc.WithErrOut(&errOut))
+
+	_, err := i.Eval("write(\"name? \")\nwrite(read())\nwrite(read())")
+	require.NoError(t, err)
+	assert.Equal(t, "name? alice\nbob\n", out.String())
+
+	_, err = i.Eval("read()")
+	require.Error(t, err)
+	assert.Contains(t, errOut.String(), "read error")
+
+	out.Reset()
+	_, err = i.Eval("write(1)\n1 / 0")
+	require.Error(t, err)
+	assert.Equal(t, "1", out.String())
+}
+
+func TestTrace(t *testing.T) {
+	var trace strings.Builder
+
+	i := calc.New(calc.WithTrace(&trace, vm.TraceFilter{Func: "f"}))
+
+	_, err := i.Eval("f = (n) -> n + 1\nf(2)")
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSuffix(trace.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], "ADD LCL[0]")
+	assert.Contains(t, lines[0], "| 2 1 | tmp nil |")
+	assert.Contains(t, lines[0], "| depth 1")
+	assert.Contains(t, lines[1], "RET STCK | 3 |")
+}
+
+func TestLimits(t *testing.T) {
+	i := calc.New(calc.WithLimits(vm.Limits{Instructions: 100000, Depth: 100, Size: 1000}))
+
+	_, err := i.Eval("while true 1")
+	assert.ErrorIs(t, err, vm.ErrInstructionLimit)
+
+	_, err = i.Eval("try {\n  while true 1\n} catch e 2")
+	assert.ErrorIs(t, err, vm.ErrInstructionLimit, "the instruction limit can't be caught")
+	var rtErr *vm.RuntimeError
+	require.ErrorAs(t, err, &rtErr)
+	if assert.NotNil(t, rtErr.Loc, "the error is reported where it was raised") {
+		assert.Equal(t, 2, rtErr.Loc.Line)
+	}
+
+	_, err = i.Eval("f = (n) -> 1 + f(n + 1)\nf(0)")
+	assert.ErrorIs(t, err, memory.ErrDepthLimit)
+
+	v, err := i.Eval("try f(0) catch e kind(e)")
+	require.NoError(t, err)
+	kind, _ := v.ToString()
+	assert.Equal(t, "depth limit", kind)
+
+	_, err = i.Eval("s = \"ab\"\nwhile true s = s + s")
+	assert.ErrorIs(t, err, vm.ErrSizeLimit)
+
+	_, err = i.Eval("a = []\nwhile true a = a + [1]")
+	assert.ErrorIs(t, err, vm.ErrSizeLimit)
+
+	_, err = i.Eval("n = 1000\n1 << n")
+	assert.ErrorIs(t, err, vm.ErrSizeLimit)
+
+	v, err = i.Eval("n = 900\n(1 << n) >> 899")
+	require.NoError(t, err)
+	assert.Equal(t, value.NewInt(2), v)
+
+	v, err = i.Eval("1 + 2")
+	require.NoError(t, err)
+	assert.Equal(t, value.NewInt(3), v)
+
+	i = calc.New(calc.WithLimits(vm.Limits{Stack: 1000}))
+
+	_, err = i.Eval("f = (n) -> 1 + f(n + 1)\nf(0)")
+	assert.ErrorIs(t, err, memory.ErrStackLimit)
+
+	// without a size limit large shifts are still rejected before computing them
+	_, err = i.Eval("1 << 1000000000")
+	assert.ErrorIs(t, err, value.ErrShift)
+
+	v, err = i.Eval("try 1 << 4611686018427387904 catch e kind(e)")
+	require.NoError(t, err)
+	assert.Equal(t, "shift", calc.FromValue(v))
+}
+
+func TestEvalContext(t *testing.T) {
+	i := calc.New()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := i.EvalContext(ctx, "while true 1")
+	assert.ErrorIs(t, err, vm.ErrCanceled)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_, err = i.EvalContext(ctx, "1")
+	assert.ErrorIs(t, err, vm.ErrCanceled)
+
+	v, err := i.Eval("1 + 2")
+	require.NoError(t, err)
+	assert.Equal(t, value.NewInt(3), v)
+}
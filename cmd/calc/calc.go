@@ -2,6 +2,7 @@
 //
 // Usage:
 //
+//	-O	optimize the bytecode of the file or the repl input with the peephole optimizer
 //	-ast
 //	  	calc outputs AST in graphviz dot format
 //	  	% ./cmd --ast ../examples/euler_35.calc > x.dot # remove any output values
@@ -9,23 +10,51 @@
 //	  	% dot -Tsvg packed.dot -o x.svg
 //	-bytecode
 //	  	calc prints expression bytecode
+//	-compile
+//	  	compile the file to bytecode without running it, .calcb files are run as compiled
 //	-cpuprof string
 //	  	filename for go pprof
+//	-debug
+//	  	debug the file or the evaluated string interactively
+//	-disasm
+//	  	compile the file without running it and print the disassembly of the bytecode
+//	-disasm-builtins
+//	  	list the builtin functions in the disassembly too
 //	-eval string
 //	  	string to evaluate
+//	-heapprof string
+//	  	filename for go pprof
+//	-o string
+//	  	file the compiled bytecode is written to, the source file with the .calcb extension by default
+//	-profile string
+//	  	file the calc level profile is written to in pprof format, the table of the functions goes to stderr
+//	-trace string
+//	  	file the executed instructions are traced to, - for stdout
+//	-trace-func string
+//	  	trace only the instructions of the named function
+//	-trace-ip string
+//	  	trace only the instructions in the address range from:to, to is exclusive
 package main
 
 import (
+	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"runtime/pprof"
+	"strconv"
+	"strings"
 
 	"os"
+	"path/filepath"
 
 	"github.com/paulsonkoly/calc/builtin"
+	"github.com/paulsonkoly/calc/debugger"
+	"github.com/paulsonkoly/calc/disasm"
 	"github.com/paulsonkoly/calc/flags"
 	"github.com/paulsonkoly/calc/memory"
 	"github.com/paulsonkoly/calc/parser"
+	"github.com/paulsonkoly/calc/profiler"
 	"github.com/paulsonkoly/calc/types/bytecode"
 	"github.com/paulsonkoly/calc/types/compresult"
 	"github.com/paulsonkoly/calc/types/dbginfo"
@@ -35,17 +64,72 @@ import (
 )
 
 func main() {
-	flag.Parse()
+	args := parseArgs()
+
+	// a failing exit status is set after the deferred functions below ran
+	status := 0
+	defer func() {
+		if status != 0 {
+			os.Exit(status)
+		}
+	}()
 
 	m := memory.New()
 	p := parser.Type{}
 	cs := []bytecode.Type{}
 	ds := []value.Type{}
 	dbg := make(dbginfo.Type)
-	cr := compresult.Type{CS: &cs, DS: &ds, Dbg: &dbg}
+	lines := dbginfo.Lines{}
+	scopes := dbginfo.Scopes{}
+	modules := make(map[string]bool)
+	cr := compresult.Type{CS: &cs, DS: &ds, Dbg: &dbg, Lines: &lines, Scopes: &scopes, Modules: &modules}
+
+	var runs []compresult.Run
+	compiled := !*flags.CompileFlag && *flags.EvalFlag == "" && len(args) >= 1 && filepath.Ext(args[0]) == ".calcb"
+	if compiled {
+		// the builtin functions are compiled in
+		cr, runs = load(args[0])
+	} else {
+		builtin.Load(cr)
+	}
 
-	builtin.Load(cr)
-	virtM := vm.New(m, cr)
+	vmOpts := []vm.Option{}
+	if *flags.DebugFlag {
+		if *flags.EvalFlag == "" && len(args) < 1 {
+			fmt.Fprintln(os.Stderr, "-debug needs a file or -eval")
+			os.Exit(2)
+		}
+		// the debugger and the program share stdin
+		in := bufio.NewReader(os.Stdin)
+		vmOpts = append(vmOpts, vm.WithIn(in), vm.WithHook(debugger.New(in, os.Stdout)))
+	}
+	if *flags.TraceFlag != "" {
+		filter, err := traceFilter()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+
+		w := os.Stdout
+		if *flags.TraceFlag != "-" {
+			if w, err = os.Create(*flags.TraceFlag); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			defer w.Close()
+		}
+		vmOpts = append(vmOpts, vm.WithTrace(w, filter))
+	}
+	if *flags.ProfileFlag != "" {
+		if *flags.EvalFlag == "" && len(args) < 1 {
+			fmt.Fprintln(os.Stderr, "-profile needs a file or -eval")
+			os.Exit(2)
+		}
+		prof := profiler.New()
+		vmOpts = append(vmOpts, vm.WithHook(prof))
+		defer writeProfile(prof)
+	}
+	virtM := vm.New(m, cr, vmOpts...)
 
 	if *flags.CPUProfFlag != "" {
 		f, err := os.Create(*flags.CPUProfFlag)
@@ -71,28 +155,57 @@ func main() {
 		}()
 	}
 
-	if *flags.EvalFlag != "" { // cmd line mode
-		t, err := parser.Parse(*flags.EvalFlag)
+	opts := node.Options{AST: *flags.AstFlag, ByteCode: *flags.ByteCodeFlag, Optimize: *flags.OptimizeFlag}
 
-		if err != nil {
-			fmt.Println(err)
+	if *flags.CompileFlag {
+		if len(args) < 1 {
+			fmt.Fprintln(os.Stderr, "-compile needs a file")
+			os.Exit(2)
+		}
+		compile(args[0], p, virtM, opts)
+		return
+	}
+
+	if *flags.DisasmFlag {
+		if len(args) < 1 {
+			fmt.Fprintln(os.Stderr, "-disasm needs a file")
+			os.Exit(2)
+		}
+		if !compiled {
+			compileFile(args[0], p, virtM, opts)
+		}
+		from := builtin.Size()
+		if *flags.DisasmBuiltinsFlag {
+			from = 0
 		}
+		disasm.Write(os.Stdout, cr, from)
+		return
+	}
 
-		if len(t) > 0 {
-			n := t[0]
-			node.ByteCode(n, cr)
-			if v, err := virtM.Run(true); err == nil {
-				fmt.Println(v)
-			}
+	if *flags.EvalFlag != "" { // cmd line mode
+		v, err := node.Eval(*flags.EvalFlag, ".", p, virtM)
+		if err == nil {
+			fmt.Println(v)
+		}
+		if _, ok := err.(node.ParserErrors); ok {
+			status = 1
 		}
+		status = exitStatus(err, status)
 		return
 	}
 
-	if flag.NArg() >= 1 { // file mode
-		fileName := flag.Arg(0)
+	if compiled {
+		status = exitStatus(node.Exec(runs, virtM), status)
+		return
+	}
+
+	if len(args) >= 1 { // file mode
+		fileName := args[0]
 		fr := node.NewFReader(fileName)
 		defer fr.Close()
-		node.Loop(fr, p, virtM, false)
+		if err := node.Loop(fr, p, virtM, opts); err != nil {
+			status = exitStatus(err, 1)
+		}
 		return
 	}
 
@@ -100,5 +213,135 @@ func main() {
 	fmt.Println("calc repl")
 	rl := node.NewRLReader()
 	defer rl.Close()
-	node.Loop(rl, p, virtM, true)
+	opts.Out = true
+	status = exitStatus(node.Loop(rl, p, virtM, opts), status)
+}
+
+// exitStatus is the exit status of the program stopped with the error err,
+// the status of exit or 0 if the debugger quit, or status if the program
+// wasn't stopped.
+func exitStatus(err error, status int) int {
+	var exit *vm.ExitError
+	if errors.As(err, &exit) {
+		return exit.Status
+	}
+	if errors.Is(err, vm.ErrStopped) {
+		return 0
+	}
+	return status
+}
+
+// parseArgs parses the command line, the flags can follow the file name as in
+// calc -compile foo.calc -o foo.calcb. It returns the arguments other than the
+// flags.
+func parseArgs() []string {
+	flag.Parse()
+
+	args := []string{}
+	for flag.NArg() > 0 {
+		args = append(args, flag.Arg(0))
+		// the command line exits on errors
+		_ = flag.CommandLine.Parse(flag.Args()[1:])
+	}
+	return args
+}
+
+// compileFile compiles the source file fileName with opts without running it,
+// exiting on errors. It returns the runs of the compiled code.
+func compileFile(fileName string, p node.Parser, virtM *vm.Type, opts node.Options) []compresult.Run {
+	fr := node.NewFReader(fileName)
+	defer fr.Close()
+
+	runs, err := node.Compile(fr, p, virtM, opts)
+	if err != nil {
+		os.Exit(1)
+	}
+	return runs
+}
+
+// compile compiles the source file fileName with opts to the file set by the
+// output flag, exiting on errors.
+func compile(fileName string, p node.Parser, virtM *vm.Type, opts node.Options) {
+	runs := compileFile(fileName, p, virtM, opts)
+
+	out := *flags.OutFlag
+	if out == "" {
+		out = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".calcb"
+	}
+
+	f, err := os.Create(out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := compresult.Write(f, virtM.CR, runs); err != nil {
+		f.Close()
+		os.Remove(out)
+		fmt.Fprintf(os.Stderr, "%s: %v\n", fileName, err)
+		os.Exit(1)
+	}
+	if err := f.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// load loads the compiled file fileName, exiting on errors.
+func load(fileName string) (compresult.Type, []compresult.Run) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	cr, runs, err := compresult.Read(f, builtin.Native)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", fileName, err)
+		os.Exit(1)
+	}
+	return cr, runs
+}
+
+// writeProfile writes the table of prof to stderr and the profile to the
+// file set by the profile flag.
+func writeProfile(prof *profiler.Type) {
+	prof.WriteTable(os.Stderr)
+
+	f, err := os.Create(*flags.ProfileFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	defer f.Close()
+
+	if err := prof.WriteProfile(f); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// traceFilter is the trace filter set by the trace flags.
+func traceFilter() (vm.TraceFilter, error) {
+	filter := vm.TraceFilter{Func: *flags.TraceFuncFlag}
+	if *flags.TraceIPFlag == "" {
+		return filter, nil
+	}
+
+	from, to, ok := strings.Cut(*flags.TraceIPFlag, ":")
+	if !ok {
+		return filter, fmt.Errorf("-trace-ip %s: from:to expected", *flags.TraceIPFlag)
+	}
+
+	var err error
+	if from != "" {
+		if filter.From, err = strconv.Atoi(from); err != nil {
+			return filter, fmt.Errorf("-trace-ip %s: %w", *flags.TraceIPFlag, err)
+		}
+	}
+	if to != "" {
+		if filter.To, err = strconv.Atoi(to); err != nil {
+			return filter, fmt.Errorf("-trace-ip %s: %w", *flags.TraceIPFlag, err)
+		}
+	}
+	return filter, nil
 }
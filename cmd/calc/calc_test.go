@@ -1,7 +1,13 @@
 package main_test
 
 import (
+	"bytes"
 	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
 	"testing"
 
@@ -13,6 +19,7 @@ import (
 	"github.com/paulsonkoly/calc/types/dbginfo"
 	"github.com/paulsonkoly/calc/types/node"
 	"github.com/paulsonkoly/calc/types/value"
+	"github.com/paulsonkoly/calc/types/value/valuetest"
 	"github.com/paulsonkoly/calc/vm"
 )
 
@@ -37,7 +44,74 @@ var testData = [...]TestDatum{
 	{"array lit with leading newline", "[\n1,2,\n3,4]", nil, value.NewArray([]value.Type{value.NewInt(1), value.NewInt(2), value.NewInt(3), value.NewInt(4)}), nil},
 	{"array lit with computed value", "[1, 2, 3 + 2, 4]", nil, value.NewArray([]value.Type{value.NewInt(1), value.NewInt(2), value.NewInt(5), value.NewInt(4)}), nil},
 
+	{"map lit/empty", "{}", nil, valuetest.MustMap(nil, nil), nil},
+	{"map lit/constant", `{"a": 1, 2: false}`, nil, valuetest.MustMap([]value.Type{value.NewString("a"), value.NewInt(2)}, []value.Type{value.NewInt(1), value.NewBool(false)}), nil},
+	{"map lit/computed", `{"a": 1, "b": 1 + 2 * 3}`, nil, valuetest.MustMap([]value.Type{value.NewString("a"), value.NewString("b")}, []value.Type{value.NewInt(1), value.NewInt(7)}), nil},
+	{"map lit/computed entries",
+		`{
+      f = (x) -> {"a": 1, "b": x, "c": x + 1}
+      m = f(1)
+      n = f(2)
+      m["c"] + 10 * n["c"] + 100 * #m
+    }`, nil, value.NewInt(332), nil},
+	{"map lit/computed invalid key", "{\nf = (x) -> {\"a\": 1, x: 2}\nf([1])\n}", nil, value.Nil, value.ErrType},
+	{"map lit/multi line", "{\n\"a\": 1,\n\"b\": 2\n}", nil, valuetest.MustMap([]value.Type{value.NewString("a"), value.NewString("b")}, []value.Type{value.NewInt(1), value.NewInt(2)}), nil},
+	{"map lit/invalid key", `{[1]: 1}`, nil, value.Nil, value.ErrType},
+	{"map/indexing", `{"a": 1, "b": 2}["b"]`, nil, value.NewInt(2), nil},
+	{"map/missing key", `{"a": 1}["b"]`, nil, value.Nil, value.ErrIndex},
+	{"map/length", `#{"a": 1, "b": 2}`, nil, value.NewInt(2), nil},
+	{"map/merge", `({"a": 1, "b": 2} + {"b": 3})["b"]`, nil, value.NewInt(3), nil},
+	{"map/equality", `{"a": 1, "b": 2} == {"b": 2, "a": 1.0}`, nil, value.NewBool(true), nil},
+	{"map/in block", "if true {\"a\": 1}", nil, valuetest.MustMap([]value.Type{value.NewString("a")}, []value.Type{value.NewInt(1)}), nil},
+	{"map/iteration",
+		`{
+      m = {"a": 1, "b": 2}
+      c = ""
+      for k, v <- keys(m), values(m) c = c + k + toa(v)
+    }`, nil, value.NewString("a1b2"), nil},
+	{"map/entries",
+		`{
+      c = 0
+      for e <- entries({1: 2, 3: 4}) c = c + e[0] * e[1]
+    }`, nil, value.NewInt(14), nil},
+
 	{"simple arithmetic/addition", "1+2", nil, value.NewInt(3), nil},
+	{"literal/hex", "0xff + 0XA", nil, value.NewInt(265), nil},
+	{"literal/binary", "0b1010", nil, value.NewInt(10), nil},
+	{"literal/octal", "0o17", nil, value.NewInt(15), nil},
+	{"literal/leading zero", "010", nil, value.NewInt(10), nil},
+	{"literal/digit separators", "1_000_000", nil, value.NewInt(1000000), nil},
+	{"literal/scientific", "6.02e23", nil, value.NewFloat(6.02e23), nil},
+	{"literal/negative exponent", "15e-1", nil, value.NewFloat(1.5), nil},
+	{"literal/big", "18446744073709551616 - 0x1_0000_0000_0000_0000", nil, value.NewInt(0), nil},
+	{"big int/factorial",
+		`{
+      f = 1
+      for i <- fromto(1, 26) f = f * i
+      toa(f / 1000000)
+    }`, nil, value.NewString("15511210043330985984"), nil},
+	{"big int/aton", `aton("123456789012345678901234567890") % 1000`, nil, value.NewInt(890), nil},
+	{"big int/map key", "{(1 << 70): 1}[1 << 70]", nil, value.NewInt(1), nil},
+	{"big int/index", `[1, 2][1 << 70]`, nil, value.Nil, value.ErrIndex},
+	{"folding/arithmetic", "60 * 60 * 24", nil, value.NewInt(86400), nil},
+	{"folding/big int", "1 << 70 >> 68", nil, value.NewInt(4), nil},
+	{"folding/string index", `"abc"[1] + "abc"[0:1]`, nil, value.NewString("ba"), nil},
+	{"folding/array", "#([1, 2] + [3])", nil, value.NewInt(3), nil},
+	{"folding/condition", `if 1 < 2 "a" else "b"`, nil, value.NewString("a"), nil},
+	{"folding/false condition", `if 2 < 1 "a"`, nil, value.Nil, nil},
+	{"folding/short circuit", "false && 1/0 == 1", nil, value.NewBool(false), nil},
+	{"folding/identity", "{\nx = 3\n(x - 1) * 1 + 0\n}", nil, value.NewInt(2), nil},
+	{"folding/identity type error", "{\nx = \"a\"\nx * 1\n}", nil, value.Nil, value.ErrType},
+	{"folding/division by zero", "1 / (1 - 1)", nil, value.Nil, value.ErrZeroDiv},
+	{"folding/index error", "[1, 2][1 + 1]", nil, value.Nil, value.ErrIndex},
+	{"literal/invalid digit", "0b102", errors.New("Lexer: invalid digit 2 in integer literal"), value.Nil, nil},
+	{"variable/identifiers",
+		`{
+      is_prime = true
+      maxValue2 = 3
+      _x = 1
+      if is_prime maxValue2 + _x else 0
+    }`, nil, value.NewInt(4), nil},
 	{"bitwise logic", "~(1<<1) & 7", nil, value.NewInt(5), nil},
 
 	{"string indexing/simple", "\"apple\"[1]", nil, value.NewString("p"), nil},
@@ -47,6 +121,8 @@ var testData = [...]TestDatum{
 	{"indexing/from stack", "[1, 2, 3][4-2]", nil, value.NewInt(3), nil},
 
 	{"string concatenation", "\"abc\" + \"def\"", nil, value.NewString("abcdef"), nil},
+	{"string/escapes", `"a\tb\n\\\"\x41\u{e9}"`, nil, value.NewString("a\tb\n\\\"A\u00e9"), nil},
+	{"string/invalid escape", `"a\qb"`, errors.New("Lexer: invalid escape sequence \\q in string literal"), value.Nil, nil},
 
 	{"arithmetics/left assoc", "1-2+1", nil, value.NewInt(0), nil},
 	{"arithmetics/parenthesis", "1-(2+1)", nil, value.NewInt(-2), nil},
@@ -71,6 +147,29 @@ var testData = [...]TestDatum{
 
 	{"bool or/low precedence", "true||false == false", nil, value.NewBool(true), nil},
 	{"bool or/high precedence", "true|false == false", nil, value.NewBool(false), nil},
+	{"bool and/short circuit", "false && 1/0 == 1", nil, value.NewBool(false), nil},
+	{"bool or/short circuit", "true || 1/0 == 1", nil, value.NewBool(true), nil},
+	{"bool and/evaluates right", "true && 1/0 == 1", nil, value.Nil, value.ErrZeroDiv},
+	{"bool and/index guard",
+		`{
+      a = [1, 2]
+      i = 2
+      i < #a && a[i] == 1
+    }`, nil, value.NewBool(false), nil},
+	{"bool and/type error", "1 && true", nil, value.Nil, value.ErrType},
+	{"bool and/int operands", "1 && 2", nil, value.Nil, value.ErrType},
+	{"bool or/in arithmetic", "1 + #[1 == 1 || false, 2]", nil, value.NewInt(3), nil},
+	{"bool and/in call argument",
+		`{
+      f = (x) -> x > 0 && x < 10
+      [f(5), f(11)]
+    }`, nil, value.NewArray([]value.Type{value.NewBool(true), value.NewBool(false)}), nil},
+	{"bool and/in loop condition",
+		`{
+      k = 2
+      while k < 91 && 91 % k != 0 k = k + 1
+      k
+    }`, nil, value.NewInt(7), nil},
 
 	{"block/single line", "{\n1\n}", nil, value.NewInt(1), nil},
 	{"block/multi line", "{\n1\n2\n}", nil, value.NewInt(2), nil},
@@ -166,6 +265,76 @@ var testData = [...]TestDatum{
         a = a + 1
       }
 	}`, nil, value.NewInt(11), nil},
+	{"loop/break",
+		`{
+      a = 1
+      while true {
+        a = a + 1
+        if a > 5 break
+      }
+      a
+	}`, nil, value.NewInt(6), nil},
+	{"loop/pushing break",
+		`{
+      a = 1
+      while true {
+        a = a + 1
+        if a > 5 break
+      }
+	}`, nil, value.Nil, nil},
+	{"loop/continue",
+		`{
+      a = 0
+      s = 0
+      while a < 10 {
+        a = a + 1
+        if a % 2 == 0 continue
+        s = s + a
+      }
+      s
+	}`, nil, value.NewInt(25), nil},
+	{"loop/pushing continue",
+		`{
+      a = 0
+      while a < 10 {
+        a = a + 1
+        if a < 5 continue
+        a
+      }
+	}`, nil, value.NewInt(10), nil},
+	{"loop/break in nested loop",
+		`{
+      a = 0
+      c = 0
+      while a < 3 {
+        a = a + 1
+        b = 0
+        while true {
+          b = b + 1
+          if b > a break
+          c = c + 1
+        }
+      }
+      c
+	}`, nil, value.NewInt(6), nil},
+	{"loop/break in function",
+		`{
+      f = (n) -> {
+        a = 0
+        while true {
+          a = a + 1
+          if a == n break
+        }
+        a
+      }
+      f(4)
+	}`, nil, value.NewInt(4), nil},
+	{"loop/break outside of loop", "break", errors.New("break or continue outside of loop"), value.Nil, nil},
+	{"loop/continue outside of loop", "if true continue", errors.New("break or continue outside of loop"), value.Nil, nil},
+	{"loop/break in function in loop",
+		`while true {
+      f = () -> break
+    }`, errors.New("break or continue outside of loop"), value.Nil, nil},
 
 	{"iterator/elems",
 		`{
@@ -174,6 +343,68 @@ var testData = [...]TestDatum{
    }`, nil, value.NewInt(14), nil},
 	{"iterator/no yield", "for i <- 1 2", nil, value.Nil, nil},
 	{"iterator/return", "for i<- fromto(5, 10) if i == 8 return 3*i else 2*i", nil, value.NewInt(24), nil},
+	{"iterator/break",
+		`{
+      c = 0
+      for i <- fromto(0, 10) {
+        if i == 4 break
+        c = c + i
+      }
+      c
+    }`, nil, value.NewInt(6), nil},
+	{"iterator/continue",
+		`{
+      c = 0
+      for i <- fromto(0, 10) {
+        if i % 3 == 0 continue
+        c = c + i
+      }
+      c
+    }`, nil, value.NewInt(27), nil},
+	{"iterator/pushing continue",
+		`for i <- fromto(0, 10) {
+      if i > 5 continue
+      i
+    }`, nil, value.Nil, nil},
+	{"iterator/break returning",
+		`{
+      f = () -> for i <- fromto(0, 10) {
+        if i == 4 break else i
+      }
+      f()
+    }`, nil, value.Nil, nil},
+	{"iterator/break zipped",
+		`{
+      c = 0
+      for i, j <- fromto(0, 10), fromto(10, 20) {
+        if i == 3 break
+        c = c + i + j
+      }
+      c
+    }`, nil, value.NewInt(36), nil},
+	{"iterator/break from generator",
+		`{
+      g = () -> {
+        i = 0
+        while true {
+          yield i
+          i = i + 1
+        }
+      }
+      f = () -> {
+        c = 0
+        i = 0
+        while i < 10 {
+          for j <- g() {
+            if j > i break
+            c = c + j
+          }
+          i = i + 1
+        }
+        c
+      }
+      f()
+    }`, nil, value.NewInt(165), nil},
 	{"iterator/yield in for",
 		`{
     f = () -> for i <- fromto(2,5) {
@@ -274,6 +505,165 @@ var testData = [...]TestDatum{
 	    g()
 		}`, nil, value.NewInt(2), nil,
 	},
+	{"function/nested closure",
+		`{
+			f = (x) -> (y) -> (z) -> x + y + z
+			g = f(1)
+			h = g(2)
+			h(3)
+		}`, nil, value.NewInt(6), nil,
+	},
+	{"function/nested closure variable updates",
+		`{
+			f = () -> {
+        x = 1
+        g = () -> () -> x
+        x = 2
+        g
+	    }
+			g = f()
+			h = g()
+	    h()
+		}`, nil, value.NewInt(2), nil,
+	},
+	{"function/closures in array",
+		`{
+			f = (n) -> [() -> n, () -> 2 * n]
+			a = f(1)
+			b = f(2)
+			c = a[0]
+			d = b[1]
+			c() + d()
+		}`, nil, value.NewInt(5), nil,
+	},
+	{"function/nested closure iterator",
+		`{
+			map = (f, iter) -> () -> for e <- iter() yield f(e)
+			add = (n) -> map((x) -> x + n, () -> fromto(0, 3))
+			it = add(10)
+			s = 0
+			for e <- it() s = s + e
+			s
+		}`, nil, value.NewInt(33), nil,
+	},
+	{"function/call result", "((x) -> (y) -> x + y)(1)(2)", nil, value.NewInt(3), nil},
+	{"function/call indexed",
+		`{
+			f = [[(a, b) -> a + b, (a, b) -> a * b]]
+			f[0][1](3, 4)
+		}`, nil, value.NewInt(12), nil,
+	},
+	{"function/index call result",
+		`{
+			f = () -> [1, 2, 3]
+			f()[1]
+		}`, nil, value.NewInt(2), nil,
+	},
+	{"function/call map value",
+		`{
+			m = {"inc": (x) -> x + 1}
+			m["inc"](41)
+		}`, nil, value.NewInt(42), nil,
+	},
+	{"function/call in expression", "2 * ((x) -> x + 1)(1) + 1", nil, value.NewInt(5), nil},
+	{"function/call non function", "[1][0](1)", nil, value.Nil, value.ErrType},
+
+	{"error/catch zero division", "try 1/0 catch e kind(e)", nil, value.NewString("zero division"), nil},
+	{"error/catch message", "try [1][2] catch e message(e)", nil, value.NewString("index error"), nil},
+	{"error/no error", "try 1 catch e 2", nil, value.NewInt(1), nil},
+	{"error/raise payload",
+		`try {
+      raise [1, 2]
+    } catch e {
+      payload(e)
+    }`, nil, value.NewArray([]value.Type{value.NewInt(1), value.NewInt(2)}), nil},
+	{"error/raise string", `try raise "oops" catch e message(e) + kind(e)`, nil, value.NewString("oopserror"), nil},
+	{"error/error value", `error("oops")`, nil, value.NewError("error", "oops", value.NewString("oops")), nil},
+	{"error/raise error value", `try raise error(1) catch e message(e)`, nil, value.NewString("1"), nil},
+	{"error/kind of non error", "kind(1)", nil, value.Nil, value.ErrType},
+	{"native/first class",
+		`{
+      apply = (f, x) -> f(x)
+      apply(toa, 12)
+    }`, nil, value.NewString("12"), nil},
+	{"native/captured", "{\nf = (g) -> (x) -> g(x)\nf(aton)(\"3\")\n}", nil, value.NewInt(3), nil},
+	{"native/arity", "toa(1, 2)", nil, value.Nil, vm.ErrArity},
+	{"native/error", `aton("x")`, nil, value.Nil, vm.ErrConversion},
+	{"native/registered", "scale(2, 3)", nil, value.NewInt(6), nil},
+	{"native/registered error", "try scale(2, nil) catch e message(e) + kind(e)", nil, value.NewString("not a numberruntime"), nil},
+	{"error/unwinding frames",
+		`{
+      f = (n) -> if n == 0 1/0 else 1 + f(n-1)
+      g = () -> try f(5) catch e kind(e)
+      g()
+    }`, nil, value.NewString("zero division"), nil},
+	{"error/unwinding stack",
+		`{
+      f = (n) -> if n == 0 raise "bottom" else 1 + f(n-1)
+      g = () -> {
+        a = 1
+        try b = f(5) catch e b = message(e)
+        [a, b]
+      }
+      g()
+    }`, nil, value.NewArray([]value.Type{value.NewInt(1), value.NewString("bottom")}), nil},
+	{"error/unwinding iterator",
+		`{
+      gen = () -> {
+        yield 1
+        raise "stop"
+      }
+      s = 0
+      try {
+        for i <- gen() s = s + i
+      } catch e s = s + 10
+      for i <- fromto(1, 3) s = s + i
+      s
+    }`, nil, value.NewInt(14), nil},
+	{"error/catch in iterator",
+		`{
+      gen = () -> {
+        try {
+          yield 1
+          yield 1/0
+        } catch e yield 5
+      }
+      s = 0
+      for i <- gen() s = s + i
+      s
+    }`, nil, value.NewInt(6), nil},
+	{"error/nested",
+		`try {
+      try 1/0 catch e raise e
+    } catch e kind(e)`, nil, value.NewString("zero division"), nil},
+	{"error/return in try",
+		`{
+      f = () -> {
+        try return 1 catch e 2
+        3
+      }
+      f()
+      try 1/0 catch e 4
+    }`, nil, value.NewInt(4), nil},
+	{"error/break in try",
+		`{
+      a = 0
+      while true {
+        try {
+          a = a + 1
+          if a == 3 break
+        } catch e 0
+      }
+      try 1/0 catch e a
+    }`, nil, value.NewInt(3), nil},
+	{"error/uncaught reraise", "try 1/0 catch e raise e", nil, value.Nil, value.ErrZeroDiv},
+	{"error/uncaught raise", `raise "oops"`, nil, value.Nil, vm.ErrRaise},
+
+	{"module/import in block",
+		`{
+      import "util.calc"
+    }`, errors.New("Parser: "), value.Nil, nil},
+	{"module/invalid name", `import "a-b.calc"`, errors.New("module file name is not a valid variable name"), value.Nil, nil},
 
 	{"array addition/doesn't share sub-slices",
 		`{
@@ -283,6 +673,7 @@ var testData = [...]TestDatum{
   }`, nil, value.NewArray([]value.Type{value.NewInt(1), value.NewInt(2), value.NewInt(3)}), nil,
 	},
 	{"keyword violation", "true = false", errors.New("Parser: "), value.Nil, nil},
+	{"parse error/expected one of", "1+)", errors.New("Parser: one of -, #, !, ~, (, float literal"), value.Nil, nil},
 	{"builtin/aton int", "aton(\"12\")", nil, value.NewInt(12), nil},
 	{"builtin/aton float", "aton(\"1.2\")", nil, value.NewFloat(1.2), nil},
 	{"builtin/aton error", "aton(\"abc\")", nil, value.Nil, vm.ErrConversion},
@@ -356,6 +747,15 @@ var testData = [...]TestDatum{
 	},
 }
 
+func init() {
+	builtin.Register("scale", 2, func(args []value.Type) (value.Type, error) {
+		if args[1].IsNil() {
+			return value.Nil, errors.New("not a number")
+		}
+		return args[0].Arith(bytecode.MUL, args[1])
+	})
+}
+
 func TestCalc(t *testing.T) {
 	for _, test := range testData {
 		t.Run(test.name, func(t *testing.T) {
@@ -364,7 +764,10 @@ func TestCalc(t *testing.T) {
 			cs := []bytecode.Type{}
 			ds := []value.Type{}
 			dbg := make(dbginfo.Type)
-			cr := compresult.Type{CS: &cs, DS: &ds, Dbg: &dbg}
+			lines := dbginfo.Lines{}
+			scopes := dbginfo.Scopes{}
+			modules := make(map[string]bool)
+			cr := compresult.Type{CS: &cs, DS: &ds, Dbg: &dbg, Lines: &lines, Scopes: &scopes, Modules: &modules}
 			builtin.Load(cr)
 			virtM := vm.New(m, cr)
 
@@ -377,12 +780,12 @@ func TestCalc(t *testing.T) {
 				var v value.Type
 				var err error
 				for _, stmnt := range ast {
-					stmnt = stmnt.STRewrite(node.SymTbl{})
+					stmnt = stmnt.STRewrite(node.SymTbl{}).Fold()
 					node.ByteCode(stmnt, cr)
 					v, err = virtM.Run(true)
 				}
 
-				if !test.value.StrictEq(v) || err != test.runtimeError {
+				if !test.value.StrictEq(v) || !errors.Is(err, test.runtimeError) {
 					t.Errorf("expected (%v, %v) got (%v, %v)", test.value, test.runtimeError, v, err)
 				}
 			} else if !strings.HasPrefix(err.Error(), test.parseError.Error()) {
@@ -391,3 +794,438 @@ func TestCalc(t *testing.T) {
 		})
 	}
 }
+
+func TestFold(t *testing.T) {
+	for _, test := range []struct {
+		input  string
+		folded node.Type
+	}{
+		{"60 * 60 * 24", node.Int(86400)},
+		{"1 << 70", node.BigInt("1180591620717411303424")},
+		{"-1.5", node.Float(-1.5)},
+		{`"abc"[1:3]`, node.String("bc")},
+		{"[1, 2 + 3][0:2]", node.List{Elems: []node.Type{node.Int(1), node.Int(5)}}},
+		{`if 1 < 2 "a" else "b"`, node.String("a")},
+		{"true || x", node.Bool(true)},
+		{"x * 1", node.BinOp{Op: "*", Left: node.Name("x"), Right: node.Int(1)}},
+		{"(x - 1) * 1", node.BinOp{Op: "-", Left: node.Name("x"), Right: node.Int(1)}},
+		{"1 / 0", node.BinOp{Op: "/", Left: node.Int(1), Right: node.Int(0)}},
+	} {
+		t.Run(test.input, func(t *testing.T) {
+			ast, err := parser.Parse(test.input)
+			if err != nil {
+				t.Fatalf("expected no error got %s", err)
+			}
+
+			folded := ast[0].STRewrite(node.SymTbl{}).Fold()
+			if b, ok := folded.(node.BinOp); ok {
+				b.Span = dbginfo.Span{}
+				folded = b
+			}
+			if !reflect.DeepEqual(folded, test.folded) {
+				t.Errorf("expected %#v got %#v", test.folded, folded)
+			}
+		})
+	}
+}
+
+type moduleTestDatum struct {
+	name         string
+	inputs       []string
+	value        value.Type
+	runtimeError error
+}
+
+var moduleTestData = [...]moduleTestDatum{
+	{"qualified access", []string{`import "util.calc"`, "util.sq(3)"}, value.NewInt(9), nil},
+	{"module globals", []string{"sq = 1", `import "util.calc"`, "util.helper(2)"}, value.NewInt(5), nil},
+	{"importer globals", []string{"sq = 1", `import "util.calc"`, "sq"}, value.NewInt(1), nil},
+	{"not leaking", []string{`import "util.calc"`, "helper"}, value.Nil, nil},
+	{"nested", []string{`import "twice.calc"`, "twice.twice(1)"}, value.NewInt(5), nil},
+	{"cached", []string{`import "util.calc"`, `import "twice.calc"`, "twice.util == util"}, value.NewBool(true), nil},
+	{"iterator",
+		[]string{`import "util.calc"`,
+			`{
+        s = 0
+        for i <- util.gen(4) s = s + i
+        s
+      }`}, value.NewInt(14), nil},
+	{"search path", []string{`import "pathlib.calc"`, "pathlib.v"}, value.NewInt(42), nil},
+	{"not found", []string{`import "nope.calc"`}, value.Nil, node.ErrModuleNotFound},
+	{"cycle", []string{`import "cyclea.calc"`}, value.Nil, node.ErrModuleFailed},
+	{"failing", []string{`import "failing.calc"`}, value.Nil, node.ErrModuleFailed},
+	{"missing member", []string{`import "util.calc"`, "util.nope"}, value.Nil, value.ErrIndex},
+	{"non module member", []string{"a = 1", "a.b"}, value.Nil, value.ErrType},
+}
+
+func TestModules(t *testing.T) {
+	t.Setenv("CALCPATH", "testdata/path")
+
+	for _, test := range moduleTestData {
+		t.Run(test.name, func(t *testing.T) {
+			m := memory.New()
+			cs := []bytecode.Type{}
+			ds := []value.Type{}
+			dbg := make(dbginfo.Type)
+			lines := dbginfo.Lines{}
+			scopes := dbginfo.Scopes{}
+			modules := make(map[string]bool)
+			cr := compresult.Type{CS: &cs, DS: &ds, Dbg: &dbg, Lines: &lines, Scopes: &scopes, Modules: &modules}
+			builtin.Load(cr)
+			virtM := vm.New(m, cr)
+
+			var v value.Type
+			var err error
+
+			for _, input := range test.inputs {
+				ast, pErr := parser.Parse(input)
+				if pErr != nil {
+					t.Errorf("expected no error got %s", pErr.Error())
+					return
+				}
+
+				for _, stmnt := range ast {
+					if imp, ok := stmnt.(node.Import); ok {
+						if stmnt, err = node.LoadModule(imp, "testdata", parser.Type{}, virtM); err != nil {
+							break
+						}
+					}
+					stmnt = stmnt.STRewrite(node.SymTbl{}).Fold()
+					node.ByteCode(stmnt, cr)
+					v, err = virtM.Run(true)
+				}
+			}
+
+			if !test.value.StrictEq(v) || !errors.Is(err, test.runtimeError) {
+				t.Errorf("expected (%v, %v) got (%v, %v)", test.value, test.runtimeError, v, err)
+			}
+		})
+	}
+}
+
+type parseErrorDatum struct {
+	pos  int
+	text string
+}
+
+func TestParseErrors(t *testing.T) {
+	input := `f = (x) -> {
+    y = x +
+    if y > 1 {
+      z = (y
+    } else {
+      return )
+    }
+  }`
+
+	_, errs := parser.Parse(input)
+
+	expected := []parseErrorDatum{
+		{strings.Index(input, "+\n") + 1, "\n"},
+		{strings.Index(input, "y\n    } else") + 1, "\n"},
+		{strings.Index(input, ")\n    }\n  }"), ")"},
+	}
+
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors got %d: %v", len(expected), len(errs), errs)
+	}
+	for i, e := range expected {
+		if errs[i].From() != e.pos || !strings.HasPrefix(input[errs[i].From():], e.text) {
+			t.Errorf("error %d: expected at %d got %d (%s)", i, e.pos, errs[i].From(), errs[i].Message())
+		}
+	}
+}
+
+func TestParseErrorsFile(t *testing.T) {
+	var out strings.Builder
+	virtM := newVM(&out)
+	fr := node.NewFReader("testdata/parse_errors.calc")
+	defer fr.Close()
+
+	err := node.Loop(fr, parser.Type{}, virtM, node.Options{})
+	if err == nil {
+		t.Errorf("expected parse error got nil")
+	}
+
+	// the lines following the errors run, up to the bracket left open
+	if !strings.HasPrefix(out.String(), "aParser: ") || !strings.Contains(out.String(), "b") || !strings.Contains(out.String(), "{ ; [") {
+		t.Errorf("expected the output of the valid lines got %q", out.String())
+	}
+	for _, pos := range []string{"parse_errors.calc:2:1\n", "parse_errors.calc:4:5\n", "parse_errors.calc:8:"} {
+		if !strings.Contains(out.String(), pos) {
+			t.Errorf("expected error at %s got %q", pos, out.String())
+		}
+	}
+}
+
+// runFile runs the source file at path, compiled to the compiled file format
+// if compiled is set. It returns the output and the error output.
+func runFile(t *testing.T, path string, compiled bool) (string, string) {
+	cs := []bytecode.Type{}
+	ds := []value.Type{}
+	dbg := make(dbginfo.Type)
+	lines := dbginfo.Lines{}
+	scopes := dbginfo.Scopes{}
+	modules := make(map[string]bool)
+	cr := compresult.Type{CS: &cs, DS: &ds, Dbg: &dbg, Lines: &lines, Scopes: &scopes, Modules: &modules}
+	builtin.Load(cr)
+
+	var out, errOut strings.Builder
+	virtM := vm.New(memory.New(), cr, vm.WithOut(&out), vm.WithErrOut(&errOut))
+
+	fr := node.NewFReader(path)
+	defer fr.Close()
+
+	if !compiled {
+		node.Loop(fr, parser.Type{}, virtM, node.Options{})
+		return out.String(), errOut.String()
+	}
+
+	runs, err := node.Compile(fr, parser.Type{}, virtM, node.Options{})
+	if err != nil {
+		t.Fatalf("expected no error got %s", err)
+	}
+
+	var b bytes.Buffer
+	if err := compresult.Write(&b, cr, runs); err != nil {
+		t.Fatalf("expected no error got %s", err)
+	}
+
+	cr, runs, err = compresult.Read(&b, builtin.Native)
+	if err != nil {
+		t.Fatalf("expected no error got %s", err)
+	}
+
+	virtM = vm.New(memory.New(), cr, vm.WithOut(&out), vm.WithErrOut(&errOut))
+	node.Exec(runs, virtM)
+	return out.String(), errOut.String()
+}
+
+func TestCompile(t *testing.T) {
+	out, errOut := runFile(t, "testdata/compiled.calc", false)
+	compiledOut, compiledErrOut := runFile(t, "testdata/compiled.calc", true)
+
+	if !strings.HasSuffix(out, "end\n") {
+		t.Fatalf("expected output to end with end got %q", out)
+	}
+	if compiledOut != out {
+		t.Errorf("expected output %q got %q", out, compiledOut)
+	}
+	for _, s := range []string{"division by zero", "module failed to load"} {
+		if strings.Count(compiledErrOut, s) != strings.Count(errOut, s) {
+			t.Errorf("expected error output %q got %q", errOut, compiledErrOut)
+		}
+	}
+}
+
+func TestCompiledFileErrors(t *testing.T) {
+	cs := []bytecode.Type{}
+	ds := []value.Type{}
+	dbg := make(dbginfo.Type)
+	lines := dbginfo.Lines{}
+	scopes := dbginfo.Scopes{}
+	modules := make(map[string]bool)
+	cr := compresult.Type{CS: &cs, DS: &ds, Dbg: &dbg, Lines: &lines, Scopes: &scopes, Modules: &modules}
+	builtin.Load(cr)
+
+	write := func(runs []compresult.Run) []byte {
+		var b bytes.Buffer
+		if err := compresult.Write(&b, cr, runs); err != nil {
+			t.Fatalf("expected no error got %s", err)
+		}
+		return b.Bytes()
+	}
+	file := write([]compresult.Run{{End: len(cs), OnError: 1}})
+
+	newer := bytes.Clone(file)
+	newer[len("calcb")] = compresult.Version + 1
+
+	// corrupt writes the code, the data and the scopes appended to the builtin
+	// ones
+	corrupt := func(code []bytecode.Type, data []value.Type, scope ...dbginfo.Scope) []byte {
+		cs := append(slices.Clone(cs), code...)
+		ds := append(slices.Clone(ds), data...)
+		scopes := append(slices.Clone(scopes), scope...)
+		cr := compresult.Type{CS: &cs, DS: &ds, Dbg: &dbg, Lines: &lines, Scopes: &scopes, Modules: &modules}
+		var b bytes.Buffer
+		if err := compresult.Write(&b, cr, []compresult.Run{{End: len(cs), OnError: 1}}); err != nil {
+			t.Fatalf("expected no error got %s", err)
+		}
+		return b.Bytes()
+	}
+	instr := func(op bytecode.OpCode, srcsel int, src uint64, addr int) bytecode.Type {
+		return bytecode.New(op) | bytecode.EncodeSrc(srcsel, src, addr)
+	}
+	ip, dsIx := len(cs), len(ds)
+	ret := bytecode.New(bytecode.RET)
+
+	deep := []byte("calcb")
+	deep = append(deep, compresult.Version, 0, 1)
+	for range 2000 {
+		deep = append(deep, 6, 1) // array of one element
+	}
+	deep = append(deep, 0, 0, 0, 0, 0)
+
+	tests := []struct {
+		name string
+		file []byte
+		err  error
+	}{
+		{"valid", file, nil},
+		{"source", []byte("a = 1\n"), compresult.ErrFormat},
+		{"version", newer, compresult.ErrVersion},
+		{"truncated", file[:len(file)-2], compresult.ErrInvalid},
+		{"trailing", append(bytes.Clone(file), 0), compresult.ErrInvalid},
+		{"run out of range", write([]compresult.Run{{End: len(cs) + 1, OnError: 1}}), compresult.ErrInvalid},
+		{"run continuing backwards", write([]compresult.Run{{End: len(cs), OnError: 0}}), compresult.ErrInvalid},
+		{
+			"function",
+			corrupt(
+				[]bytecode.Type{instr(bytecode.FUNC, 0, bytecode.AddrDS, dsIx), instr(bytecode.PUSH, 0, bytecode.AddrLcl, 0), ret},
+				[]value.Type{value.NewFunction(ip+1, nil, 1, 1)},
+				dbginfo.Scope{From: ip + 1, To: ip + 3, Locals: []string{"x"}},
+			),
+			nil,
+		},
+		{"jump out of range", corrupt([]bytecode.Type{instr(bytecode.JMP, 0, bytecode.AddrImm, 2)}, nil), compresult.ErrInvalid},
+		{"context switch out of range", corrupt([]bytecode.Type{instr(bytecode.CCONT, 0, bytecode.AddrImm, -ip-1)}, nil), compresult.ErrInvalid},
+		{"error handler out of range", corrupt([]bytecode.Type{instr(bytecode.TRY, 0, bytecode.AddrImm, 2)}, nil), compresult.ErrInvalid},
+		{"jump into a function", corrupt([]bytecode.Type{instr(bytecode.JMP, 0, bytecode.AddrImm, scopes[0].From-ip)}, nil), compresult.ErrInvalid},
+		{
+			"jump out of a function",
+			corrupt([]bytecode.Type{instr(bytecode.JMPF, 1, bytecode.AddrImm, 2), ret}, nil, dbginfo.Scope{From: ip, To: ip + 2}),
+			compresult.ErrInvalid,
+		},
+		{"local variable out of function", corrupt([]bytecode.Type{instr(bytecode.PUSH, 0, bytecode.AddrLcl, 0)}, nil), compresult.ErrInvalid},
+		{
+			"local variable out of range",
+			corrupt([]bytecode.Type{instr(bytecode.PUSH, 0, bytecode.AddrLcl, 1), ret}, nil, dbginfo.Scope{From: ip, To: ip + 2, Locals: []string{"x"}}),
+			compresult.ErrInvalid,
+		},
+		{
+			"closure variable out of range",
+			corrupt(
+				[]bytecode.Type{instr(bytecode.PUSH, 0, bytecode.AddrCls, bytecode.EncodeCls(1, 0)), ret},
+				nil,
+				dbginfo.Scope{From: ip, To: ip + 2, Locals: []string{"x"}},
+			),
+			compresult.ErrInvalid,
+		},
+		{
+			"overlapping scopes",
+			corrupt([]bytecode.Type{ret, ret, ret}, nil, dbginfo.Scope{From: ip, To: ip + 2}, dbginfo.Scope{From: ip + 1, To: ip + 3}),
+			compresult.ErrInvalid,
+		},
+		{
+			"function without scope",
+			corrupt([]bytecode.Type{instr(bytecode.FUNC, 0, bytecode.AddrDS, dsIx), ret}, []value.Type{value.NewFunction(ip+1, nil, 0, 0)}),
+			compresult.ErrInvalid,
+		},
+		{
+			"function without closure",
+			corrupt(
+				[]bytecode.Type{instr(bytecode.PUSH, 0, bytecode.AddrDS, dsIx), ret},
+				[]value.Type{value.NewFunction(ip+1, nil, 0, 0)},
+				dbginfo.Scope{From: ip + 1, To: ip + 2},
+			),
+			compresult.ErrInvalid,
+		},
+		{"function in array", corrupt(nil, []value.Type{value.NewArray([]value.Type{value.NewFunction(scopes[0].From, nil, 0, 0)})}), compresult.ErrInvalid},
+		{"values nested too deep", deep, compresult.ErrInvalid},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := compresult.Read(bytes.NewReader(test.file), builtin.Native)
+			if !errors.Is(err, test.err) {
+				t.Errorf("expected %v got %v", test.err, err)
+			}
+		})
+	}
+}
+
+// newVM is a virtual machine with the builtin functions loaded writing its
+// output and errors to out.
+func newVM(out io.Writer) *vm.Type {
+	cs := []bytecode.Type{}
+	ds := []value.Type{}
+	dbg := make(dbginfo.Type)
+	lines := dbginfo.Lines{}
+	scopes := dbginfo.Scopes{}
+	modules := make(map[string]bool)
+	cr := compresult.Type{CS: &cs, DS: &ds, Dbg: &dbg, Lines: &lines, Scopes: &scopes, Modules: &modules}
+	builtin.Load(cr)
+
+	return vm.New(memory.New(), cr, vm.WithOut(out), vm.WithErrOut(out))
+}
+
+func TestOptimize(t *testing.T) {
+	files, err := filepath.Glob("../../examples/*.calc")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("expected examples got %v", err)
+	}
+
+	total, optimizedTotal := 0, 0
+	for _, file := range files {
+		instructions := func(opts node.Options) int {
+			virtM := newVM(io.Discard)
+			fr := node.NewFReader(file)
+			defer fr.Close()
+
+			if _, err := node.Compile(fr, parser.Type{}, virtM, opts); err != nil {
+				t.Fatalf("%s: expected no error got %s", file, err)
+			}
+			return len(*virtM.CR.CS)
+		}
+
+		cnt, optimizedCnt := instructions(node.Options{}), instructions(node.Options{Optimize: true})
+		if optimizedCnt > cnt {
+			t.Errorf("%s: expected at most %d instructions got %d", file, cnt, optimizedCnt)
+		}
+		total += cnt
+		optimizedTotal += optimizedCnt
+	}
+	if optimizedTotal >= total {
+		t.Errorf("expected less than %d instructions got %d", total, optimizedTotal)
+	}
+
+	if testing.Short() {
+		t.Skip("running the examples is slow")
+	}
+
+	// the output of the examples is recorded in examples.res
+	expected, err := os.ReadFile("../../examples/examples.res")
+	if err != nil {
+		t.Fatalf("expected no error got %s", err)
+	}
+
+	var out strings.Builder
+	for _, file := range files {
+		virtM := newVM(&out)
+		fr := node.NewFReader(file)
+		node.Loop(fr, parser.Type{}, virtM, node.Options{Optimize: true})
+		fr.Close()
+	}
+
+	if out.String() != string(expected) {
+		t.Errorf("expected output %q got %q", expected, out.String())
+	}
+}
+
+func BenchmarkExamples(b *testing.B) {
+	files, err := filepath.Glob("../../examples/*.calc")
+	if err != nil || len(files) == 0 {
+		b.Fatalf("expected examples got %v", err)
+	}
+
+	for _, file := range files {
+		b.Run(filepath.Base(file), func(b *testing.B) {
+			for range b.N {
+				virtM := newVM(io.Discard)
+				fr := node.NewFReader(file)
+				node.Loop(fr, parser.Type{}, virtM, node.Options{})
+				fr.Close()
+			}
+		})
+	}
+}
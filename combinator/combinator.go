@@ -130,19 +130,27 @@ type Conditional struct {
 // to parsing with OnSuccess part of choice. It rolls back a failing Predicate
 // automatically. A succeeding predicate will be prepended to the result of
 // success.
+//
+// If OnSuccess fails at the same token where the Gates of the previous choices
+// failed, the error lists what all of them expected.
 func Choose(choices ...Conditional) Parser {
 	return func(input RollbackLexer) ([]Node, *Error) {
+		gErrs := []*Error{}
 		for _, c := range choices {
 			input.Snapshot()
 			pRes, pErr := c.Gate(input)
 			if pErr == nil {
 				input.Commit()
 				sRes, sErr := c.OnSuccess(input)
+				if sErr != nil {
+					sErr = merge(sErr, gErrs)
+				}
 				if sRes != nil {
 					return append(pRes, sRes...), sErr
 				}
 				return nil, sErr
 			}
+			gErrs = append(gErrs, pErr)
 			input.Rollback()
 		}
 		// Modify your grammar using Choose, so the last choice always passes
@@ -159,28 +167,26 @@ func Choose(choices ...Conditional) Parser {
 // attempt It is meant to be used with terminal rules only, for complex
 // language rules prefer Choose because it gives much closer syntax errors to
 // the actual error location.
+//
+// If all parsers fail, the error is the one that got the furthest in the
+// input, listing what all the parsers failing there expected.
 func OneOf(args ...Parser) Parser {
 	if len(args) < 1 {
 		panic("Parser: OneOf needs at least one parser")
 	}
 	return func(input RollbackLexer) ([]Node, *Error) {
-		input.Snapshot()
-		pRes, pErr := args[0](input)
-		if pErr == nil {
-			input.Commit()
-			return pRes, nil
-		}
-		input.Rollback()
-		for _, p := range args[1:] {
+		errs := make([]*Error, 0, len(args))
+		for _, p := range args {
 			input.Snapshot()
-			pRes, pErr = p(input)
+			pRes, pErr := p(input)
 			if pErr == nil {
 				input.Commit()
 				return pRes, nil
 			}
 			input.Rollback()
+			errs = append(errs, pErr)
 		}
-		return nil, pErr
+		return nil, furthest(errs)
 	}
 }
 
@@ -316,8 +322,14 @@ func Accept(p func(Token) bool, msg string, wrp TokenWrapper) Parser {
 		}
 		tok := input.Token()
 		if !p(tok) {
-			msg := fmt.Sprintf("Parser: %s expected, got %v", msg, tok)
-			return nil, &Error{from: tok.From(), to: tok.To(), message: msg}
+			got := fmt.Sprint(tok)
+			return nil, &Error{
+				from:     tok.From(),
+				to:       tok.To(),
+				message:  fmt.Sprintf("Parser: %s expected, got %s", msg, got),
+				expected: []string{msg},
+				got:      got,
+			}
 		}
 		return []Node{wrp.Wrap(tok)}, nil
 	}
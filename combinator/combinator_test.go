@@ -27,6 +27,12 @@ func accept(t string) combinator.Parser {
 	return combinator.Accept(func(a combinator.Token) bool { return string(a.(testToken)) == t }, "?", tokenWrap)
 }
 
+// expect is accept, describing the expected token as t.
+func expect(t string) combinator.Parser {
+	tokenWrap := tokenWrapper{}
+	return combinator.Accept(func(a combinator.Token) bool { return string(a.(testToken)) == t }, t, tokenWrap)
+}
+
 var testData = []testDatum{
 	{
 		name:      "Accept",
@@ -70,6 +76,13 @@ var testData = []testDatum{
 		parserOut: nil,
 		err:       "Parser: ? expected, got c",
 	},
+	{
+		name:      "OneOf failed/aggregated",
+		parser:    combinator.OneOf(expect("a"), expect("b"), expect("a")),
+		lexerOut:  []testToken{"c"},
+		parserOut: nil,
+		err:       "Parser: one of a, b expected, got c",
+	},
 	{
 		name: "Backtrack aab -> a(aa|ab)",
 		parser: combinator.And(
@@ -94,6 +107,16 @@ var testData = []testDatum{
 		parserOut: []testNode{{token: testToken("a")}, {token: testToken("b")}},
 		err:       "",
 	},
+	{
+		name: "Choose failed/aggregated",
+		parser: combinator.Choose(
+			combinator.Conditional{Gate: expect("a"), OnSuccess: expect("b")},
+			combinator.Conditional{Gate: combinator.Ok(), OnSuccess: expect("c")},
+		),
+		lexerOut:  []testToken{"d"},
+		parserOut: nil,
+		err:       "Parser: one of a, c expected, got d",
+	},
 	{
 		name:      "Any (none)",
 		parser:    combinator.Any(combinator.Conditional{Gate: accept("a"), OnSuccess: combinator.Ok()}),
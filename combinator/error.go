@@ -1,10 +1,18 @@
 package combinator
 
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
 // Error indicates an error in the input source code.
 type Error struct {
-	from    int
-	to      int
-	message string
+	from     int
+	to       int
+	message  string
+	expected []string // expected describes the tokens that would have been accepted
+	got      string   // got is the unexpected token
 }
 
 func NewError(msg string, from, to int) *Error { return &Error{message: msg, from: from, to: to} }
@@ -19,3 +27,59 @@ func (e *Error) To() int { return e.to }
 
 // Message describes the error.
 func (e *Error) Message() string { return e.message }
+
+// Expected describes the tokens that would have been accepted at the position
+// of the error. It is empty if the error is not an unexpected token.
+func (e *Error) Expected() []string { return e.expected }
+
+// merge merges the expectations of the errors errs at the position of e into
+// e. It returns e if there is nothing to merge.
+func merge(e *Error, errs []*Error) *Error {
+	if len(e.expected) == 0 {
+		return e
+	}
+
+	expected := []string{}
+	for _, o := range append(errs, e) {
+		if o.from != e.from || o.got != e.got {
+			continue
+		}
+		for _, x := range o.expected {
+			if !slices.Contains(expected, x) {
+				expected = append(expected, x)
+			}
+		}
+	}
+
+	if len(expected) < 2 {
+		return e
+	}
+
+	msg := fmt.Sprintf("Parser: one of %s expected, got %s", strings.Join(expected, ", "), e.got)
+	return &Error{from: e.from, to: e.to, message: msg, expected: expected, got: e.got}
+}
+
+// furthest is the error of errs that got the furthest in the input, with the
+// expectations of the errors at the same position merged. Of errors at the
+// same position the last one is preferred.
+func furthest(errs []*Error) *Error {
+	e := errs[0]
+	for _, o := range errs[1:] {
+		if o.from >= e.from {
+			e = o
+		}
+	}
+	return merge(e, errs)
+}
+
+// Errors are the errors in the input source code in the order of their
+// position.
+type Errors []*Error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
@@ -0,0 +1,152 @@
+package calc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+
+	"github.com/paulsonkoly/calc/types/value"
+)
+
+// ErrConversion is returned when a Go value has no calc equivalent.
+var ErrConversion = errors.New("conversion error")
+
+var (
+	valueType  = reflect.TypeFor[value.Type]()
+	bigIntType = reflect.TypeFor[*big.Int]()
+)
+
+// ToValue converts a Go value to a calc value.
+//
+// nil, booleans, integers, floats and strings convert to the corresponding
+// calc values, integers that don't fit in int and *big.Int convert to
+// arbitrary precision integers. Slices and arrays convert to arrays, maps
+// convert to maps. A value.Type is returned as is.
+func ToValue(v any) (value.Type, error) {
+	if v == nil {
+		return value.Nil, nil
+	}
+	return toValue(reflect.ValueOf(v))
+}
+
+func toValue(rv reflect.Value) (value.Type, error) {
+	switch rv.Type() {
+	case valueType:
+		return rv.Interface().(value.Type), nil
+	case bigIntType:
+		if rv.IsNil() {
+			return value.Nil, nil
+		}
+		return value.NewBigInt(rv.Interface().(*big.Int)), nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		return value.NewBool(rv.Bool()), nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.NewInt(int(rv.Int())), nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := rv.Uint()
+		if u > math.MaxInt {
+			return value.NewBigInt(new(big.Int).SetUint64(u)), nil
+		}
+		return value.NewInt(int(u)), nil
+
+	case reflect.Float32, reflect.Float64:
+		return value.NewFloat(rv.Float()), nil
+
+	case reflect.String:
+		return value.NewString(rv.String()), nil
+
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return value.Nil, nil
+		}
+		a := make([]value.Type, rv.Len())
+		for i := range a {
+			e, err := toValue(rv.Index(i))
+			if err != nil {
+				return value.Nil, err
+			}
+			a[i] = e
+		}
+		return value.NewArray(a), nil
+
+	case reflect.Map:
+		if rv.IsNil() {
+			return value.Nil, nil
+		}
+		keys := make([]value.Type, 0, rv.Len())
+		values := make([]value.Type, 0, rv.Len())
+		for it := rv.MapRange(); it.Next(); {
+			k, err := toValue(it.Key())
+			if err != nil {
+				return value.Nil, err
+			}
+			v, err := toValue(it.Value())
+			if err != nil {
+				return value.Nil, err
+			}
+			keys = append(keys, k)
+			values = append(values, v)
+		}
+		return value.NewMap(keys, values)
+
+	case reflect.Interface, reflect.Pointer:
+		if rv.IsNil() {
+			return value.Nil, nil
+		}
+		return toValue(rv.Elem())
+	}
+
+	return value.Nil, fmt.Errorf("%w: %s", ErrConversion, rv.Type())
+}
+
+// FromValue converts a calc value to a Go value.
+//
+// nil converts to nil, integers to int or *big.Int, floats to float64,
+// booleans to bool, strings to string, arrays to []any, maps to map[any]any
+// and errors to value.ErrorData. Functions and modules are returned as
+// value.Type.
+func FromValue(v value.Type) any {
+	if v.IsNil() {
+		return nil
+	}
+	if i, ok := v.ToInt(); ok {
+		return i
+	}
+	if n, ok := v.ToBigInt(); ok {
+		return n
+	}
+	if f, ok := v.ToFloat(); ok {
+		return f
+	}
+	if b, ok := v.ToBool(); ok {
+		return b
+	}
+	if s, ok := v.ToString(); ok {
+		return s
+	}
+	if a, ok := v.ToArray(); ok {
+		r := make([]any, len(a))
+		for i, e := range a {
+			r[i] = FromValue(e)
+		}
+		return r
+	}
+	if keys, values, ok := v.ToMap(); ok {
+		r := make(map[any]any, len(keys))
+		for i, k := range keys {
+			r[FromValue(k)] = FromValue(values[i])
+		}
+		return r
+	}
+	if e, ok := v.ToError(); ok {
+		return e
+	}
+	return v
+}
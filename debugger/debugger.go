@@ -0,0 +1,377 @@
+// Package debugger is an interactive debugger for calc programs.
+//
+// The debugger is a hook of the virtual machine. It stops the execution at
+// breakpoints, on source lines or on calling functions, and after stepping,
+// and reads debugger commands until the execution is resumed. Type help at
+// the debugger prompt for the commands.
+package debugger
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/paulsonkoly/calc/types/value"
+	"github.com/paulsonkoly/calc/vm"
+)
+
+const prompt = "(dbg) "
+
+const help = `commands:
+  s, step            run to the next line, stepping into calls and generators
+  n, next            run to the next line, stepping over calls and generators
+  f, finish          run until the function returns or the generator yields
+  c, continue        run until a breakpoint
+  b, break           list the breakpoints
+  b [file:]line      break on a source line
+  b function         break on calling a function
+  d, delete n        delete breakpoint n
+  p, print name      print a local, closure or global variable
+  l, locals          print the local and closure variables
+  bt, backtrace      print the call stacks of the memory contexts
+  q, quit            stop the program
+an empty line repeats the last command`
+
+// mode is what the debugger is waiting for before stopping.
+type mode int
+
+const (
+	run    mode = iota // run stops at breakpoints only
+	step               // step stops at the next line
+	next               // next stops at the next line in the same function
+	finish             // finish stops when leaving the function
+)
+
+// pos is the position of the execution, as far as stepping is concerned.
+type pos struct {
+	ctxs  []string // ctxs are the memory contexts, innermost first
+	depth int      // depth is the call depth in the innermost memory context
+	file  string   // file is the source file
+	line  int      // line is the source line
+}
+
+// sameFrame determines whether p and o are in the same function call.
+func (p pos) sameFrame(o pos) bool {
+	return len(p.ctxs) > 0 && len(o.ctxs) > 0 && p.ctxs[0] == o.ctxs[0] && p.depth == o.depth
+}
+
+// sameLine determines whether p and o are on the same line of the same
+// function call.
+func (p pos) sameLine(o pos) bool { return p.sameFrame(o) && p.file == o.file && p.line == o.line }
+
+// left determines whether p has left the frame of o to the caller, or to the
+// consumer of the generator.
+func (p pos) left(o pos) bool {
+	if len(p.ctxs) < 1 || len(o.ctxs) < 1 {
+		return false
+	}
+	return (p.ctxs[0] == o.ctxs[0] && p.depth < o.depth) || slices.Contains(o.ctxs[1:], p.ctxs[0])
+}
+
+// breakpoint is a breakpoint on a source line or on calling a function.
+type breakpoint struct {
+	id   int
+	file string // file is the file name or its suffix, empty for any file
+	line int    // line is the source line, 0 for function breakpoints
+	fn   string // fn is the name of the called function
+}
+
+func (b breakpoint) String() string {
+	switch {
+	case b.fn != "":
+		return fmt.Sprintf("%d: %s()", b.id, b.fn)
+	case b.file != "":
+		return fmt.Sprintf("%d: %s:%d", b.id, b.file, b.line)
+	default:
+		return fmt.Sprintf("%d: line %d", b.id, b.line)
+	}
+}
+
+// matches determines whether the execution at p is on the line of b.
+func (b breakpoint) matches(p pos) bool {
+	if b.fn != "" || b.line != p.line {
+		return false
+	}
+	return b.file == "" || p.file == b.file || strings.HasSuffix(p.file, string(filepath.Separator)+b.file)
+}
+
+// Type is the debugger.
+type Type struct {
+	in      *bufio.Reader
+	out     io.Writer
+	mode    mode
+	from    pos          // from is where the execution was resumed
+	last    pos          // last is the position of the last instruction with a source location
+	bps     []breakpoint // bps are the breakpoints
+	nextID  int          // nextID is the id of the next breakpoint
+	entry   bool         // entry stops at the next instruction, the entry of a function
+	lastCmd string       // lastCmd is the last command, repeated on an empty line
+	off     bool         // off is set when the input is closed, the debugger never stops
+}
+
+// New creates a debugger reading commands from in and writing to out. It stops
+// at the first line executed.
+func New(in io.Reader, out io.Writer) *Type {
+	return &Type{in: bufio.NewReader(in), out: out, mode: step, nextID: 1}
+}
+
+// Step implements vm.Hook.
+func (d *Type) Step(s vm.State) {
+	if d.off {
+		return
+	}
+
+	loc := s.Loc()
+
+	if d.entry {
+		d.entry = false
+		cur := d.pos(s)
+		d.last = cur
+		d.stop(s, cur)
+	} else if loc != nil {
+		cur := d.pos(s)
+		stop := d.stops(cur)
+		d.last = cur
+		if stop {
+			d.stop(s, cur)
+		}
+	}
+
+	if call, ok := s.Call(); ok && slices.ContainsFunc(d.bps, func(b breakpoint) bool { return b.fn == call.Name }) {
+		d.entry = true
+	}
+}
+
+// pos is the position of the execution in s.
+func (d *Type) pos(s vm.State) pos {
+	p := pos{ctxs: s.Contexts(), depth: s.Depth()}
+	if loc := s.Loc(); loc != nil {
+		p.file = loc.File
+		p.line = loc.Line
+	}
+	return p
+}
+
+// stops determines whether the execution stops at p.
+func (d *Type) stops(p pos) bool {
+	if !p.sameLine(d.last) && slices.ContainsFunc(d.bps, func(b breakpoint) bool { return b.matches(p) }) {
+		return true
+	}
+
+	switch d.mode {
+	case step:
+		return !p.sameLine(d.from)
+	case next:
+		return p.left(d.from) || (p.sameFrame(d.from) && !p.sameLine(d.from))
+	case finish:
+		return p.left(d.from)
+	}
+	return false
+}
+
+// stop shows where the execution stopped and reads commands until the
+// execution is resumed.
+func (d *Type) stop(s vm.State, p pos) {
+	d.from = p
+	d.mode = run
+
+	if loc := s.Loc(); loc != nil {
+		fmt.Fprintf(d.out, "stopped at %v\n", loc.Pos)
+		fmt.Fprintln(d.out, loc.Text)
+	} else {
+		fmt.Fprintf(d.out, "stopped at %d: %v\n", s.IP, s.Instr)
+	}
+
+	for {
+		fmt.Fprint(d.out, prompt)
+		line, err := d.in.ReadString('\n')
+		if err != nil && line == "" {
+			// no more commands, let the program run
+			fmt.Fprintln(d.out)
+			d.off = true
+			return
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			line = d.lastCmd
+		}
+		d.lastCmd = line
+
+		if d.command(s, strings.Fields(line)) {
+			return
+		}
+	}
+}
+
+// command executes the command cmd. It returns true if the execution is
+// resumed.
+func (d *Type) command(s vm.State, cmd []string) bool {
+	if len(cmd) < 1 {
+		return false
+	}
+
+	switch cmd[0] {
+	case "s", "step":
+		d.mode = step
+		return true
+
+	case "n", "next":
+		d.mode = next
+		return true
+
+	case "f", "finish":
+		if d.from.depth < 1 && len(d.from.ctxs) < 2 {
+			fmt.Fprintln(d.out, "not in a function")
+			return false
+		}
+		d.mode = finish
+		return true
+
+	case "c", "continue":
+		d.mode = run
+		return true
+
+	case "b", "break":
+		if len(cmd) < 2 {
+			for _, b := range d.bps {
+				fmt.Fprintln(d.out, b)
+			}
+			return false
+		}
+		b := parseBreakpoint(cmd[1])
+		b.id = d.nextID
+		d.nextID++
+		d.bps = append(d.bps, b)
+		fmt.Fprintf(d.out, "breakpoint %v\n", b)
+
+	case "d", "delete":
+		if len(cmd) < 2 {
+			fmt.Fprintln(d.out, "breakpoint number expected")
+			return false
+		}
+		id, err := strconv.Atoi(cmd[1])
+		ix := slices.IndexFunc(d.bps, func(b breakpoint) bool { return b.id == id })
+		if err != nil || ix == -1 {
+			fmt.Fprintf(d.out, "no breakpoint %s\n", cmd[1])
+			return false
+		}
+		d.bps = slices.Delete(d.bps, ix, ix+1)
+
+	case "p", "print":
+		if len(cmd) < 2 {
+			fmt.Fprintln(d.out, "variable name expected")
+			return false
+		}
+		fmt.Fprintln(d.out, lookup(s, cmd[1]).Display())
+
+	case "l", "locals":
+		d.locals(s)
+
+	case "bt", "backtrace":
+		d.backtrace(s)
+
+	case "q", "quit":
+		// the caller of the virtual machine decides what to do after the program stopped
+		s.Stop()
+		d.off = true
+		return true
+
+	case "h", "help":
+		fmt.Fprintln(d.out, help)
+
+	default:
+		fmt.Fprintf(d.out, "unknown command %s, try help\n", cmd[0])
+	}
+
+	return false
+}
+
+// parseBreakpoint parses a breakpoint given as [file:]line or function name.
+func parseBreakpoint(arg string) breakpoint {
+	file, ln := "", arg
+	if i := strings.LastIndexByte(arg, ':'); i != -1 {
+		file, ln = arg[:i], arg[i+1:]
+	}
+
+	if line, err := strconv.Atoi(ln); err == nil {
+		return breakpoint{file: file, line: line}
+	}
+
+	return breakpoint{fn: arg}
+}
+
+// lookup looks up the variable name the same way the code at s would.
+func lookup(s vm.State, name string) value.Type {
+	scopes := s.Scopes()
+	if len(scopes) > 0 {
+		if ix := slices.Index(scopes[0].Locals, name); ix != -1 {
+			if v, ok := s.Local(ix); ok {
+				return v
+			}
+		}
+
+		for depth, scope := range scopes[1:] {
+			if ix := slices.Index(scope.Locals, name); ix != -1 {
+				return s.Closure(depth+1, ix)
+			}
+		}
+	}
+
+	return s.Global(name)
+}
+
+// locals prints the local variables and the closure variables visible at s.
+func (d *Type) locals(s vm.State) {
+	scopes := s.Scopes()
+	if len(scopes) < 1 {
+		fmt.Fprintln(d.out, "no local variables outside of functions")
+		return
+	}
+
+	seen := []string{}
+	for depth, scope := range scopes {
+		for ix, name := range scope.Locals {
+			if slices.Contains(seen, name) {
+				continue
+			}
+			seen = append(seen, name)
+
+			if depth == 0 {
+				if v, ok := s.Local(ix); ok {
+					fmt.Fprintf(d.out, "%s = %s\n", name, v.Display())
+				}
+			} else {
+				fmt.Fprintf(d.out, "%s = %s (closure)\n", name, s.Closure(depth, ix).Display())
+			}
+		}
+	}
+}
+
+// backtrace prints the function calls of the memory contexts at s.
+func (d *Type) backtrace(s vm.State) {
+	for _, ctx := range s.Backtrace() {
+		fmt.Fprintf(d.out, "memory context %s\n", ctx.ID)
+		for _, c := range ctx.Calls {
+			args := make([]string, len(c.Args))
+			for i, v := range c.Args {
+				args[i] = v.Abbrev()
+			}
+			fmt.Fprintf(d.out, "  %s(%s)", c.Name, strings.Join(args, ", "))
+			if c.Loc != nil {
+				fmt.Fprintf(d.out, " at %v", c.Loc.Pos)
+			}
+			fmt.Fprintln(d.out)
+			if c.Elided > 0 {
+				fmt.Fprintf(d.out, "  ... tail calls elided: %d\n", c.Elided)
+			}
+		}
+		if ctx.Err != nil {
+			fmt.Fprintf(d.out, "  %v\n", ctx.Err)
+		}
+	}
+}
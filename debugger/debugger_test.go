@@ -0,0 +1,102 @@
+package debugger_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/paulsonkoly/calc"
+	"github.com/paulsonkoly/calc/debugger"
+	"github.com/paulsonkoly/calc/types/value"
+	"github.com/paulsonkoly/calc/vm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const program = `sq = (x) -> {
+  y = x * x
+  y
+}
+gen = (n) -> for i <- fromto(0, n) yield sq(i)
+mk = (a) -> (b) -> {
+  c = a + b
+  c
+}
+add1 = mk(1)
+s = 0
+for v <- gen(3) s = s + v
+write(add1(s))`
+
+type sessionDatum struct {
+	name     string
+	commands string
+	expected []string
+}
+
+var sessionData = [...]sessionDatum{
+	{"step", "n\nn\nn\n", []string{
+		"stopped at 1:1\nsq = (x) -> {",
+		"stopped at 5:1\ngen = ",
+		"stopped at 6:1\nmk = ",
+		"stopped at 10:8\nadd1 = mk(1)",
+	}},
+	{"line breakpoint", "b 7\nc\nl\np a\np b\np s\nbt\nf\n", []string{
+		"breakpoint 1: line 7",
+		"stopped at 7:7\n  c = a + b",
+		"b = 5\nc = nil\na = 1 (closure)",
+		"(dbg) 1\n(dbg) 5\n(dbg) 5\n",
+		"  add1(5) at 13:7",
+		"stopped at 13:1\nwrite(add1(s))",
+	}},
+	{"function breakpoint", "b sq\nc\nbt\nn\nn\nd 1\nn\nn\n", []string{
+		"breakpoint 1: sq()",
+		"stopped at 2:7\n  y = x * x",
+		"  sq(0) at 5:42\n  gen(3) at 12:10",
+		"stopped at 12:1\nfor v <- gen(3) s = s + v",
+		"stopped at 2:7\n  y = x * x",
+		"stopped at 12:1\nfor v <- gen(3) s = s + v",
+		"stopped at 13:7\nwrite(add1(s))",
+	}},
+	{"finish outside of functions", "f\n", []string{"not in a function"}},
+}
+
+func TestDebugger(t *testing.T) {
+	for _, test := range sessionData {
+		t.Run(test.name, func(t *testing.T) {
+			var out strings.Builder
+			var dbgOut strings.Builder
+
+			d := debugger.New(strings.NewReader(test.commands), &dbgOut)
+			i := calc.New(calc.WithOut(&out), calc.WithHook(d))
+
+			_, err := i.Eval(program)
+			require.NoError(t, err)
+			assert.Equal(t, "6", out.String())
+
+			log := dbgOut.String()
+			for _, e := range test.expected {
+				ix := strings.Index(log, e)
+				if !assert.NotEqual(t, -1, ix, "%q not in\n%s", e, dbgOut.String()) {
+					return
+				}
+				log = log[ix+len(e):]
+			}
+		})
+	}
+}
+
+func TestQuit(t *testing.T) {
+	var out strings.Builder
+	var dbgOut strings.Builder
+
+	d := debugger.New(strings.NewReader("n\nq\n"), &dbgOut)
+	i := calc.New(calc.WithOut(&out), calc.WithHook(d))
+
+	_, err := i.Eval("write(\"a\")\nwrite(\"b\")\nwrite(\"c\")")
+	require.ErrorIs(t, err, vm.ErrStopped)
+	assert.Equal(t, "a", out.String())
+
+	// the interpreter can be used after the program stopped
+	v, err := i.Eval("1 + 1")
+	require.NoError(t, err)
+	assert.Equal(t, value.NewInt(2), v)
+}
@@ -0,0 +1,331 @@
+// Package disasm is a disassembler for the compiled calc code.
+//
+// The code is listed in sections, the top level code and a section for each
+// function, named after the variable the function is assigned to. Jump targets
+// are labelled, and the operands are shown symbolically: the constants of the
+// data segment inline, and the global variables by name.
+package disasm
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/paulsonkoly/calc/types/bytecode"
+	"github.com/paulsonkoly/calc/types/compresult"
+	"github.com/paulsonkoly/calc/types/dbginfo"
+	"github.com/paulsonkoly/calc/types/value"
+)
+
+// maxConst is the length constants are abbreviated to.
+const maxConst = 24
+
+// function is a compiled calc function.
+type function struct {
+	entry  int           // entry is the address of the first instruction of the body
+	scope  dbginfo.Scope // scope is the lexical scope of the body
+	name   string        // name is the unique label of the function
+	params int           // params is the number of parameters
+}
+
+// disassembler is the state of disassembling a compilation result.
+type disassembler struct {
+	cr     compresult.Type
+	funcs  []*function         // funcs are the functions sorted by entry address
+	byNode map[int]*function   // byNode are the functions by entry address
+	labels map[int]string      // labels are the names of the jump targets
+	owner  []*function         // owner is the innermost function of the instructions, nil for the top level
+	names  map[string]struct{} // names are the labels of the functions
+}
+
+// Write writes the disassembly of the code of cr to w. The code below the
+// address from, and the functions defined in it, are left out.
+func Write(w io.Writer, cr compresult.Type, from int) {
+	from = min(from, len(*cr.CS))
+	d := &disassembler{
+		cr:     cr,
+		byNode: map[int]*function{},
+		labels: map[int]string{},
+		names:  map[string]struct{}{},
+	}
+	d.findFuncs()
+	d.findLabels(from)
+
+	d.section(w, nil, from)
+	for _, f := range d.funcs {
+		if f.entry >= from {
+			d.section(w, f, from)
+		}
+	}
+}
+
+// findFuncs finds the functions of the data segment.
+func (d *disassembler) findFuncs() {
+	cs, ds := *d.cr.CS, *d.cr.DS
+
+	// a function value is assigned by the instruction following FUNC
+	names := map[int]string{}
+	for ip, instr := range cs {
+		if instr.OpCode() != bytecode.FUNC || instr.Src0() != bytecode.AddrDS || ip+1 >= len(cs) {
+			continue
+		}
+		if f, ok := ds[instr.Src0Addr()].ToFunction(); ok {
+			names[f.Node] = d.assignee(ip+1, f.Node)
+		}
+	}
+
+	for _, v := range ds {
+		fv, ok := v.ToFunction()
+		if !ok || fv.Native != nil {
+			continue
+		}
+		if _, ok := d.byNode[fv.Node]; ok {
+			continue
+		}
+
+		f := &function{entry: fv.Node, scope: dbginfo.Scope{From: fv.Node, To: fv.Node}, params: fv.ParamCnt}
+		for _, s := range *d.cr.Scopes {
+			if s.From == fv.Node {
+				f.scope = s
+			}
+		}
+		d.byNode[f.entry] = f
+		d.funcs = append(d.funcs, f)
+	}
+
+	slices.SortFunc(d.funcs, func(a, b *function) int { return cmp.Compare(a.entry, b.entry) })
+
+	// function bodies are nested in the bodies of the enclosing functions
+	d.owner = make([]*function, len(cs))
+	for _, f := range d.funcs {
+		f.scope.Body(func(ip int) { d.owner[ip] = f })
+	}
+
+	for _, f := range d.funcs {
+		name, ok := names[f.entry]
+		if !ok || name == "" {
+			name = "anonymous"
+		}
+		f.name = name
+		for i := 2; ; i++ {
+			if _, ok := d.names[f.name]; !ok {
+				break
+			}
+			f.name = fmt.Sprintf("%s.%d", name, i)
+		}
+		d.names[f.name] = struct{}{}
+	}
+}
+
+// assignee is the name of the variable the instruction at ip assigns the
+// function value with entry node to, empty if it's not an assignment.
+func (d *disassembler) assignee(ip, node int) string {
+	instr := (*d.cr.CS)[ip]
+	if instr.OpCode() != bytecode.MOV || instr.Src0() != bytecode.AddrStck {
+		return ""
+	}
+
+	switch instr.Src1() {
+	case bytecode.AddrGbl:
+		name, _ := (*d.cr.DS)[instr.Src1Addr()].ToString()
+		return name
+
+	case bytecode.AddrLcl:
+		// the local variable of the enclosing function
+		for _, s := range d.cr.Scopes.Lookup(ip) {
+			if s.From != node {
+				if ix := instr.Src1Addr(); ix < len(s.Locals) {
+					return s.Locals[ix]
+				}
+				return ""
+			}
+		}
+	}
+	return ""
+}
+
+// findLabels labels the jump targets from the address from. The labels are
+// numbered in the order of the listing.
+func (d *disassembler) findLabels(from int) {
+	cs := *d.cr.CS
+	targets := map[int]struct{}{}
+	for ip, instr := range cs[from:] {
+		if target, ok := instr.JumpTarget(ip + from); ok && target >= from {
+			targets[target] = struct{}{}
+		}
+	}
+
+	n := 0
+	label := func(f *function) {
+		for ip := from; ip < len(cs); ip++ {
+			if _, ok := targets[ip]; ok && d.owner[ip] == f {
+				n++
+				d.labels[ip] = fmt.Sprintf("L%d", n)
+			}
+		}
+	}
+
+	label(nil)
+	for _, f := range d.funcs {
+		if f.entry >= from {
+			label(f)
+		}
+	}
+}
+
+// section writes the section of the function f, or the top level if f is nil,
+// from the address from.
+func (d *disassembler) section(w io.Writer, f *function, from int) {
+	if f == nil {
+		fmt.Fprintf(w, "%s:\n", dbginfo.TopLevel)
+	} else {
+		all := f.scope.Locals
+		params, locals := all[:min(f.params, len(all))], all[min(f.params, len(all)):]
+		fmt.Fprintf(w, "\n%s(%s):", f.name, strings.Join(params, ", "))
+		if len(locals) > 0 {
+			fmt.Fprintf(w, " ; locals %s", strings.Join(locals, ", "))
+		}
+		fmt.Fprintln(w)
+	}
+
+	for ip, instr := range (*d.cr.CS)[from:] {
+		ip += from
+		if d.owner[ip] != f {
+			continue
+		}
+		if label, ok := d.labels[ip]; ok {
+			fmt.Fprintf(w, "%s:\n", label)
+		}
+
+		ops, comment := d.instruction(ip, instr)
+		line := fmt.Sprintf("%8d    %-9v %s", ip, instr.OpCode(), strings.Join(ops, ", "))
+		if comment != "" {
+			line = fmt.Sprintf("%-48s ; %s", line, comment)
+		}
+		fmt.Fprintln(w, strings.TrimRight(line, " "))
+	}
+}
+
+// instruction is the operands of the instruction instr at ip, and a comment
+// describing it.
+func (d *disassembler) instruction(ip int, instr bytecode.Type) ([]string, string) {
+	switch instr.OpCode() {
+	case bytecode.JMP:
+		return []string{d.label(ip + instr.Src0Addr())}, ""
+
+	case bytecode.JMPF, bytecode.JMPT:
+		return []string{d.label(ip + instr.Src1Addr()), d.operand(ip, instr.Src0(), instr.Src0Addr())}, ""
+
+	case bytecode.CCONT:
+		return []string{d.label(ip + instr.Src0Addr())},
+			fmt.Sprintf("create context %d, continue at %s", instr.Src1Addr(), d.label(ip+instr.Src0Addr()))
+
+	case bytecode.SCONT:
+		return nil, fmt.Sprintf("switch to context %d", instr.Src0Addr())
+
+	case bytecode.DCONT:
+		return nil, "destroy " + contexts(instr.Src0Addr(), instr.Src1Addr())
+
+	case bytecode.RCONT:
+		return nil, "remove " + contexts(instr.Src0Addr(), instr.Src1Addr())
+
+	case bytecode.YIELD:
+		return []string{d.operand(ip, instr.Src0(), instr.Src0Addr())}, "yield to the parent context"
+
+	case bytecode.TRY:
+		return []string{d.label(ip + instr.Src0Addr())},
+			fmt.Sprintf("errors destroy the contexts from %d", instr.Src1Addr())
+
+	case bytecode.UNTRY:
+		return []string{d.operand(ip, instr.Src0(), instr.Src0Addr())}, ""
+
+	case bytecode.CALL, bytecode.TAIL:
+		ops := []string{d.operand(ip, instr.Src0(), instr.Src0Addr()), d.operand(ip, instr.Src1(), instr.Src1Addr())}
+		if call, ok := (*d.cr.Dbg)[ip]; ok && instr.Src0() != bytecode.AddrGbl {
+			return ops, fmt.Sprintf("%s/%d", call.Name, call.ArgCnt)
+		}
+		return ops, ""
+
+	default:
+		ops := []string{}
+		srcs := [...]struct {
+			src  uint64
+			addr int
+		}{{instr.Src2(), instr.Src2Addr()}, {instr.Src1(), instr.Src1Addr()}, {instr.Src0(), instr.Src0Addr()}}
+		for _, s := range srcs {
+			if s.src != bytecode.AddrInv {
+				ops = append(ops, d.operand(ip, s.src, s.addr))
+			}
+		}
+		return ops, ""
+	}
+}
+
+// contexts describes the context ids from lo to hi.
+func contexts(lo, hi int) string {
+	if lo == hi {
+		return fmt.Sprintf("context %d", lo)
+	}
+	return fmt.Sprintf("contexts %d..%d", lo, hi)
+}
+
+// label is the label of the address ip.
+func (d *disassembler) label(ip int) string {
+	if label, ok := d.labels[ip]; ok {
+		return label
+	}
+	return fmt.Sprint(ip)
+}
+
+// operand is the symbolic form of the operand src with address addr of the
+// instruction at ip.
+func (d *disassembler) operand(ip int, src uint64, addr int) string {
+	switch src {
+	case bytecode.AddrDS:
+		return fmt.Sprintf("DS[%d]=%s", addr, d.constant((*d.cr.DS)[addr]))
+	case bytecode.AddrGbl:
+		name, _ := (*d.cr.DS)[addr].ToString()
+		return name
+	case bytecode.AddrCls:
+		depth, ix := bytecode.DecodeCls(addr)
+		var name string
+		if scopes := d.cr.Scopes.Lookup(ip); depth < len(scopes) && ix < len(scopes[depth].Locals) {
+			name = ":" + scopes[depth].Locals[ix]
+		}
+		return fmt.Sprintf("CLS[%d:%d]%s", depth, ix, name)
+	case bytecode.AddrLcl:
+		var name string
+		if f := d.owner[ip]; f != nil && addr < len(f.scope.Locals) {
+			name = ":" + f.scope.Locals[addr]
+		}
+		return fmt.Sprintf("LCL[%d]%s", addr, name)
+	case bytecode.AddrStck:
+		return "STCK"
+	case bytecode.AddrTmp:
+		return "TMP"
+	case bytecode.AddrImm:
+		return fmt.Sprint(addr)
+	default:
+		return ""
+	}
+}
+
+// constant is the abbreviated form of the constant v.
+func (d *disassembler) constant(v value.Type) string {
+	if f, ok := v.ToFunction(); ok {
+		if f.Native != nil {
+			return "<native " + f.Native.Name + ">"
+		}
+		if fn, ok := d.byNode[f.Node]; ok {
+			return "<" + fn.name + ">"
+		}
+	}
+
+	s := v.Display()
+	if len(s) > maxConst {
+		return s[:maxConst-3] + "..."
+	}
+	return s
+}
@@ -0,0 +1,114 @@
+package disasm_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/paulsonkoly/calc/builtin"
+	"github.com/paulsonkoly/calc/disasm"
+	"github.com/paulsonkoly/calc/parser"
+	"github.com/paulsonkoly/calc/types/bytecode"
+	"github.com/paulsonkoly/calc/types/compresult"
+	"github.com/paulsonkoly/calc/types/dbginfo"
+	"github.com/paulsonkoly/calc/types/node"
+	"github.com/paulsonkoly/calc/types/value"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var program = []string{
+	"sq = (x) -> x * x",
+	`gen = (n) -> {
+  step = (k) -> yield k + n
+  for i <- fromto(0, n) step(i)
+}`,
+	`if sq(2) > 3 write("big") else write(["small", 1.5])`,
+}
+
+// compile compiles the program after the builtin functions.
+func compile(t *testing.T) compresult.Type {
+	cs := []bytecode.Type{}
+	ds := []value.Type{}
+	dbg := make(dbginfo.Type)
+	lines := dbginfo.Lines{}
+	scopes := dbginfo.Scopes{}
+	modules := make(map[string]bool)
+	cr := compresult.Type{CS: &cs, DS: &ds, Dbg: &dbg, Lines: &lines, Scopes: &scopes, Modules: &modules}
+	builtin.Load(cr)
+
+	for _, input := range program {
+		ast, err := parser.Parse(input)
+		require.Nil(t, err)
+		for _, stmnt := range ast {
+			node.ByteCodeNoStck(stmnt.STRewrite(node.SymTbl{}), cr)
+		}
+	}
+
+	return cr
+}
+
+func TestWrite(t *testing.T) {
+	var b strings.Builder
+	disasm.Write(&b, compile(t), 0)
+	out := b.String()
+
+	for _, s := range []string{
+		"top level:\n",
+		"\nsq(x):\n",
+		"\ngen(n): ; locals step, i\n",
+		"\nstep(k):\n",
+		"\nfromto(a, b):\n",
+		"FUNC      DS[",
+		"]=<sq>\n",
+		"MOV       sq, STCK\n",
+		"MUL       LCL[0]:x, LCL[0]:x\n",
+		"ADD       LCL[0]:k, CLS[1:0]:n\n",
+		"CALL      LCL[1]:step, 1",
+		"; step/1\n",
+		`]="big"`,
+		`]=["small", 1.5]`,
+		"; create context 0, continue at L",
+		"; switch to context 0\n",
+		"; destroy context 0\n",
+		"; yield to the parent context\n",
+	} {
+		assert.Contains(t, out, s)
+	}
+
+	// each jump target is labelled once
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		switch fields[1] {
+		case "JMP", "JMPF", "JMPT", "CCONT":
+			label := strings.TrimSuffix(fields[2], ",")
+			assert.Equal(t, 1, strings.Count(out, "\n"+label+":\n"), line)
+		}
+	}
+}
+
+func TestWriteFrom(t *testing.T) {
+	var b strings.Builder
+	disasm.Write(&b, compile(t), builtin.Size())
+	out := b.String()
+
+	for _, s := range []string{"top level:\n", "\nsq(x):\n", "\ngen(n): ; locals step, i\n", "\nstep(k):\n", "CALL      fromto, 2"} {
+		assert.Contains(t, out, s)
+	}
+	for _, s := range []string{"\nfromto(a, b):\n", "\nwrite(", "MOV       fromto, STCK\n"} {
+		assert.NotContains(t, out, s)
+	}
+
+	// the labels are numbered from L1 in the order of the listing
+	n := 0
+	for _, line := range strings.Split(out, "\n") {
+		if label, ok := strings.CutSuffix(line, ":"); ok && strings.HasPrefix(label, "L") {
+			n++
+			assert.Equal(t, fmt.Sprintf("L%d", n), label)
+		}
+	}
+	assert.Positive(t, n)
+}
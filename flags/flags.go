@@ -9,5 +9,15 @@ var AstFlag = flag.Bool("ast", false, `calc outputs AST in graphviz dot format
 % gvpack -u x.dot > packed.dot
 % dot -Tsvg packed.dot -o x.svg`)
 var EvalFlag = flag.String("eval", "", "string to evaluate")
+var DebugFlag = flag.Bool("debug", false, "debug the file or the evaluated string interactively")
+var TraceFlag = flag.String("trace", "", "file the executed instructions are traced to, - for stdout")
+var TraceFuncFlag = flag.String("trace-func", "", "trace only the instructions of the named function")
+var TraceIPFlag = flag.String("trace-ip", "", "trace only the instructions in the address range from:to, to is exclusive")
+var ProfileFlag = flag.String("profile", "", "file the calc level profile is written to in pprof format, the table of the functions goes to stderr")
+var DisasmFlag = flag.Bool("disasm", false, "compile the file without running it and print the disassembly of the bytecode")
+var DisasmBuiltinsFlag = flag.Bool("disasm-builtins", false, "list the builtin functions in the disassembly too")
+var OptimizeFlag = flag.Bool("O", false, "optimize the bytecode of the file or the repl input with the peephole optimizer")
+var CompileFlag = flag.Bool("compile", false, "compile the file to bytecode without running it, .calcb files are run as compiled")
+var OutFlag = flag.String("o", "", "file the compiled bytecode is written to, the source file with the .calcb extension by default")
 var CPUProfFlag = flag.String("cpuprof", "", "filename for go pprof")
 var HeapProfFlag = flag.String("heapprof", "", "filename for go pprof")
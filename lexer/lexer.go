@@ -13,6 +13,7 @@
 package lexer
 
 import (
+	"io"
 	"strings"
 
 	"github.com/paulsonkoly/calc/types/token"
@@ -33,6 +34,18 @@ func NewLexer(input string) Lexer {
 	return Lexer{input: input, rdr: *strings.NewReader(input), state: whiteSpace}
 }
 
+// NewLexerAt creates a new lexer with input string, that starts lexing at the
+// byte offset off.
+func NewLexerAt(input string, off int) Lexer {
+	l := NewLexer(input)
+	off = min(off, len(input))
+	if _, err := l.rdr.Seek(int64(off), io.SeekStart); err != nil {
+		panic(err)
+	}
+	l.from, l.to = off, off
+	return l
+}
+
 // Next advances the lexer to a new token.
 //
 // It returns false if an error happened or there are no tokens left.
@@ -62,7 +75,7 @@ func (l *Lexer) Next() bool {
 		if str.doEmit {
 			word := l.input[l.from:l.to]
 			if str.typ == token.StringLit {
-				word = strings.ReplaceAll(word, "\\n", "\n")
+				word = unescape(word)
 			}
 			l.Token = token.WithFromTo(str.typ, word, l.from, l.to)
 			l.state = str.next
@@ -78,10 +91,10 @@ func (l *Lexer) Next() bool {
 	l.Err = nil
 	switch {
 	case !l.eof && l.Token.Type != token.EOL:
-		l.Token = token.Type{Value: "\n", Type: token.EOL}
+		l.Token = token.WithFromTo(token.EOL, "\n", len(l.input), len(l.input))
 		return true
 	case !l.eof:
-		l.Token = token.Type{Value: string(EOF), Type: token.EOF}
+		l.Token = token.WithFromTo(token.EOF, string(EOF), len(l.input), len(l.input))
 		l.eof = true
 		return true
 	}
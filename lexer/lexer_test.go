@@ -37,10 +37,27 @@ var testData = []testDatum{
 	{"single lexeme", "&", []token.Type{{Value: "&", Type: token.Sticky}, eol, eof}},
 	{"single lexeme", "|", []token.Type{{Value: "|", Type: token.Sticky}, eol, eof}},
 	{"single lexeme", "~", []token.Type{{Value: "~", Type: token.Sticky}, eol, eof}},
+	{"name with digits", "x2", []token.Type{{Value: "x2", Type: token.Name}, eol, eof}},
+	{"name with underscore", "_is_prime", []token.Type{{Value: "_is_prime", Type: token.Name}, eol, eof}},
+	{"name with upper case", "maxValue", []token.Type{{Value: "maxValue", Type: token.Name}, eol, eof}},
+	{"zero", "0", []token.Type{{Value: "0", Type: token.IntLit}, eol, eof}},
+	{"hex literal", "0xfF", []token.Type{{Value: "0xfF", Type: token.IntLit}, eol, eof}},
+	{"binary literal", "0b1010", []token.Type{{Value: "0b1010", Type: token.IntLit}, eol, eof}},
+	{"octal literal", "0o17", []token.Type{{Value: "0o17", Type: token.IntLit}, eol, eof}},
+	{"digit separators", "1_000_000", []token.Type{{Value: "1_000_000", Type: token.IntLit}, eol, eof}},
+	{"hex digit separators", "0xff_ff", []token.Type{{Value: "0xff_ff", Type: token.IntLit}, eol, eof}},
+	{"float digit separators", "1_0.5_5", []token.Type{{Value: "1_0.5_5", Type: token.FloatLit}, eol, eof}},
+	{"scientific float", "6.02e23", []token.Type{{Value: "6.02e23", Type: token.FloatLit}, eol, eof}},
+	{"scientific float without fraction", "1E-3", []token.Type{{Value: "1E-3", Type: token.FloatLit}, eol, eof}},
 	{"string literal", "\"abc\"", []token.Type{{Value: "\"abc\"", Type: token.StringLit}, eol, eof}},
-	{"escaped string literal", "\"a\\\"bc\"", []token.Type{{Value: "\"a\\\"bc\"", Type: token.StringLit}, eol, eof}},
+	{"escaped string literal", "\"a\\\"bc\"", []token.Type{{Value: "\"a\"bc\"", Type: token.StringLit}, eol, eof}},
+	{"escaped backslash", "\"a\\\\\"", []token.Type{{Value: "\"a\\\"", Type: token.StringLit}, eol, eof}},
+	{"escaped tab", "\"a\\tb\"", []token.Type{{Value: "\"a\tb\"", Type: token.StringLit}, eol, eof}},
+	{"hex escape", "\"\\x41\\x7e\"", []token.Type{{Value: "\"A~\"", Type: token.StringLit}, eol, eof}},
+	{"unicode escape", "\"\\u{e9}\\u{1F600}\"", []token.Type{{Value: "\"\u00e9\U0001F600\"", Type: token.StringLit}, eol, eof}},
 	{"string literal with new line", "\"a\nbc\"", []token.Type{{Value: "\"a\nbc\"", Type: token.StringLit}, eol, eof}},
 	{"string literal with escaped line", "\"a\\nbc\"", []token.Type{{Value: "\"a\nbc\"", Type: token.StringLit}, eol, eof}},
+	{"comment at end of input", "1 ; one", []token.Type{{Value: "1", Type: token.IntLit}, eol, eof}},
 	{"sticky double", "<=", []token.Type{{Value: "<=", Type: token.Sticky}, eol, eof}},
 	{"non-sticky double", "((", []token.Type{{Value: "(", Type: token.NotSticky}, {Value: "(", Type: token.NotSticky}, eol, eof}},
 	{"new line lexeme", "a\nb", []token.Type{{Value: "a", Type: token.Name}, eol, {Value: "b", Type: token.Name}, eol, eof}},
@@ -91,3 +108,44 @@ func TestLexer(t *testing.T) {
 		assert.Equal(t, len(test.dat), i, "%s/%s doesn't consume all input", test.title, test.input)
 	}
 }
+
+var errorTestData = []struct {
+	input    string
+	message  string
+	from, to int
+}{
+	{"0x", "Lexer: unexpected end of input in integer literal", 0, 2},
+	{"0b12", "Lexer: invalid digit 2 in integer literal", 0, 3},
+	{"1__0", "Lexer: unexpected char _ following _ in integer literal", 0, 2},
+	{"1_", "Lexer: unexpected end of input following _ in integer literal", 0, 2},
+	{"0x_f", "Lexer: unexpected char _ in integer literal", 0, 2},
+	{"1.5e", "Lexer: unexpected end of input in float literal exponent", 0, 4},
+	{"1e+x", "Lexer: unexpected char x in float literal exponent", 0, 3},
+	{"\"a\\q\"", "Lexer: invalid escape sequence \\q in string literal", 0, 3},
+	{"x = \"\\x4g\"", "Lexer: unexpected char g in \\x escape sequence", 4, 8},
+	{"\"\\u41\"", "Lexer: unexpected char 4 in \\u escape sequence, expected {", 0, 3},
+	{"\"\\u{}\"", "Lexer: invalid code point in \\u escape sequence", 0, 4},
+	{"\"\\u{110000}\"", "Lexer: invalid code point in \\u escape sequence", 0, 10},
+	{"\"\\u{1234567}\"", "Lexer: unexpected char 7 in \\u escape sequence", 0, 10},
+	{"x = \"abc", "Lexer: unterminated string", 4, 8},
+	{"\"a\\", "Lexer: unterminated string", 0, 3},
+	{"\"\\x4", "Lexer: unterminated string", 0, 4},
+	{"\"\\u{4", "Lexer: unterminated string", 0, 5},
+}
+
+func TestLexerErrors(t *testing.T) {
+	for _, test := range errorTestData {
+		t.Run(test.input, func(t *testing.T) {
+			l := lexer.NewTLexer(test.input)
+
+			for l.Next() && l.Err() == nil {
+			}
+
+			if assert.Error(t, l.Err()) {
+				assert.Equal(t, test.message, l.Err().Error())
+				assert.Equal(t, test.from, l.From())
+				assert.Equal(t, test.to, l.To())
+			}
+		})
+	}
+}
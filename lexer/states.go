@@ -1,16 +1,19 @@
 package lexer
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/paulsonkoly/calc/types/token"
 )
 
 const (
 	stickyChars     = "+*/=<>!-&|#%~"
-	nonStrickyChars = "(){}[],:"
+	nonStrickyChars = "(){}[],:."
 )
 
 type str struct {
@@ -37,10 +40,13 @@ func newSTR(c rune, typ token.Kind, emit, adv bool, format string, args ...any)
 	case c == EOF:
 		return str{next: eof, doEmit: emit, doAdv: adv, typ: typ}
 
+	case c == '0':
+		return str{next: zeroLit, doEmit: emit, doAdv: adv, typ: typ}
+
 	case '0' <= c && c <= '9':
 		return str{next: intLit, doEmit: emit, doAdv: adv, typ: typ}
 
-	case 'a' <= c && c <= 'z':
+	case isNameStart(c):
 		return str{next: varName, doEmit: emit, doAdv: adv, typ: typ}
 
 	case c == '"':
@@ -57,35 +63,140 @@ func newSTR(c rune, typ token.Kind, emit, adv bool, format string, args ...any)
 	}
 }
 
+// unexpected is the error of the unexpected char c, or the unexpected end of
+// the input, at the place described by where.
+func unexpected(c rune, where string) error {
+	if c == EOF {
+		return fmt.Errorf("Lexer: unexpected end of input %s", where)
+	}
+	return fmt.Errorf("Lexer: unexpected char %c %s", c, where)
+}
+
 func whiteSpace(c rune) str {
 	return newSTR(c, token.Invalid, false, true, "Lexer: unexpected char %c", c)
 }
 
 func comment(c rune) str {
-	if c == '\n' {
+	switch c {
+	case '\n':
 		return str{next: eol, doEmit: false, doAdv: true, typ: token.Invalid}
+	case EOF:
+		return str{next: eof, doEmit: false, doAdv: true, typ: token.Invalid}
 	}
 	return str{next: comment}
 }
 
+// zeroLit is an integer literal starting with 0, possibly followed by a base
+// prefix.
+func zeroLit(c rune) str {
+	switch c {
+	case 'x', 'X':
+		return str{next: radixStart(isHexDigit)}
+
+	case 'b', 'B':
+		return str{next: radixStart(isBinDigit)}
+
+	case 'o', 'O':
+		return str{next: radixStart(isOctDigit)}
+
+	default:
+		return intLit(c)
+	}
+}
+
 func intLit(c rune) str {
 	switch {
-	case '0' <= c && c <= '9':
+	case isDecDigit(c):
 		return str{next: intLit}
 
+	case c == '_':
+		return str{next: digitSep(isDecDigit, intLit, "integer literal")}
+
 	case c == '.':
 		return str{next: floatLit}
 
+	case c == 'e' || c == 'E':
+		return str{next: exponentSign}
+
 	default:
 		return newSTR(c, token.IntLit, true, false, "Lexer: unexpected char %c in integer literal", c)
 	}
 }
 
+// radixStart is the first digit of an integer literal after the base prefix.
+func radixStart(isDigit func(rune) bool) stateFunc {
+	return func(c rune) str {
+		if !isDigit(c) {
+			return str{err: unexpected(c, "in integer literal")}
+		}
+		return str{next: radixLit(isDigit)}
+	}
+}
+
+func radixLit(isDigit func(rune) bool) stateFunc {
+	return func(c rune) str {
+		switch {
+		case isDigit(c):
+			return str{next: radixLit(isDigit)}
+
+		case c == '_':
+			return str{next: digitSep(isDigit, radixLit(isDigit), "integer literal")}
+
+		case isDecDigit(c):
+			return str{err: fmt.Errorf("Lexer: invalid digit %c in integer literal", c)}
+
+		default:
+			return newSTR(c, token.IntLit, true, false, "Lexer: unexpected char %c in integer literal", c)
+		}
+	}
+}
+
+// digitSep is a digit separator _, that has to be followed by a digit of the
+// literal continuing in next.
+func digitSep(isDigit func(rune) bool, next stateFunc, lit string) stateFunc {
+	return func(c rune) str {
+		if !isDigit(c) {
+			return str{err: unexpected(c, "following _ in "+lit)}
+		}
+		return next(c)
+	}
+}
+
 func floatLit(c rune) str {
 	switch {
-	case '0' <= c && c <= '9':
+	case isDecDigit(c):
 		return str{next: floatLit}
 
+	case c == '_':
+		return str{next: digitSep(isDecDigit, floatLit, "float literal")}
+
+	case c == 'e' || c == 'E':
+		return str{next: exponentSign}
+
+	default:
+		return newSTR(c, token.FloatLit, true, false, "Lexer: unexpected char %c in float literal", c)
+	}
+}
+
+func exponentSign(c rune) str {
+	if c == '+' || c == '-' {
+		return str{next: exponentStart}
+	}
+	return exponentStart(c)
+}
+
+func exponentStart(c rune) str {
+	if !isDecDigit(c) {
+		return str{err: unexpected(c, "in float literal exponent")}
+	}
+	return str{next: exponent}
+}
+
+func exponent(c rune) str {
+	switch {
+	case isDecDigit(c):
+		return str{next: exponent}
+
 	default:
 		return newSTR(c, token.FloatLit, true, false, "Lexer: unexpected char %c in float literal", c)
 	}
@@ -93,7 +204,7 @@ func floatLit(c rune) str {
 
 func varName(c rune) str {
 	switch {
-	case 'a' <= c && c <= 'z':
+	case isNameStart(c) || isDecDigit(c):
 		return str{next: varName}
 
 	default:
@@ -101,8 +212,37 @@ func varName(c rune) str {
 	}
 }
 
+// IsName determines whether s is a lexically valid variable name.
+func IsName(s string) bool {
+	for i, c := range s {
+		if !isNameStart(c) && (i == 0 || !isDecDigit(c)) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func isNameStart(c rune) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_'
+}
+
+func isDecDigit(c rune) bool { return '0' <= c && c <= '9' }
+func isBinDigit(c rune) bool { return c == '0' || c == '1' }
+func isOctDigit(c rune) bool { return '0' <= c && c <= '7' }
+
+func isHexDigit(c rune) bool {
+	_, ok := hexDigit(c)
+	return ok
+}
+
+// errUnterminated is the error of the input ending in a string literal.
+var errUnterminated = errors.New("Lexer: unterminated string")
+
 func stringLit(c rune) str {
 	switch {
+	case c == EOF:
+		return str{err: errUnterminated}
+
 	case c == '"':
 		return str{next: stringLitEnd}
 
@@ -114,8 +254,125 @@ func stringLit(c rune) str {
 	}
 }
 
-func escapeStringLit(_ rune) str {
-	return str{next: stringLit}
+func escapeStringLit(c rune) str {
+	switch c {
+	case 'n', 't', '\\', '"':
+		return str{next: stringLit}
+
+	case 'x':
+		return str{next: hexEscape(2)}
+
+	case 'u':
+		return str{next: unicodeEscape}
+
+	case EOF:
+		return str{err: errUnterminated}
+
+	default:
+		return str{err: fmt.Errorf("Lexer: invalid escape sequence \\%c in string literal", c)}
+	}
+}
+
+// hexEscape lexes the remaining n hex digits of a \xNN escape.
+func hexEscape(n int) stateFunc {
+	return func(c rune) str {
+		if c == EOF {
+			return str{err: errUnterminated}
+		}
+		if _, ok := hexDigit(c); !ok {
+			return str{err: fmt.Errorf("Lexer: unexpected char %c in \\x escape sequence", c)}
+		}
+		if n == 1 {
+			return str{next: stringLit}
+		}
+		return str{next: hexEscape(n - 1)}
+	}
+}
+
+func unicodeEscape(c rune) str {
+	if c == EOF {
+		return str{err: errUnterminated}
+	}
+	if c != '{' {
+		return str{err: fmt.Errorf("Lexer: unexpected char %c in \\u escape sequence, expected {", c)}
+	}
+	return str{next: unicodeDigits(0, 0)}
+}
+
+// unicodeDigits lexes the hex digits of a \u{...} escape, n digits with value
+// cp have been seen so far.
+func unicodeDigits(n int, cp rune) stateFunc {
+	return func(c rune) str {
+		if d, ok := hexDigit(c); ok && n < 6 {
+			return str{next: unicodeDigits(n+1, cp<<4|d)}
+		}
+
+		switch {
+		case c == EOF:
+			return str{err: errUnterminated}
+
+		case c != '}':
+			return str{err: fmt.Errorf("Lexer: unexpected char %c in \\u escape sequence", c)}
+
+		case n == 0 || !utf8.ValidRune(cp):
+			return str{err: errors.New("Lexer: invalid code point in \\u escape sequence")}
+
+		default:
+			return str{next: stringLit}
+		}
+	}
+}
+
+func hexDigit(c rune) (rune, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// unescape decodes the escape sequences of the string literal lit. lit has
+// been validated by the string literal states.
+func unescape(lit string) string {
+	if !strings.ContainsRune(lit, '\\') {
+		return lit
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(lit); i++ {
+		if lit[i] != '\\' {
+			b.WriteByte(lit[i])
+			continue
+		}
+
+		i++
+		switch lit[i] {
+		case 'n':
+			b.WriteByte('\n')
+
+		case 't':
+			b.WriteByte('\t')
+
+		case 'x':
+			x, _ := strconv.ParseUint(lit[i+1:i+3], 16, 8)
+			b.WriteByte(byte(x))
+			i += 2
+
+		case 'u':
+			end := i + strings.IndexByte(lit[i:], '}')
+			x, _ := strconv.ParseUint(lit[i+2:end], 16, 32)
+			b.WriteRune(rune(x))
+			i = end
+
+		default:
+			b.WriteByte(lit[i])
+		}
+	}
+	return b.String()
 }
 
 func stringLitEnd(c rune) str {
@@ -35,6 +35,13 @@ func NewTLexer(input string) TLexer {
 	}
 }
 
+// NewTLexerAt returns a new TLexer that starts lexing at the byte offset off.
+func NewTLexerAt(input string, off int) TLexer {
+	tl := NewTLexer(input)
+	tl.lexer = NewLexerAt(input, off)
+	return tl
+}
+
 // Next advances the lexer to a new token.
 //
 // It returns false if an error happened or there are no tokens left.
@@ -8,23 +8,36 @@
 // The global region is special, it's a map from variable names to values. This
 // is because we can gradually parse more and more code that can define new
 // global variables, so the symbol table phase can't work out a symbol tbl
-// index for these variables.
+// index for these variables. Imported modules have their own global frames,
+// code defined in a module sees the module's global frame through its
+// environment on the closure stack. Globals not found in the module are looked
+// up in the main global frame, where the builtin functions are.
 //
-// The closure region is pointers to cloned slices of the normal stack. When a
-// function returns a function we save the frame of the defining function in
-// the returned function value. When a function is called apart from pushing
-// the normal frame on the normal stack we need to push the closure frame from
-// the function value  on the closure stack.
+// The closure region is a stack of lexical environments. When a function is
+// defined in a function call, the function value captures the environment of
+// the call: the frame of the call and the environment of the called function,
+// which chains all enclosing lexical scopes. While the call is in progress the
+// environment frame is the slice of the normal stack, when the call returns it
+// is replaced with a copy. When a function is called apart from pushing the
+// normal frame on the normal stack we need to push the environment from the
+// function value on the closure stack.
 //
 // Normal stack is an ever growing slice of values. The fp has a pair of
 // pointers into the stack per frame: fp and le the frame pointer and local
 // end. Local variables live on the normal stack. Function arguments count as
 // local variables. Local variables of the frame are between fp and le . le
 // points to the function return address. After le it's stack scratch area.
+//
+// A tail call replaces the frame of the call returning its result with the
+// frame of the called function, which returns to where the replaced call would
+// have returned. The tail calls are recorded apart from the frames, for walking
+// the stack, so the frames made by calls don't pay for them.
 package memory
 
 import (
-	"fmt"
+	"cmp"
+	"errors"
+	"slices"
 
 	"github.com/paulsonkoly/calc/types/dbginfo"
 	"github.com/paulsonkoly/calc/types/value"
@@ -44,21 +57,47 @@ type gframe map[string]value.Type
 type Type struct {
 	sp      int
 	fp      []int
+	env     []*value.Env // env is the captured environment per frame, nil if not captured
+	tail    []tailCall   // tail are the tail calls that made frames, by frame ascending
 	global  gframe
-	closure []Frame
+	modules map[string]value.Type
+	closure []*value.Env
 	stack   []value.Type
+
+	maxDepth int // maxDepth is the call depth limit, 0 for no limit
+	maxStack int // maxStack is the stack size limit, 0 for no limit
+}
+
+// tailCall is the tail call that made a frame.
+type tailCall struct {
+	frame  int // frame is the index of the stack frame
+	ip     int // ip is the address of the tail call
+	elided int // elided is the number of calls replaced
+}
+
+// Memory limit errors.
+var (
+	ErrDepthLimit = errors.New("call depth limit exceeded")
+	ErrStackLimit = errors.New("stack size limit exceeded")
+)
+
+// SetLimits limits the call depth to depth frames and the stack size to stack
+// values. Zero means no limit.
+func (m *Type) SetLimits(depth, stack int) {
+	m.maxDepth = depth
+	m.maxStack = stack
 }
 
 // New creates a new memory, with an empty global frame and an empty stack.
 func New() *Type {
 	fp := make([]int, 0, minStackSize)
-	return &Type{fp: fp, global: gframe{}, closure: []Frame{}, stack: []value.Type{}}
+	return &Type{fp: fp, global: gframe{}, modules: map[string]value.Type{}, closure: []*value.Env{}, stack: []value.Type{}}
 }
 
 // Clone does a memory copy for context switching.
 //
-// The clone would point to the same global, same closure, and the last frame
-// of the stack will be deep copied. reuse can be nil, when it's not it's
+// The clone would point to the same global and modules, a copy of the closure stack, and
+// the last frame of the stack will be deep copied. reuse can be nil, when it's not it's
 // resources are re-used to create a new memory.
 func (m *Type) Clone(reuse *Type) *Type {
 	var newStackSize int
@@ -80,14 +119,22 @@ func (m *Type) Clone(reuse *Type) *Type {
 	}
 
 	var newFP []int
+	var newEnv, newClosure []*value.Env
+	var newTail []tailCall
 	if reuse != nil {
 		newFP = reuse.fp[:0]
+		newEnv = reuse.env[:0]
+		newTail = reuse.tail[:0]
+		newClosure = reuse.closure[:0]
 	} else {
 		newFP = make([]int, 0, newStackSize)
 	}
 
+	// the contexts push and pop closures independently
+	newClosure = append(newClosure, m.closure...)
+
 	if len(m.fp) < 2 {
-		return &Type{sp: 0, fp: newFP, global: m.global, closure: m.closure, stack: newStack}
+		return &Type{sp: 0, fp: newFP, env: newEnv, tail: newTail, global: m.global, modules: m.modules, closure: newClosure, stack: newStack, maxDepth: m.maxDepth, maxStack: m.maxStack}
 	}
 
 	fp := m.fp[len(m.fp)+localFP]
@@ -95,17 +142,27 @@ func (m *Type) Clone(reuse *Type) *Type {
 
 	copy(newStack, m.stack[fp:m.sp])
 	newFP = append(newFP, 0, le-fp)
+	newEnv = append(newEnv, nil)
+	if t, ok := m.tailCall(len(m.fp)/2 - 1); ok {
+		t.frame = 0
+		newTail = append(newTail, t)
+	}
 
 	if reuse != nil {
 		reuse.sp = m.sp - fp
 		reuse.fp = newFP
+		reuse.env = newEnv
+		reuse.tail = newTail
 		reuse.global = m.global
-		reuse.closure = m.closure
+		reuse.modules = m.modules
+		reuse.closure = newClosure
 		reuse.stack = newStack
+		reuse.maxDepth = m.maxDepth
+		reuse.maxStack = m.maxStack
 		return reuse
 	}
 
-	return &Type{sp: m.sp - fp, fp: newFP, global: m.global, closure: m.closure, stack: newStack}
+	return &Type{sp: m.sp - fp, fp: newFP, env: newEnv, tail: newTail, global: m.global, modules: m.modules, closure: newClosure, stack: newStack, maxDepth: m.maxDepth, maxStack: m.maxStack}
 }
 
 // CallDepth is the number of call frames.
@@ -114,7 +171,7 @@ func (m *Type) CallDepth() int {
 }
 
 // SetGlobal sets a global variable.
-func (m *Type) SetGlobal(name string, v value.Type) { m.global[name] = v }
+func (m *Type) SetGlobal(name string, v value.Type) { m.globals()[name] = v }
 
 // Set sets a local variable.
 func (m *Type) Set(symIdx int, v value.Type) {
@@ -131,29 +188,134 @@ func (m *Type) LookUpLocal(symIdx int) value.Type {
 }
 
 // LookUpClosure looks up a closure variable. A variable that was local in the
-// containing lexical scope.
-func (m *Type) LookUpClosure(symIdx int) value.Type {
-	return m.closure[len(m.closure)-1][symIdx]
+// depth-th enclosing lexical scope.
+func (m *Type) LookUpClosure(depth, symIdx int) value.Type {
+	env := m.closure[len(m.closure)-1]
+	for range depth - 1 {
+		env = env.Parent
+	}
+	return env.Frame[symIdx]
+}
+
+// Env is the lexical environment of the current frame, to be captured by
+// functions defined in the frame. Outside of function calls it is the
+// environment of the module being loaded, or nil in the main program.
+func (m *Type) Env() *value.Env {
+	var parent *value.Env
+	if len(m.closure) > 0 {
+		parent = m.closure[len(m.closure)-1]
+	}
+
+	if len(m.env) < 1 {
+		return parent
+	}
+
+	env := m.env[len(m.env)-1]
+	if env == nil {
+		env = &value.Env{Frame: m.Top(), Parent: parent}
+		if parent != nil {
+			env.Globals = parent.Globals
+		}
+		m.env[len(m.env)-1] = env
+	}
+
+	return env
 }
 
 // LookUpGlobal looks up a global variable.
 func (m *Type) LookUpGlobal(name string) value.Type {
-	v, ok := m.global[name]
+	v, ok := m.globals()[name]
+	if !ok {
+		v, ok = m.global[name]
+	}
 	if !ok {
 		return value.Nil
 	}
 	return v
 }
 
-// PushFrame pushes a stack frame.
-func (m *Type) PushFrame(argsCnt, localCnt int) {
+// globals is the global frame of the running code.
+func (m *Type) globals() gframe {
+	if len(m.closure) > 0 {
+		if env := m.closure[len(m.closure)-1]; env != nil && env.Globals != nil {
+			return env.Globals
+		}
+	}
+	return m.global
+}
+
+// Module is the module loaded from path, ok is false if no such module has
+// been loaded.
+func (m *Type) Module(path string) (value.Type, bool) {
+	v, ok := m.modules[path]
+	return v, ok
+}
+
+// PushModule registers the module loaded from path, and pushes its
+// environment on the closure stack for the loading of the module.
+func (m *Type) PushModule(path string, module value.Type) {
+	data, ok := module.ToModule()
+	if !ok {
+		panic("PushModule called with non module")
+	}
+	m.modules[path] = module
+	m.PushClosure(&value.Env{Globals: data.Globals})
+}
+
+// PopModule pops the environment of the module being loaded. A runtime error
+// in the module has already removed it by resetting the memory.
+func (m *Type) PopModule() {
+	if len(m.closure) > 0 {
+		m.PopClosure()
+	}
+}
+
+// PushFrame pushes a stack frame. It returns an error without pushing the frame
+// if that would exceed the limits.
+func (m *Type) PushFrame(argsCnt, localCnt int) error {
+	if m.maxDepth > 0 && m.CallDepth() >= m.maxDepth {
+		return ErrDepthLimit
+	}
 	locals := localCnt - argsCnt
+	if m.maxStack > 0 && m.sp+locals > m.maxStack {
+		return ErrStackLimit
+	}
 	m.growStack(localCnt - argsCnt)
 	for i := m.sp; i < m.sp+locals; i++ {
 		m.stack[i] = value.Nil
 	}
 	m.sp += localCnt - argsCnt
 	m.fp = append(m.fp, m.sp-localCnt, m.sp)
+	m.env = append(m.env, nil)
+	return nil
+}
+
+// ReplaceFrame pops the stack frame and the closure environment of the current
+// call, and pushes a stack frame for the tail call at ip in its place, with
+// the argsCnt values last pushed as the arguments. It returns an error without
+// replacing the frame if the new frame would exceed the limits.
+//
+// The caller pushes the closure environment and the return address of the
+// replaced call, as for any call.
+func (m *Type) ReplaceFrame(ip, argsCnt, localCnt int) error {
+	fp := m.fp[len(m.fp)+localFP]
+	if m.maxStack > 0 && fp+localCnt > m.maxStack {
+		return ErrStackLimit
+	}
+	frame := m.CallDepth() - 1
+	t, _ := m.tailCall(frame)
+	args := m.sp - argsCnt
+
+	m.PopFrame()
+	m.PopClosure()
+
+	copy(m.stack[m.sp:], m.stack[args:args+argsCnt])
+	m.sp += argsCnt
+
+	// the call depth is the same as before and the stack size is checked above
+	_ = m.PushFrame(argsCnt, localCnt)
+	m.tail = append(m.tail, tailCall{frame: frame, ip: ip, elided: t.elided + 1})
+	return nil
 }
 
 // Push pushes a value.
@@ -163,13 +325,23 @@ func (m *Type) Push(v value.Type) {
 	m.sp++
 }
 
-// PushClosure pushes the closure frame.
-func (m *Type) PushClosure(f Frame) {
-	m.closure = append(m.closure, f)
+// PushClosure pushes the closure environment.
+func (m *Type) PushClosure(env *value.Env) {
+	m.closure = append(m.closure, env)
 }
 
 // PopFrame pops a stack frame.
+//
+// If the frame was captured by a closure, the closure gets a copy of the frame.
 func (m *Type) PopFrame() {
+	if env := m.env[len(m.env)-1]; env != nil {
+		env.Frame = slices.Clone(m.Top())
+	}
+	m.env = m.env[:len(m.env)-1]
+	if n := len(m.tail); n > 0 && m.tail[n-1].frame == m.CallDepth()-1 {
+		m.tail = m.tail[:n-1]
+	}
+
 	fp := m.fp[len(m.fp)+localFP]
 	m.sp = fp
 	m.fp = m.fp[:len(m.fp)-2]
@@ -181,7 +353,22 @@ func (m *Type) Pop() value.Type {
 	return m.stack[m.sp]
 }
 
-// PopClosure pops a frame from the closure region.
+// Peek is the n-th value from the top of the stack, without popping it. It
+// returns false if the stack doesn't have that many values.
+func (m *Type) Peek(n int) (value.Type, bool) {
+	if n < 0 || n >= m.sp {
+		return value.Nil, false
+	}
+	return m.stack[m.sp-1-n], true
+}
+
+// PopN pops the last n pushed values, in the order they were pushed.
+func (m *Type) PopN(n int) []value.Type {
+	m.sp -= n
+	return slices.Clone(m.stack[m.sp : m.sp+n])
+}
+
+// PopClosure pops an environment from the closure region.
 func (m *Type) PopClosure() {
 	m.closure = m.closure[:len(m.closure)-1]
 }
@@ -205,6 +392,21 @@ func (m *Type) IP() *value.Type {
 	return &m.stack[le]
 }
 
+// SP is the stack pointer.
+func (m *Type) SP() int {
+	return m.sp
+}
+
+// Unwind pops the stack frames and the closures until the call depth is depth,
+// and resets the stack pointer to sp.
+func (m *Type) Unwind(depth, sp int) {
+	for m.CallDepth() > depth {
+		m.PopFrame()
+		m.PopClosure()
+	}
+	m.sp = sp
+}
+
 // ResetSP resets the stack pointer to 0.
 func (m *Type) ResetSP() {
 	m.sp = 0
@@ -216,47 +418,92 @@ func (m *Type) growStack(size int) {
 	}
 }
 
-// DumpStack is a debug dump of the stack.
-func (m *Type) DumpStack(dbg *dbginfo.Type) {
-	fmt.Println("= stack =============================================")
+// Call is a function call on the stack.
+type Call struct {
+	IP     int          // IP is the address of the call, or of the tail call that replaced it
+	Name   string       // Name describes the called function
+	Args   []value.Type // Args are the arguments of the call
+	Elided int          // Elided is the number of calls replaced by tail calls
+}
+
+// Stack walking errors.
+var (
+	ErrCorruptStack = errors.New("corrupt stack")
+	ErrNoDebugInfo  = errors.New("no debug info found for call")
+	ErrCorruptFP    = errors.New("corrupt frame pointer")
+)
+
+// CallStack is the function calls on the stack, innermost first, described
+// by dbg. If the stack can't be walked it returns the calls up to the error.
+func (m *Type) CallStack(dbg *dbginfo.Type) ([]Call, error) {
+	calls := []Call{}
 	for i := len(m.fp) - 1; i >= 0; i -= 2 {
-		ipAddr := m.fp[i]
-		ipv := m.stack[ipAddr]
-		ip, ok := ipv.ToInt()
+		ip, ok := m.site(i / 2)
 		if !ok {
-			fmt.Println("corrupt stack. giving up")
-			return
+			return calls, ErrCorruptStack
 		}
 		info, ok := (*dbg)[ip]
 		if !ok {
-			fmt.Println("No debug info found for call. giving up")
-			return
+			return calls, ErrNoDebugInfo
 		}
-		name := info.Name
-		argCnt := info.ArgCnt
 
 		if i < 1 {
-			fmt.Println("corrupt frame pointer. giving up")
-			return
+			return calls, ErrCorruptFP
 		}
 		fp := m.fp[i-1]
-		argv := m.stack[fp : fp+argCnt]
+		argv := slices.Clone(m.stack[fp : fp+info.ArgCnt])
+
+		t, _ := m.tailCall(i / 2)
+		calls = append(calls, Call{IP: ip, Name: info.Name, Args: argv, Elided: t.elided})
+	}
+	return calls, nil
+}
 
-		args := ""
-		sep := ""
-		for i, v := range argv {
-			args += fmt.Sprintf("%sarg[%d]: %s", sep, i, v.Abbrev())
-			sep = " "
+// CallSites appends the addresses of the calls of the stack frames to buf,
+// innermost first. The call of a frame replaced by a tail call is the tail
+// call.
+func (m *Type) CallSites(buf []int) []int {
+	for i := len(m.fp)/2 - 1; i >= 0; i-- {
+		if ip, ok := m.site(i); ok {
+			buf = append(buf, ip)
 		}
+	}
+	return buf
+}
+
+// CallSite is the address of the call of the innermost stack frame. It returns
+// false if there is no stack frame.
+func (m *Type) CallSite() (int, bool) {
+	if m.CallDepth() < 1 {
+		return 0, false
+	}
+	return m.site(m.CallDepth() - 1)
+}
 
-		fmt.Printf("IP: %d %s() args: %s\n", ip, name, args)
+// site is the address of the call, or the tail call that made the frame-th
+// stack frame.
+func (m *Type) site(frame int) (int, bool) {
+	if t, ok := m.tailCall(frame); ok {
+		return t.ip, true
+	}
+	return m.stack[m.fp[2*frame+1]].ToInt()
+}
+
+// tailCall is the tail call that made the frame-th stack frame. It returns
+// false if the frame was made by a call.
+func (m *Type) tailCall(frame int) (tailCall, bool) {
+	i, ok := slices.BinarySearchFunc(m.tail, frame, func(t tailCall, frame int) int { return cmp.Compare(t.frame, frame) })
+	if !ok {
+		return tailCall{}, false
 	}
-	fmt.Println("=====================================================")
+	return m.tail[i], true
 }
 
 // Reset drops all stack local allocations.
 func (m *Type) Reset() {
 	m.sp = 0
-	m.closure = []Frame{}
+	m.closure = []*value.Env{}
 	m.fp = []int{}
+	m.env = []*value.Env{}
+	m.tail = []tailCall{}
 }
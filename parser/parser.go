@@ -3,27 +3,33 @@ package parser
 
 import (
 	"slices"
+	"strings"
 
 	c "github.com/paulsonkoly/calc/combinator"
 	"github.com/paulsonkoly/calc/lexer"
+	"github.com/paulsonkoly/calc/types/dbginfo"
 	"github.com/paulsonkoly/calc/types/node"
 	"github.com/paulsonkoly/calc/types/token"
 )
 
 // Keywords is a list of keywords.
-var Keywords = [...]string{"if", "else", "while", "for", "return", "yield", "true", "false"}
+var Keywords = [...]string{"if", "else", "while", "for", "return", "yield", "break", "continue", "try", "catch", "raise", "import", "true", "false"}
 
 // Type is an empty struct that implements Parse. Useful to dependency inject the parser.
 type Type struct{}
 type Error = c.Error
+type Errors = c.Errors
 
-// Parse parses the input string and returns an AST or a parse error.
-func (t Type) Parse(input string) ([]node.Type, *Error) {
+// Parse parses the input string and returns an AST or the parse errors.
+func (t Type) Parse(input string) ([]node.Type, Errors) {
 	return Parse(input)
 }
 
-// Parse parses the input string and returns an AST or a parse error.
-func Parse(input string) ([]node.Type, *Error) {
+// Parse parses the input string and returns an AST or the parse errors.
+//
+// After an error it resumes parsing at the start of the next line, so all the
+// errors in input are reported, not just the first one.
+func Parse(input string) ([]node.Type, Errors) {
 	l := lexer.NewTLexer(input)
 	rn := make([]node.Type, 0)
 
@@ -31,7 +37,29 @@ func Parse(input string) ([]node.Type, *Error) {
 	for _, e := range r {
 		rn = append(rn, e.(node.Type))
 	}
-	return rn, err
+	if err == nil {
+		return rn, nil
+	}
+
+	errs := Errors{err}
+	for off := resync(input, err); off < len(input); off = max(resync(input, err), off+1) {
+		l := lexer.NewTLexerAt(input, off)
+		if _, err = resumed(&l); err == nil {
+			break
+		}
+		errs = append(errs, err)
+	}
+
+	return rn, errs
+}
+
+// resync is the byte offset in input of the line following the line of err.
+func resync(input string, err *Error) int {
+	from := min(err.From(), len(input))
+	if i := strings.IndexByte(input[from:], '\n'); i != -1 {
+		return from + i + 1
+	}
+	return len(input)
 }
 
 func acceptTerm(tokType token.Kind, msg string) c.Parser {
@@ -77,21 +105,38 @@ func arrayLit(input c.RollbackLexer) ([]c.Node, *Error) {
 			acceptToken("]")))(input)
 }
 
+func mapLit(input c.RollbackLexer) ([]c.Node, *Error) {
+	return spanned(mkMap,
+		c.SurroundedBy(
+			c.And(acceptToken("{"), eols),
+			c.SeparatedBy(c.Seq(expression, c.Drop(acceptToken(":")), expression), c.And(acceptToken(","), eols)),
+			c.And(eols, acceptToken("}"))))(input)
+}
+
+// mapStart asserts that a map literal follows as opposed to a block.
+func mapStart(input c.RollbackLexer) ([]c.Node, *Error) {
+	return c.Assert(
+		c.Seq(
+			acceptToken("{"),
+			eols,
+			c.OneOf(acceptToken("}"), c.And(expression, acceptToken(":")))))(input)
+}
+
 func atom(input c.RollbackLexer) ([]c.Node, *Error) {
 	return c.Choose(
 		c.Conditional{Gate: c.Assert(c.And(parameters, acceptToken("->"))), OnSuccess: function},
-		c.Conditional{Gate: c.Assert(c.And(varName, acceptToken("("))), OnSuccess: call},
 		c.Conditional{Gate: floatLit, OnSuccess: c.Ok()},
 		c.Conditional{Gate: intLit, OnSuccess: c.Ok()},
 		c.Conditional{Gate: acceptToken("true"), OnSuccess: c.Ok()},
 		c.Conditional{Gate: acceptToken("false"), OnSuccess: c.Ok()},
 		c.Conditional{Gate: stringLit, OnSuccess: c.Ok()},
 		c.Conditional{Gate: c.Assert(acceptToken("[")), OnSuccess: arrayLit},
+		c.Conditional{Gate: c.Assert(acceptToken("{")), OnSuccess: mapLit},
 		c.Conditional{Gate: c.Assert(acceptToken("(")), OnSuccess: paren},
 		c.Conditional{Gate: c.Ok(), OnSuccess: varName})(input)
 }
 
-func index(input c.RollbackLexer) ([]c.Node, *Error) {
+func postfix(input c.RollbackLexer) ([]c.Node, *Error) {
 	indexInner := c.Fmap(mkLeftChain,
 		c.SurroundedBy(
 			acceptToken("["),
@@ -105,31 +150,36 @@ func index(input c.RollbackLexer) ([]c.Node, *Error) {
 			acceptToken("]"),
 		),
 	)
-	indexCond := c.Any(c.Conditional{Gate: c.Assert(acceptToken("[")), OnSuccess: indexInner})
-	return c.Fmap(mkIndex, c.And(atom, indexCond))(input)
+	sfx := spanned(mkSuffix, c.Choose(
+		c.Conditional{Gate: c.Assert(acceptToken("[")), OnSuccess: indexInner},
+		c.Conditional{Gate: c.Assert(acceptToken(".")), OnSuccess: c.Fmap(mkMember, c.And(acceptToken("."), varName))},
+		c.Conditional{Gate: c.Ok(), OnSuccess: c.Fmap(mkCallArgs, arguments)},
+	))
+	suffixCond := c.Any(c.Conditional{Gate: c.Assert(c.OneOf(acceptToken("["), acceptToken("("), acceptToken("."))), OnSuccess: sfx})
+	return c.Fmap(mkPostfix, c.And(withSpan(atom), suffixCond))(input)
 }
 
 func unary(input c.RollbackLexer) ([]c.Node, *Error) {
 	op := c.OneOf(acceptToken("-"), acceptToken("#"), acceptToken("!"), acceptToken("~"))
-	return c.OneOf(c.Fmap(mkUnaryOp, (c.And(op, index))), index)(input)
+	return c.OneOf(spanned(mkUnaryOp, c.And(op, postfix)), postfix)(input)
 }
 
 func divmul(input c.RollbackLexer) ([]c.Node, *Error) {
 	op := c.OneOf(acceptToken("*"), acceptToken("/"), acceptToken("%"), acceptToken("<<"), acceptToken(">>"))
-	chain := c.Any(c.Conditional{Gate: op, OnSuccess: unary})
-	return c.Fmap(mkLeftChain, c.And(unary, chain))(input)
+	chain := c.Any(c.Conditional{Gate: op, OnSuccess: withSpan(unary)})
+	return c.Fmap(mkLeftChain, c.And(withSpan(unary), chain))(input)
 }
 
 func addsub(input c.RollbackLexer) ([]c.Node, *Error) {
 	op := c.OneOf(acceptToken("+"), acceptToken("-"))
-	chain := c.Any(c.Conditional{Gate: op, OnSuccess: divmul})
-	return c.Fmap(mkLeftChain, c.And(divmul, chain))(input)
+	chain := c.Any(c.Conditional{Gate: op, OnSuccess: withSpan(divmul)})
+	return c.Fmap(mkLeftChain, c.And(withSpan(divmul), chain))(input)
 }
 
 func logic(input c.RollbackLexer) ([]c.Node, *Error) {
 	op := c.OneOf(acceptToken("&"), acceptToken("|"))
-	chain := c.Any(c.Conditional{Gate: op, OnSuccess: addsub})
-	return c.Fmap(mkLeftChain, c.And(addsub, chain))(input)
+	chain := c.Any(c.Conditional{Gate: op, OnSuccess: withSpan(addsub)})
+	return c.Fmap(mkLeftChain, c.And(withSpan(addsub), chain))(input)
 }
 
 var relOp = c.OneOf(
@@ -142,14 +192,14 @@ var relOp = c.OneOf(
 )
 
 func relational(input c.RollbackLexer) ([]c.Node, *Error) {
-	chain := c.Any(c.Conditional{Gate: relOp, OnSuccess: logic})
-	return c.Fmap(mkLeftChain, c.And(logic, chain))(input)
+	chain := c.Any(c.Conditional{Gate: relOp, OnSuccess: withSpan(logic)})
+	return c.Fmap(mkLeftChain, c.And(withSpan(logic), chain))(input)
 }
 
 func boolOp(input c.RollbackLexer) ([]c.Node, *Error) {
 	op := c.OneOf(acceptToken("&&"), acceptToken("||"))
-	chain := c.Any(c.Conditional{Gate: op, OnSuccess: relational})
-	return c.Fmap(mkLeftChain, c.And(relational, chain))(input)
+	chain := c.Any(c.Conditional{Gate: op, OnSuccess: withSpan(relational)})
+	return c.Fmap(mkLeftChain, c.And(withSpan(relational), chain))(input)
 }
 
 func expression(input c.RollbackLexer) ([]c.Node, *Error) {
@@ -157,7 +207,7 @@ func expression(input c.RollbackLexer) ([]c.Node, *Error) {
 }
 
 func assignment(input c.RollbackLexer) ([]c.Node, *Error) {
-	return c.Fmap(mkAssign, c.Seq(varName, acceptToken("="), expression))(input)
+	return spanned(mkAssign, c.Seq(varName, acceptToken("="), expression))(input)
 }
 
 func statement(input c.RollbackLexer) ([]c.Node, *Error) {
@@ -167,6 +217,10 @@ func statement(input c.RollbackLexer) ([]c.Node, *Error) {
 		c.Conditional{Gate: c.Assert(acceptToken("for")), OnSuccess: forLoop},
 		c.Conditional{Gate: c.Assert(acceptToken("return")), OnSuccess: returning},
 		c.Conditional{Gate: c.Assert(acceptToken("yield")), OnSuccess: yield},
+		c.Conditional{Gate: c.Assert(acceptToken("try")), OnSuccess: tryCatch},
+		c.Conditional{Gate: c.Assert(acceptToken("raise")), OnSuccess: raise},
+		c.Conditional{Gate: c.Assert(acceptToken("break")), OnSuccess: c.Fmap(mkBreak, acceptToken("break"))},
+		c.Conditional{Gate: c.Assert(acceptToken("continue")), OnSuccess: c.Fmap(mkContinue, acceptToken("continue"))},
 		c.Conditional{Gate: c.Assert(c.And(varName, acceptToken("="))), OnSuccess: assignment},
 		c.Conditional{Gate: c.Ok(), OnSuccess: expression})(input)
 }
@@ -175,7 +229,7 @@ func conditional(input c.RollbackLexer) ([]c.Node, *Error) {
 	return c.Fmap(mkIf,
 		c.Seq(
 			acceptToken("if"),
-			expression,
+			withSpan(expression),
 			block,
 			c.Choose(
 				c.Conditional{Gate: acceptToken("else"), OnSuccess: block},
@@ -184,10 +238,11 @@ func conditional(input c.RollbackLexer) ([]c.Node, *Error) {
 }
 
 func whileLoop(input c.RollbackLexer) ([]c.Node, *Error) {
-	return c.Fmap(mkWhile, c.Seq(acceptToken("while"), expression, block))(input)
+	return c.Fmap(mkWhile, c.Seq(acceptToken("while"), withSpan(expression), block))(input)
 }
 
 func forLoop(input c.RollbackLexer) ([]c.Node, *Error) {
+	span := dbginfo.Span{From: peekFrom(input)}
 	r, err := c.Seq(
 		acceptToken("for"),
 		c.Fmap(mkList, c.And(varName, c.Any(c.Conditional{Gate: c.Drop(acceptToken(",")), OnSuccess: varName}))),
@@ -206,7 +261,9 @@ func forLoop(input c.RollbackLexer) ([]c.Node, *Error) {
 		return nil, c.NewError("for loop must have the same number of variables and expressions", from, to)
 	}
 
-	return mkFor(r), nil
+	span.To = input.Token().To()
+
+	return mkFor(span, r), nil
 }
 
 func returning(input c.RollbackLexer) ([]c.Node, *Error) {
@@ -217,8 +274,57 @@ func yield(input c.RollbackLexer) ([]c.Node, *Error) {
 	return c.Fmap(mkYield, c.And(acceptToken("yield"), expression))(input)
 }
 
+func tryCatch(input c.RollbackLexer) ([]c.Node, *Error) {
+	return c.Fmap(mkTry, c.Seq(acceptToken("try"), block, acceptToken("catch"), varName, block))(input)
+}
+
+func raise(input c.RollbackLexer) ([]c.Node, *Error) {
+	return spanned(mkRaise, c.And(acceptToken("raise"), expression))(input)
+}
+
 func function(input c.RollbackLexer) ([]c.Node, *Error) {
-	return c.Fmap(mkFunction, c.Seq(parameters, acceptToken("->"), block))(input)
+	return c.Fmap(mkFunction, c.Seq(parameters, acceptToken("->"), loopless(block)))(input)
+}
+
+// loopless fails if p results in a break or continue statement outside of a
+// loop.
+func loopless(p c.Parser) c.Parser {
+	return func(input c.RollbackLexer) ([]c.Node, *Error) {
+		r, err := p(input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, n := range r {
+			if loopJump(n.(node.Type)) {
+				return nil, c.NewError("break or continue outside of loop", input.From(), input.To())
+			}
+		}
+
+		return r, nil
+	}
+}
+
+// loopJump determines whether t has a break or continue that is not enclosed
+// in a loop. Function bodies are checked on their own.
+func loopJump(t node.Type) bool {
+	switch t := t.(type) {
+	case node.Break, node.Continue:
+		return true
+
+	case node.Block:
+		return slices.ContainsFunc(t.Body, loopJump)
+
+	case node.If:
+		return loopJump(t.TrueCase)
+
+	case node.IfElse:
+		return loopJump(t.TrueCase) || loopJump(t.FalseCase)
+
+	case node.Try:
+		return loopJump(t.Body) || loopJump(t.Catch)
+	}
+	return false
 }
 
 var parameters = c.Fmap(mkList,
@@ -227,10 +333,6 @@ var parameters = c.Fmap(mkList,
 		c.SeparatedBy(varName, acceptToken(",")),
 		acceptToken(")")))
 
-func call(input c.RollbackLexer) ([]c.Node, *Error) {
-	return c.Fmap(mkFCall, c.Seq(varName, arguments))(input)
-}
-
 func arguments(input c.RollbackLexer) ([]c.Node, *Error) {
 	return c.Fmap(mkList,
 		c.SurroundedBy(
@@ -251,6 +353,7 @@ func statements(input c.RollbackLexer) ([]c.Node, *Error) {
 
 func block(input c.RollbackLexer) ([]c.Node, *Error) {
 	return c.Choose(
+		c.Conditional{Gate: mapStart, OnSuccess: statement},
 		c.Conditional{Gate: c.Assert(acceptToken("{")),
 			OnSuccess: c.Fmap(mkBlock,
 				c.SurroundedBy(
@@ -260,4 +363,50 @@ func block(input c.RollbackLexer) ([]c.Node, *Error) {
 		c.Conditional{Gate: c.Ok(), OnSuccess: statement})(input)
 }
 
-var program = c.Seq(c.Any(c.Conditional{Gate: c.Assert(c.Not(eol)), OnSuccess: block}), eols1, eof)
+// importing is only valid on the top level of the program.
+func importing(input c.RollbackLexer) ([]c.Node, *Error) {
+	r, err := c.Fmap(mkImport, c.Seq(acceptToken("import"), stringLit))(input)
+	if err != nil {
+		return nil, err
+	}
+
+	if r[0].(node.Import).VarRef == nil {
+		return nil, c.NewError("module file name is not a valid variable name", input.From(), input.To())
+	}
+
+	return r, nil
+}
+
+var topLevel = c.Choose(
+	c.Conditional{Gate: c.Assert(acceptToken("import")), OnSuccess: importing},
+	c.Conditional{Gate: c.Ok(), OnSuccess: loopless(block)})
+
+// programLine is a line of the program, empty or a top level statement.
+var programLine = c.Seq(
+	c.Choose(
+		c.Conditional{Gate: c.Assert(eol), OnSuccess: c.Ok()},
+		c.Conditional{Gate: c.Ok(), OnSuccess: topLevel}),
+	eols1)
+
+var program = c.And(c.Any(c.Conditional{Gate: c.Assert(c.Not(eof)), OnSuccess: programLine}), eof)
+
+// closing is the closing of the blocks that were open at the point of an
+// error, at the start of a line where parsing is resumed.
+var closing = c.Any(c.Conditional{
+	Gate:      c.OneOf(acceptToken("}"), acceptToken("else"), c.And(acceptToken("catch"), varName)),
+	OnSuccess: c.Ok(),
+})
+
+// resumedLine is a line of the program after an error. Break and continue are
+// not checked, as the loop enclosing them might have been skipped.
+var resumedLine = c.Seq(
+	closing,
+	c.Choose(
+		c.Conditional{Gate: c.Assert(eol), OnSuccess: c.Ok()},
+		c.Conditional{Gate: c.Assert(acceptToken("import")), OnSuccess: importing},
+		c.Conditional{Gate: c.Ok(), OnSuccess: block}),
+	eols1)
+
+// resumed is the rest of the program after an error, starting at the start of
+// a line.
+var resumed = c.And(c.Any(c.Conditional{Gate: c.Assert(c.Not(eof)), OnSuccess: resumedLine}), eof)
@@ -2,11 +2,13 @@ package parser
 
 import (
 	"log"
+	"math/big"
 	"slices"
 	"strconv"
 	"strings"
 
 	"github.com/paulsonkoly/calc/combinator"
+	"github.com/paulsonkoly/calc/types/dbginfo"
 	"github.com/paulsonkoly/calc/types/node"
 	"github.com/paulsonkoly/calc/types/token"
 )
@@ -24,14 +26,14 @@ func (tokenWrapper) Wrap(t combinator.Token) combinator.Node {
 
 	switch realT.Type {
 	case token.IntLit:
-		x, err := strconv.Atoi(realT.Value)
-		if err != nil {
-			panic(err)
+		x, ok := parseInt(realT.Value)
+		if !ok {
+			return node.BigInt(x.String())
 		}
-		return node.Int(x)
+		return node.Int(x.Int64())
 
 	case token.FloatLit:
-		x, err := strconv.ParseFloat(realT.Value, 64)
+		x, err := strconv.ParseFloat(strings.ReplaceAll(realT.Value, "_", ""), 64)
 		if err != nil {
 			panic(err)
 		}
@@ -40,14 +42,12 @@ func (tokenWrapper) Wrap(t combinator.Token) combinator.Node {
 	case token.StringLit:
 		s := realT.Value
 
-		// remove the first and last quotes, and replace escaped quotes with quotes
-		s = strings.ReplaceAll(s, "\\\"", "\"")
-		s = s[1 : len(s)-1]
-		return node.String(s)
+		// remove the first and last quotes, escapes are decoded by the lexer
+		return node.String(s[1 : len(s)-1])
 
 	case token.Sticky, token.NotSticky:
 		if slices.Contains(ops[:], realT.Value) {
-			return node.BinOp{Op: realT.Value}
+			return node.BinOp{Op: realT.Value, Span: dbginfo.Span{From: realT.From(), To: realT.To()}}
 		}
 
 		return node.Invalid{}
@@ -70,3 +70,30 @@ func (tokenWrapper) Wrap(t combinator.Token) combinator.Node {
 	}
 	panic("unreachable code")
 }
+
+// parseInt parses an integer literal with an optional base prefix and digit
+// separators. It returns ok false if the literal doesn't fit in int.
+func parseInt(lit string) (*big.Int, bool) {
+	lit = strings.ReplaceAll(lit, "_", "")
+
+	base := 10
+	if len(lit) > 2 && lit[0] == '0' {
+		switch lit[1] {
+		case 'x', 'X':
+			base = 16
+		case 'b', 'B':
+			base = 2
+		case 'o', 'O':
+			base = 8
+		}
+	}
+	if base != 10 {
+		lit = lit[2:]
+	}
+
+	x, ok := new(big.Int).SetString(lit, base)
+	if !ok {
+		log.Panicf("invalid integer literal %s", lit)
+	}
+	return x, x.IsInt64()
+}
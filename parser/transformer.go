@@ -2,21 +2,76 @@ package parser
 
 import (
 	"log"
+	"path/filepath"
+	"slices"
+	"strings"
 
 	c "github.com/paulsonkoly/calc/combinator"
+	"github.com/paulsonkoly/calc/lexer"
+	"github.com/paulsonkoly/calc/types/dbginfo"
 	"github.com/paulsonkoly/calc/types/node"
 )
 
 // Node transformations. We receive a parsed linear sequence of nodes, arrange it in sub-trees.
 
+// spanned is like c.Fmap, but f also receives the source span of the tokens
+// parsed by p.
+func spanned(f func(dbginfo.Span, []c.Node) []c.Node, p c.Parser) c.Parser {
+	return func(input c.RollbackLexer) ([]c.Node, *Error) {
+		from := peekFrom(input)
+
+		r, err := p(input)
+		if err != nil {
+			return nil, err
+		}
+		return f(dbginfo.Span{From: from, To: input.Token().To()}, r), nil
+	}
+}
+
+// peekFrom is the start of the next token.
+func peekFrom(input c.RollbackLexer) int {
+	from := 0
+	input.Snapshot()
+	if input.Next() && input.Err() == nil {
+		from = input.Token().From()
+	}
+	input.Rollback()
+	return from
+}
+
+// operand is a node with its source span, the operand of an operator chain.
+type operand struct {
+	n    node.Type
+	span dbginfo.Span
+}
+
+// withSpan wraps the single result of p in an operand.
+func withSpan(p c.Parser) c.Parser {
+	return spanned(func(span dbginfo.Span, nodes []c.Node) []c.Node {
+		if len(nodes) != 1 {
+			log.Panicf("incorrect number of sub nodes for operand (%d)", len(nodes))
+		}
+		return []c.Node{operand{n: nodes[0].(node.Type), span: span}}
+	}, p)
+}
+
+// unwrap is the node and the source span of an operand. Nodes that are not
+// operands have no span.
+func unwrap(n c.Node) (node.Type, dbginfo.Span) {
+	if o, ok := n.(operand); ok {
+		return o.n, o.span
+	}
+	return n.(node.Type), dbginfo.Span{}
+}
+
 // mkUnaryOp is used for unary operators.
 //
 // It rewrites the pair of nodes putting the second under the first.
-func mkUnaryOp(nodes []c.Node) []c.Node {
+func mkUnaryOp(span dbginfo.Span, nodes []c.Node) []c.Node {
 	if len(nodes) != 2 {
 		log.Panicf("incorrect number of sub nodes for unary operator (%d)", len(nodes))
 	}
-	n := node.UnOp{Op: nodes[0].(node.BinOp).Op, Target: nodes[1].(node.Type)}
+	n := node.UnOp{Op: nodes[0].(node.BinOp).Op, Target: nodes[1].(node.Type), Span: span}
 
 	return []c.Node{n}
 }
@@ -39,8 +94,86 @@ func mkYield(nodes []c.Node) []c.Node {
 	return []c.Node{n}
 }
 
+// mkTry is for try catch statements.
+func mkTry(nodes []c.Node) []c.Node {
+	if len(nodes) != 5 {
+		log.Panicf("incorrect number of sub nodes for try (%d)", len(nodes))
+	}
+	n := node.Try{Body: nodes[1].(node.Type), VarRef: nodes[3].(node.Type), Catch: nodes[4].(node.Type)}
+	return []c.Node{n}
+}
+
+// mkRaise is for raise statements.
+func mkRaise(span dbginfo.Span, nodes []c.Node) []c.Node {
+	if len(nodes) != 2 {
+		log.Panicf("incorrect number of sub nodes for raise (%d)", len(nodes))
+	}
+	n := node.Raise{Target: nodes[1].(node.Type), Span: span}
+	return []c.Node{n}
+}
+
+// mkImport is for import statements. The module is bound to the variable
+// named after the file name without extension, or nil if that is not a valid
+// variable name.
+func mkImport(nodes []c.Node) []c.Node {
+	if len(nodes) != 2 {
+		log.Panicf("incorrect number of sub nodes for import (%d)", len(nodes))
+	}
+	path := string(nodes[1].(node.String))
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	var varRef node.Type
+	if lexer.IsName(name) && !slices.Contains(Keywords[:], name) {
+		varRef = node.Name(name)
+	}
+
+	return []c.Node{node.Import{Path: path, VarRef: varRef}}
+}
+
+// mkMember is for the member access suffix of postfix expressions.
+func mkMember(nodes []c.Node) []c.Node {
+	if len(nodes) != 2 {
+		log.Panicf("incorrect number of sub nodes for member (%d)", len(nodes))
+	}
+	return []c.Node{member(nodes[1].(node.Name))}
+}
+
+// member is the name in the member access suffix of a postfix expression.
+type member string
+
+// suffix is a suffix of a postfix expression with its source span.
+type suffix struct {
+	n    c.Node
+	span dbginfo.Span
+}
+
+// mkSuffix wraps a suffix of a postfix expression.
+func mkSuffix(span dbginfo.Span, nodes []c.Node) []c.Node {
+	if len(nodes) != 1 {
+		log.Panicf("incorrect number of sub nodes for suffix (%d)", len(nodes))
+	}
+	return []c.Node{suffix{n: nodes[0], span: span}}
+}
+
+// mkBreak is for break statements.
+func mkBreak(nodes []c.Node) []c.Node {
+	if len(nodes) != 1 {
+		log.Panicf("incorrect number of sub nodes for break (%d)", len(nodes))
+	}
+	return []c.Node{node.Break{}}
+}
+
+// mkContinue is for continue statements.
+func mkContinue(nodes []c.Node) []c.Node {
+	if len(nodes) != 1 {
+		log.Panicf("incorrect number of sub nodes for continue (%d)", len(nodes))
+	}
+	return []c.Node{node.Continue{}}
+}
+
 // mkLeftChain rewrites a sequence of binary operators applied on operands in a
-// left assictive structure.
+// left assictive structure. The operator nodes span their operands, if the
+// operands have spans.
 //
 // In effect it arranges a+b+c sequence in:
 //
@@ -53,39 +186,69 @@ func mkLeftChain(nodes []c.Node) []c.Node {
 	if len(nodes)%2 == 0 {
 		log.Panicf("incorrect number of sub nodes for left chain (%d)", len(nodes))
 	}
-	r := nodes[0]
+	r, span := unwrap(nodes[0])
 	for i := 1; i+1 < len(nodes); i += 2 {
 		n := nodes[i].(node.BinOp)
-		n.Left = r.(node.Type)
-		n.Right = nodes[i+1].(node.Type)
-		r = n
+		right, rSpan := unwrap(nodes[i+1])
+		n.Left = r
+		n.Right = right
+		if span != (dbginfo.Span{}) && rSpan != (dbginfo.Span{}) {
+			n.Span = dbginfo.Span{From: span.From, To: rSpan.To}
+		}
+		r, span = n, n.Span
 	}
 	return []c.Node{r}
 }
 
 // mkAssign creates an assigment to a variable.
-func mkAssign(nodes []c.Node) []c.Node {
+func mkAssign(span dbginfo.Span, nodes []c.Node) []c.Node {
 	if len(nodes) != 3 {
 		log.Panicf("incorrect number of sub nodes for assignment (%d)", len(nodes))
 	}
-	assign := node.Assign{VarRef: nodes[0].(node.Type), Value: nodes[2].(node.Type)}
+	assign := node.Assign{VarRef: nodes[0].(node.Type), Value: nodes[2].(node.Type), Span: span}
 	return []c.Node{assign}
 }
 
-// mkIndex rewrites a sequence describing an array indexing into an Index node.
-func mkIndex(nodes []c.Node) []c.Node {
+// callArgs is the argument list of a call in a postfix expression, telling it
+// apart from an array literal index.
+type callArgs struct{ node.List }
+
+// mkCallArgs wraps the argument list of a call.
+func mkCallArgs(nodes []c.Node) []c.Node {
+	if len(nodes) != 1 {
+		log.Panicf("incorrect number of sub nodes for call arguments (%d)", len(nodes))
+	}
+	return []c.Node{callArgs{nodes[0].(node.List)}}
+}
+
+// mkPostfix rewrites a sequence describing indexing, member access and
+// function calls into Index, Member and Call nodes. The suffixes apply left to
+// right, f(1)[2] indexes the result of the call. The nodes span from the start
+// of the operand to the end of their suffix.
+func mkPostfix(nodes []c.Node) []c.Node {
 	if len(nodes) == 0 {
-		panic("no nodes in mkIndex")
+		panic("no nodes in mkPostfix")
 	}
 
-	r := nodes[0]
+	r, span := unwrap(nodes[0])
 
 	for _, n := range nodes[1:] {
-		if n, ok := n.(node.BinOp); ok && n.Op == ":" {
-			r = node.IndexFromTo{Ary: r.(node.Type), From: n.Left, To: n.Right}
+		sfx := n.(suffix)
+		span.To = sfx.span.To
+
+		if n, ok := sfx.n.(member); ok {
+			r = node.Member{Module: r, Name: string(n), Span: span}
+			continue
+		}
+		if n, ok := sfx.n.(callArgs); ok {
+			r = node.Call{Callee: r, Arguments: n.List, Span: span}
+			continue
+		}
+		if n, ok := sfx.n.(node.BinOp); ok && n.Op == ":" {
+			r = node.IndexFromTo{Ary: r, From: n.Left, To: n.Right, Span: span}
 			continue
 		}
-		r = node.IndexAt{Ary: r.(node.Type), At: n.(node.Type)}
+		r = node.IndexAt{Ary: r, At: sfx.n.(node.Type), Span: span}
 	}
 
 	return []c.Node{r}
@@ -99,6 +262,19 @@ func mkList(nodes []c.Node) []c.Node {
 	return []c.Node{r}
 }
 
+// mkMap creates a map literal from a sequence of alternating keys and values.
+func mkMap(span dbginfo.Span, nodes []c.Node) []c.Node {
+	if len(nodes)%2 != 0 {
+		log.Panicf("incorrect number of sub nodes for map (%d)", len(nodes))
+	}
+	r := node.Map{Keys: node.List{Elems: make([]node.Type, 0)}, Values: node.List{Elems: make([]node.Type, 0)}, Span: span}
+	for i := 0; i < len(nodes); i += 2 {
+		r.Keys.Elems = append(r.Keys.Elems, nodes[i].(node.Type))
+		r.Values.Elems = append(r.Values.Elems, nodes[i+1].(node.Type))
+	}
+	return []c.Node{r}
+}
+
 // mkBlock wraps a sequence of nodes in a single block node.
 func mkBlock(nodes []c.Node) []c.Node {
 	if len(nodes) <= 1 {
@@ -111,12 +287,6 @@ func mkBlock(nodes []c.Node) []c.Node {
 	return []c.Node{r}
 }
 
-// mkFCall creates a function call node.
-func mkFCall(nodes []c.Node) []c.Node {
-	r := node.Call{Name: nodes[0].(node.Type), Arguments: nodes[1].(node.List)}
-	return []c.Node{r}
-}
-
 func mkFunction(nodes []c.Node) []c.Node {
 	if len(nodes) != 3 {
 		log.Panicf("incorrect number of sub nodes for function (%d)", len(nodes))
@@ -126,34 +296,37 @@ func mkFunction(nodes []c.Node) []c.Node {
 	return []c.Node{r}
 }
 
-// mkIf creates a conditional structure.
+// mkIf creates a conditional structure. It spans the condition.
 func mkIf(nodes []c.Node) []c.Node {
 	var n node.Type
 	switch len(nodes) {
 	case 3:
-		n = node.If{Condition: nodes[1].(node.Type), TrueCase: nodes[2].(node.Type)}
+		cond, span := unwrap(nodes[1])
+		n = node.If{Condition: cond, TrueCase: nodes[2].(node.Type), Span: span}
 	case 5:
-		n = node.IfElse{Condition: nodes[1].(node.Type), TrueCase: nodes[2].(node.Type), FalseCase: nodes[4].(node.Type)}
+		cond, span := unwrap(nodes[1])
+		n = node.IfElse{Condition: cond, TrueCase: nodes[2].(node.Type), FalseCase: nodes[4].(node.Type), Span: span}
 	default:
 		log.Panicf("incorrect number of sub nodes for if (%d)", len(nodes))
 	}
 	return []c.Node{n}
 }
 
-// mkWhile creates a while loop structure.
+// mkWhile creates a while loop structure. It spans the condition.
 func mkWhile(nodes []c.Node) []c.Node {
 	if len(nodes) != 3 {
 		log.Panicf("incorrect number of sub nodes for while (%d)", len(nodes))
 	}
-	n := node.While{Condition: nodes[1].(node.Type), Body: nodes[2].(node.Type)}
+	cond, span := unwrap(nodes[1])
+	n := node.While{Condition: cond, Body: nodes[2].(node.Type), Span: span}
 	return []c.Node{n}
 }
 
 // mkFor creates a for loop structure.
-func mkFor(nodes []c.Node) []c.Node {
+func mkFor(span dbginfo.Span, nodes []c.Node) []c.Node {
 	if len(nodes) != 5 {
 		log.Panicf("incorrect number of sub nodes for for (%d)", len(nodes))
 	}
-	n := node.For{VarRefs: nodes[1].(node.List), Iterators: nodes[3].(node.List), Body: nodes[4].(node.Type)}
+	n := node.For{VarRefs: nodes[1].(node.List), Iterators: nodes[3].(node.List), Body: nodes[4].(node.Type), Span: span}
 	return []c.Node{n}
 }
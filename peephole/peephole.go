@@ -0,0 +1,362 @@
+// Package peephole is a peephole optimizer of the compiled calc code.
+//
+// It rewrites short instruction sequences of the bytecode to fewer
+// instructions:
+//
+//   - PUSH x followed by an instruction popping its first operand is folded to
+//     the instruction reading x
+//   - MOV TMP, x followed by PUSHTMP is PUSH x, if the temp register isn't read
+//     later
+//   - PUSH x followed by POP, or by a jump to POP is removed
+//   - conditional jumps on constants are removed or replaced by jumps
+//   - jumps to jumps go to the final target
+//   - jumps to the next instruction and unreachable instructions are removed
+//
+// The relative jump offsets, the function entry addresses and the debug
+// information are relocated after the instructions removed.
+package peephole
+
+import (
+	"github.com/paulsonkoly/calc/types/bytecode"
+	"github.com/paulsonkoly/calc/types/compresult"
+	"github.com/paulsonkoly/calc/types/dbginfo"
+	"github.com/paulsonkoly/calc/types/value"
+)
+
+// folding are the instructions fetching src0 first, a PUSH preceding them
+// can be folded in when src0 is the stack.
+var folding = map[bytecode.OpCode]bool{
+	bytecode.PUSH: true, bytecode.MOV: true,
+	bytecode.ADD: true, bytecode.SUB: true, bytecode.MUL: true, bytecode.DIV: true, bytecode.MOD: true,
+	bytecode.ADDTMP: true, bytecode.SUBTMP: true, bytecode.MULTMP: true, bytecode.DIVTMP: true, bytecode.MODTMP: true,
+	bytecode.NOT: true, bytecode.AND: true, bytecode.OR: true, bytecode.ANDTMP: true, bytecode.ORTMP: true,
+	bytecode.LT: true, bytecode.GT: true, bytecode.LE: true, bytecode.GE: true, bytecode.EQ: true, bytecode.NE: true,
+	bytecode.LTTMP: true, bytecode.GTTMP: true, bytecode.LETMP: true, bytecode.GETMP: true, bytecode.EQTMP: true, bytecode.NETMP: true,
+	bytecode.LSH: true, bytecode.RSH: true, bytecode.FLIP: true, bytecode.LSHTMP: true, bytecode.RSHTMP: true,
+	bytecode.IX1: true, bytecode.IX2: true, bytecode.LEN: true, bytecode.ARR: true, bytecode.MAP: true,
+	bytecode.JMPF: true, bytecode.JMPT: true, bytecode.RET: true, bytecode.YIELD: true, bytecode.RAISE: true,
+	bytecode.WRITE: true, bytecode.EXIT: true, bytecode.KEYS: true, bytecode.ERROR: true,
+}
+
+// optimizer is the state of optimizing a compilation result.
+type optimizer struct {
+	cr      compresult.Type
+	from    int    // from is the address of the first instruction optimized
+	entries []bool // entries are set for the instructions reached other than from the previous instruction
+	removed []bool // removed are set for the instructions removed
+	changed bool   // changed is set if instructions are rewritten
+}
+
+// Optimize optimizes the code of cr from the address from to the end. The code
+// before from is left as is, it might have run already.
+func Optimize(cr compresult.Type, from int) {
+	for {
+		o := &optimizer{cr: cr, from: from}
+		// the jumps threaded leave their targets unreachable
+		o.thread()
+		o.findEntries()
+
+		o.branch()
+		o.fold()
+		o.discard()
+		o.removeJumps()
+		o.removeUnreachable()
+
+		if !o.relocate() && !o.changed {
+			return
+		}
+	}
+}
+
+// findEntries finds the instructions that are jumped to, or are the entry of a
+// function.
+func (o *optimizer) findEntries() {
+	cs := *o.cr.CS
+	o.entries = make([]bool, len(cs)-o.from)
+	o.removed = make([]bool, len(cs)-o.from)
+	if len(cs) > o.from {
+		o.entries[0] = true
+	}
+
+	for ip, instr := range cs {
+		if target, ok := instr.JumpTarget(ip); ok {
+			o.entry(target)
+		}
+	}
+	for _, v := range *o.cr.DS {
+		if f, ok := v.ToFunction(); ok && f.Native == nil {
+			o.entry(f.Node)
+		}
+	}
+}
+
+// entry marks the instruction at ip as an entry.
+func (o *optimizer) entry(ip int) {
+	if ip >= o.from && ip < len(*o.cr.CS) {
+		o.entries[ip-o.from] = true
+	}
+}
+
+// thread retargets the jumps to jumps to the final target.
+func (o *optimizer) thread() {
+	cs := *o.cr.CS
+	for ip := o.from; ip < len(cs); ip++ {
+		target, ok := cs[ip].JumpTarget(ip)
+		if !ok || cs[ip].OpCode() == bytecode.CCONT || cs[ip].OpCode() == bytecode.TRY {
+			continue
+		}
+
+		final := target
+		// jump cycles are followed no longer than the length of the code
+		for i := 0; i < len(cs) && final >= o.from && final < len(cs) && cs[final].OpCode() == bytecode.JMP; i++ {
+			final += cs[final].Src0Addr()
+		}
+		if final != target {
+			cs[ip] = retarget(ip, cs[ip], final)
+			o.changed = true
+		}
+	}
+}
+
+// branch removes the conditional jumps on constants not taken, and replaces
+// the ones taken by jumps.
+func (o *optimizer) branch() {
+	cs := *o.cr.CS
+	for ip := o.from; ip < len(cs); ip++ {
+		instr := cs[ip]
+		if (instr.OpCode() != bytecode.JMPF && instr.OpCode() != bytecode.JMPT) || instr.Src0() != bytecode.AddrDS {
+			continue
+		}
+
+		// a jump on other than bool raises an error
+		b, ok := (*o.cr.DS)[instr.Src0Addr()].ToBool()
+		if !ok {
+			continue
+		}
+
+		if b == (instr.OpCode() == bytecode.JMPT) {
+			cs[ip] = bytecode.New(bytecode.JMP) | bytecode.EncodeSrc(0, bytecode.AddrImm, instr.Src1Addr())
+			o.changed = true
+		} else {
+			o.removed[ip-o.from] = true
+		}
+	}
+}
+
+// fold folds PUSH x into the following instruction popping x, and MOV TMP, x
+// followed by PUSHTMP into PUSH x.
+func (o *optimizer) fold() {
+	cs := *o.cr.CS
+	for ip := o.from; ip+1 < len(cs); ip++ {
+		instr, next := cs[ip], cs[ip+1]
+		if o.removed[ip-o.from] || o.entries[ip+1-o.from] {
+			continue
+		}
+
+		switch {
+		case instr.OpCode() == bytecode.PUSH && operand(instr.Src0()) &&
+			folding[next.OpCode()] && next.Src0() == bytecode.AddrStck:
+
+			cs[ip+1] = next.ReplaceSrc(0, instr.Src0(), instr.Src0Addr())
+			o.removed[ip-o.from] = true
+			o.changed = true
+
+		case instr.OpCode() == bytecode.MOV && instr.Src1() == bytecode.AddrTmp && instr.Src0() == bytecode.AddrDS &&
+			next.OpCode() == bytecode.PUSHTMP && !o.tmpRead(ip+2):
+
+			// MOV raises an error for nil, PUSH doesn't
+			if (*o.cr.DS)[instr.Src0Addr()].IsNil() {
+				continue
+			}
+			cs[ip+1] = bytecode.New(bytecode.PUSH) | bytecode.EncodeSrc(0, bytecode.AddrDS, instr.Src0Addr())
+			o.removed[ip-o.from] = true
+			o.changed = true
+		}
+	}
+}
+
+// discard removes PUSH x followed by POP, and PUSH x followed by a jump to POP
+// jumping past the POP instead.
+func (o *optimizer) discard() {
+	cs := *o.cr.CS
+	for ip := o.from; ip+1 < len(cs); ip++ {
+		instr, next := cs[ip], cs[ip+1]
+		if instr.OpCode() != bytecode.PUSH || !operand(instr.Src0()) ||
+			o.removed[ip-o.from] || o.removed[ip+1-o.from] || o.entries[ip+1-o.from] {
+			continue
+		}
+
+		switch next.OpCode() {
+		case bytecode.POP:
+			o.removed[ip-o.from] = true
+			o.removed[ip+1-o.from] = true
+
+		case bytecode.JMP:
+			target := ip + 1 + next.Src0Addr()
+			if target >= o.from && target < len(cs) && cs[target].OpCode() == bytecode.POP && !o.removed[target-o.from] {
+				cs[ip+1] = retarget(ip+1, next, target+1)
+				o.removed[ip-o.from] = true
+			}
+		}
+	}
+}
+
+// tmpRead determines whether the temp register might be read from the
+// instruction at ip before it's written. Only the straight code is followed,
+// any jump or entry counts as a read.
+func (o *optimizer) tmpRead(ip int) bool {
+	cs := *o.cr.CS
+	for ; ip < len(cs); ip++ {
+		instr := cs[ip]
+		if o.entries[ip-o.from] {
+			return true
+		}
+
+		switch op := instr.OpCode(); {
+		case op&bytecode.TempFlag != 0:
+			return true
+
+		case op == bytecode.MOV:
+			if instr.Src0() == bytecode.AddrTmp {
+				return true
+			}
+			if instr.Src1() == bytecode.AddrTmp {
+				return false
+			}
+
+		case op == bytecode.JMP, op == bytecode.JMPF, op == bytecode.JMPT, op == bytecode.CALL, op == bytecode.RET,
+			op == bytecode.TAIL, op == bytecode.CCONT, op == bytecode.DCONT, op == bytecode.SCONT, op == bytecode.YIELD,
+			op == bytecode.TRY, op == bytecode.RAISE:
+			return true
+		}
+	}
+	return false
+}
+
+// removeJumps removes the jumps to the next instruction.
+func (o *optimizer) removeJumps() {
+	cs := *o.cr.CS
+	for ip := o.from; ip < len(cs); ip++ {
+		if cs[ip].OpCode() == bytecode.JMP && cs[ip].Src0Addr() == 1 {
+			o.removed[ip-o.from] = true
+		}
+	}
+}
+
+// removeUnreachable removes the instructions following a jump or a return
+// that are not entries.
+func (o *optimizer) removeUnreachable() {
+	cs := *o.cr.CS
+	reachable := true
+	for ip := o.from; ip < len(cs); ip++ {
+		reachable = reachable || o.entries[ip-o.from]
+		if !reachable {
+			o.removed[ip-o.from] = true
+			continue
+		}
+
+		switch cs[ip].OpCode() {
+		case bytecode.RET, bytecode.RAISE:
+			reachable = false
+		case bytecode.JMP:
+			// a jump to the next instruction is removed, and falls through
+			reachable = cs[ip].Src0Addr() == 1
+		}
+	}
+}
+
+// relocate deletes the removed instructions and relocates the addresses
+// following them. It returns whether there were instructions removed.
+func (o *optimizer) relocate() bool {
+	cs := *o.cr.CS
+
+	// nips are the new addresses, removed instructions are replaced by the
+	// instruction following them
+	nips := make([]int, len(cs)+1-o.from)
+	nip := o.from
+	for ip := o.from; ip < len(cs); ip++ {
+		nips[ip-o.from] = nip
+		if !o.removed[ip-o.from] {
+			nip++
+		}
+	}
+	nips[len(cs)-o.from] = nip
+	if nip == len(cs) {
+		return false
+	}
+
+	move := func(ip int) int {
+		if ip < o.from || ip > len(cs) {
+			return ip
+		}
+		return nips[ip-o.from]
+	}
+
+	code := cs[:o.from]
+	for ip := o.from; ip < len(cs); ip++ {
+		if o.removed[ip-o.from] {
+			continue
+		}
+		instr := cs[ip]
+		if target, ok := instr.JumpTarget(ip); ok {
+			instr = retarget(move(ip), instr, move(target))
+		}
+		code = append(code, instr)
+	}
+	*o.cr.CS = code
+
+	for i, v := range *o.cr.DS {
+		if f, ok := v.ToFunction(); ok && f.Native == nil && f.Node >= o.from {
+			(*o.cr.DS)[i] = value.NewFunction(move(f.Node), f.Env, f.ParamCnt, f.LocalCnt)
+		}
+	}
+
+	for i, s := range *o.cr.Scopes {
+		(*o.cr.Scopes)[i].From, (*o.cr.Scopes)[i].To = move(s.From), move(s.To)
+	}
+
+	reloc := func(ip int) (int, bool) {
+		if ip >= o.from && ip < len(cs) && o.removed[ip-o.from] {
+			return 0, false
+		}
+		return move(ip), true
+	}
+
+	dbg := *o.cr.Dbg
+	moved := map[int]dbginfo.Call{}
+	for ip, call := range dbg {
+		if ip >= o.from {
+			delete(dbg, ip)
+			if nip, ok := reloc(ip); ok {
+				moved[nip] = call
+			}
+		}
+	}
+	for ip, call := range moved {
+		dbg[ip] = call
+	}
+
+	o.cr.Lines.Relocate(reloc)
+
+	return true
+}
+
+// operand determines whether src is an operand that can be read by any
+// instruction.
+func operand(src uint64) bool {
+	switch src {
+	case bytecode.AddrDS, bytecode.AddrLcl, bytecode.AddrCls, bytecode.AddrGbl:
+		return true
+	}
+	return false
+}
+
+// retarget is the jump instruction instr at ip jumping to target.
+func retarget(ip int, instr bytecode.Type, target int) bytecode.Type {
+	switch instr.OpCode() {
+	case bytecode.JMPF, bytecode.JMPT:
+		return instr.ReplaceSrc(1, bytecode.AddrImm, target-ip)
+	default:
+		return instr.ReplaceSrc(0, bytecode.AddrImm, target-ip)
+	}
+}
@@ -0,0 +1,121 @@
+package peephole_test
+
+import (
+	"testing"
+
+	"github.com/paulsonkoly/calc/peephole"
+	"github.com/paulsonkoly/calc/types/bytecode"
+	"github.com/paulsonkoly/calc/types/compresult"
+	"github.com/paulsonkoly/calc/types/dbginfo"
+	"github.com/paulsonkoly/calc/types/value"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// instr is the instruction op with the operands srcs.
+func instr(op bytecode.OpCode, srcs ...bytecode.Type) bytecode.Type {
+	i := bytecode.New(op)
+	for _, s := range srcs {
+		i |= s
+	}
+	return i
+}
+
+// src is the operand srcsel encoded.
+func src(srcsel int, src uint64, addr int) bytecode.Type {
+	return bytecode.EncodeSrc(srcsel, src, addr)
+}
+
+// newCR is a compilation result with the code cs and the data ds.
+func newCR(cs []bytecode.Type, ds []value.Type) compresult.Type {
+	dbg := make(dbginfo.Type)
+	lines := dbginfo.Lines{}
+	scopes := dbginfo.Scopes{}
+	modules := make(map[string]bool)
+	return compresult.Type{CS: &cs, DS: &ds, Dbg: &dbg, Lines: &lines, Scopes: &scopes, Modules: &modules}
+}
+
+func TestOptimize(t *testing.T) {
+	cr := newCR([]bytecode.Type{
+		instr(bytecode.PUSH, src(0, bytecode.AddrDS, 0)),
+		instr(bytecode.ADD, src(0, bytecode.AddrStck, 0), src(1, bytecode.AddrDS, 1)),
+		instr(bytecode.JMP, src(0, bytecode.AddrImm, 1)),
+		instr(bytecode.JMP, src(0, bytecode.AddrImm, 3)),
+		instr(bytecode.PUSH, src(0, bytecode.AddrLcl, 0)),
+		instr(bytecode.RET, src(0, bytecode.AddrStck, 0)),
+		instr(bytecode.FUNC, src(0, bytecode.AddrDS, 2)),
+		instr(bytecode.CALL, src(0, bytecode.AddrStck, 0), src(1, bytecode.AddrImm, 1)),
+		instr(bytecode.MOV, src(0, bytecode.AddrDS, 1), src(1, bytecode.AddrTmp, 0)),
+		instr(bytecode.PUSHTMP),
+	}, []value.Type{value.NewInt(1), value.NewInt(2), value.NewFunction(4, nil, 1, 1)})
+
+	(*cr.Dbg)[7] = dbginfo.Call{Name: "f", ArgCnt: 1}
+	cr.Scopes.Add(dbginfo.Scope{From: 4, To: 6, Locals: []string{"x"}})
+	cr.Lines.AddSource(dbginfo.Source{Line: 1, Text: "f(1 + 2)"})
+	cr.Lines.Add(1, dbginfo.Span{From: 2, To: 7})
+	cr.Lines.Add(7, dbginfo.Span{From: 0, To: 8})
+
+	peephole.Optimize(cr, 0)
+
+	assert.Equal(t, []bytecode.Type{
+		instr(bytecode.ADD, src(0, bytecode.AddrDS, 0), src(1, bytecode.AddrDS, 1)),
+		instr(bytecode.JMP, src(0, bytecode.AddrImm, 2)),
+		instr(bytecode.RET, src(0, bytecode.AddrLcl, 0)),
+		instr(bytecode.FUNC, src(0, bytecode.AddrDS, 2)),
+		instr(bytecode.CALL, src(0, bytecode.AddrStck, 0), src(1, bytecode.AddrImm, 1)),
+		instr(bytecode.PUSH, src(0, bytecode.AddrDS, 1)),
+	}, *cr.CS)
+
+	f, ok := (*cr.DS)[2].ToFunction()
+	require.True(t, ok)
+	assert.Equal(t, 2, f.Node)
+	assert.Equal(t, dbginfo.Scopes{{From: 2, To: 3, Locals: []string{"x"}}}, *cr.Scopes)
+	assert.Equal(t, dbginfo.Type{4: {Name: "f", ArgCnt: 1}}, *cr.Dbg)
+
+	loc, ok := cr.Lines.Lookup(0)
+	require.True(t, ok)
+	assert.Equal(t, "1 + 2", loc.Text[loc.Col-1:loc.EndCol-1])
+	_, ok = cr.Lines.Lookup(4)
+	assert.True(t, ok)
+}
+
+func TestOptimizeJumps(t *testing.T) {
+	cr := newCR([]bytecode.Type{
+		instr(bytecode.JMPT, src(0, bytecode.AddrDS, 2), src(1, bytecode.AddrImm, 3)),
+		instr(bytecode.PUSH, src(0, bytecode.AddrDS, 0)),
+		instr(bytecode.POP),
+		instr(bytecode.JMP, src(0, bytecode.AddrImm, 2)),
+		instr(bytecode.PUSH, src(0, bytecode.AddrDS, 1)),
+		instr(bytecode.PUSH, src(0, bytecode.AddrDS, 0)),
+		instr(bytecode.POP),
+		instr(bytecode.RET, src(0, bytecode.AddrDS, 1)),
+	}, []value.Type{value.NewInt(1), value.NewInt(2), value.NewBool(true)})
+
+	peephole.Optimize(cr, 0)
+
+	assert.Equal(t, []bytecode.Type{instr(bytecode.RET, src(0, bytecode.AddrDS, 1))}, *cr.CS)
+}
+
+func TestOptimizeKeeps(t *testing.T) {
+	code := []bytecode.Type{
+		// the temp register is read after PUSHTMP
+		instr(bytecode.MOV, src(0, bytecode.AddrDS, 0), src(1, bytecode.AddrTmp, 0)),
+		instr(bytecode.PUSHTMP),
+		instr(bytecode.ADDTMP, src(0, bytecode.AddrStck, 0)),
+		// the value pushed is popped by the call
+		instr(bytecode.PUSH, src(0, bytecode.AddrDS, 0)),
+		instr(bytecode.CALL, src(0, bytecode.AddrGbl, 1), src(1, bytecode.AddrImm, 1)),
+		// the jump target pushes a different value
+		instr(bytecode.JMPF, src(0, bytecode.AddrStck, 0), src(1, bytecode.AddrImm, 3)),
+		instr(bytecode.PUSH, src(0, bytecode.AddrDS, 0)),
+		instr(bytecode.JMP, src(0, bytecode.AddrImm, 2)),
+		instr(bytecode.PUSH, src(0, bytecode.AddrDS, 2)),
+		instr(bytecode.RET, src(0, bytecode.AddrStck, 0)),
+	}
+	cr := newCR(append([]bytecode.Type{}, code...),
+		[]value.Type{value.NewInt(1), value.NewString("f"), value.NewInt(2)})
+
+	peephole.Optimize(cr, 0)
+
+	assert.Equal(t, code, *cr.CS)
+}
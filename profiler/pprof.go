@@ -0,0 +1,144 @@
+package profiler
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// message is a protocol buffer message being encoded.
+type message []byte
+
+func (m *message) tag(field, wire int) { *m = binary.AppendUvarint(*m, uint64(field<<3|wire)) }
+
+// uint encodes a varint field.
+func (m *message) uint(field int, v uint64) {
+	m.tag(field, 0)
+	*m = binary.AppendUvarint(*m, v)
+}
+
+// bytes encodes a length delimited field.
+func (m *message) bytes(field int, b []byte) {
+	m.tag(field, 2)
+	*m = binary.AppendUvarint(*m, uint64(len(b)))
+	*m = append(*m, b...)
+}
+
+// packed encodes a packed repeated varint field.
+func (m *message) packed(field int, vs []uint64) {
+	var b message
+	for _, v := range vs {
+		b = binary.AppendUvarint(b, v)
+	}
+	m.bytes(field, b)
+}
+
+// stringTable is the string table of a profile.
+type stringTable struct {
+	table []string
+	ix    map[string]uint64
+}
+
+func (s *stringTable) index(str string) uint64 {
+	if ix, ok := s.ix[str]; ok {
+		return ix
+	}
+	ix := uint64(len(s.table))
+	s.table = append(s.table, str)
+	s.ix[str] = ix
+	return ix
+}
+
+// WriteProfile writes the profile to w in the gzipped protocol buffer format
+// of pprof. The samples are the call stacks of the calc functions, valued by
+// the count of instructions and the nanoseconds spent.
+func (p *Type) WriteProfile(w io.Writer) error {
+	strs := stringTable{table: []string{""}, ix: map[string]uint64{"": 0}}
+	var prof message
+
+	// sample_type
+	for _, typ := range [...][2]string{{"instructions", "count"}, {"time", "nanoseconds"}} {
+		var vt message
+		vt.uint(1, strs.index(typ[0]))
+		vt.uint(2, strs.index(typ[1]))
+		prof.bytes(1, vt)
+	}
+
+	funcs := make([]*function, 0, len(p.funcs))
+	for _, f := range p.funcs {
+		funcs = append(funcs, f)
+	}
+	slices.SortFunc(funcs, func(a, b *function) int { return a.node - b.node })
+	ids := map[*function]uint64{}
+	names := map[string]int{}
+	for i, f := range funcs {
+		ids[f] = uint64(i + 1)
+		names[f.name]++
+	}
+
+	// sample
+	p.root.walk(func(smp *sample) {
+		if smp.instrs == 0 {
+			return
+		}
+		funcs := smp.funcs()
+		locs := make([]uint64, len(funcs))
+		for i, f := range funcs {
+			locs[i] = ids[f]
+		}
+		var s message
+		s.packed(1, locs)
+		s.packed(2, []uint64{uint64(smp.instrs), uint64(smp.time.Nanoseconds())})
+		prof.bytes(2, s)
+	})
+
+	// location and function, one location for each function
+	for _, f := range funcs {
+		var line message
+		line.uint(1, ids[f])
+		line.uint(2, uint64(f.line))
+
+		var loc message
+		loc.uint(1, ids[f])
+		loc.bytes(4, line)
+		prof.bytes(4, loc)
+
+		// pprof merges the functions by name
+		name := f.name
+		if names[name] > 1 {
+			name = fmt.Sprintf("%s:%d", name, f.line)
+		}
+
+		var fn message
+		fn.uint(1, ids[f])
+		fn.uint(2, strs.index(name))
+		fn.uint(3, strs.index(f.name))
+		fn.uint(4, strs.index(f.file))
+		fn.uint(5, uint64(f.line))
+		prof.bytes(5, fn)
+	}
+
+	// time_nanos, duration_nanos, period_type, period
+	if !p.start.IsZero() {
+		prof.uint(9, uint64(p.start.UnixNano()))
+		prof.uint(10, uint64(p.last.Sub(p.start).Nanoseconds()))
+	}
+	var pt message
+	pt.uint(1, strs.index("instructions"))
+	pt.uint(2, strs.index("count"))
+	prof.bytes(11, pt)
+	prof.uint(12, 1)
+
+	// string_table comes last as the fields above add to it
+	for _, str := range strs.table {
+		prof.bytes(6, []byte(str))
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(prof); err != nil {
+		return err
+	}
+	return gz.Close()
+}
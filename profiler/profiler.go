@@ -0,0 +1,308 @@
+// Package profiler is a profiler for calc programs.
+//
+// The profiler is a hook of the virtual machine. It counts the executed
+// instructions and measures the wall time spent on them, attributing them to
+// the calc functions on the call stack. Functions are identified by their
+// entry address, and named after the name they were first called by.
+package profiler
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/paulsonkoly/calc/types/bytecode"
+	"github.com/paulsonkoly/calc/types/dbginfo"
+	"github.com/paulsonkoly/calc/vm"
+)
+
+// function is a profiled calc function.
+type function struct {
+	node int    // node is the entry address, -1 for the top level
+	name string // name is the name the function was first called by
+	file string // file is the source file of the function
+	line int    // line is the first source line of the function
+
+	located bool // located is set when the source location was looked up
+}
+
+// locate looks up the source location of f entered at s. The source location
+// is the first line of the lexical scope of the function that has a source
+// location. The builtin functions have none.
+func (f *function) locate(s vm.State) {
+	f.located = true
+
+	scopes := s.Scopes()
+	if len(scopes) < 1 || scopes[0].From != f.node {
+		return
+	}
+	scopes[0].Body(func(ip int) {
+		if loc := s.LocAt(ip); loc != nil && (f.line == 0 || loc.Line < f.line) {
+			f.file, f.line = loc.File, loc.Line
+		}
+	})
+}
+
+func (f *function) String() string {
+	if f.file == "" && f.line == 0 {
+		return f.name
+	}
+	if f.file == "" {
+		return fmt.Sprintf("%s (line %d)", f.name, f.line)
+	}
+	return fmt.Sprintf("%s (%s:%d)", f.name, f.file, f.line)
+}
+
+// sample is the profile of a call stack. The samples form the call tree, the
+// parent of a sample is the call stack of the caller.
+type sample struct {
+	f        *function
+	parent   *sample
+	children []*sample
+	instrs   int64         // instrs is the count of instructions executed
+	time     time.Duration // time is the wall time spent
+}
+
+// child is the sample of f called from smp.
+func (smp *sample) child(f *function) *sample {
+	for _, c := range smp.children {
+		if c.f == f {
+			return c
+		}
+	}
+	c := &sample{f: f, parent: smp}
+	smp.children = append(smp.children, c)
+	return c
+}
+
+// funcs are the functions on the call stack of smp, innermost first.
+func (smp *sample) funcs() []*function {
+	funcs := []*function{}
+	for ; smp != nil; smp = smp.parent {
+		funcs = append(funcs, smp.f)
+	}
+	return funcs
+}
+
+// walk calls fn with smp and all samples under it.
+func (smp *sample) walk(fn func(*sample)) {
+	fn(smp)
+	for _, c := range smp.children {
+		c.walk(fn)
+	}
+}
+
+// Type is the profiler.
+type Type struct {
+	start   time.Time
+	last    time.Time         // last is when the current sample started
+	root    *sample           // root is the sample of the top level
+	cur     *sample           // cur is the sample of the last instruction
+	funcs   map[int]*function // funcs are the functions by entry address
+	sites   []*function       // sites are the functions last called by call site address
+	prevIP  int               // prevIP is the address of the last instruction
+	prevOp  bytecode.OpCode   // prevOp is the opcode of the last instruction
+	depth   int               // depth is the call depth of the last instruction
+	callee  *function         // callee is the function called by the last instruction
+	retSite bool              // retSite is set if the last instruction returned from a profiled call
+	sbuf    []int             // sbuf is reused for the call sites
+}
+
+// New creates a profiler.
+func New() *Type {
+	top := &function{node: -1, name: dbginfo.TopLevel, located: true}
+	return &Type{
+		root:  &sample{f: top},
+		funcs: map[int]*function{-1: top},
+	}
+}
+
+// Step implements vm.Hook.
+func (p *Type) Step(s vm.State) {
+	depth := s.Depth()
+
+	smp := p.cur
+	switch {
+	case smp == nil:
+		smp = p.sample(s)
+	case p.prevOp == bytecode.CALL && depth == p.depth+1 && p.callee != nil:
+		smp = smp.child(p.callee)
+	case p.prevOp == bytecode.TAIL && depth == p.depth && p.callee != nil && smp.parent != nil:
+		// the tail call replaces the caller
+		smp = smp.parent.child(p.callee)
+	case p.prevOp == bytecode.RET && depth == p.depth-1 && p.retSite && smp.parent != nil:
+		smp = smp.parent
+	case !p.sameStack(s, depth):
+		smp = p.sample(s)
+	}
+
+	if smp != p.cur {
+		now := time.Now()
+		if p.cur != nil {
+			p.cur.time += now.Sub(p.last)
+		}
+		if p.start.IsZero() {
+			p.start = now
+		}
+		p.last = now
+		p.cur = smp
+	}
+
+	if !smp.f.located && s.IP == smp.f.node {
+		smp.f.locate(s)
+	}
+
+	smp.instrs++
+	p.prevIP, p.prevOp, p.depth, p.callee = s.IP, s.Instr.OpCode(), depth, nil
+
+	switch p.prevOp {
+	case bytecode.CALL, bytecode.TAIL:
+		p.call(s)
+	case bytecode.RET:
+		site, ok := s.CallSite()
+		p.retSite = ok && p.site(site) != nil
+	}
+}
+
+// sameStack determines whether the call stack at s is the same as at the last
+// instruction. The call stack changes on calls, returns and context switches,
+// and when a raised error is caught, continuing the execution at the error
+// handler.
+func (p *Type) sameStack(s vm.State, depth int) bool {
+	if depth != p.depth {
+		return false
+	}
+	switch p.prevOp {
+	case bytecode.JMP, bytecode.JMPF, bytecode.JMPT:
+		return true
+	case bytecode.CCONT, bytecode.DCONT, bytecode.SCONT, bytecode.YIELD:
+		return false
+	}
+	return s.IP == p.prevIP+1
+}
+
+// sample is the sample of the call stack at s.
+func (p *Type) sample(s vm.State) *sample {
+	p.sbuf = s.CallSites(p.sbuf[:0])
+
+	smp := p.root
+	for i := len(p.sbuf) - 1; i >= 0; i-- {
+		if f := p.site(p.sbuf[i]); f != nil {
+			smp = smp.child(f)
+		}
+	}
+	return smp
+}
+
+// site is the function last called at the call site address ip, nil if the
+// call isn't profiled.
+func (p *Type) site(ip int) *function {
+	if ip < 0 || ip >= len(p.sites) {
+		return nil
+	}
+	return p.sites[ip]
+}
+
+// call records the function called at s.
+func (p *Type) call(s vm.State) {
+	fv, ok := s.Operand(0)
+	if !ok {
+		return
+	}
+	fn, ok := fv.ToFunction()
+	if !ok || fn.Native != nil {
+		return
+	}
+
+	f, ok := p.funcs[fn.Node]
+	if !ok {
+		call, _ := s.Call()
+		f = &function{node: fn.Node, name: call.Name}
+		p.funcs[fn.Node] = f
+	}
+	if s.IP >= len(p.sites) {
+		p.sites = append(p.sites, make([]*function, s.IP+1-len(p.sites))...)
+	}
+	p.sites[s.IP] = f
+	p.callee = f
+}
+
+// Stop implements vm.Stopper. It attributes the time since the last
+// instruction to it, the time until the next run isn't profiled.
+func (p *Type) Stop() {
+	if p.cur != nil {
+		now := time.Now()
+		p.cur.time += now.Sub(p.last)
+		p.last = now
+		p.cur = nil
+	}
+}
+
+// stat is the profile of a function.
+type stat struct {
+	f                 *function
+	instrs, cumInstrs int64
+	time, cumTime     time.Duration
+}
+
+// stats are the profiles of the functions, by exclusive time descending, and
+// the profile of the whole program.
+func (p *Type) stats() ([]stat, stat) {
+	byFunc := map[*function]*stat{}
+	total := stat{}
+	p.root.walk(func(smp *sample) {
+		total.instrs += smp.instrs
+		total.time += smp.time
+
+		funcs := smp.funcs()
+		for i, f := range funcs {
+			st, ok := byFunc[f]
+			if !ok {
+				st = &stat{f: f}
+				byFunc[f] = st
+			}
+			if i == 0 {
+				st.instrs += smp.instrs
+				st.time += smp.time
+			}
+			// recursive calls count once
+			if !slices.Contains(funcs[:i], f) {
+				st.cumInstrs += smp.instrs
+				st.cumTime += smp.time
+			}
+		}
+	})
+
+	stats := make([]stat, 0, len(byFunc))
+	for _, st := range byFunc {
+		stats = append(stats, *st)
+	}
+	slices.SortFunc(stats, func(a, b stat) int {
+		if c := cmp.Compare(b.time, a.time); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.f.node, b.f.node)
+	})
+	return stats, total
+}
+
+// WriteTable writes the table of the profiled functions to w, by exclusive
+// time descending.
+func (p *Type) WriteTable(w io.Writer) {
+	stats, total := p.stats()
+
+	pct := func(d time.Duration) float64 {
+		if total.time == 0 {
+			return 0
+		}
+		return 100 * float64(d) / float64(total.time)
+	}
+
+	fmt.Fprintf(w, "%12s %12s %12s %7s %12s %7s  %s\n", "instrs", "cum instrs", "time", "time%", "cum time", "cum%", "function")
+	for _, st := range stats {
+		fmt.Fprintf(w, "%12d %12d %12v %6.2f%% %12v %6.2f%%  %s\n",
+			st.instrs, st.cumInstrs, st.time, pct(st.time), st.cumTime, pct(st.cumTime), st.f)
+	}
+}
@@ -0,0 +1,103 @@
+package profiler_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/paulsonkoly/calc"
+	"github.com/paulsonkoly/calc/profiler"
+	"github.com/paulsonkoly/calc/vm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const program = `sq = (x) -> x * x
+sum = (n) -> {
+  s = 0
+  for i <- fromto(0, n) s = s + sq(i)
+  s
+}
+fact = (n) -> if n < 2 1 else n * fact(n - 1)
+sum(5) + fact(4)`
+
+// row is a row of the profile table.
+type row struct {
+	instrs, cumInstrs int
+}
+
+// table is the profile table of p by function name.
+func table(t *testing.T, p *profiler.Type) map[string]row {
+	var b strings.Builder
+	p.WriteTable(&b)
+
+	rows := map[string]row{}
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		require.GreaterOrEqual(t, len(fields), 7)
+		instrs, err := strconv.Atoi(fields[0])
+		require.NoError(t, err)
+		cumInstrs, err := strconv.Atoi(fields[1])
+		require.NoError(t, err)
+		// the rows are by function name, ignoring the source location
+		name, _, _ := strings.Cut(strings.Join(fields[6:], " "), " (")
+		rows[name] = row{instrs, cumInstrs}
+	}
+	return rows
+}
+
+func TestProfiler(t *testing.T) {
+	var trace strings.Builder
+
+	p := profiler.New()
+	i := calc.New(calc.WithHook(p), calc.WithTrace(&trace, vm.TraceFilter{}))
+
+	_, err := i.Eval(program)
+	require.NoError(t, err)
+
+	rows := table(t, p)
+
+	top, ok := rows["top level"]
+	require.True(t, ok)
+	assert.Equal(t, strings.Count(trace.String(), "\n"), top.cumInstrs, "every instruction is counted")
+
+	sq, ok := rows["sq"]
+	require.True(t, ok)
+	assert.Equal(t, sq.instrs, sq.cumInstrs)
+
+	sum, ok := rows["sum"]
+	require.True(t, ok)
+	fromto, ok := rows["fromto"]
+	require.True(t, ok)
+	assert.Equal(t, sum.instrs+sq.instrs+fromto.instrs, sum.cumInstrs)
+
+	fact, ok := rows["fact"]
+	require.True(t, ok)
+	assert.Equal(t, fact.instrs, fact.cumInstrs, "recursive calls count once")
+
+	assert.Equal(t, top.instrs+sum.cumInstrs+fact.cumInstrs, top.cumInstrs)
+}
+
+func TestWriteProfile(t *testing.T) {
+	p := profiler.New()
+	i := calc.New(calc.WithHook(p))
+
+	_, err := i.Eval(program)
+	require.NoError(t, err)
+
+	var b bytes.Buffer
+	require.NoError(t, p.WriteProfile(&b))
+
+	r, err := gzip.NewReader(&b)
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+
+	for _, s := range []string{"instructions", "nanoseconds", "top level", "sq", "sum", "fact", "fromto"} {
+		assert.Contains(t, string(data), s)
+	}
+}
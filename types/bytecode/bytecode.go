@@ -44,6 +44,13 @@ const (
 	AddrDS   // data segment
 )
 
+// Closure variable address layout. A closure variable address encodes the
+// lexical scope depth of the variable and its index in the frame of that scope.
+const (
+	ClsIxWidth    = 10
+	ClsDepthWidth = SrcChanWidth - ClsIxWidth - 1
+)
+
 // OpCode is the instruction code.
 type OpCode uint64
 
@@ -87,12 +94,14 @@ const (
 
 	LEN // LEN pushes the length of src0
 	ARR // ARR pushes the src0 + [src1]
+	MAP // MAP pushes src2 + {src1: src0}
 
 	JMP  // JMP jumps relative to ip + src0
 	JMPF // JMPF jumps relative to ip+src1 if src0 is false
 	JMPT // JMPT jumps relative to ip+src1 if src0 is true
 	FUNC // FUNC pushes a function value sourced from src0 while setting the closure frame in it to current top
 	CALL // CALL calls src0 with argument cnt src1
+	TAIL // TAIL calls src0 with argument cnt src1 in the frame of the current call
 	RET  // RET returns from a function call pushing src0 after rolling back the stack
 
 	// CCONT jumps relative to ip + src0 in current context, and switches to a
@@ -108,11 +117,25 @@ const (
 	// its parent, and pushes src0 in the new context.
 	YIELD
 
+	// TRY installs an error handler at ip + src0 in the current context. src1 is
+	// the first context id allocated in the try block.
+	TRY
+	UNTRY // UNTRY removes the last src0 error handlers of the current context
+	RAISE // RAISE raises the error src0, or an error with payload src0
+
 	READ  // READ builtin
 	WRITE // WRITE builtin
-	ATON  // ATON converts src0 to a number and pushes it
-	TOA   // TOA converts src0 to a string and pushes it
 	EXIT  // EXIT terminates the program
+	KEYS  // KEYS pushes the array of keys of the map src0
+
+	ERROR // ERROR pushes an error with payload src0
+
+	// MODULE starts loading the module from path src0 named src1, code runs in
+	// the module's global frame until ENDMODULE.
+	MODULE
+	ENDMODULE // ENDMODULE finishes loading the module
+	IMPORT    // IMPORT pushes the module loaded from path src0
+	MEMBER    // MEMBER pushes the global variable named src0 of the module src1
 
 	PUSHTMP = OpCode(TempFlag | PUSH) // PUSHTMP pushes the temp register
 
@@ -182,6 +205,29 @@ func EncodeSrc(srcsel int, src uint64, srcAddr int) Type {
 	}
 }
 
+// ReplaceSrc replaces the srcsel operand of the instruction with src and
+// srcAddr, as encoded by EncodeSrc.
+func (b Type) ReplaceSrc(srcsel int, src uint64, srcAddr int) Type {
+	return b&^EncodeSrc(srcsel, (1<<(Src0Hi-Src0Lo+1))-1, -1) | EncodeSrc(srcsel, src, srcAddr)
+}
+
+// EncodeCls encodes a closure variable address.
+//
+// depth is the number of lexical scopes between the variable and the scope it
+// is defined in, starting from 1 for the immediately enclosing scope. ix is the
+// index in the frame of the defining scope.
+func EncodeCls(depth, ix int) int {
+	if depth < 1 || depth >= (1<<ClsDepthWidth) || ix < 0 || ix >= (1<<ClsIxWidth) {
+		panic("closure variable out of range")
+	}
+	return depth<<ClsIxWidth | ix
+}
+
+// DecodeCls decodes a closure variable address into depth and index.
+func DecodeCls(addr int) (depth, ix int) {
+	return addr >> ClsIxWidth, addr & ((1 << ClsIxWidth) - 1)
+}
+
 // String provides Stringer implementation for Type.
 func (b Type) String() string {
 	oc := b.OpCode()
@@ -197,7 +243,8 @@ func srcString(src uint64, addr int) string {
 	case AddrDS:
 		return fmt.Sprintf("DS[%d] ", addr)
 	case AddrCls:
-		return fmt.Sprintf("CLS[%d] ", addr)
+		depth, ix := DecodeCls(addr)
+		return fmt.Sprintf("CLS[%d:%d] ", depth, ix)
 	case AddrLcl:
 		return fmt.Sprintf("LCL[%d] ", addr)
 	case AddrGbl:
@@ -260,6 +307,18 @@ func (b Type) Src2Addr() int {
 	return convImm((b >> Src2AddrLo) & ((1 << (Src2AddrHi - Src2AddrLo + 1)) - 1))
 }
 
+// JumpTarget is the address the instruction at ip jumps to, if it is a jump,
+// a context switch or an error handler installation.
+func (b Type) JumpTarget(ip int) (int, bool) {
+	switch b.OpCode() {
+	case JMP, CCONT, TRY:
+		return ip + b.Src0Addr(), true
+	case JMPF, JMPT:
+		return ip + b.Src1Addr(), true
+	}
+	return 0, false
+}
+
 func convImm(n Type) int {
 	if n&(1<<(SrcChanWidth-1)) != 0 {
 		n |= SrcChanSignExtend
@@ -34,22 +34,31 @@ func _() {
 	_ = x[IX2-23]
 	_ = x[LEN-24]
 	_ = x[ARR-25]
-	_ = x[JMP-26]
-	_ = x[JMPF-27]
-	_ = x[JMPT-28]
-	_ = x[FUNC-29]
-	_ = x[CALL-30]
-	_ = x[RET-31]
-	_ = x[CCONT-32]
-	_ = x[DCONT-33]
-	_ = x[RCONT-34]
-	_ = x[SCONT-35]
-	_ = x[YIELD-36]
-	_ = x[READ-37]
-	_ = x[WRITE-38]
-	_ = x[ATON-39]
-	_ = x[TOA-40]
-	_ = x[EXIT-41]
+	_ = x[MAP-26]
+	_ = x[JMP-27]
+	_ = x[JMPF-28]
+	_ = x[JMPT-29]
+	_ = x[FUNC-30]
+	_ = x[CALL-31]
+	_ = x[TAIL-32]
+	_ = x[RET-33]
+	_ = x[CCONT-34]
+	_ = x[DCONT-35]
+	_ = x[RCONT-36]
+	_ = x[SCONT-37]
+	_ = x[YIELD-38]
+	_ = x[TRY-39]
+	_ = x[UNTRY-40]
+	_ = x[RAISE-41]
+	_ = x[READ-42]
+	_ = x[WRITE-43]
+	_ = x[EXIT-44]
+	_ = x[KEYS-45]
+	_ = x[ERROR-46]
+	_ = x[MODULE-47]
+	_ = x[ENDMODULE-48]
+	_ = x[IMPORT-49]
+	_ = x[MEMBER-50]
 	_ = x[PUSHTMP-65]
 	_ = x[ADDTMP-68]
 	_ = x[SUBTMP-69]
@@ -72,7 +81,7 @@ func _() {
 }
 
 const (
-	_OpCode_name_0 = "NOPPUSHPOPMOVADDSUBMULDIVMODINCNOTANDORLTGTLEGEEQNELSHRSHFLIPIX1IX2LENARRJMPJMPFJMPTFUNCCALLRETCCONTDCONTRCONTSCONTYIELDREADWRITEATONTOAEXIT"
+	_OpCode_name_0 = "NOPPUSHPOPMOVADDSUBMULDIVMODINCNOTANDORLTGTLEGEEQNELSHRSHFLIPIX1IX2LENARRMAPJMPJMPFJMPTFUNCCALLTAILRETCCONTDCONTRCONTSCONTYIELDTRYUNTRYRAISEREADWRITEEXITKEYSERRORMODULEENDMODULEIMPORTMEMBER"
 	_OpCode_name_1 = "PUSHTMP"
 	_OpCode_name_2 = "ADDTMPSUBTMPMULTMPDIVTMPMODTMP"
 	_OpCode_name_3 = "NOTTMPANDTMPORTMPLTTMPGTTMPLETMPGETMPEQTMPNETMPLSHTMPRSHTMPFLIPTMP"
@@ -80,14 +89,14 @@ const (
 )
 
 var (
-	_OpCode_index_0 = [...]uint8{0, 3, 7, 10, 13, 16, 19, 22, 25, 28, 31, 34, 37, 39, 41, 43, 45, 47, 49, 51, 54, 57, 61, 64, 67, 70, 73, 76, 80, 84, 88, 92, 95, 100, 105, 110, 115, 120, 124, 129, 133, 136, 140}
+	_OpCode_index_0 = [...]uint8{0, 3, 7, 10, 13, 16, 19, 22, 25, 28, 31, 34, 37, 39, 41, 43, 45, 47, 49, 51, 54, 57, 61, 64, 67, 70, 73, 76, 79, 83, 87, 91, 95, 99, 102, 107, 112, 117, 122, 127, 130, 135, 140, 144, 149, 153, 157, 162, 168, 177, 183, 189}
 	_OpCode_index_2 = [...]uint8{0, 6, 12, 18, 24, 30}
 	_OpCode_index_3 = [...]uint8{0, 6, 12, 17, 22, 27, 32, 37, 42, 47, 53, 59, 66}
 )
 
 func (i OpCode) String() string {
 	switch {
-	case i <= 41:
+	case i <= 50:
 		return _OpCode_name_0[_OpCode_index_0[i]:_OpCode_index_0[i+1]]
 	case i == 65:
 		return _OpCode_name_1
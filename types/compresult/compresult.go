@@ -12,4 +12,13 @@ type Type struct {
 	CS  *[]bytecode.Type // Code segment
 	DS  *[]value.Type    // Data segment
 	Dbg *dbginfo.Type    // Debug info
+
+	// Lines maps the instructions to the source code they are compiled from
+	Lines *dbginfo.Lines
+
+	// Scopes are the lexical scopes of the functions, naming their variables
+	Scopes *dbginfo.Scopes
+
+	// Modules are the imported modules by path, false while the module is loading
+	Modules *map[string]bool
 }
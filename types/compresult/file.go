@@ -0,0 +1,591 @@
+package compresult
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"slices"
+	"strings"
+
+	"github.com/paulsonkoly/calc/types/bytecode"
+	"github.com/paulsonkoly/calc/types/dbginfo"
+	"github.com/paulsonkoly/calc/types/value"
+)
+
+// Version is the version of the compiled file format. It changes whenever the
+// format or the instruction set changes, files of other versions are rejected.
+const Version = 2
+
+// magic starts a compiled file.
+const magic = "calcb"
+
+// Compiled file errors.
+var (
+	ErrFormat  = errors.New("not a compiled calc file")
+	ErrVersion = errors.New("compiled calc file version mismatch")
+	ErrInvalid = errors.New("invalid compiled calc file")
+)
+
+// Run is a piece of the compiled code run at once, the code of a statement or
+// the start or the end of a module. A runtime error stops the run, the
+// execution continues with the run of index OnError.
+//
+// A runtime error in a module skips the rest of the module to the run ending
+// it, and the module failing to load is a runtime error of the run ending it.
+type Run struct {
+	End     int    // End is the address following the code of the run
+	OnError int    // OnError is the index of the run continuing after a runtime error
+	Module  string // Module is the path of the module, set if the run ends a module
+}
+
+// value tags in the data segment
+const (
+	tagNil = iota
+	tagInt
+	tagBig
+	tagFloat
+	tagString
+	tagBool
+	tagArray
+	tagMap
+	tagFunction
+	tagNative
+	tagError
+)
+
+// maxNesting is the maximal depth of the values nested in arrays, maps and
+// errors in the data segment.
+const maxNesting = 1000
+
+// encoder is a compiled file being encoded.
+type encoder []byte
+
+func (e *encoder) uint(v int) { *e = binary.AppendUvarint(*e, uint64(v)) }
+
+func (e *encoder) int(v int) { *e = binary.AppendVarint(*e, int64(v)) }
+
+func (e *encoder) string(s string) {
+	e.uint(len(s))
+	*e = append(*e, s...)
+}
+
+func (e *encoder) bool(b bool) {
+	if b {
+		*e = append(*e, 1)
+	} else {
+		*e = append(*e, 0)
+	}
+}
+
+func (e *encoder) value(v value.Type, depth int) error {
+	if depth > maxNesting {
+		return fmt.Errorf("can't encode values nested deeper than %d", maxNesting)
+	}
+	if v.IsNil() {
+		e.uint(tagNil)
+		return nil
+	}
+	if i, ok := v.ToInt(); ok {
+		e.uint(tagInt)
+		e.int(i)
+		return nil
+	}
+	if n, ok := v.ToBigInt(); ok {
+		e.uint(tagBig)
+		e.string(n.Text(16))
+		return nil
+	}
+	if f, ok := v.ToFloat(); ok {
+		e.uint(tagFloat)
+		*e = binary.LittleEndian.AppendUint64(*e, math.Float64bits(f))
+		return nil
+	}
+	if s, ok := v.ToString(); ok {
+		e.uint(tagString)
+		e.string(s)
+		return nil
+	}
+	if b, ok := v.ToBool(); ok {
+		e.uint(tagBool)
+		e.bool(b)
+		return nil
+	}
+	if a, ok := v.ToArray(); ok {
+		e.uint(tagArray)
+		e.uint(len(a))
+		for _, elem := range a {
+			if err := e.value(elem, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if keys, values, ok := v.ToMap(); ok {
+		e.uint(tagMap)
+		e.uint(len(keys))
+		for i := range keys {
+			if err := e.value(keys[i], depth+1); err != nil {
+				return err
+			}
+			if err := e.value(values[i], depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if f, ok := v.ToFunction(); ok {
+		switch {
+		case f.Native != nil:
+			e.uint(tagNative)
+			e.string(f.Native.Name)
+			e.uint(f.Native.Arity)
+		case f.Env != nil:
+			return fmt.Errorf("can't encode closure %s", v)
+		default:
+			e.uint(tagFunction)
+			e.uint(f.Node)
+			e.uint(f.ParamCnt)
+			e.uint(f.LocalCnt)
+		}
+		return nil
+	}
+	if ed, ok := v.ToError(); ok {
+		e.uint(tagError)
+		e.string(ed.Kind)
+		e.string(ed.Message)
+		return e.value(ed.Payload, depth+1)
+	}
+	return fmt.Errorf("can't encode %s", v)
+}
+
+// Write writes the compilation result cr, with the runs of its code, to w in
+// the compiled file format.
+//
+// The file holds the code segment, the data segment and the debug info. The
+// native functions are referred to by name, the modules aren't written as the
+// code of the imported modules is part of the code segment.
+func Write(w io.Writer, cr Type, runs []Run) error {
+	e := encoder(magic)
+	e.uint(Version)
+
+	e.uint(len(*cr.CS))
+	for _, instr := range *cr.CS {
+		e = binary.LittleEndian.AppendUint64(e, uint64(instr))
+	}
+
+	e.uint(len(*cr.DS))
+	for _, v := range *cr.DS {
+		if err := e.value(v, 0); err != nil {
+			return err
+		}
+	}
+
+	ips := make([]int, 0, len(*cr.Dbg))
+	for ip := range *cr.Dbg {
+		ips = append(ips, ip)
+	}
+	slices.Sort(ips)
+	e.uint(len(ips))
+	for _, ip := range ips {
+		call := (*cr.Dbg)[ip]
+		e.uint(ip)
+		e.string(call.Name)
+		e.uint(call.ArgCnt)
+	}
+
+	// the spans are written after their sources
+	type ipSpan struct {
+		ip   int
+		span dbginfo.Span
+	}
+	sources := cr.Lines.Sources()
+	spans := make([][]ipSpan, len(sources))
+	cr.Lines.Each(func(ip, src int, span dbginfo.Span) { spans[src] = append(spans[src], ipSpan{ip, span}) })
+	e.uint(len(sources))
+	for i, src := range sources {
+		e.string(src.File)
+		e.uint(src.Line)
+		e.string(src.Text)
+		slices.SortFunc(spans[i], func(a, b ipSpan) int { return cmp.Compare(a.ip, b.ip) })
+		e.uint(len(spans[i]))
+		for _, s := range spans[i] {
+			e.uint(s.ip)
+			e.uint(s.span.From)
+			e.uint(s.span.To)
+		}
+	}
+
+	e.uint(len(*cr.Scopes))
+	for _, s := range *cr.Scopes {
+		e.uint(s.From)
+		e.uint(s.To)
+		e.uint(len(s.Locals))
+		for _, l := range s.Locals {
+			e.string(l)
+		}
+	}
+
+	e.uint(len(runs))
+	for _, r := range runs {
+		e.uint(r.End)
+		e.uint(r.OnError)
+		e.string(r.Module)
+	}
+
+	_, err := w.Write(e)
+	return err
+}
+
+// decoder is a compiled file being decoded. The first error is kept, the
+// values decoded after it are zero.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) fail(format string, args ...any) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %s", ErrInvalid, fmt.Sprintf(format, args...))
+	}
+}
+
+func (d *decoder) uint() int {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 || v > math.MaxInt32 {
+		d.fail("bad number")
+		return 0
+	}
+	d.b = d.b[n:]
+	return int(v)
+}
+
+func (d *decoder) int() int {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.fail("bad number")
+		return 0
+	}
+	d.b = d.b[n:]
+	return int(v)
+}
+
+// count is the length of a list of items of at least size bytes each.
+func (d *decoder) count(size int) int {
+	n := d.uint()
+	if n > len(d.b)/size {
+		d.fail("truncated")
+		return 0
+	}
+	return n
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.b) {
+		d.fail("truncated")
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decoder) uint64() uint64 {
+	if b := d.bytes(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *decoder) string() string { return string(d.bytes(d.count(1))) }
+
+func (d *decoder) bool() bool {
+	b := d.bytes(1)
+	if b != nil && b[0] > 1 {
+		d.fail("bad bool")
+	}
+	return b != nil && b[0] == 1
+}
+
+// value decodes a value nested depth deep in the data segment. Only the values
+// of the data segment can be functions, the functions in arrays, maps and
+// errors wouldn't have their closures set up.
+func (d *decoder) value(natives func(name string) (value.Type, bool), depth int) value.Type {
+	if depth > maxNesting {
+		d.fail("values nested deeper than %d", maxNesting)
+		return value.Nil
+	}
+	switch tag := d.uint(); tag {
+	case tagNil:
+		return value.Nil
+	case tagInt:
+		return value.NewInt(d.int())
+	case tagBig:
+		s := d.string()
+		n, ok := new(big.Int).SetString(s, 16)
+		if !ok {
+			d.fail("bad integer %q", s)
+			return value.Nil
+		}
+		return value.NewBigInt(n)
+	case tagFloat:
+		return value.NewFloat(math.Float64frombits(d.uint64()))
+	case tagString:
+		return value.NewString(d.string())
+	case tagBool:
+		return value.NewBool(d.bool())
+	case tagArray:
+		a := make([]value.Type, d.count(1))
+		for i := range a {
+			a[i] = d.value(natives, depth+1)
+		}
+		return value.NewArray(a)
+	case tagMap:
+		n := d.count(2)
+		keys := make([]value.Type, n)
+		values := make([]value.Type, n)
+		for i := range n {
+			keys[i] = d.value(natives, depth+1)
+			values[i] = d.value(natives, depth+1)
+		}
+		m, err := value.NewMap(keys, values)
+		if err != nil && d.err == nil {
+			d.fail("bad map: %v", err)
+		}
+		return m
+	case tagFunction:
+		node := d.uint()
+		paramCnt := d.uint()
+		localCnt := d.uint()
+		if depth > 0 {
+			d.fail("function nested in a value")
+			return value.Nil
+		}
+		return value.NewFunction(node, nil, paramCnt, localCnt)
+	case tagNative:
+		name := d.string()
+		arity := d.uint()
+		if d.err != nil {
+			return value.Nil
+		}
+		v, ok := natives(name)
+		if !ok {
+			d.fail("unknown native function %s", name)
+			return value.Nil
+		}
+		if f, _ := v.ToFunction(); f.ParamCnt != arity {
+			d.fail("native function %s has %d parameters instead of %d", name, f.ParamCnt, arity)
+		}
+		return v
+	case tagError:
+		kind := d.string()
+		message := d.string()
+		return value.NewError(kind, message, d.value(natives, depth+1))
+	default:
+		d.fail("bad value tag %d", tag)
+		return value.Nil
+	}
+}
+
+// Read reads a compilation result with the runs of its code from r in the
+// compiled file format. natives looks up the native functions by name.
+//
+// The file is validated, the addresses in the code and the debug info have to
+// be in range, the jumps in the function bodies and the variables in the
+// frames of the enclosing functions. A file of another version is an
+// ErrVersion error.
+func Read(r io.Reader, natives func(name string) (value.Type, bool)) (Type, []Run, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return Type{}, nil, err
+	}
+	if !strings.HasPrefix(string(b), magic) {
+		return Type{}, nil, ErrFormat
+	}
+	d := &decoder{b: b[len(magic):]}
+
+	if v := d.uint(); d.err == nil && v != Version {
+		return Type{}, nil, fmt.Errorf("%w: file version %d, supported version %d, recompile the source", ErrVersion, v, Version)
+	}
+
+	cs := make([]bytecode.Type, d.count(8))
+	for i := range cs {
+		cs[i] = bytecode.Type(d.uint64())
+	}
+
+	ds := make([]value.Type, d.count(1))
+	for i := range ds {
+		ds[i] = d.value(natives, 0)
+	}
+
+	dbg := make(dbginfo.Type)
+	for range d.count(3) {
+		ip := d.uint()
+		dbg[ip] = dbginfo.Call{Name: d.string(), ArgCnt: d.uint()}
+	}
+
+	lines := dbginfo.Lines{}
+	for range d.count(4) {
+		lines.AddSource(dbginfo.Source{File: d.string(), Line: d.uint(), Text: d.string()})
+		for range d.count(3) {
+			ip := d.uint()
+			lines.Add(ip, dbginfo.Span{From: d.uint(), To: d.uint()})
+		}
+	}
+
+	scopes := make(dbginfo.Scopes, d.count(3))
+	for i := range scopes {
+		scopes[i] = dbginfo.Scope{From: d.uint(), To: d.uint(), Locals: make([]string, d.count(1))}
+		for j := range scopes[i].Locals {
+			scopes[i].Locals[j] = d.string()
+		}
+	}
+
+	runs := make([]Run, d.count(3))
+	for i := range runs {
+		runs[i] = Run{End: d.uint(), OnError: d.uint(), Module: d.string()}
+	}
+
+	if d.err == nil && len(d.b) > 0 {
+		d.fail("trailing data")
+	}
+	if d.err != nil {
+		return Type{}, nil, d.err
+	}
+
+	modules := make(map[string]bool)
+	cr := Type{CS: &cs, DS: &ds, Dbg: &dbg, Lines: &lines, Scopes: &scopes, Modules: &modules}
+	if err := validate(cr, runs); err != nil {
+		return Type{}, nil, err
+	}
+	return cr, runs, nil
+}
+
+// validate checks that the addresses in cr and runs are in range. The
+// function bodies have to nest, the jumps have to stay in the function body
+// and the local and closure variables have to be in the frames of the
+// enclosing functions.
+func validate(cr Type, runs []Run) error {
+	cs, ds := *cr.CS, *cr.DS
+	scopes := *cr.Scopes
+
+	sorted := slices.Clone(scopes)
+	slices.SortFunc(sorted, func(a, b dbginfo.Scope) int { return cmp.Or(cmp.Compare(a.From, b.From), cmp.Compare(b.To, a.To)) })
+	open := []dbginfo.Scope{}
+	for i, s := range sorted {
+		if s.From >= s.To || s.To > len(cs) {
+			return fmt.Errorf("%w: scope %d-%d out of range", ErrInvalid, s.From, s.To)
+		}
+		if i > 0 && sorted[i-1].From == s.From {
+			return fmt.Errorf("%w: scopes %d-%d and %d-%d start at the same address", ErrInvalid, sorted[i-1].From, sorted[i-1].To, s.From, s.To)
+		}
+		for len(open) > 0 && open[len(open)-1].To <= s.From {
+			open = open[:len(open)-1]
+		}
+		if len(open) > 0 && open[len(open)-1].To < s.To {
+			o := open[len(open)-1]
+			return fmt.Errorf("%w: scopes %d-%d and %d-%d overlap", ErrInvalid, o.From, o.To, s.From, s.To)
+		}
+		open = append(open, s)
+	}
+
+	for i, v := range ds {
+		if f, ok := v.ToFunction(); ok && f.Native == nil {
+			if f.Node >= len(cs) {
+				return fmt.Errorf("%w: function address %d out of range in data segment %d", ErrInvalid, f.Node, i)
+			}
+			chain := scopes.Lookup(f.Node)
+			if len(chain) == 0 || chain[0].From != f.Node || len(chain[0].Locals) != f.LocalCnt || f.ParamCnt > f.LocalCnt {
+				return fmt.Errorf("%w: function at %d doesn't match its scope in data segment %d", ErrInvalid, f.Node, i)
+			}
+		}
+	}
+
+	// body is the address of the function body enclosing the chain of scopes,
+	// -1 outside of functions
+	body := func(chain []dbginfo.Scope) int {
+		if len(chain) == 0 {
+			return -1
+		}
+		return chain[0].From
+	}
+
+	for ip, instr := range cs {
+		op := instr.OpCode()
+		if strings.HasPrefix(op.String(), "OpCode(") {
+			return fmt.Errorf("%w: unknown opcode %d at %d", ErrInvalid, op, ip)
+		}
+
+		chain := scopes.Lookup(ip)
+
+		srcs := [...]struct {
+			src  uint64
+			addr int
+		}{{instr.Src0(), instr.Src0Addr()}, {instr.Src1(), instr.Src1Addr()}, {instr.Src2(), instr.Src2Addr()}}
+		for sel, s := range srcs {
+			switch s.src {
+			case bytecode.AddrDS:
+				if s.addr < 0 || s.addr >= len(ds) {
+					return fmt.Errorf("%w: data segment address %d out of range at %d", ErrInvalid, s.addr, ip)
+				}
+				// the function values get their closures from FUNC, in the scope
+				// enclosing the function
+				if f, ok := ds[s.addr].ToFunction(); ok && f.Native == nil {
+					if op != bytecode.FUNC || sel != 0 || body(scopes.Lookup(f.Node)[1:]) != body(chain) {
+						return fmt.Errorf("%w: function at %d used out of its scope at %d", ErrInvalid, f.Node, ip)
+					}
+				}
+			case bytecode.AddrGbl:
+				if s.addr < 0 || s.addr >= len(ds) {
+					return fmt.Errorf("%w: data segment address %d out of range at %d", ErrInvalid, s.addr, ip)
+				}
+				if _, ok := ds[s.addr].ToString(); !ok {
+					return fmt.Errorf("%w: global variable name %s isn't a string at %d", ErrInvalid, ds[s.addr], ip)
+				}
+			case bytecode.AddrLcl:
+				if len(chain) == 0 || s.addr < 0 || s.addr >= len(chain[0].Locals) {
+					return fmt.Errorf("%w: local variable %d out of range at %d", ErrInvalid, s.addr, ip)
+				}
+			case bytecode.AddrCls:
+				depth, ix := bytecode.DecodeCls(s.addr)
+				if depth < 1 || depth >= len(chain) || ix >= len(chain[depth].Locals) {
+					return fmt.Errorf("%w: closure variable %d:%d out of range at %d", ErrInvalid, depth, ix, ip)
+				}
+			}
+		}
+
+		if target, ok := instr.JumpTarget(ip); ok {
+			if target < 0 || target > len(cs) {
+				return fmt.Errorf("%w: jump target %d out of range at %d", ErrInvalid, target, ip)
+			}
+			if body(scopes.Lookup(target)) != body(chain) {
+				return fmt.Errorf("%w: jump target %d out of the function at %d", ErrInvalid, target, ip)
+			}
+		}
+	}
+
+	end := 0
+	for i, r := range runs {
+		if r.End < end || r.End > len(cs) {
+			return fmt.Errorf("%w: run %d ends at %d out of range", ErrInvalid, i, r.End)
+		}
+		if r.OnError <= i || r.OnError > len(runs) {
+			return fmt.Errorf("%w: run %d continues at %d after errors", ErrInvalid, i, r.OnError)
+		}
+		end = r.End
+	}
+
+	return nil
+}
@@ -2,11 +2,27 @@
 // compilation time useful at runtime.
 package dbginfo
 
+import "fmt"
+
 // Type describes a function call for stack dumping.
 type Call struct {
-	Name   string // variable holding the function when called
+	Name   string // Name describes the called function, the variable holding it when named
 	ArgCnt int    // number of function arguments
 }
 
 // Type maps instruction pointer to Call.
 type Type map[int]Call
+
+// Pos is a position in the source code.
+type Pos struct {
+	File string // File is the source file, empty for code not read from a file
+	Line int    // Line is the 1 based line number
+	Col  int    // Col is the 1 based column number
+}
+
+func (p Pos) String() string {
+	if p.File == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Col)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+}
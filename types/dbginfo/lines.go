@@ -0,0 +1,136 @@
+package dbginfo
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Span is a span of source code, From and To are byte offsets in the source,
+// To is exclusive.
+type Span struct {
+	From int
+	To   int
+}
+
+// Source is a piece of source code compiled at once.
+type Source struct {
+	File string // File is the source file, empty for code not read from a file
+	Line int    // Line is the line number of the first line of Text
+	Text string // Text is the source code
+}
+
+// srcSpan is a span in a source.
+type srcSpan struct {
+	src  int // src is the index of the source
+	span Span
+}
+
+// Lines maps instruction pointers to source spans.
+type Lines struct {
+	sources []Source
+	spans   map[int]srcSpan
+}
+
+// AddSource adds src to l, the spans added after this are in src.
+func (l *Lines) AddSource(src Source) { l.sources = append(l.sources, src) }
+
+// Add maps ip to span in the last source added.
+func (l *Lines) Add(ip int, span Span) {
+	if len(l.sources) == 0 {
+		return
+	}
+	if l.spans == nil {
+		l.spans = make(map[int]srcSpan)
+	}
+	l.spans[ip] = srcSpan{src: len(l.sources) - 1, span: span}
+}
+
+// Sources are the sources added to l.
+func (l *Lines) Sources() []Source { return l.sources }
+
+// Each calls fn with each instruction mapped to a span, and the index of the
+// source of the span in Sources.
+func (l *Lines) Each(fn func(ip, src int, span Span)) {
+	for ip, s := range l.spans {
+		fn(ip, s.src, s.span)
+	}
+}
+
+// Relocate moves the span of each instruction to the address returned by
+// reloc, and drops it if reloc returns false.
+func (l *Lines) Relocate(reloc func(ip int) (int, bool)) {
+	spans := make(map[int]srcSpan, len(l.spans))
+	for ip, s := range l.spans {
+		if nip, ok := reloc(ip); ok {
+			spans[nip] = s
+		}
+	}
+	l.spans = spans
+}
+
+// Loc is the source location of an instruction.
+type Loc struct {
+	Pos           // Pos is the start of the span
+	Text   string // Text is the source line of Pos
+	EndCol int    // EndCol is the column of the end of the span, or the end of the line
+}
+
+// Lookup is the source location of the instruction at ip.
+//
+// It returns ok false if there is no source span for ip.
+func (l *Lines) Lookup(ip int) (Loc, bool) {
+	s, ok := l.spans[ip]
+	if !ok {
+		return Loc{}, false
+	}
+	return l.sources[s.src].Loc(s.span), true
+}
+
+// Loc is the source location of span in s.
+func (s Source) Loc(span Span) Loc {
+	text := s.Text
+	from := min(span.From, len(text))
+	to := min(max(span.To, from), len(text))
+
+	start := strings.LastIndexByte(text[:from], '\n') + 1
+	end := strings.IndexByte(text[from:], '\n')
+	if end == -1 {
+		end = len(text)
+	} else {
+		end += from
+	}
+	to = min(to, end)
+
+	line := text[start:end]
+	col := utf8.RuneCountInString(text[start:from]) + 1
+	endCol := utf8.RuneCountInString(text[start:to]) + 1
+
+	pos := Pos{File: s.File, Line: s.Line + strings.Count(text[:start], "\n"), Col: col}
+	return Loc{Pos: pos, Text: line, EndCol: endCol}
+}
+
+// Caret is the marker under the span of the location in Text.
+func (l Loc) Caret() string {
+	var b strings.Builder
+
+	i := 1
+	for _, r := range l.Text {
+		if i >= l.Col {
+			break
+		}
+		if r == '\t' {
+			b.WriteRune('\t')
+		} else {
+			b.WriteRune(' ')
+		}
+		i++
+	}
+
+	b.WriteByte('^')
+	if l.EndCol-l.Col > 1 {
+		b.WriteString(strings.Repeat("~", l.EndCol-l.Col-2))
+		b.WriteByte('^')
+	}
+
+	return b.String()
+}
@@ -0,0 +1,44 @@
+package dbginfo
+
+import (
+	"cmp"
+	"slices"
+)
+
+// TopLevel is the name of the code outside of functions.
+const TopLevel = "top level"
+
+// Scope is the lexical scope of a function.
+type Scope struct {
+	From   int      // From is the address of the first instruction of the function body
+	To     int      // To is the address following the last instruction of the function body
+	Locals []string // Locals are the names of the local variables by frame index
+}
+
+// Body calls fn with the address of each instruction of the function body of
+// s, in order. The bodies of the nested functions are part of the body.
+func (s Scope) Body(fn func(ip int)) {
+	for ip := s.From; ip < s.To; ip++ {
+		fn(ip)
+	}
+}
+
+// Scopes are the lexical scopes of the compiled functions.
+type Scopes []Scope
+
+// Add adds the scope s.
+func (ss *Scopes) Add(s Scope) { *ss = append(*ss, s) }
+
+// Lookup is the chain of lexical scopes enclosing the instruction at ip,
+// innermost first. The closure variables of depth d are in the d-th scope.
+func (ss Scopes) Lookup(ip int) []Scope {
+	r := []Scope{}
+	for _, s := range ss {
+		if s.From <= ip && ip < s.To {
+			r = append(r, s)
+		}
+	}
+	// function bodies are nested in the bodies of the enclosing functions
+	slices.SortFunc(r, func(a, b Scope) int { return cmp.Compare(b.From, a.From) })
+	return r
+}
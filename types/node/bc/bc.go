@@ -8,14 +8,27 @@ package bc
 
 // Data is the data that is passed to the bytecoder.
 type Data struct {
-	Discard             bool // Discard determines whether computation result can be discarded. Non-transitive
-	ForbidTemp          bool // ForbidTemp determines whether tmp register can be used.
-	AcceptTemp          bool // AcceptTemp determines whether the result in tmp register is acceptable. Non-transitive
-	Returning           bool // Returning determines whether the node is the last statement of a function. Non-transitive
-	OpDepth             int  // OpDepth is the depth of arithemtics, logic and relational.
-	InFor               bool // InFor determines whether the current node is in a for loop. Transitive
-	InFunc              bool // InFunc determines whether the current node is in a function. Transitive
-	CtxID, CtxLo, CtxHi int  // CtxID is the current context. CtxLo is the lower bound of the allocated contexts. CtxHi is the upper bound.
+	Discard             bool  // Discard determines whether computation result can be discarded. Non-transitive
+	ForbidTemp          bool  // ForbidTemp determines whether tmp register can be used.
+	AcceptTemp          bool  // AcceptTemp determines whether the result in tmp register is acceptable. Non-transitive
+	Returning           bool  // Returning determines whether the node is the last statement of a function. Non-transitive
+	OpDepth             int   // OpDepth is the depth of arithemtics, logic and relational.
+	InFor               bool  // InFor determines whether the current node is in a for loop. Transitive
+	InFunc              bool  // InFunc determines whether the current node is in a function. Transitive
+	CtxID, CtxLo, CtxHi int   // CtxID is the current context. CtxLo is the lower bound of the allocated contexts. CtxHi is the upper bound.
+	Loop                *Loop // Loop is the innermost loop. Transitive
+	Try                 int   // Try is the number of enclosing try blocks in the function. Transitive
+}
+
+// Loop is the loop being compiled. break and continue register their jumps in
+// it, to be patched when the loop is finished.
+type Loop struct {
+	Breaks       []int // Breaks are the addresses of the break jumps
+	Continues    []int // Continues are the addresses of the continue jumps
+	Discard      bool  // Discard determines whether the loop result is discarded
+	InFor        bool  // InFor determines whether the loop is a for loop
+	Tries        int   // Tries is the number of enclosing try blocks of the loop
+	CtxLo, CtxHi int   // CtxLo and CtxHi are the bounds of the for loop contexts
 }
 
 // Pass is the value a bytecoder receives as argument.
@@ -93,6 +106,20 @@ func WithInFunc(inFunc bool) Option {
 	}
 }
 
+// WithLoop sets loop on the data.
+func WithLoop(loop *Loop) Option {
+	return func(d *Data) {
+		d.Loop = loop
+	}
+}
+
+// WithTry sets the number of enclosing try blocks on the data.
+func WithTry(try int) Option {
+	return func(d *Data) {
+		d.Try = try
+	}
+}
+
 // WithCtxID sets ctxID on the data.
 func WithCtxID(ctxID int) Option {
 	return func(d *Data) {
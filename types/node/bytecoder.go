@@ -1,6 +1,8 @@
 package node
 
 import (
+	"fmt"
+
 	"github.com/paulsonkoly/calc/types/bytecode"
 	"github.com/paulsonkoly/calc/types/compresult"
 	"github.com/paulsonkoly/calc/types/dbginfo"
@@ -43,6 +45,13 @@ func ByteCodeNoStck(bc ByteCoder, cr compResult) {
 	}
 }
 
+// addSpan maps the instruction at ip to the source code span.
+func addSpan(ip int, span dbginfo.Span, cr compResult) {
+	if span != (dbginfo.Span{}) {
+		cr.Lines.Add(ip, span)
+	}
+}
+
 func (i Int) byteCode(srcsel int, _ flags.Pass, cr compResult) bytecode.Type {
 	v := value.NewInt(int(i))
 	ix := len(*cr.DS)
@@ -51,6 +60,14 @@ func (i Int) byteCode(srcsel int, _ flags.Pass, cr compResult) bytecode.Type {
 	return bytecode.EncodeSrc(srcsel, bytecode.AddrDS, ix)
 }
 
+func (i BigInt) byteCode(srcsel int, _ flags.Pass, cr compResult) bytecode.Type {
+	v, _ := i.Constant()
+	ix := len(*cr.DS)
+	*cr.DS = append(*cr.DS, v)
+
+	return bytecode.EncodeSrc(srcsel, bytecode.AddrDS, ix)
+}
+
 func (b Bool) byteCode(srcsel int, _ flags.Pass, cr compResult) bytecode.Type {
 	v := value.NewBool(bool(b))
 	ix := len(*cr.DS)
@@ -107,12 +124,59 @@ func (l List) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
 	return bytecode.EncodeSrc(srcsel, bytecode.AddrStck, 0)
 }
 
+func (m Map) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
+	keys := make([]value.Type, 0, len(m.Keys.Elems))
+	values := make([]value.Type, 0, len(m.Values.Elems))
+	i := 0
+
+	for ; i < len(m.Keys.Elems); i++ {
+		k, ok := m.Keys.Elems[i].Constant()
+		if !ok {
+			break
+		}
+		v, ok := m.Values.Elems[i].Constant()
+		if !ok {
+			break
+		}
+		keys = append(keys, k)
+		values = append(values, v)
+	}
+
+	v, err := value.NewMap(keys, values)
+	if err != nil {
+		// invalid key in the constant part, build the whole map at runtime to
+		// report the error
+		i = 0
+		v, _ = value.NewMap(nil, nil)
+	}
+
+	ix := len(*cr.DS)
+	*cr.DS = append(*cr.DS, v)
+	if i >= len(m.Keys.Elems) {
+		return bytecode.EncodeSrc(srcsel, bytecode.AddrDS, ix)
+	}
+
+	mp := bytecode.EncodeSrc(2, bytecode.AddrDS, ix)
+	for ; i < len(m.Keys.Elems); i++ {
+		k := m.Keys.Elems[i].byteCode(1, fl.Data().Pass(flags.WithOpDepth(0)), cr)
+		v := m.Values.Elems[i].byteCode(0, fl.Data().Pass(flags.WithOpDepth(0)), cr)
+
+		addSpan(len(*cr.CS), m.Span, cr)
+		instr := bytecode.New(bytecode.MAP) | mp | k | v
+		*cr.CS = append(*cr.CS, instr)
+
+		mp = bytecode.EncodeSrc(2, bytecode.AddrStck, 0)
+	}
+
+	return bytecode.EncodeSrc(srcsel, bytecode.AddrStck, 0)
+}
+
 func (l Local) byteCode(srcsel int, _ flags.Pass, _ compResult) bytecode.Type {
 	return bytecode.EncodeSrc(srcsel, bytecode.AddrLcl, l.Ix)
 }
 
 func (c Closure) byteCode(srcsel int, _ flags.Pass, _ compResult) bytecode.Type {
-	return bytecode.EncodeSrc(srcsel, bytecode.AddrCls, c.Ix)
+	return bytecode.EncodeSrc(srcsel, bytecode.AddrCls, bytecode.EncodeCls(c.Depth, c.Ix))
 }
 
 func (n Name) byteCode(srcsel int, _ flags.Pass, cr compResult) bytecode.Type {
@@ -129,6 +193,8 @@ func (f Function) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Ty
 
 	subfl := fl.Data().Pass(
 		flags.WithInFor(false),
+		flags.WithLoop(nil),
+		flags.WithTry(0),
 		flags.WithForbidTemp(false),
 		flags.WithOpDepth(0),
 		flags.WithInFunc(true),
@@ -142,6 +208,8 @@ func (f Function) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Ty
 		*cr.CS = append(*cr.CS, instr)
 	}
 
+	cr.Scopes.Add(dbginfo.Scope{From: bodyAddr, To: len(*cr.CS), Locals: f.Locals})
+
 	funVal := value.NewFunction(bodyAddr, nil, len(f.Parameters.Elems), f.LocalCnt)
 	ix := len(*cr.DS)
 	*cr.DS = append(*cr.DS, funVal)
@@ -168,21 +236,52 @@ func (c Call) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
 		}
 	}
 
-	name, ok := c.Name.(Namer)
-	if !ok {
-		panic("function name is not held by a named node")
-	}
-	(*cr.Dbg)[len(*cr.CS)] = dbginfo.Call{Name: string(name.Name()), ArgCnt: len(c.Arguments.Elems)}
-
 	// get the function
-	instr := c.Name.byteCode(0, fl.Data().Pass(), cr)
+	instr := c.Callee.byteCode(0, fl.Data().Pass(), cr)
+
+	(*cr.Dbg)[len(*cr.CS)] = dbginfo.Call{Name: callLabel(c.Callee), ArgCnt: len(c.Arguments.Elems)}
+	addSpan(len(*cr.CS), c.Span, cr)
+
+	// the result of a call in returning position is returned by the called
+	// function in place of the current call. Native functions push the result
+	// for the RET that follows.
+	op := bytecode.CALL
+	if fl.Data().Returning {
+		op = bytecode.TAIL
+	}
 
-	instr |= bytecode.New(bytecode.CALL) | bytecode.EncodeSrc(1, bytecode.AddrImm, len(c.Arguments.Elems))
+	instr |= bytecode.New(op) | bytecode.EncodeSrc(1, bytecode.AddrImm, len(c.Arguments.Elems))
 	*cr.CS = append(*cr.CS, instr)
 
 	return bytecode.EncodeSrc(srcsel, bytecode.AddrStck, 0)
 }
 
+// callLabel is the description of the callee in stack dumps.
+func callLabel(t Type) string {
+	switch t := t.(type) {
+	case Namer:
+		return t.Name()
+
+	case IndexAt:
+		if v, ok := t.At.Constant(); ok {
+			return fmt.Sprintf("%s[%v]", callLabel(t.Ary), v)
+		}
+		return callLabel(t.Ary) + "[...]"
+
+	case Call:
+		return callLabel(t.Callee) + "()"
+
+	case Member:
+		return callLabel(t.Module) + "." + t.Name
+
+	case Function:
+		return "<anonymous>"
+
+	default:
+		return "<expression>"
+	}
+}
+
 func (r Return) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
 	if fl.Data().InFor {
 		instr := bytecode.New(bytecode.RCONT) |
@@ -190,9 +289,15 @@ func (r Return) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type
 			bytecode.EncodeSrc(1, bytecode.AddrImm, fl.Data().CtxHi)
 		*cr.CS = append(*cr.CS, instr)
 	}
-	target := r.Target.byteCode(0, fl.Data().Pass(), cr)
-	instr := bytecode.New(bytecode.RET) | target
-	*cr.CS = append(*cr.CS, instr)
+	// the returned value is in returning position, unless the try blocks have
+	// to be removed after it, or there is no function to return from
+	returning := fl.Data().InFunc && fl.Data().Try == 0
+	target := r.Target.byteCode(0, fl.Data().Pass(flags.WithReturning(returning)), cr)
+	untry(fl.Data().Try, cr)
+	if target.Src0() != bytecode.AddrInv {
+		instr := bytecode.New(bytecode.RET) | target
+		*cr.CS = append(*cr.CS, instr)
+	}
 
 	// return doesn't leave result - at least in the current lexical scope. It
 	// pushes the function return value but that has to be encoded in the scope
@@ -204,6 +309,97 @@ func (r Return) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type
 	return bytecode.EncodeSrc(srcsel, bytecode.AddrStck, 0)
 }
 
+func (i Import) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
+	ix := len(*cr.DS)
+	*cr.DS = append(*cr.DS, value.NewString(i.Path))
+	instr := bytecode.New(bytecode.IMPORT) | bytecode.EncodeSrc(0, bytecode.AddrDS, ix)
+	*cr.CS = append(*cr.CS, instr)
+
+	instr = bytecode.New(bytecode.MOV) | i.VarRef.byteCode(1, fl.Data().Pass(), cr) | bytecode.EncodeSrc(0, bytecode.AddrStck, 0)
+	*cr.CS = append(*cr.CS, instr)
+
+	return bytecode.EncodeSrc(srcsel, instr.Src1(), instr.Src1Addr())
+}
+
+func (m Member) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
+	module := m.Module.byteCode(1, fl.Data().Pass(), cr)
+
+	ix := len(*cr.DS)
+	*cr.DS = append(*cr.DS, value.NewString(m.Name))
+	addSpan(len(*cr.CS), m.Span, cr)
+	instr := bytecode.New(bytecode.MEMBER) | module | bytecode.EncodeSrc(0, bytecode.AddrDS, ix)
+	*cr.CS = append(*cr.CS, instr)
+
+	return bytecode.EncodeSrc(srcsel, bytecode.AddrStck, 0)
+}
+
+func (b Break) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
+	loop := fl.Data().Loop
+	if loop == nil {
+		panic("break outside of loop")
+	}
+
+	untry(fl.Data().Try-loop.Tries, cr)
+
+	if loop.InFor {
+		instr := bytecode.New(bytecode.RCONT) |
+			bytecode.EncodeSrc(0, bytecode.AddrImm, loop.CtxLo) |
+			bytecode.EncodeSrc(1, bytecode.AddrImm, loop.CtxHi)
+		*cr.CS = append(*cr.CS, instr)
+	}
+
+	loop.Breaks = append(loop.Breaks, loopJump(loop, cr))
+
+	return bytecode.EncodeSrc(srcsel, bytecode.AddrInv, 0)
+}
+
+func (c Continue) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
+	loop := fl.Data().Loop
+	if loop == nil {
+		panic("continue outside of loop")
+	}
+
+	untry(fl.Data().Try-loop.Tries, cr)
+
+	loop.Continues = append(loop.Continues, loopJump(loop, cr))
+
+	return bytecode.EncodeSrc(srcsel, bytecode.AddrInv, 0)
+}
+
+// loopJump emits the jump of break or continue, leaving nil as the loop body
+// result unless the loop discards it. It returns the address of the jump to be
+// patched.
+func loopJump(loop *flags.Loop, cr compResult) int {
+	if !loop.Discard {
+		ix := len(*cr.DS)
+		*cr.DS = append(*cr.DS, value.Nil)
+		instr := bytecode.New(bytecode.PUSH) | bytecode.EncodeSrc(0, bytecode.AddrDS, ix)
+		*cr.CS = append(*cr.CS, instr)
+	}
+
+	jmpAddr := len(*cr.CS)
+	instr := bytecode.New(bytecode.JMP)
+	*cr.CS = append(*cr.CS, instr)
+
+	return jmpAddr
+}
+
+// untry emits the removal of cnt error handlers that are left without
+// reaching the end of their try blocks.
+func untry(cnt int, cr compResult) {
+	if cnt > 0 {
+		instr := bytecode.New(bytecode.UNTRY) | bytecode.EncodeSrc(0, bytecode.AddrImm, cnt)
+		*cr.CS = append(*cr.CS, instr)
+	}
+}
+
+// patchJumps patches the JMP instructions at addrs to jump to target.
+func patchJumps(addrs []int, target int, cr compResult) {
+	for _, addr := range addrs {
+		(*cr.CS)[addr] |= bytecode.EncodeSrc(0, bytecode.AddrImm, target-addr)
+	}
+}
+
 func (y Yield) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
 	target := y.Target.byteCode(0, fl.Data().Pass(), cr)
 	instr := bytecode.New(bytecode.YIELD) | target
@@ -233,6 +429,7 @@ func (a Assign) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type
 		}
 
 		if inc {
+			addSpan(len(*cr.CS), a.Span, cr)
 			instr := bytecode.New(bytecode.INC) | vref.byteCode(0, fl.Data().Pass(), cr)
 			*cr.CS = append(*cr.CS, instr)
 
@@ -244,6 +441,7 @@ func (a Assign) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type
 	instr := srcInstr | vref.byteCode(1, fl.Data().Pass(), cr)
 	instr |= bytecode.New(bytecode.MOV)
 
+	addSpan(len(*cr.CS), a.Span, cr)
 	*cr.CS = append(*cr.CS, instr)
 
 	return bytecode.EncodeSrc(srcsel, instr.Src1(), instr.Src1Addr())
@@ -263,9 +461,11 @@ func (b BinOp) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type
 		op = bytecode.DIV
 	case "%":
 		op = bytecode.MOD
-	case "&", "&&":
+	case "&&", "||":
+		return shortCircuit(b, srcsel, fl, cr)
+	case "&":
 		op = bytecode.AND
-	case "|", "||":
+	case "|":
 		op = bytecode.OR
 	case "==":
 		op = bytecode.EQ
@@ -315,6 +515,7 @@ func (b BinOp) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type
 		instr := bytecode.New(bytecode.PUSHTMP)
 		*cr.CS = append(*cr.CS, instr)
 
+		addSpan(len(*cr.CS), b.Span, cr)
 		instr = bytecode.New(op|bytecode.TempFlag) | bytecode.EncodeSrc(0, bytecode.AddrStck, 0)
 		*cr.CS = append(*cr.CS, instr)
 	} else {
@@ -326,6 +527,7 @@ func (b BinOp) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type
 		} else {
 			instr = bytecode.New(op) | left | right
 		}
+		addSpan(len(*cr.CS), b.Span, cr)
 		*cr.CS = append(*cr.CS, instr)
 	}
 
@@ -343,6 +545,47 @@ func (b BinOp) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type
 	return bytecode.EncodeSrc(srcsel, bytecode.AddrStck, 0)
 }
 
+func shortCircuit(b BinOp, srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
+	//
+	// JMPF/JMPT left                          --+  ; JMPF for &&, JMPT for ||
+	// JMPF/JMPT right                         --+
+	// PUSH true/false                           |
+	// JMP +2                                  --|-+
+	// PUSH false/true                         <-+ |
+	//                                         <---+
+	//
+	// the right operand is only evaluated if the left operand doesn't decide the
+	// result. The result is computed on the stack, leaving the temp register
+	// alone, which might hold a pending operand of the containing expression.
+
+	and := b.Op == "&&"
+
+	leftAddr := condition(b.Left, and, 0, fl.Data().Pass(flags.WithOpDepth(0)), cr)
+	rightAddr := condition(b.Right, and, 0, fl.Data().Pass(flags.WithOpDepth(0)), cr)
+	addSpan(leftAddr, b.Span, cr)
+	addSpan(rightAddr, b.Span, cr)
+
+	ix := len(*cr.DS)
+	*cr.DS = append(*cr.DS, value.NewBool(and))
+	instr := bytecode.New(bytecode.PUSH) | bytecode.EncodeSrc(0, bytecode.AddrDS, ix)
+	*cr.CS = append(*cr.CS, instr)
+
+	instr = bytecode.New(bytecode.JMP) | bytecode.EncodeSrc(0, bytecode.AddrImm, 2)
+	*cr.CS = append(*cr.CS, instr)
+
+	shortAddr := len(*cr.CS)
+	ix = len(*cr.DS)
+	*cr.DS = append(*cr.DS, value.NewBool(!and))
+	instr = bytecode.New(bytecode.PUSH) | bytecode.EncodeSrc(0, bytecode.AddrDS, ix)
+	*cr.CS = append(*cr.CS, instr)
+
+	// patch the jumps
+	(*cr.CS)[leftAddr] |= bytecode.EncodeSrc(1, bytecode.AddrImm, shortAddr-leftAddr)
+	(*cr.CS)[rightAddr] |= bytecode.EncodeSrc(1, bytecode.AddrImm, shortAddr-rightAddr)
+
+	return bytecode.EncodeSrc(srcsel, bytecode.AddrStck, 0)
+}
+
 func (u UnOp) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
 	var op bytecode.OpCode
 
@@ -351,7 +594,7 @@ func (u UnOp) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
 
 	switch u.Op {
 	case "-":
-		return BinOp{Op: "*", Left: Int(-1), Right: u.Target}.byteCode(srcsel, fl.Data().Pass(), cr)
+		return BinOp{Op: "*", Left: Int(-1), Right: u.Target, Span: u.Span}.byteCode(srcsel, fl.Data().Pass(), cr)
 	case "#":
 		op = bytecode.LEN
 	case "!":
@@ -381,6 +624,7 @@ func (u UnOp) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
 	} else {
 		instr = bytecode.New(op) | target
 	}
+	addSpan(len(*cr.CS), u.Span, cr)
 	*cr.CS = append(*cr.CS, instr)
 
 	if tempified && opDepth == 0 && !fl.Data().Discard && !fl.Data().AcceptTemp {
@@ -453,7 +697,7 @@ func (i If) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
 	jmpfAddr := condition(i.Condition, true, 0, fl.Data().Pass(), cr)
 
 	tcSize := len(*cr.CS)
-	tcInstr := i.TrueCase.byteCode(0, fl.Data().Pass(flags.WithDiscard(discard)), cr)
+	tcInstr := i.TrueCase.byteCode(0, fl.Data().Pass(flags.WithDiscard(discard), flags.WithReturning(returning)), cr)
 	tcSize = len(*cr.CS) - tcSize
 
 	if tcSize == 0 && discard {
@@ -463,6 +707,8 @@ func (i If) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
 		return bytecode.EncodeSrc(srcsel, tcInstr.Src0(), tcInstr.Src0Addr())
 	}
 
+	addSpan(jmpfAddr, i.Span, cr)
+
 	dest := bytecode.EncodeSrc(srcsel, tcInstr.Src0(), tcInstr.Src0Addr())
 	if tcInstr.Src0() != bytecode.AddrStck && tcInstr.Src0() != bytecode.AddrInv && !discard && !returning {
 		instr := bytecode.New(bytecode.PUSH) | tcInstr
@@ -470,6 +716,12 @@ func (i If) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
 		dest = bytecode.EncodeSrc(srcsel, bytecode.AddrStck, 0)
 	}
 
+	// true case doesn't finish, by return, break or continue, but no result
+	// leaves nil on the stack
+	if tcInstr.Src0() == bytecode.AddrInv && !discard && !returning {
+		dest = bytecode.EncodeSrc(srcsel, bytecode.AddrStck, 0)
+	}
+
 	if tcInstr.Src0() == bytecode.AddrStck && discard && !returning {
 		instr := bytecode.New(bytecode.POP)
 		*cr.CS = append(*cr.CS, instr)
@@ -480,8 +732,10 @@ func (i If) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
 	noResultAddr := len(*cr.CS)
 
 	if returning {
-		instr := bytecode.New(bytecode.RET) | tcInstr
-		*cr.CS = append(*cr.CS, instr)
+		if tcInstr.Src0() != bytecode.AddrInv {
+			instr := bytecode.New(bytecode.RET) | tcInstr
+			*cr.CS = append(*cr.CS, instr)
+		}
 
 		dest = bytecode.EncodeSrc(srcsel, bytecode.AddrInv, 0)
 
@@ -489,7 +743,7 @@ func (i If) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
 		*cr.DS = append(*cr.DS, value.Nil)
 
 		noResultAddr = len(*cr.CS)
-		instr = bytecode.New(bytecode.RET) | bytecode.EncodeSrc(0, bytecode.AddrDS, ix)
+		instr := bytecode.New(bytecode.RET) | bytecode.EncodeSrc(0, bytecode.AddrDS, ix)
 		*cr.CS = append(*cr.CS, instr)
 	}
 
@@ -527,8 +781,9 @@ func (i IfElse) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type
 	returning := fl.Data().Returning
 
 	jmpFAddr := condition(i.Condition, true, 0, fl.Data().Pass(), cr)
+	addSpan(jmpFAddr, i.Span, cr)
 
-	tCase := i.TrueCase.byteCode(0, fl.Data().Pass(), cr)
+	tCase := i.TrueCase.byteCode(0, fl.Data().Pass(flags.WithReturning(returning)), cr)
 	if tCase.Src0() != bytecode.AddrStck && tCase.Src0() != bytecode.AddrInv && !returning {
 		instr := bytecode.New(bytecode.PUSH) | tCase
 		*cr.CS = append(*cr.CS, instr)
@@ -536,8 +791,10 @@ func (i IfElse) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type
 
 	var jmpTAddr int
 	if returning {
-		instr := bytecode.New(bytecode.RET) | tCase
-		*cr.CS = append(*cr.CS, instr)
+		if tCase.Src0() != bytecode.AddrInv {
+			instr := bytecode.New(bytecode.RET) | tCase
+			*cr.CS = append(*cr.CS, instr)
+		}
 	} else {
 		jmpTAddr = len(*cr.CS)
 		instr := bytecode.New(bytecode.JMP)
@@ -545,13 +802,13 @@ func (i IfElse) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type
 	}
 
 	fCaseAddr := len(*cr.CS)
-	fCase := i.FalseCase.byteCode(0, fl.Data().Pass(), cr)
+	fCase := i.FalseCase.byteCode(0, fl.Data().Pass(flags.WithReturning(returning)), cr)
 	if fCase.Src0() != bytecode.AddrStck && fCase.Src0() != bytecode.AddrInv && !returning {
 		instr := bytecode.New(bytecode.PUSH) | fCase
 		*cr.CS = append(*cr.CS, instr)
 	}
 
-	if returning {
+	if returning && fCase.Src0() != bytecode.AddrInv {
 		instr := bytecode.New(bytecode.RET) | fCase
 		*cr.CS = append(*cr.CS, instr)
 	}
@@ -585,20 +842,27 @@ func (w While) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type
 
 func discardingWhile(w While, srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
 	jmpfAddr := condition(w.Condition, true, 0, fl.Data().Pass(), cr)
+	addSpan(jmpfAddr, w.Span, cr)
+
+	loop := &flags.Loop{Discard: true, Tries: fl.Data().Try}
 
 	bodyAddr := len(*cr.CS)
-	body := w.Body.byteCode(0, fl.Data().Pass(flags.WithDiscard(true)), cr)
+	body := w.Body.byteCode(0, fl.Data().Pass(flags.WithDiscard(true), flags.WithLoop(loop)), cr)
 
 	if body.Src0() == bytecode.AddrStck {
 		instr := bytecode.New(bytecode.POP)
 		*cr.CS = append(*cr.CS, instr)
 	}
 
+	patchJumps(loop.Continues, len(*cr.CS), cr)
+
 	jumpBackAddr := condition(w.Condition, false, 0, fl.Data().Pass(), cr)
+	addSpan(jumpBackAddr, w.Span, cr)
 	(*cr.CS)[jumpBackAddr] |= bytecode.EncodeSrc(1, bytecode.AddrImm, bodyAddr-jumpBackAddr)
 
 	// patch the JMPF
 	(*cr.CS)[jmpfAddr] |= bytecode.EncodeSrc(1, bytecode.AddrImm, len(*cr.CS)-jmpfAddr)
+	patchJumps(loop.Breaks, len(*cr.CS), cr)
 
 	return bytecode.EncodeSrc(srcsel, bytecode.AddrInv, 0)
 }
@@ -612,16 +876,29 @@ func pushingWhile(w While, srcsel int, fl flags.Pass, cr compResult) bytecode.Ty
 	*cr.CS = append(*cr.CS, instr)
 
 	initJmpFAddr := condition(w.Condition, true, 0, fl.Data().Pass(), cr)
+	addSpan(initJmpFAddr, w.Span, cr)
 
 	popAddr := len(*cr.CS)
 	instr = bytecode.New(bytecode.POP)
 	*cr.CS = append(*cr.CS, instr)
 
+	loop := &flags.Loop{Tries: fl.Data().Try}
+
 	bodyAddr := len(*cr.CS)
-	body := w.Body.byteCode(0, fl.Data().Pass(flags.WithDiscard(false)), cr)
+	body := w.Body.byteCode(0, fl.Data().Pass(flags.WithDiscard(false), flags.WithLoop(loop)), cr)
 
+	// the body didn't finish: it did break, continue or return. If we get here
+	// it was a continue, which left the result on the stack
 	if body.Src0() == bytecode.AddrInv {
-		panic("while body result is invalid in non-discarding while")
+		body = bytecode.EncodeSrc(0, bytecode.AddrStck, 0)
+	}
+
+	// continue leaves the result on the stack, so the body result has to be
+	// there as well
+	if body.Src0() != bytecode.AddrStck && len(loop.Continues) > 0 {
+		instr = bytecode.New(bytecode.PUSH) | body
+		*cr.CS = append(*cr.CS, instr)
+		body = bytecode.EncodeSrc(0, bytecode.AddrStck, 0)
 	}
 
 	jumpBack := bodyAddr
@@ -629,7 +906,10 @@ func pushingWhile(w While, srcsel int, fl flags.Pass, cr compResult) bytecode.Ty
 		jumpBack = popAddr
 	}
 
+	patchJumps(loop.Continues, len(*cr.CS), cr)
+
 	jumpBackAddr := condition(w.Condition, false, 0, fl.Data().Pass(), cr)
+	addSpan(jumpBackAddr, w.Span, cr)
 	(*cr.CS)[jumpBackAddr] |= bytecode.EncodeSrc(1, bytecode.AddrImm, jumpBack-jumpBackAddr)
 
 	dest := body
@@ -655,6 +935,7 @@ func pushingWhile(w While, srcsel int, fl flags.Pass, cr compResult) bytecode.Ty
 	}
 
 	(*cr.CS)[initJmpFAddr] |= bytecode.EncodeSrc(1, bytecode.AddrImm, endAddr-initJmpFAddr)
+	patchJumps(loop.Breaks, endAddr, cr)
 
 	return dest
 }
@@ -704,6 +985,7 @@ func (f For) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
 
 			// mov the previous iterator result into its destination
 			vref := f.VarRefs.Elems[i-1].byteCode(1, fl.Data().Pass(), cr)
+			addSpan(len(*cr.CS), f.Span, cr)
 			instr := bytecode.New(bytecode.MOV) | vref | bytecode.EncodeSrc(0, bytecode.AddrStck, 0)
 			*cr.CS = append(*cr.CS, instr)
 		}
@@ -743,6 +1025,7 @@ func (f For) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
 		assignAddr = len(*cr.CS)
 
 		assignee := vRef.byteCode(1, fl.Data().Pass(), cr)
+		addSpan(len(*cr.CS), f.Span, cr)
 		instr = bytecode.New(bytecode.MOV) | assignee | bytecode.EncodeSrc(0, bytecode.AddrStck, 0)
 		*cr.CS = append(*cr.CS, instr)
 	}
@@ -752,8 +1035,17 @@ func (f For) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
 		*cr.CS = append(*cr.CS, instr)
 	}
 
+	loop := &flags.Loop{
+		Discard: discard,
+		InFor:   true,
+		Tries:   fl.Data().Try,
+		CtxLo:   ctxID,
+		CtxHi:   ctxID + len(f.VarRefs.Elems) - 1,
+	}
+
 	body := f.Body.byteCode(0, fl.Data().Pass(
 		flags.WithInFor(true),
+		flags.WithLoop(loop),
 		flags.WithCtxID(ctxID+len(f.VarRefs.Elems)),
 		flags.WithCtxLo(ctxID),
 		flags.WithCtxHi(ctxID+len(f.VarRefs.Elems)-1),
@@ -772,11 +1064,20 @@ func (f For) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
 	instr := bytecode.New(bytecode.JMP) | bytecode.EncodeSrc(0, bytecode.AddrImm, switchAddr-len(*cr.CS))
 	*cr.CS = append(*cr.CS, instr)
 
-	// patch jumps
-	for _, jmpAddr := range jmpAddrs {
-		(*cr.CS)[jmpAddr] |= bytecode.EncodeSrc(0, bytecode.AddrImm, len(*cr.CS)-jmpAddr)
+	patchJumps(loop.Continues, switchAddr, cr)
+
+	endAddr := len(*cr.CS)
+
+	// break has removed the iterator contexts and left the result on the stack
+	if returning && len(loop.Breaks) > 0 {
+		instr = bytecode.New(bytecode.RET) | bytecode.EncodeSrc(0, bytecode.AddrStck, 0)
+		*cr.CS = append(*cr.CS, instr)
 	}
 
+	// patch jumps
+	patchJumps(jmpAddrs, endAddr, cr)
+	patchJumps(loop.Breaks, endAddr, cr)
+
 	// patch ccont
 	(*cr.CS)[ccontAddr] |= bytecode.EncodeSrc(0, bytecode.AddrImm, assignAddr-ccontAddr)
 
@@ -787,11 +1088,101 @@ func (f For) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
 	return bytecode.EncodeSrc(srcsel, bytecode.AddrStck, 0)
 }
 
+func (t Try) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
+	//
+	// TRY                                     --+            ; install the handler
+	// body                                      |
+	// if body result is not on the stack        |
+	//    PUSH body result                       |
+	// UNTRY 1                                   |            ; remove the handler
+	// JMP                                     --|-+
+	// MOV e, STCK                             <-+ |          ; the raised error
+	// catch                                       |
+	// if catch result is not on the stack         |
+	//    PUSH catch result                        |
+	//                                         <---+
+	//
+
+	discard := fl.Data().Discard
+	returning := fl.Data().Returning
+	try := fl.Data().Try
+
+	tryAddr := len(*cr.CS)
+	instr := bytecode.New(bytecode.TRY) | bytecode.EncodeSrc(1, bytecode.AddrImm, fl.Data().CtxID)
+	*cr.CS = append(*cr.CS, instr)
+
+	body := t.Body.byteCode(0, fl.Data().Pass(flags.WithTry(try+1), flags.WithDiscard(discard)), cr)
+	body = tryResult(body, discard, cr)
+
+	untry(1, cr)
+
+	jmpAddr := len(*cr.CS)
+	instr = bytecode.New(bytecode.JMP)
+	*cr.CS = append(*cr.CS, instr)
+
+	handlerAddr := len(*cr.CS)
+	vref := t.VarRef.byteCode(1, fl.Data().Pass(), cr)
+	instr = bytecode.New(bytecode.MOV) | vref | bytecode.EncodeSrc(0, bytecode.AddrStck, 0)
+	*cr.CS = append(*cr.CS, instr)
+
+	catch := t.Catch.byteCode(0, fl.Data().Pass(flags.WithDiscard(discard)), cr)
+	catch = tryResult(catch, discard, cr)
+
+	// patch the TRY and the JMP
+	(*cr.CS)[tryAddr] |= bytecode.EncodeSrc(0, bytecode.AddrImm, handlerAddr-tryAddr)
+	(*cr.CS)[jmpAddr] |= bytecode.EncodeSrc(0, bytecode.AddrImm, len(*cr.CS)-jmpAddr)
+
+	// if both the body and the catch are Inv then there is nothing on the stack
+	if discard || (body.Src0() == bytecode.AddrInv && catch.Src0() == bytecode.AddrInv) {
+		return bytecode.EncodeSrc(srcsel, bytecode.AddrInv, 0)
+	}
+
+	if returning {
+		instr = bytecode.New(bytecode.RET) | bytecode.EncodeSrc(0, bytecode.AddrStck, 0)
+		*cr.CS = append(*cr.CS, instr)
+
+		return bytecode.EncodeSrc(srcsel, bytecode.AddrInv, 0)
+	}
+
+	return bytecode.EncodeSrc(srcsel, bytecode.AddrStck, 0)
+}
+
+// tryResult moves the result of a try block or a catch block on the stack, or
+// removes it from there if it's discarded.
+func tryResult(result bytecode.Type, discard bool, cr compResult) bytecode.Type {
+	switch {
+	case result.Src0() == bytecode.AddrStck && discard:
+		instr := bytecode.New(bytecode.POP)
+		*cr.CS = append(*cr.CS, instr)
+
+		return bytecode.EncodeSrc(0, bytecode.AddrInv, 0)
+
+	case result.Src0() != bytecode.AddrStck && result.Src0() != bytecode.AddrInv && !discard:
+		instr := bytecode.New(bytecode.PUSH) | result
+		*cr.CS = append(*cr.CS, instr)
+
+		return bytecode.EncodeSrc(0, bytecode.AddrStck, 0)
+	}
+
+	return result
+}
+
+func (r Raise) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
+	target := r.Target.byteCode(0, fl.Data().Pass(), cr)
+	addSpan(len(*cr.CS), r.Span, cr)
+	instr := bytecode.New(bytecode.RAISE) | target
+	*cr.CS = append(*cr.CS, instr)
+
+	// raise doesn't finish, the result is left by the handler
+	return bytecode.EncodeSrc(srcsel, bytecode.AddrInv, 0)
+}
+
 func (i IndexAt) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
 	ary := i.Ary.byteCode(1, fl.Data().Pass(), cr)
 	at := i.At.byteCode(0, fl.Data().Pass(), cr)
 	instr := bytecode.New(bytecode.IX1) | ary | at
 
+	addSpan(len(*cr.CS), i.Span, cr)
 	*cr.CS = append(*cr.CS, instr)
 
 	return bytecode.EncodeSrc(srcsel, bytecode.AddrStck, 0)
@@ -805,6 +1196,7 @@ func (i IndexFromTo) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode
 
 	instr := bytecode.New(bytecode.IX2) | ary | from | to
 
+	addSpan(len(*cr.CS), i.Span, cr)
 	*cr.CS = append(*cr.CS, instr)
 
 	return bytecode.EncodeSrc(srcsel, bytecode.AddrStck, 0)
@@ -825,23 +1217,30 @@ func (w Write) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type
 	return bytecode.EncodeSrc(srcsel, bytecode.AddrStck, 0)
 }
 
-func (a Aton) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
-	instr := bytecode.New(bytecode.ATON) | a.Value.byteCode(0, fl.Data().Pass(), cr)
+func (e Exit) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
+	instr := bytecode.New(bytecode.EXIT) | e.Value.byteCode(0, fl.Data().Pass(), cr)
+
 	*cr.CS = append(*cr.CS, instr)
 
 	return bytecode.EncodeSrc(srcsel, bytecode.AddrStck, 0)
 }
 
-func (t Toa) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
-	instr := bytecode.New(bytecode.TOA) | t.Value.byteCode(0, fl.Data().Pass(), cr)
+func (k Keys) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
+	instr := bytecode.New(bytecode.KEYS) | k.Value.byteCode(0, fl.Data().Pass(), cr)
 	*cr.CS = append(*cr.CS, instr)
 
 	return bytecode.EncodeSrc(srcsel, bytecode.AddrStck, 0)
 }
 
-func (e Exit) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
-	instr := bytecode.New(bytecode.EXIT) | e.Value.byteCode(0, fl.Data().Pass(), cr)
+func (n Native) byteCode(srcsel int, _ flags.Pass, cr compResult) bytecode.Type {
+	ix := len(*cr.DS)
+	*cr.DS = append(*cr.DS, n.Value)
+
+	return bytecode.EncodeSrc(srcsel, bytecode.AddrDS, ix)
+}
 
+func (e Error) byteCode(srcsel int, fl flags.Pass, cr compResult) bytecode.Type {
+	instr := bytecode.New(bytecode.ERROR) | e.Value.byteCode(0, fl.Data().Pass(), cr)
 	*cr.CS = append(*cr.CS, instr)
 
 	return bytecode.EncodeSrc(srcsel, bytecode.AddrStck, 0)
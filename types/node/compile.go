@@ -0,0 +1,100 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/paulsonkoly/calc/types/compresult"
+	"github.com/paulsonkoly/calc/types/dbginfo"
+	"github.com/paulsonkoly/calc/types/value"
+	"github.com/paulsonkoly/calc/vm"
+)
+
+// Compile compiles the source read from r to the compilation result of vm
+// without running it, importing modules relative to the directory of r. opts
+// control the compilation as in Loop, the runs are recorded regardless. It
+// returns the runs of the compiled code, or the first error after reporting it.
+func Compile(r lineReader, p Parser, vm *vm.Type, opts Options) ([]compresult.Run, error) {
+	runs := []compresult.Run{}
+	opts.Runs = &runs
+	var err error
+
+	readInputs(r, func(src dbginfo.Source) bool {
+		start := opts.recorded()
+		_, err = processInput(src, r.dir(), p, vm, opts)
+		// a runtime error continues with the next input
+		opts.onError(start)
+		return err == nil
+	})
+
+	return runs, err
+}
+
+// Exec runs the code compiled by Compile in the compilation result of vm. Like
+// Loop it continues with the next input after runtime errors, and stops when
+// the program is stopped, returning the vm.ErrStopped error.
+func Exec(runs []compresult.Run, vm *vm.Type) error {
+	cs := *vm.CR.CS
+	defer func() { *vm.CR.CS = cs }()
+
+	unwinding := false // unwinding is set if a module failed to load
+	for i := 0; i < len(runs); {
+		start := 0
+		if i > 0 {
+			start = runs[i-1].End
+		}
+		*vm.CR.CS = cs[:runs[i].End]
+		vm.SetIP(start)
+
+		_, err := vm.Run(false)
+		if stopped(err) {
+			return err
+		}
+
+		next := i + 1
+		if err != nil || (unwinding && runs[i].Module != "") {
+			if unwinding {
+				fmt.Fprintf(vm.ErrOut(), "%v: %s\n", ErrModuleFailed, runs[i].Module)
+			}
+			next = runs[i].OnError
+			unwinding = next < len(runs) && runs[next].Module != ""
+		}
+		i = next
+	}
+	return nil
+}
+
+// stopped determines whether err stopped the program, by exit or by a hook.
+func stopped(err error) bool { return errors.Is(err, vm.ErrStopped) }
+
+// run runs the code compiled since the last run, unless opts records the runs.
+// module is the path of the module ended by the run, if any.
+func run(vm *vm.Type, opts Options, module string) (value.Type, error) {
+	if opts.Runs == nil {
+		return vm.Run(opts.Out)
+	}
+	*opts.Runs = append(*opts.Runs, compresult.Run{End: len(*vm.CR.CS), OnError: -1, Module: module})
+	return value.Nil, nil
+}
+
+// recorded is the number of runs recorded.
+func (o Options) recorded() int {
+	if o.Runs == nil {
+		return 0
+	}
+	return len(*o.Runs)
+}
+
+// onError sets the runs recorded from the index start without an OnError to
+// continue with the next run recorded after a runtime error.
+func (o Options) onError(start int) {
+	if o.Runs == nil {
+		return
+	}
+	runs := *o.Runs
+	for i := start; i < len(runs); i++ {
+		if runs[i].OnError < 0 {
+			runs[i].OnError = len(runs)
+		}
+	}
+}
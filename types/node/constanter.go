@@ -1,6 +1,10 @@
 package node
 
-import "github.com/paulsonkoly/calc/types/value"
+import (
+	"math/big"
+
+	"github.com/paulsonkoly/calc/types/value"
+)
 
 // Constanter converts a constant node to a value.
 //
@@ -17,6 +21,13 @@ func (i Int) Constant() (value.Type, bool)      { return value.NewInt(int(i)), t
 func (f Float) Constant() (value.Type, bool)    { return value.NewFloat(float64(f)), true }
 func (s String) Constant() (value.Type, bool)   { return value.NewString(string(s)), true }
 func (b Bool) Constant() (value.Type, bool)     { return value.NewBool(bool(b)), true }
+func (i BigInt) Constant() (value.Type, bool) {
+	n, ok := new(big.Int).SetString(string(i), 10)
+	if !ok {
+		panic("invalid big integer literal")
+	}
+	return value.NewBigInt(n), true
+}
 func (l List) Constant() (value.Type, bool) {
 	ary := make([]value.Type, 0, len(l.Elems))
 	for _, t := range l.Elems {
@@ -28,6 +39,24 @@ func (l List) Constant() (value.Type, bool) {
 	}
 	return value.NewArray(ary), true
 }
+func (m Map) Constant() (value.Type, bool) {
+	keys, ok := m.Keys.Constant()
+	if !ok {
+		return value.Nil, false
+	}
+	values, ok := m.Values.Constant()
+	if !ok {
+		return value.Nil, false
+	}
+	kAry, _ := keys.ToArray()
+	vAry, _ := values.ToArray()
+	// an invalid key is left to the runtime to report
+	v, err := value.NewMap(kAry, vAry)
+	if err != nil {
+		return value.Nil, false
+	}
+	return v, true
+}
 func (b BinOp) Constant() (value.Type, bool)       { return value.Nil, false }
 func (a Assign) Constant() (value.Type, bool)      { return value.Nil, false }
 func (u UnOp) Constant() (value.Type, bool)        { return value.Nil, false }
@@ -39,12 +68,19 @@ func (w While) Constant() (value.Type, bool)       { return value.Nil, false }
 func (f For) Constant() (value.Type, bool)         { return value.Nil, false }
 func (r Return) Constant() (value.Type, bool)      { return value.Nil, false }
 func (y Yield) Constant() (value.Type, bool)       { return value.Nil, false }
+func (t Try) Constant() (value.Type, bool)         { return value.Nil, false }
+func (r Raise) Constant() (value.Type, bool)       { return value.Nil, false }
+func (i Import) Constant() (value.Type, bool)      { return value.Nil, false }
+func (m Member) Constant() (value.Type, bool)      { return value.Nil, false }
+func (b Break) Constant() (value.Type, bool)       { return value.Nil, false }
+func (c Continue) Constant() (value.Type, bool)    { return value.Nil, false }
 func (r Read) Constant() (value.Type, bool)        { return value.Nil, false }
 func (w Write) Constant() (value.Type, bool)       { return value.Nil, false }
-func (a Aton) Constant() (value.Type, bool)        { return value.Nil, false }
-func (t Toa) Constant() (value.Type, bool)         { return value.Nil, false }
 func (n Name) Constant() (value.Type, bool)        { return value.Nil, false }
 func (l Local) Constant() (value.Type, bool)       { return value.Nil, false }
 func (c Closure) Constant() (value.Type, bool)     { return value.Nil, false }
 func (b Block) Constant() (value.Type, bool)       { return value.Nil, false }
 func (e Exit) Constant() (value.Type, bool)        { return value.Nil, false }
+func (k Keys) Constant() (value.Type, bool)        { return value.Nil, false }
+func (e Error) Constant() (value.Type, bool)       { return value.Nil, false }
+func (n Native) Constant() (value.Type, bool)      { return n.Value, true }
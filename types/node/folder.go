@@ -0,0 +1,389 @@
+package node
+
+import (
+	"github.com/paulsonkoly/calc/types/bytecode"
+	"github.com/paulsonkoly/calc/types/value"
+)
+
+// foldLimit is the largest length of a string, array or map, and the largest
+// bit length of a big integer computed at compile time. Larger values are left
+// to the runtime, where the execution limits apply to them.
+const foldLimit = 1 << 12
+
+// Folder is a recursive node transformation that evaluates constant
+// expressions at compile time.
+//
+// It is supposed to be called after STRewrite. Operators are evaluated with
+// the same value operations the vm uses, an operation that fails is left in
+// the tree, so the error is raised at runtime.
+type Folder interface {
+	Fold() Type
+}
+
+func (c Call) Fold() Type {
+	return Call{Callee: c.Callee.Fold(), Arguments: c.Arguments.Fold().(List), Span: c.Span}
+}
+
+func (f Function) Fold() Type {
+	return Function{Parameters: f.Parameters, Body: f.Body.Fold(), LocalCnt: f.LocalCnt, Locals: f.Locals}
+}
+
+func (i Int) Fold() Type    { return i }
+func (i BigInt) Fold() Type { return i }
+func (f Float) Fold() Type  { return f }
+func (s String) Fold() Type { return s }
+func (b Bool) Fold() Type   { return b }
+
+func (b BinOp) Fold() Type {
+	folded := BinOp{Op: b.Op, Left: b.Left.Fold(), Right: b.Right.Fold(), Span: b.Span}
+
+	l, lok := folded.Left.Constant()
+	r, rok := folded.Right.Constant()
+
+	switch {
+	case lok && rok:
+		if t, ok := literal(binOp(b.Op, l, r)); ok {
+			return t
+		}
+
+	case lok:
+		// the right operand is not evaluated
+		if c, ok := l.ToBool(); ok && (b.Op == "&&" && !c || b.Op == "||" && c) {
+			return Bool(c)
+		}
+	}
+
+	if t, ok := identity(folded); ok {
+		return t
+	}
+
+	return folded
+}
+
+func (u UnOp) Fold() Type {
+	folded := UnOp{Op: u.Op, Target: u.Target.Fold(), Span: u.Span}
+
+	v, ok := folded.Target.Constant()
+	if !ok {
+		return folded
+	}
+
+	var r value.Type
+	var err error
+
+	switch u.Op {
+	case "-":
+		r, err = value.NewInt(-1).Arith(bytecode.MUL, v)
+	case "!":
+		r, err = v.Not()
+	case "~":
+		r, err = v.Flip()
+	case "#":
+		r, err = v.Len()
+	default:
+		return folded
+	}
+
+	if t, ok := literal(r, err); ok {
+		return t
+	}
+	return folded
+}
+
+func (i IndexAt) Fold() Type {
+	folded := IndexAt{Ary: i.Ary.Fold(), At: i.At.Fold(), Span: i.Span}
+
+	ary, ok := folded.Ary.Constant()
+	if !ok {
+		return folded
+	}
+	at, ok := folded.At.Constant()
+	if !ok {
+		return folded
+	}
+
+	if t, ok := literal(ary.Index(at)); ok {
+		return t
+	}
+	return folded
+}
+
+func (i IndexFromTo) Fold() Type {
+	folded := IndexFromTo{Ary: i.Ary.Fold(), From: i.From.Fold(), To: i.To.Fold(), Span: i.Span}
+
+	ary, ok := folded.Ary.Constant()
+	if !ok {
+		return folded
+	}
+	from, ok := folded.From.Constant()
+	if !ok {
+		return folded
+	}
+	to, ok := folded.To.Constant()
+	if !ok {
+		return folded
+	}
+
+	if t, ok := literal(ary.Index(from, to)); ok {
+		return t
+	}
+	return folded
+}
+
+func (i If) Fold() Type {
+	folded := If{Condition: i.Condition.Fold(), TrueCase: i.TrueCase.Fold(), Span: i.Span}
+
+	// a false condition evaluates to nil, that has no literal
+	if c, ok := constantBool(folded.Condition); ok && c {
+		return folded.TrueCase
+	}
+	return folded
+}
+
+func (i IfElse) Fold() Type {
+	folded := IfElse{Condition: i.Condition.Fold(), TrueCase: i.TrueCase.Fold(), FalseCase: i.FalseCase.Fold(), Span: i.Span}
+
+	if c, ok := constantBool(folded.Condition); ok {
+		if c {
+			return folded.TrueCase
+		}
+		return folded.FalseCase
+	}
+	return folded
+}
+
+func (w While) Fold() Type {
+	return While{Condition: w.Condition.Fold(), Body: w.Body.Fold(), Span: w.Span}
+}
+
+func (f For) Fold() Type {
+	return For{VarRefs: f.VarRefs, Iterators: f.Iterators.Fold().(List), Body: f.Body.Fold(), Span: f.Span}
+}
+
+func (r Return) Fold() Type { return Return{Target: r.Target.Fold()} }
+func (y Yield) Fold() Type  { return Yield{Target: y.Target.Fold()} }
+
+func (t Try) Fold() Type {
+	return Try{Body: t.Body.Fold(), VarRef: t.VarRef, Catch: t.Catch.Fold()}
+}
+
+func (r Raise) Fold() Type  { return Raise{Target: r.Target.Fold(), Span: r.Span} }
+func (i Import) Fold() Type { return i }
+
+func (m Member) Fold() Type {
+	return Member{Module: m.Module.Fold(), Name: m.Name, Span: m.Span}
+}
+
+func (b Break) Fold() Type    { return b }
+func (c Continue) Fold() Type { return c }
+func (n Name) Fold() Type     { return n }
+func (l Local) Fold() Type    { return l }
+func (c Closure) Fold() Type  { return c }
+
+func (a Assign) Fold() Type {
+	return Assign{VarRef: a.VarRef, Value: a.Value.Fold(), Span: a.Span}
+}
+
+func (b Block) Fold() Type {
+	body := []Type{}
+
+	for _, t := range b.Body {
+		body = append(body, t.Fold())
+	}
+
+	return Block{Body: body}
+}
+
+func (m Map) Fold() Type {
+	return Map{Keys: m.Keys.Fold().(List), Values: m.Values.Fold().(List), Span: m.Span}
+}
+
+func (l List) Fold() Type {
+	elems := []Type{}
+
+	for _, t := range l.Elems {
+		elems = append(elems, t.Fold())
+	}
+
+	return List{Elems: elems}
+}
+
+func (r Read) Fold() Type   { return r }
+func (w Write) Fold() Type  { return Write{Value: w.Value.Fold()} }
+func (e Exit) Fold() Type   { return Exit{Value: e.Value.Fold()} }
+func (k Keys) Fold() Type   { return Keys{Value: k.Value.Fold()} }
+func (e Error) Fold() Type  { return Error{Value: e.Value.Fold()} }
+func (n Native) Fold() Type { return n }
+
+// binOp evaluates the binary operator op on the constants a and b.
+func binOp(op string, a, b value.Type) (value.Type, error) {
+	switch op {
+	case "+":
+		return a.Arith(bytecode.ADD, b)
+	case "-":
+		return a.Arith(bytecode.SUB, b)
+	case "*":
+		return a.Arith(bytecode.MUL, b)
+	case "/":
+		return a.Arith(bytecode.DIV, b)
+	case "%":
+		return a.Mod(b)
+	case "&":
+		return a.Logic(bytecode.AND, b)
+	case "|":
+		return a.Logic(bytecode.OR, b)
+	case "==":
+		return a.Eq(bytecode.EQ, b)
+	case "!=":
+		return a.Eq(bytecode.NE, b)
+	case "<":
+		return a.Relational(bytecode.LT, b)
+	case "<=":
+		return a.Relational(bytecode.LE, b)
+	case ">":
+		return a.Relational(bytecode.GT, b)
+	case ">=":
+		return a.Relational(bytecode.GE, b)
+	case "<<":
+		// a large shift is left to the runtime, that checks its size first
+		if n, ok := b.ToInt(); ok && n > foldLimit {
+			return value.Nil, value.ErrType
+		}
+		return a.Shift(bytecode.LSH, b)
+	case ">>":
+		return a.Shift(bytecode.RSH, b)
+	case "&&", "||":
+		// the short circuit operators only take booleans
+		aVal, aok := a.ToBool()
+		bVal, bok := b.ToBool()
+		if !aok || !bok {
+			return value.Nil, value.ErrType
+		}
+		if op == "&&" {
+			return value.NewBool(aVal && bVal), nil
+		}
+		return value.NewBool(aVal || bVal), nil
+	default:
+		return value.Nil, value.ErrType
+	}
+}
+
+// identity simplifies b if one of its operands is the identity element of the
+// operator, ie. x+0 or x*1.
+//
+// The other operand has to be a number, otherwise the simplification would
+// hide the type error of the operation.
+func identity(b BinOp) (Type, bool) {
+	switch b.Op {
+	case "+":
+		if b.Right == Int(0) && numeric(b.Left) {
+			return b.Left, true
+		}
+		if b.Left == Int(0) && numeric(b.Right) {
+			return b.Right, true
+		}
+
+	case "-":
+		if b.Right == Int(0) && numeric(b.Left) {
+			return b.Left, true
+		}
+
+	case "*":
+		if b.Right == Int(1) && numeric(b.Left) {
+			return b.Left, true
+		}
+		if b.Left == Int(1) && numeric(b.Right) {
+			return b.Right, true
+		}
+
+	case "/":
+		if b.Right == Int(1) && numeric(b.Left) {
+			return b.Left, true
+		}
+	}
+	return nil, false
+}
+
+// numeric determines whether t evaluates to a number, if its evaluation
+// succeeds.
+func numeric(t Type) bool {
+	switch t := t.(type) {
+	case Int, BigInt, Float:
+		return true
+	case BinOp:
+		switch t.Op {
+		case "-", "*", "/", "%", "<<", ">>":
+			return true
+		case "+":
+			return numeric(t.Left) && numeric(t.Right)
+		}
+	case UnOp:
+		switch t.Op {
+		case "-", "~", "#":
+			return true
+		}
+	}
+	return false
+}
+
+// constantBool is the value of the constant boolean condition t.
+//
+// It returns ok false if t is not a constant boolean.
+func constantBool(t Type) (bool, bool) {
+	v, ok := t.Constant()
+	if !ok {
+		return false, false
+	}
+	return v.ToBool()
+}
+
+// literal converts the result of a constant evaluation back to a literal
+// node.
+//
+// It returns ok false if the evaluation failed, or v has no literal, or v is
+// larger than foldLimit.
+func literal(v value.Type, err error) (Type, bool) {
+	if err != nil {
+		return nil, false
+	}
+
+	if i, ok := v.ToInt(); ok {
+		return Int(i), true
+	}
+	if f, ok := v.ToFloat(); ok {
+		return Float(f), true
+	}
+	if b, ok := v.ToBool(); ok {
+		return Bool(b), true
+	}
+	if s, ok := v.ToString(); ok && len(s) <= foldLimit {
+		return String(s), true
+	}
+	if n, ok := v.ToBigInt(); ok && n.BitLen() <= foldLimit {
+		return BigInt(n.String()), true
+	}
+	if ary, ok := v.ToArray(); ok && len(ary) <= foldLimit {
+		elems, ok := literals(ary)
+		return List{Elems: elems}, ok
+	}
+	if keys, values, ok := v.ToMap(); ok && len(keys) <= foldLimit {
+		kElems, kok := literals(keys)
+		vElems, vok := literals(values)
+		return Map{Keys: List{Elems: kElems}, Values: List{Elems: vElems}}, kok && vok
+	}
+
+	return nil, false
+}
+
+// literals converts the values vs to literal nodes.
+func literals(vs []value.Type) ([]Type, bool) {
+	elems := make([]Type, 0, len(vs))
+	for _, v := range vs {
+		t, ok := literal(v, nil)
+		if !ok {
+			return nil, false
+		}
+		elems = append(elems, t)
+	}
+	return elems, true
+}
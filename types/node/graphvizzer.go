@@ -49,10 +49,12 @@ func (i Invalid) option() opt     { return defaultOpts }
 func (c Call) option() opt        { return defaultOpts }
 func (f Function) option() opt    { return defaultOpts }
 func (i Int) option() opt         { return constOpts }
+func (i BigInt) option() opt      { return constOpts }
 func (f Float) option() opt       { return constOpts }
 func (s String) option() opt      { return constOpts }
 func (b Bool) option() opt        { return constOpts }
 func (l List) option() opt        { return constOpts }
+func (m Map) option() opt         { return constOpts }
 func (b BinOp) option() opt       { return opteratorOpts }
 func (a Assign) option() opt      { return defaultOpts }
 func (u UnOp) option() opt        { return opteratorOpts }
@@ -64,24 +66,33 @@ func (w While) option() opt       { return defaultOpts }
 func (f For) option() opt         { return defaultOpts }
 func (r Return) option() opt      { return defaultOpts }
 func (y Yield) option() opt       { return defaultOpts }
+func (t Try) option() opt         { return defaultOpts }
+func (r Raise) option() opt       { return defaultOpts }
+func (i Import) option() opt      { return defaultOpts }
+func (m Member) option() opt      { return defaultOpts }
+func (b Break) option() opt       { return defaultOpts }
+func (c Continue) option() opt    { return defaultOpts }
 func (r Read) option() opt        { return defaultOpts }
 func (w Write) option() opt       { return defaultOpts }
-func (a Aton) option() opt        { return defaultOpts }
-func (t Toa) option() opt         { return defaultOpts }
 func (n Name) option() opt        { return variableOpts }
 func (l Local) option() opt       { return variableOpts }
 func (c Closure) option() opt     { return variableOpts }
 func (b Block) option() opt       { return defaultOpts }
 func (e Exit) option() opt        { return defaultOpts }
+func (k Keys) option() opt        { return defaultOpts }
+func (e Error) option() opt       { return defaultOpts }
+func (n Native) option() opt      { return constOpts }
 
 func (i Invalid) label() string     { return fmt.Sprintf("%T", i) }
 func (c Call) label() string        { return fmt.Sprintf("%T", c) }
 func (f Function) label() string    { return fmt.Sprintf("%T", f) }
 func (i Int) label() string         { return fmt.Sprintf("int:%v", i) }
+func (i BigInt) label() string      { return fmt.Sprintf("int:%v", string(i)) }
 func (f Float) label() string       { return fmt.Sprintf("float:%v", f) }
 func (s String) label() string      { return strings.Trim(string(s), "\"") }
 func (b Bool) label() string        { return fmt.Sprint(b) }
 func (l List) label() string        { return "[]" }
+func (m Map) label() string         { return "{}" }
 func (b BinOp) label() string       { return b.Op }
 func (a Assign) label() string      { return fmt.Sprintf("%T", a) }
 func (u UnOp) label() string        { return u.Op }
@@ -93,15 +104,25 @@ func (w While) label() string       { return fmt.Sprintf("%T", w) }
 func (f For) label() string         { return fmt.Sprintf("%T", f) }
 func (r Return) label() string      { return fmt.Sprintf("%T", r) }
 func (y Yield) label() string       { return fmt.Sprintf("%T", y) }
+func (t Try) label() string         { return fmt.Sprintf("%T", t) }
+func (r Raise) label() string       { return fmt.Sprintf("%T", r) }
+func (i Import) label() string      { return fmt.Sprintf("import %q", i.Path) }
+func (m Member) label() string      { return "." + m.Name }
+func (b Break) label() string       { return fmt.Sprintf("%T", b) }
+func (c Continue) label() string    { return fmt.Sprintf("%T", c) }
 func (r Read) label() string        { return fmt.Sprintf("%T", r) }
 func (w Write) label() string       { return fmt.Sprintf("%T", w) }
-func (a Aton) label() string        { return fmt.Sprintf("%T", a) }
-func (t Toa) label() string         { return fmt.Sprintf("%T", t) }
 func (n Name) label() string        { return string(n) }
 func (l Local) label() string       { return fmt.Sprintf("lvar:%d", l.Ix) }
-func (c Closure) label() string     { return fmt.Sprintf("cvar:%d", c.Ix) }
+func (c Closure) label() string     { return fmt.Sprintf("cvar:%d:%d", c.Depth, c.Ix) }
 func (b Block) label() string       { return fmt.Sprintf("%T", b) }
 func (e Exit) label() string        { return fmt.Sprintf("%T", e) }
+func (k Keys) label() string        { return fmt.Sprintf("%T", k) }
+func (e Error) label() string       { return fmt.Sprintf("%T", e) }
+func (n Native) label() string {
+	f, _ := n.Value.ToFunction()
+	return "native:" + f.Native.Name
+}
 
 func children(t graphvizzer) map[string]graphvizzer {
 	typ := reflect.TypeOf(t)
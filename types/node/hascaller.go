@@ -8,6 +8,7 @@ type HasCaller interface {
 func (c Call) HasCall() bool     { return true }
 func (f Function) HasCall() bool { return false }
 func (i Int) HasCall() bool      { return false }
+func (i BigInt) HasCall() bool   { return false }
 func (f Float) HasCall() bool    { return false }
 func (s String) HasCall() bool   { return false }
 func (b Bool) HasCall() bool     { return false }
@@ -19,6 +20,7 @@ func (l List) HasCall() bool {
 	}
 	return false
 }
+func (m Map) HasCall() bool         { return m.Keys.HasCall() || m.Values.HasCall() }
 func (b BinOp) HasCall() bool       { return b.Left.HasCall() || b.Right.HasCall() }
 func (a Assign) HasCall() bool      { return a.Value.HasCall() }
 func (u UnOp) HasCall() bool        { return u.Target.HasCall() }
@@ -28,17 +30,21 @@ func (i If) HasCall() bool          { return i.Condition.HasCall() || i.TrueCase
 func (i IfElse) HasCall() bool {
 	return i.Condition.HasCall() || i.TrueCase.HasCall() || i.FalseCase.HasCall()
 }
-func (w While) HasCall() bool   { return w.Condition.HasCall() || w.Body.HasCall() }
-func (f For) HasCall() bool     { return f.Iterators.HasCall() || f.Body.HasCall() }
-func (r Return) HasCall() bool  { return r.Target.HasCall() }
-func (y Yield) HasCall() bool   { return y.Target.HasCall() }
-func (r Read) HasCall() bool    { return false }
-func (w Write) HasCall() bool   { return false }
-func (a Aton) HasCall() bool    { return false }
-func (t Toa) HasCall() bool     { return false }
-func (n Name) HasCall() bool    { return false }
-func (l Local) HasCall() bool   { return false }
-func (c Closure) HasCall() bool { return false }
+func (w While) HasCall() bool    { return w.Condition.HasCall() || w.Body.HasCall() }
+func (f For) HasCall() bool      { return f.Iterators.HasCall() || f.Body.HasCall() }
+func (r Return) HasCall() bool   { return r.Target.HasCall() }
+func (y Yield) HasCall() bool    { return y.Target.HasCall() }
+func (t Try) HasCall() bool      { return t.Body.HasCall() || t.Catch.HasCall() }
+func (r Raise) HasCall() bool    { return r.Target.HasCall() }
+func (i Import) HasCall() bool   { return false }
+func (m Member) HasCall() bool   { return m.Module.HasCall() }
+func (b Break) HasCall() bool    { return false }
+func (c Continue) HasCall() bool { return false }
+func (r Read) HasCall() bool     { return false }
+func (w Write) HasCall() bool    { return false }
+func (n Name) HasCall() bool     { return false }
+func (l Local) HasCall() bool    { return false }
+func (c Closure) HasCall() bool  { return false }
 func (b Block) HasCall() bool {
 	for _, t := range b.Body {
 		if t.HasCall() {
@@ -47,4 +53,7 @@ func (b Block) HasCall() bool {
 	}
 	return false
 }
-func (e Exit) HasCall() bool { return false }
+func (e Exit) HasCall() bool   { return false }
+func (k Keys) HasCall() bool   { return false }
+func (e Error) HasCall() bool  { return false }
+func (n Native) HasCall() bool { return false }
@@ -0,0 +1,128 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/paulsonkoly/calc/types/bytecode"
+	"github.com/paulsonkoly/calc/types/dbginfo"
+	"github.com/paulsonkoly/calc/types/value"
+	"github.com/paulsonkoly/calc/vm"
+)
+
+// CalcPathEnv is the environment variable listing the directories modules are
+// searched in, after the directory of the importing file.
+const CalcPathEnv = "CALCPATH"
+
+// Module loading errors.
+var (
+	ErrModuleNotFound = errors.New("module not found")
+	ErrImportCycle    = errors.New("import cycle")
+	ErrModuleFailed   = errors.New("module failed to load")
+)
+
+// LoadModule loads the module imported by imp, unless it's already loaded. The
+// module is searched relative to dir, then in the directories of CALCPATH.
+//
+// The module is parsed, compiled and run once in its own global frame, its
+// loading stops at the first error. The returned Import refers to the module by
+// its resolved path, compiling it binds the loaded module.
+func LoadModule(imp Import, dir string, p Parser, vm *vm.Type) (Import, error) {
+	return loadModule(imp, dir, p, vm, Options{})
+}
+
+// loadModule is LoadModule, recording the runs of the module code if opts
+// records the runs, and optimizing it if opts optimizes.
+func loadModule(imp Import, dir string, p Parser, vm *vm.Type, opts Options) (Import, error) {
+	path, err := findModule(imp.Path, dir)
+	if err != nil {
+		return imp, err
+	}
+	imp.Path = path
+
+	if loaded, ok := (*vm.CR.Modules)[path]; ok {
+		if !loaded {
+			return imp, fmt.Errorf("%w: %s", ErrImportCycle, path)
+		}
+		return imp, nil
+	}
+
+	(*vm.CR.Modules)[path] = false
+
+	if err := runModule(path, string(imp.VarRef.(Name)), p, vm, opts); err != nil {
+		delete(*vm.CR.Modules, path)
+		return imp, err
+	}
+
+	(*vm.CR.Modules)[path] = true
+
+	return imp, nil
+}
+
+// runModule runs the file at path in the global frame of a new module named
+// name. It stops at the first error.
+func runModule(path, name string, p Parser, vm *vm.Type, opts Options) error {
+	fr, err := newFReader(path)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrModuleFailed, err)
+	}
+	defer fr.Close()
+
+	ix := len(*vm.CR.DS)
+	*vm.CR.DS = append(*vm.CR.DS, value.NewString(path), value.NewString(name))
+	instr := bytecode.New(bytecode.MODULE) |
+		bytecode.EncodeSrc(0, bytecode.AddrDS, ix) |
+		bytecode.EncodeSrc(1, bytecode.AddrDS, ix+1)
+	*vm.CR.CS = append(*vm.CR.CS, instr)
+
+	opts = Options{Optimize: opts.Optimize, Runs: opts.Runs}
+	start := opts.recorded()
+	_, err = run(vm, opts, "")
+
+	readInputs(fr, func(src dbginfo.Source) bool {
+		if err == nil {
+			_, err = processInput(src, fr.dir(), p, vm, opts)
+		}
+		return err == nil
+	})
+
+	// a runtime error in the module continues at its end
+	opts.onError(start + 1)
+
+	*vm.CR.CS = append(*vm.CR.CS, bytecode.New(bytecode.ENDMODULE))
+	if _, err := run(vm, opts, path); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrModuleFailed, path, err)
+	}
+
+	if stopped(err) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrModuleFailed, path)
+	}
+	return nil
+}
+
+// findModule finds the file at path relative to dir, or relative to the
+// directories of CALCPATH. It returns the absolute path of the file.
+func findModule(path, dir string) (string, error) {
+	candidates := []string{path}
+	if !filepath.IsAbs(path) {
+		candidates = []string{filepath.Join(dir, path)}
+		for _, d := range filepath.SplitList(os.Getenv(CalcPathEnv)) {
+			if d != "" {
+				candidates = append(candidates, filepath.Join(d, path))
+			}
+		}
+	}
+
+	for _, c := range candidates {
+		if info, err := os.Stat(c); err == nil && !info.IsDir() {
+			return filepath.Abs(c)
+		}
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrModuleNotFound, path)
+}
@@ -1,6 +1,11 @@
 // Package node is defines the abstract syntax tree (AST) node.
 package node
 
+import (
+	"github.com/paulsonkoly/calc/types/dbginfo"
+	"github.com/paulsonkoly/calc/types/value"
+)
+
 // Type is AST node type.
 type Type interface {
 	STRewriter
@@ -8,6 +13,7 @@ type Type interface {
 	ByteCoder
 	Constanter
 	HasCaller
+	Folder
 }
 
 // Invalid is an invalid AST node.
@@ -15,20 +21,25 @@ type Invalid struct{}
 
 // Call is function call.
 type Call struct {
-	Name      Type // Variable referencing function
-	Arguments List // Arguments passed to the function
+	Callee    Type         // Callee evaluates to the called function
+	Arguments List         // Arguments passed to the function
+	Span      dbginfo.Span // Span is the source code of the node
 }
 
 // Function is a function definition.
 type Function struct {
-	Parameters List // Parameters of the function
-	Body       Type // Body of the function
-	LocalCnt   int  // count of local variables
+	Parameters List     // Parameters of the function
+	Body       Type     // Body of the function
+	LocalCnt   int      // count of local variables
+	Locals     []string // Locals are the names of the local variables by frame index
 }
 
 // Int is integer literal.
 type Int int
 
+// BigInt is integer literal that doesn't fit in Int, in decimal.
+type BigInt string
+
 // Float is float literal.
 type Float float64
 
@@ -40,52 +51,60 @@ type Bool bool
 
 // BinOp is a binary operator of any kind, anything from "=", etc.
 type BinOp struct {
-	Op    string // Op is the operator string
-	Left  Type   // Left operand
-	Right Type   // Right operand
+	Op    string       // Op is the operator string
+	Left  Type         // Left operand
+	Right Type         // Right operand
+	Span  dbginfo.Span // Span is the source code of the node
 }
 
 // UnOp is a unary operator of any kind, ie. '-'.
 type UnOp struct {
-	Op     string // Op is the operator string
-	Target Type   // Target is the operand
+	Op     string       // Op is the operator string
+	Target Type         // Target is the operand
+	Span   dbginfo.Span // Span is the source code of the node
 }
 
 type IndexAt struct {
-	Ary Type // Ary is the indexed node
-	At  Type // At is the index
+	Ary  Type         // Ary is the indexed node
+	At   Type         // At is the index
+	Span dbginfo.Span // Span is the source code of the node
 }
 
 type IndexFromTo struct {
-	Ary  Type // Ary is the indexed node
-	From Type // From is the start of the range
-	To   Type // To is the end of the range
+	Ary  Type         // Ary is the indexed node
+	From Type         // From is the start of the range
+	To   Type         // To is the end of the range
+	Span dbginfo.Span // Span is the source code of the node
 }
 
 // If is a conditional construct without an else case.
 type If struct {
-	Condition Type // Condition is the condition for the if statement
-	TrueCase  Type // TrueCase is executed if condition evaluates to true
+	Condition Type         // Condition is the condition for the if statement
+	TrueCase  Type         // TrueCase is executed if condition evaluates to true
+	Span      dbginfo.Span // Span is the source code of the condition
 }
 
 // IfElse is a conditional construct.
 type IfElse struct {
-	Condition Type // Condition is the condition for the if statement
-	TrueCase  Type // TrueCase is executed if condition evaluates to true
-	FalseCase Type // FalseCase is executed if condition evaluates to false
+	Condition Type         // Condition is the condition for the if statement
+	TrueCase  Type         // TrueCase is executed if condition evaluates to true
+	FalseCase Type         // FalseCase is executed if condition evaluates to false
+	Span      dbginfo.Span // Span is the source code of the condition
 }
 
 // While is a loop construct.
 type While struct {
-	Condition Type // Condition is the condition for the loop
-	Body      Type // Body is the loop body
+	Condition Type         // Condition is the condition for the loop
+	Body      Type         // Body is the loop body
+	Span      dbginfo.Span // Span is the source code of the condition
 }
 
 // For is a loop for iterators ans generators.
 type For struct {
-	VarRefs   List // VarRef is the variable references list
-	Iterators List // Iterator is the iterator list
-	Body      Type // Body is the loop body
+	VarRefs   List         // VarRef is the variable references list
+	Iterators List         // Iterator is the iterator list
+	Body      Type         // Body is the loop body
+	Span      dbginfo.Span // Span is the source code of the node
 }
 
 // Return is a return statement.
@@ -93,6 +112,38 @@ type Return struct {
 	Target Type // Target is the returned value
 }
 
+// Try is a try catch statement.
+type Try struct {
+	Body   Type // Body is executed with the error handler installed
+	VarRef Type // VarRef is the variable the caught error is assigned to
+	Catch  Type // Catch is executed when Body raises an error
+}
+
+// Raise is a raise statement.
+type Raise struct {
+	Target Type         // Target is the raised error or payload
+	Span   dbginfo.Span // Span is the source code of the node
+}
+
+// Import is an import statement.
+type Import struct {
+	Path   string // Path is the path of the imported file
+	VarRef Type   // VarRef is the variable the module is bound to
+}
+
+// Member is the access of a global variable of a module.
+type Member struct {
+	Module Type         // Module is the module
+	Name   string       // Name is the name of the variable
+	Span   dbginfo.Span // Span is the source code of the node
+}
+
+// Break is a break statement.
+type Break struct{}
+
+// Continue is a continue statement.
+type Continue struct{}
+
 // Yield statement.
 type Yield struct {
 	Target Type // Target is the yielded value
@@ -109,13 +160,22 @@ type Local struct {
 
 // Closure variable reference.
 type Closure struct {
+	Depth   int    // Depth is the number of lexical scopes to the defining scope
 	Ix      int    // Ix is the index in the call frame
 	VarName string // VarName is variable name
 }
 
 type Assign struct {
-	VarRef Type // VarRef is variable reference
-	Value  Type // Value is assigned value
+	VarRef Type         // VarRef is variable reference
+	Value  Type         // Value is assigned value
+	Span   dbginfo.Span // Span is the source code of the node
+}
+
+// Map is a map literal.
+type Map struct {
+	Keys   List         // Keys are the keys of the entries
+	Values List         // Values are the values of the entries
+	Span   dbginfo.Span // Span is the source code of the node
 }
 
 // Block is a code block / sequence that was in '{', '}'.
@@ -136,11 +196,14 @@ type Read struct{}
 // Write writes a value to stdout.
 type Write struct{ Value Type }
 
-// Aton converts a string to a number type.
-type Aton struct{ Value Type }
-
-// Toa converts a valye to a string.
-type Toa struct{ Value Type }
-
 // Exit exits the interpreter with an os exit code.
 type Exit struct{ Value Type }
+
+// Keys converts a map to the array of its keys.
+type Keys struct{ Value Type }
+
+// Error creates an error value with a payload.
+type Error struct{ Value Type }
+
+// Native is a native function value implemented in Go.
+type Native struct{ Value value.Type }
@@ -7,16 +7,22 @@ import (
 	"log"
 
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/chzyer/readline"
 	"github.com/paulsonkoly/calc/combinator"
-	"github.com/paulsonkoly/calc/flags"
+	"github.com/paulsonkoly/calc/peephole"
+	"github.com/paulsonkoly/calc/types/compresult"
+	"github.com/paulsonkoly/calc/types/dbginfo"
+	"github.com/paulsonkoly/calc/types/value"
 	"github.com/paulsonkoly/calc/vm"
 )
 
 type lineReader interface {
 	read() (string, error)
+	dir() string  // dir is the directory imports are relative to
+	file() string // file is the name of the source file, empty if not reading a file
 	io.Closer
 }
 
@@ -32,115 +38,258 @@ func NewRLReader() RLReader {
 
 func (rl RLReader) read() (string, error) { return rl.r.Readline() }
 
+func (rl RLReader) dir() string { return "." }
+
+func (rl RLReader) file() string { return "" }
+
 func (rl RLReader) Close() error { return rl.r.Close() }
 
 type FReader struct {
 	r *os.File
 	b *bufio.Reader
+	d string
+	f string
 }
 
+// NewFReader opens the file fn for reading. It exits the program if the file
+// can't be opened.
 func NewFReader(fn string) FReader {
-	r, err := os.Open(fn)
+	fr, err := newFReader(fn)
 	if err != nil {
 		log.Fatal(err)
 	}
+	return fr
+}
+
+// newFReader opens the file fn for reading.
+func newFReader(fn string) (FReader, error) {
+	r, err := os.Open(fn)
+	if err != nil {
+		return FReader{}, err
+	}
 
 	b := bufio.NewReader(r)
-	return FReader{r: r, b: b}
+	return FReader{r: r, b: b, d: filepath.Dir(fn), f: fn}, nil
+}
+
+func (f FReader) read() (string, error) {
+	line, err := f.b.ReadString('\n')
+	if err == io.EOF && line != "" {
+		return line, nil
+	}
+	return line, err
 }
 
-func (f FReader) read() (string, error) { return f.b.ReadString('\n') }
+func (f FReader) dir() string { return f.d }
+
+func (f FReader) file() string { return f.f }
 
 func (f FReader) Close() error { return f.r.Close() }
 
-type ParserError = *combinator.Error
+type ParserErrors = combinator.Errors
 
 type Parser interface {
-	Parse(string) ([]Type, ParserError)
+	Parse(string) ([]Type, ParserErrors)
+}
+
+// Options control the processing of inputs.
+type Options struct {
+	Out      bool // Out outputs the evaluation results
+	AST      bool // AST outputs the AST in graphviz dot format
+	ByteCode bool // ByteCode outputs the bytecode
+	Optimize bool // Optimize runs the peephole optimizer on the bytecode
+
+	// Runs, if not nil, records the runs of the compiled code instead of running
+	// it
+	Runs *[]compresult.Run
+}
+
+// Loop is the repl-loop. It continues with the next input after errors, and
+// returns the parse errors of the first input that failed to parse. It stops
+// when the program is stopped, by exit or by a hook, and returns the
+// vm.ErrStopped error.
+func Loop(r lineReader, p Parser, vm *vm.Type, opts Options) error {
+	var loopErr error
+
+	readInputs(r, func(src dbginfo.Source) bool {
+		v, err := processInput(src, r.dir(), p, vm, opts)
+		if stopped(err) {
+			loopErr = err
+			return false
+		}
+		if errs, ok := err.(ParserErrors); ok && loopErr == nil {
+			loopErr = errs
+		}
+		if err == nil && opts.Out {
+			fmt.Printf("> %s\n", v.Display())
+		}
+		return true
+	})
+
+	return loopErr
+}
+
+// Eval evaluates src, importing modules relative to dir. It returns the
+// result of the last statement, and stops at the first error. Errors are
+// reported to the error output of vm.
+//
+// src is parsed as a whole, nothing is run if it has parse errors.
+func Eval(src, dir string, p Parser, vm *vm.Type) (value.Type, error) {
+	return processInput(dbginfo.Source{Line: 1, Text: src}, dir, p, vm, Options{Out: true})
 }
 
-// Loop is the repl-loop.
-func Loop(r lineReader, p Parser, vm *vm.Type, doOut bool) {
-	blocksOpen := 0
-	quotesOpen := 0
-	bracketsOpen := 0
+// readInputs reads the lines of r until the blocks, strings and brackets are
+// closed, and calls process with the source read. It stops when process
+// returns false.
+//
+// A line closing more blocks or brackets than open is processed right away,
+// so its error is reported and the lines following it are read afresh. The
+// input left open at the end of r is processed as it is, so its errors, such
+// as an unterminated string or block, are reported.
+func readInputs(r lineReader, process func(src dbginfo.Source) bool) {
+	g := grouper{}
 	input := ""
 	sep := ""
+	lineNo := 0
+	start := 1
 
 	for {
 		line, err := r.read()
 		if err != nil { // io.EOF
-			break
+			if input != "" {
+				process(dbginfo.Source{File: r.file(), Line: start, Text: input})
+			}
+			return
 		}
+		line = strings.TrimSuffix(line, "\n")
+		lineNo++
 
-		blocksOpen += strings.Count(line, "{") - strings.Count(line, "}")
-		quotesOpen += strings.Count(line, "\"") - strings.Count(line, "\\\"")
-		bracketsOpen += strings.Count(line, "[") - strings.Count(line, "]")
+		g.scan(line)
 		input += sep + line
 		sep = "\n"
 
-		if blocksOpen == 0 && quotesOpen%2 == 0 && bracketsOpen == 0 {
-			processInput(input, p, vm, doOut)
+		if g.closed() || g.stray() {
+			if !process(dbginfo.Source{File: r.file(), Line: start, Text: input}) {
+				return
+			}
+			g = grouper{}
 			sep = ""
 			input = ""
+			start = lineNo + 1
 		}
 	}
 }
 
-func processInput(input string, p Parser, vm *vm.Type, doOut bool) {
-	t, err := p.Parse(input)
+// grouper counts the blocks and brackets open in the lines scanned, outside of
+// strings and comments.
+type grouper struct {
+	blocks   int
+	brackets int
+	inString bool // inString is set if a string is open at the end of the last line
+}
+
+// scan scans line continuing the lines scanned before.
+func (g *grouper) scan(line string) {
+	for i := 0; i < len(line); i++ {
+		if g.inString {
+			switch line[i] {
+			case '\\':
+				i++
+			case '"':
+				g.inString = false
+			}
+			continue
+		}
+
+		switch line[i] {
+		case '"':
+			g.inString = true
+		case ';':
+			return
+		case '{':
+			g.blocks++
+		case '}':
+			g.blocks--
+		case '[':
+			g.brackets++
+		case ']':
+			g.brackets--
+		}
+	}
+}
+
+// closed determines whether everything is closed that was open.
+func (g grouper) closed() bool { return !g.inString && g.blocks == 0 && g.brackets == 0 }
+
+// stray determines whether more blocks or brackets were closed than opened.
+func (g grouper) stray() bool { return !g.inString && (g.blocks < 0 || g.brackets < 0) }
+
+// processInput parses, compiles and runs the source code src. It returns the
+// result of the last statement, or the first error after reporting it.
+func processInput(src dbginfo.Source, dir string, p Parser, vm *vm.Type, opts Options) (value.Type, error) {
+	t, err := p.Parse(src.Text)
 	if err != nil {
-		reportError(err, input)
-		return
+		reportErrors(vm.ErrOut(), err, src)
+		return value.Nil, err
 	}
 
+	var v value.Type
+
 	for _, e := range t {
-		e := e.STRewrite(SymTbl{})
+		if imp, ok := e.(Import); ok {
+			imp, err := loadModule(imp, dir, p, vm, opts)
+			if err != nil {
+				if !stopped(err) {
+					fmt.Fprintln(vm.ErrOut(), err)
+				}
+				return value.Nil, err
+			}
+			e = imp
+		}
 
-		if *flags.AstFlag {
+		e := e.STRewrite(SymTbl{}).Fold()
+
+		if opts.AST {
 			Graphviz(e)
 		}
 
+		// imports compile their own sources, so this is set for each statement
+		vm.CR.Lines.AddSource(src)
+
 		ip := len(*vm.CR.CS)
-		if doOut {
+		if opts.Out {
 			ByteCode(e, vm.CR)
 		} else {
 			ByteCodeNoStck(e, vm.CR)
 		}
 
-		if *flags.ByteCodeFlag {
+		if opts.Optimize {
+			peephole.Optimize(vm.CR, ip)
+		}
+
+		if opts.ByteCode {
 			for i, c := range (*vm.CR.CS)[ip:] {
 				fmt.Printf(" %8d | %v\n", ip+i, c)
 			}
 		}
 
-		v, err := vm.Run(doOut)
-		if doOut && err == nil {
-			fmt.Printf("> %s\n", v.Display())
+		var err error
+		if v, err = run(vm, opts, ""); err != nil {
+			return value.Nil, err
 		}
 	}
+
+	return v, nil
 }
 
-func reportError(err ParserError, line string) {
-	fmt.Println(err.Message())
-	start := strings.LastIndex(line[0:err.From()], "\n")
-	if start == -1 {
-		start = 0
-	}
-	end := strings.Index(line[err.To():], "\n")
-	if end == -1 {
-		end = len(line)
-	} else {
-		end += err.To()
-	}
-	fmt.Println(line[start:end])
-	empty := ""
-	if err.From() > start {
-		empty = strings.Repeat(" ", err.From()-start-1)
-	}
-	squiggly := ""
-	if err.To() > err.From() {
-		squiggly = strings.Repeat("~", err.To()-err.From()-1)
+// reportErrors writes the parser errors errs in src with their source
+// locations to w.
+func reportErrors(w io.Writer, errs ParserErrors, src dbginfo.Source) {
+	for _, err := range errs {
+		loc := src.Loc(dbginfo.Span{From: err.From(), To: err.To()})
+		fmt.Fprintln(w, err.Message())
+		fmt.Fprintf(w, "at %v\n", loc.Pos)
+		fmt.Fprintln(w, loc.Text)
+		fmt.Fprintln(w, loc.Caret())
 	}
-	fmt.Println(empty + "^" + squiggly + "^")
 }
@@ -14,7 +14,7 @@ type STRewriter interface {
 }
 
 func (c Call) STRewrite(symTbl SymTbl) Type {
-	return Call{Name: c.Name.STRewrite(symTbl), Arguments: c.Arguments.STRewrite(symTbl).(List)}
+	return Call{Callee: c.Callee.STRewrite(symTbl), Arguments: c.Arguments.STRewrite(symTbl).(List), Span: c.Span}
 }
 
 func (f Function) STRewrite(symTbl SymTbl) Type {
@@ -35,49 +35,55 @@ func (f Function) STRewrite(symTbl SymTbl) Type {
 
 	localCnt := len(symTbl[len(symTbl)-1])
 
+	locals := make([]string, localCnt)
+	for name, ix := range scope {
+		locals[ix] = name
+	}
+
 	// pop the lexical scope by ignoring slc
 
-	return Function{Parameters: parameters, Body: body, LocalCnt: localCnt}
+	return Function{Parameters: parameters, Body: body, LocalCnt: localCnt, Locals: locals}
 }
 
 func (i Int) STRewrite(_ SymTbl) Type    { return (i) }
+func (i BigInt) STRewrite(_ SymTbl) Type { return (i) }
 func (f Float) STRewrite(_ SymTbl) Type  { return (f) }
 func (s String) STRewrite(_ SymTbl) Type { return (s) }
 func (b Bool) STRewrite(_ SymTbl) Type   { return (b) }
 
 func (b BinOp) STRewrite(symTbl SymTbl) Type {
-	return BinOp{Op: b.Op, Left: b.Left.STRewrite(symTbl), Right: b.Right.STRewrite(symTbl)}
+	return BinOp{Op: b.Op, Left: b.Left.STRewrite(symTbl), Right: b.Right.STRewrite(symTbl), Span: b.Span}
 }
 
 func (u UnOp) STRewrite(symTbl SymTbl) Type {
-	return UnOp{Op: u.Op, Target: u.Target.STRewrite(symTbl)}
+	return UnOp{Op: u.Op, Target: u.Target.STRewrite(symTbl), Span: u.Span}
 }
 
 func (i IndexAt) STRewrite(symTbl SymTbl) Type {
-	return IndexAt{Ary: i.Ary.STRewrite(symTbl), At: i.At.STRewrite(symTbl)}
+	return IndexAt{Ary: i.Ary.STRewrite(symTbl), At: i.At.STRewrite(symTbl), Span: i.Span}
 }
 
 func (i IndexFromTo) STRewrite(symTbl SymTbl) Type {
-	return IndexFromTo{Ary: i.Ary.STRewrite(symTbl), From: i.From.STRewrite(symTbl), To: i.To.STRewrite(symTbl)}
+	return IndexFromTo{Ary: i.Ary.STRewrite(symTbl), From: i.From.STRewrite(symTbl), To: i.To.STRewrite(symTbl), Span: i.Span}
 }
 
 func (i If) STRewrite(symTbl SymTbl) Type {
-	return If{Condition: i.Condition.STRewrite(symTbl), TrueCase: i.TrueCase.STRewrite(symTbl)}
+	return If{Condition: i.Condition.STRewrite(symTbl), TrueCase: i.TrueCase.STRewrite(symTbl), Span: i.Span}
 }
 
 func (i IfElse) STRewrite(symTbl SymTbl) Type {
-	return IfElse{Condition: i.Condition.STRewrite(symTbl), TrueCase: i.TrueCase.STRewrite(symTbl), FalseCase: i.FalseCase.STRewrite(symTbl)}
+	return IfElse{Condition: i.Condition.STRewrite(symTbl), TrueCase: i.TrueCase.STRewrite(symTbl), FalseCase: i.FalseCase.STRewrite(symTbl), Span: i.Span}
 }
 
 func (w While) STRewrite(symTbl SymTbl) Type {
-	return While{Condition: w.Condition.STRewrite(symTbl), Body: w.Body.STRewrite(symTbl)}
+	return While{Condition: w.Condition.STRewrite(symTbl), Body: w.Body.STRewrite(symTbl), Span: w.Span}
 }
 
 func (f For) STRewrite(symTbl SymTbl) Type {
 	iterator := f.Iterators.STRewrite(symTbl).(List)
 
 	if len(symTbl) < 1 {
-		return For{VarRefs: f.VarRefs, Iterators: iterator, Body: f.Body.STRewrite(symTbl)}
+		return For{VarRefs: f.VarRefs, Iterators: iterator, Body: f.Body.STRewrite(symTbl), Span: f.Span}
 	}
 
 	varRefs := []Type{}
@@ -94,7 +100,7 @@ func (f For) STRewrite(symTbl SymTbl) Type {
 		varRefs = append(varRefs, Local{Ix: ix, VarName: name})
 	}
 
-	return For{VarRefs: List{Elems: varRefs}, Iterators: iterator, Body: f.Body.STRewrite(symTbl)}
+	return For{VarRefs: List{Elems: varRefs}, Iterators: iterator, Body: f.Body.STRewrite(symTbl), Span: f.Span}
 }
 
 func (r Return) STRewrite(symTbl SymTbl) Type {
@@ -105,6 +111,39 @@ func (y Yield) STRewrite(symTbl SymTbl) Type {
 	return Yield{Target: y.Target.STRewrite(symTbl)}
 }
 
+func (t Try) STRewrite(symTbl SymTbl) Type {
+	body := t.Body.STRewrite(symTbl)
+
+	if len(symTbl) < 1 {
+		return Try{Body: body, VarRef: t.VarRef, Catch: t.Catch.STRewrite(symTbl)}
+	}
+
+	varRef := t.VarRef.(Name)
+	name := string(varRef)
+
+	ix, ok := symTbl[len(symTbl)-1][name]
+	if !ok {
+		l := len(symTbl[len(symTbl)-1])
+		symTbl[len(symTbl)-1][name] = l
+		ix = l
+	}
+
+	return Try{Body: body, VarRef: Local{Ix: ix, VarName: name}, Catch: t.Catch.STRewrite(symTbl)}
+}
+
+func (r Raise) STRewrite(symTbl SymTbl) Type {
+	return Raise{Target: r.Target.STRewrite(symTbl), Span: r.Span}
+}
+
+func (i Import) STRewrite(_ SymTbl) Type { return i }
+
+func (m Member) STRewrite(symTbl SymTbl) Type {
+	return Member{Module: m.Module.STRewrite(symTbl), Name: m.Name, Span: m.Span}
+}
+
+func (b Break) STRewrite(_ SymTbl) Type    { return b }
+func (c Continue) STRewrite(_ SymTbl) Type { return c }
+
 func (n Name) STRewrite(symTbl SymTbl) Type {
 	name := string(n)
 
@@ -115,14 +154,14 @@ func (n Name) STRewrite(symTbl SymTbl) Type {
 		}
 	}
 
-	// look up variable in the enclosing lexical scope
-	if len(symTbl) > 1 {
-		if ix, ok := symTbl[len(symTbl)-2][string(n)]; ok {
-			return Closure{Ix: ix, VarName: name}
+	// look up variable in the enclosing lexical scopes
+	for depth := 1; depth < len(symTbl); depth++ {
+		if ix, ok := symTbl[len(symTbl)-1-depth][string(n)]; ok {
+			return Closure{Depth: depth, Ix: ix, VarName: name}
 		}
 	}
 
-	// variable not defined in either, assume global variable
+	// variable not defined in any, assume global variable
 	return n
 }
 
@@ -132,7 +171,7 @@ func (a Assign) STRewrite(symTbl SymTbl) Type {
 	name := string(varRef)
 
 	if len(symTbl) < 1 {
-		return Assign{VarRef: varRef, Value: value}
+		return Assign{VarRef: varRef, Value: value, Span: a.Span}
 	}
 
 	ix, ok := symTbl[len(symTbl)-1][name]
@@ -142,7 +181,7 @@ func (a Assign) STRewrite(symTbl SymTbl) Type {
 		ix = l
 	}
 
-	return Assign{VarRef: Local{Ix: ix, VarName: name}, Value: value}
+	return Assign{VarRef: Local{Ix: ix, VarName: name}, Value: value, Span: a.Span}
 }
 
 func (l Local) STRewrite(_ SymTbl) Type   { panic("STRewrite called on local") }
@@ -158,6 +197,10 @@ func (b Block) STRewrite(symTbl SymTbl) Type {
 	return Block{Body: body}
 }
 
+func (m Map) STRewrite(symTbl SymTbl) Type {
+	return Map{Keys: m.Keys.STRewrite(symTbl).(List), Values: m.Values.STRewrite(symTbl).(List), Span: m.Span}
+}
+
 func (l List) STRewrite(symTbl SymTbl) Type {
 	elems := []Type{}
 
@@ -170,6 +213,7 @@ func (l List) STRewrite(symTbl SymTbl) Type {
 
 func (r Read) STRewrite(_ SymTbl) Type       { return r }
 func (w Write) STRewrite(symTbl SymTbl) Type { return Write{Value: w.Value.STRewrite(symTbl)} }
-func (a Aton) STRewrite(symTbl SymTbl) Type  { return Aton{Value: a.Value.STRewrite(symTbl)} }
-func (t Toa) STRewrite(symTbl SymTbl) Type   { return Toa{Value: t.Value.STRewrite(symTbl)} }
 func (e Exit) STRewrite(symTbl SymTbl) Type  { return Exit{Value: e.Value.STRewrite(symTbl)} }
+func (k Keys) STRewrite(symTbl SymTbl) Type  { return Keys{Value: k.Value.STRewrite(symTbl)} }
+func (e Error) STRewrite(symTbl SymTbl) Type { return Error{Value: e.Value.STRewrite(symTbl)} }
+func (n Native) STRewrite(_ SymTbl) Type     { return n }
@@ -12,8 +12,8 @@ const (
 	Invalid   = Kind(iota) // Invalid token
 	EOL                    // EOL is end of line
 	EOF                    // EOF is end of file
-	IntLit                 // IntLit is integer literal
-	FloatLit               // FloatLit is float literal
+	IntLit                 // IntLit is integer literal, possibly with base prefix and digit separators
+	FloatLit               // FloatLit is float literal, possibly with exponent and digit separators
 	StringLit              // StringLit is String literal
 	Name                   // Name is a variable name or keyword
 	Sticky                 // one of +, -, *, /, =, <, >, ! a sequence of these stick together in a single lexeme
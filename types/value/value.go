@@ -4,8 +4,14 @@ package value
 import (
 	"errors"
 	"fmt"
+	"math"
+	"math/big"
+	"math/bits"
 	"slices"
 	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 	"unsafe"
 
 	"github.com/paulsonkoly/calc/types/bytecode"
@@ -21,6 +27,11 @@ const (
 	arrayT
 	boolT
 	functionT
+	mapT
+	errorT
+	moduleT
+	bigT
+	nativeT
 )
 
 // Type is evaluation result value.
@@ -35,18 +46,76 @@ type Type struct {
 
 // A structure that represents a function value.
 type FunctionData struct {
-	Node     int     // Pointer to the code of the function - the AST node that holds the function
-	Frame    *[]Type // Pointer to the closure stack frame
-	ParamCnt int     // ParamCnt is the number of parameters of the function
-	LocalCnt int     // LocalCnt is the number of local variables of the function including ParamCnt
+	Node     int  // Pointer to the code of the function - the AST node that holds the function
+	Env      *Env // Env is the lexical environment captured by the function
+	ParamCnt int  // ParamCnt is the number of parameters of the function
+	LocalCnt int  // LocalCnt is the number of local variables of the function including ParamCnt
+
+	Native *NativeData // Native is the Go implementation of a native function, nil for calc functions
+}
+
+// NativeFunc is the Go implementation of a native function. It is called
+// with exactly as many arguments as the function's arity. A returned error is
+// raised as a runtime error.
+type NativeFunc func(args []Type) (Type, error)
+
+// NativeData is the data of a native function value.
+type NativeData struct {
+	Name  string     // Name is the name the function is registered as
+	Arity int        // Arity is the number of parameters of the function
+	Fn    NativeFunc // Fn is the implementation
+}
+
+// ErrorData is the data of an error value.
+type ErrorData struct {
+	Kind    string // Kind is the kind of the error, "error" for errors created by calc code
+	Message string // Message describes the error
+	Payload Type   // Payload is the value the error was created from
+}
+
+// ModuleData is the data of a module value.
+type ModuleData struct {
+	Name    string          // Name is the name the module is imported as
+	Globals map[string]Type // Globals are the global variables of the module
+}
+
+// Env is a lexical environment captured by a closure.
+//
+// Frame is the frame of the function call that defined the closure, Parent is
+// the environment of the defining function, thus the chain of environments
+// reaches out to all enclosing lexical scopes. Globals is the global frame of
+// the module the closure was defined in, nil in the main program.
+type Env struct {
+	Frame   []Type          // Frame is the frame of the defining function call
+	Parent  *Env            // Parent is the environment of the defining function
+	Globals map[string]Type // Globals are the global variables of the defining module
+}
+
+// mapKey is the hashable representation of a map key.
+type mapKey struct {
+	typ   kind
+	morph uint64
+	s     string
+}
+
+// mapData is the storage of a map value. Keys and values are kept in
+// insertion order, index maps the hashed keys to their position.
+type mapData struct {
+	index  map[mapKey]int
+	keys   []Type
+	values []Type
 }
 
 // unsafe (no type check) accessors.
-func (t Type) i() int     { return *(*int)(unsafe.Pointer(&t.morph)) }
-func (t Type) f() float64 { return *(*float64)(unsafe.Pointer(&t.morph)) }
-func (t Type) b() bool    { return t.morph != 0 }
-func (t Type) s() string  { return *(*string)(t.ptr) }
-func (t Type) a() []Type  { return *(*[]Type)(t.ptr) }
+func (t Type) i() int         { return *(*int)(unsafe.Pointer(&t.morph)) }
+func (t Type) f() float64     { return *(*float64)(unsafe.Pointer(&t.morph)) }
+func (t Type) b() bool        { return t.morph != 0 }
+func (t Type) s() string      { return *(*string)(t.ptr) }
+func (t Type) a() []Type      { return *(*[]Type)(t.ptr) }
+func (t Type) m() *mapData    { return (*mapData)(t.ptr) }
+func (t Type) e() *ErrorData  { return (*ErrorData)(t.ptr) }
+func (t Type) o() *ModuleData { return (*ModuleData)(t.ptr) }
+func (t Type) n() *big.Int    { return (*big.Int)(t.ptr) }
 
 // Nil is the nil value.
 var Nil = Type{typ: nilT}
@@ -57,6 +126,21 @@ func (t Type) IsNil() bool { return t.typ == nilT }
 // NewInt allocates a new int value.
 func NewInt(i int) Type { return Type{typ: intT, morph: *(*uint64)(unsafe.Pointer(&i))} }
 
+// NewBigInt allocates a new integer value from n.
+//
+// Integers that fit in int are always represented as int, bigger ones are
+// arbitrary-precision. Arithmetic promotes between the two representations
+// automatically, thus the language has a single integer type.
+func NewBigInt(n *big.Int) Type { return normalize(new(big.Int).Set(n)) }
+
+// normalize takes ownership of n, and demotes it to int if it fits.
+func normalize(n *big.Int) Type {
+	if n.IsInt64() {
+		return NewInt(int(n.Int64()))
+	}
+	return Type{typ: bigT, ptr: unsafe.Pointer(n)}
+}
+
 // NewFloat allocates a new float value.
 func NewFloat(f float64) Type { return Type{typ: floatT, morph: *(*uint64)(unsafe.Pointer(&f))} }
 
@@ -78,6 +162,77 @@ func NewArray(a []Type) Type { return Type{typ: arrayT, ptr: unsafe.Pointer(&a)}
 // NewString allocates a new string value.
 func NewString(s string) Type { return Type{typ: stringT, ptr: unsafe.Pointer(&s)} }
 
+// NewMap allocates a new map value mapping keys to values pairwise.
+//
+// Later keys override earlier duplicates. Only ints, floats, bools and strings
+// can be keys, it returns type error for other keys.
+func NewMap(keys, values []Type) (Type, error) {
+	if len(keys) != len(values) {
+		panic("NewMap incorrectly called")
+	}
+
+	d := &mapData{index: make(map[mapKey]int, len(keys))}
+	for i, k := range keys {
+		if err := d.put(k, values[i]); err != nil {
+			return Nil, err
+		}
+	}
+	return Type{typ: mapT, ptr: unsafe.Pointer(d)}, nil
+}
+
+func (t Type) key() (mapKey, error) {
+	switch t.typ {
+	case intT, floatT, boolT:
+		return mapKey{typ: t.typ, morph: t.morph}, nil
+	case stringT:
+		return mapKey{typ: t.typ, s: t.s()}, nil
+	case bigT:
+		return mapKey{typ: t.typ, s: t.n().String()}, nil
+	case nilT:
+		return mapKey{}, ErrNil
+	default:
+		return mapKey{}, ErrType
+	}
+}
+
+func (d *mapData) put(k, v Type) error {
+	mk, err := k.key()
+	if err != nil {
+		return err
+	}
+
+	if i, ok := d.index[mk]; ok {
+		d.values[i] = v
+		return nil
+	}
+
+	d.index[mk] = len(d.keys)
+	d.keys = append(d.keys, k)
+	d.values = append(d.values, v)
+	return nil
+}
+
+func (d *mapData) get(k Type) (Type, bool) {
+	mk, err := k.key()
+	if err != nil {
+		return Nil, false
+	}
+
+	i, ok := d.index[mk]
+	if !ok {
+		return Nil, false
+	}
+	return d.values[i], true
+}
+
+func (d *mapData) clone() *mapData {
+	index := make(map[mapKey]int, len(d.index))
+	for k, v := range d.index {
+		index[k] = v
+	}
+	return &mapData{index: index, keys: slices.Clone(d.keys), values: slices.Clone(d.values)}
+}
+
 // Function binary layout.
 const (
 	paramsCntHi = 63
@@ -89,25 +244,37 @@ const (
 )
 
 // NewFunction allocates a new function value.
-func NewFunction(node int, frame *[]Type, paramCnt int, localCnt int) Type {
+func NewFunction(node int, env *Env, paramCnt int, localCnt int) Type {
 	nd := ((uint64)(node)) & ((1 << (ipHi - ipLo + 1)) - 1)
 	pc := ((uint64)(paramCnt)) & ((1 << (paramsCntHi - paramsCntLo + 1)) - 1)
 	lc := ((uint64)(localCnt)) & ((1 << (localCntHi - localCntLo + 1)) - 1)
 	morp := (pc << paramsCntLo) | (lc << localCntLo) | nd<<ipLo
-	return Type{typ: functionT, morph: morp, ptr: unsafe.Pointer(frame)}
+	return Type{typ: functionT, morph: morp, ptr: unsafe.Pointer(env)}
+}
+
+// NewNative allocates a new native function value named name, implemented by
+// fn with arity number of parameters.
+func NewNative(name string, arity int, fn NativeFunc) Type {
+	return Type{typ: nativeT, ptr: unsafe.Pointer(&NativeData{Name: name, Arity: arity, Fn: fn})}
 }
 
-func (t *Type) SetFrame(frame *[]Type) {
+// SetEnv sets the lexical environment captured by a function.
+func (t *Type) SetEnv(env *Env) {
 	if t.typ != functionT {
 		panic("type is not a function")
 	}
-	t.ptr = unsafe.Pointer(frame)
+	t.ptr = unsafe.Pointer(env)
 }
 
 // ToFunction converts a value to FunctionData.
 //
 // It returns ok false if not a function.
 func (t Type) ToFunction() (FunctionData, bool) {
+	if t.typ == nativeT {
+		d := (*NativeData)(t.ptr)
+		return FunctionData{ParamCnt: d.Arity, Native: d}, true
+	}
+
 	if t.typ != functionT {
 		return FunctionData{}, false
 	}
@@ -116,7 +283,37 @@ func (t Type) ToFunction() (FunctionData, bool) {
 	pc := int((t.morph)>>paramsCntLo) & ((1 << (paramsCntHi - paramsCntLo + 1)) - 1)
 	lc := int((t.morph)>>localCntLo) & ((1 << (localCntHi - localCntLo + 1)) - 1)
 
-	return FunctionData{ParamCnt: pc, Frame: (*[]Type)(t.ptr), LocalCnt: lc, Node: nd}, true
+	return FunctionData{ParamCnt: pc, Env: (*Env)(t.ptr), LocalCnt: lc, Node: nd}, true
+}
+
+// NewError creates an error value.
+func NewError(kind, message string, payload Type) Type {
+	return Type{typ: errorT, ptr: unsafe.Pointer(&ErrorData{Kind: kind, Message: message, Payload: payload})}
+}
+
+// NewModule creates a module value named name with an empty global frame.
+func NewModule(name string) Type {
+	return Type{typ: moduleT, ptr: unsafe.Pointer(&ModuleData{Name: name, Globals: map[string]Type{}})}
+}
+
+// ToModule converts a value to ModuleData.
+//
+// It returns ok false if not a module.
+func (t Type) ToModule() (ModuleData, bool) {
+	if t.typ != moduleT {
+		return ModuleData{}, false
+	}
+	return *t.o(), true
+}
+
+// ToError converts a value to ErrorData.
+//
+// It returns ok false if not an error.
+func (t Type) ToError() (ErrorData, bool) {
+	if t.typ != errorT {
+		return ErrorData{}, false
+	}
+	return *t.e(), true
 }
 
 // ToInt converts a value to int.
@@ -129,6 +326,49 @@ func (t Type) ToInt() (int, bool) {
 	return *(*int)(unsafe.Pointer(&t.morph)), true
 }
 
+// ToFloat converts a value to float64.
+//
+// It returns ok false if not a float.
+func (t Type) ToFloat() (float64, bool) {
+	if t.typ != floatT {
+		return 0, false
+	}
+	return t.f(), true
+}
+
+// ToBigInt converts an integer value to *big.Int.
+//
+// It returns ok false if not an integer. Unlike ToInt it accepts integers of
+// any size.
+func (t Type) ToBigInt() (*big.Int, bool) {
+	switch t.typ {
+	case intT:
+		return big.NewInt(int64(t.i())), true
+	case bigT:
+		return new(big.Int).Set(t.n()), true
+	default:
+		return nil, false
+	}
+}
+
+// BitLen is the bit length of the absolute value of an integer.
+//
+// It returns ok false if not an integer.
+func (t Type) BitLen() (int, bool) {
+	switch t.typ {
+	case intT:
+		i := t.i()
+		if i < 0 {
+			i = -i
+		}
+		return bits.Len64(uint64(i)), true
+	case bigT:
+		return t.n().BitLen(), true
+	default:
+		return 0, false
+	}
+}
+
 // ToBool converts a value to bool.
 //
 // It returns ok false if not an bool.
@@ -149,6 +389,9 @@ func (t Type) ToString() (string, bool) {
 	return *(*string)(unsafe.Pointer(t.ptr)), true
 }
 
+// ToArray converts a value to a slice of values.
+//
+// It returns ok false if not an array.
 func (t Type) ToArray() ([]Type, bool) {
 	if t.typ != arrayT {
 		return nil, false
@@ -156,6 +399,51 @@ func (t Type) ToArray() ([]Type, bool) {
 	return *(*[]Type)(unsafe.Pointer(t.ptr)), true
 }
 
+// ToMap converts a value to the keys and values of a map in insertion order.
+//
+// It returns ok false if not a map.
+func (t Type) ToMap() ([]Type, []Type, bool) {
+	if t.typ != mapT {
+		return nil, nil, false
+	}
+	d := t.m()
+	return d.keys, d.values, true
+}
+
+// Put returns a new map with k mapped to v, and all other entries of t.
+func (t Type) Put(k, v Type) (Type, error) {
+	if t.typ != mapT {
+		return Nil, ErrType
+	}
+
+	d := t.m().clone()
+	if err := d.put(k, v); err != nil {
+		return Nil, err
+	}
+	return Type{typ: mapT, ptr: unsafe.Pointer(d)}, nil
+}
+
+// Insert maps k to v in the map t in place. The map must not be shared yet,
+// as a map being built by a map literal.
+func (t Type) Insert(k, v Type) error {
+	if t.typ != mapT {
+		return ErrType
+	}
+	return t.m().put(k, v)
+}
+
+// Keys is the array of keys of a map in insertion order.
+func (t Type) Keys() (Type, error) {
+	switch t.typ {
+	case mapT:
+		return NewArray(slices.Clone(t.m().keys)), nil
+	case nilT:
+		return Nil, ErrNil
+	default:
+		return Nil, ErrType
+	}
+}
+
 // String converts any value.Type to string.
 func (t Type) String() string {
 	switch t.typ {
@@ -163,13 +451,15 @@ func (t Type) String() string {
 		return "nil"
 	case intT:
 		return strconv.Itoa(*(*int)(unsafe.Pointer(&t.morph)))
+	case bigT:
+		return t.n().String()
 	case floatT:
 		return fmt.Sprint(*(*float64)(unsafe.Pointer(&t.morph)))
 	case boolT:
 		return strconv.FormatBool(t.morph == 1)
 	case stringT:
 		return *(*string)(t.ptr)
-	case functionT:
+	case functionT, nativeT:
 		return "function"
 	case arrayT:
 		a := *(*[]Type)(t.ptr)
@@ -183,6 +473,21 @@ func (t Type) String() string {
 			}
 		}
 		return "[" + r + "]"
+	case mapT:
+		d := t.m()
+
+		r := ""
+		sep := ""
+		for i, k := range d.keys {
+			r += fmt.Sprintf("%s%v: %v", sep, k, d.values[i])
+			sep = ", "
+		}
+		return "{" + r + "}"
+	case errorT:
+		d := t.e()
+		return fmt.Sprintf("error(%s: %s)", d.Kind, d.Message)
+	case moduleT:
+		return fmt.Sprintf("module(%s)", t.o().Name)
 	}
 	panic("type not handled in String")
 }
@@ -198,22 +503,80 @@ func (t Type) Abbrev() string {
 
 // Display converts a value to a string for calc result printing.
 //
-// Adds extra quotes around string type.
+// Adds extra quotes around string type, and escapes it the way a string
+// literal would be written. Strings in arrays and maps are quoted the same
+// way, so {"1": 1} and {1: 1} display differently.
 func (t Type) Display() string {
-	if t.typ == stringT {
-		return fmt.Sprintf("\"%v\"", *(*string)(t.ptr))
+	switch t.typ {
+	case stringT:
+		return quote(*(*string)(t.ptr))
+	case arrayT:
+		r := ""
+		sep := ""
+		for _, v := range t.a() {
+			r += sep + v.Display()
+			sep = ", "
+		}
+		return "[" + r + "]"
+	case mapT:
+		d := t.m()
+
+		r := ""
+		sep := ""
+		for i, k := range d.keys {
+			r += sep + k.Display() + ": " + d.values[i].Display()
+			sep = ", "
+		}
+		return "{" + r + "}"
 	}
 	return t.String()
 }
 
+func quote(s string) string {
+	var b strings.Builder
+
+	b.WriteByte('"')
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+
+		switch {
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&b, "\\x%02x", s[i])
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString("\\n")
+		case r == '\t':
+			b.WriteString("\\t")
+		case r < utf8.RuneSelf && !unicode.IsPrint(r):
+			fmt.Fprintf(&b, "\\x%02x", r)
+		case !unicode.IsPrint(r):
+			fmt.Fprintf(&b, "\\u{%x}", r)
+		default:
+			b.WriteRune(r)
+		}
+
+		i += size
+	}
+	b.WriteByte('"')
+
+	return b.String()
+}
+
 // Predefined errors.
 var (
 	ErrNil     = errors.New("nil error")
 	ErrType    = errors.New("type error")
 	ErrZeroDiv = errors.New("division by zero")
 	ErrIndex   = errors.New("index error")
+	ErrShift   = errors.New("shift too large")
 )
 
+// MaxShiftBits is the largest bit length of the result of a left shift. The
+// shift is checked before computing it, that could run out of memory.
+const MaxShiftBits = 1 << 24
+
 // Arith is value arithmetics, +, -, * /.
 func (t Type) Arith(op bytecode.OpCode, b Type) (Type, error) {
 
@@ -227,17 +590,23 @@ func (t Type) Arith(op bytecode.OpCode, b Type) (Type, error) {
 			return Nil, ErrZeroDiv
 		}
 
-		return NewInt(builtinArith(op, aVal, bVal)), nil
+		if r, ok := intArith(op, aVal, bVal); ok {
+			return NewInt(r), nil
+		}
+		return bigArith(op, t.big(), b.big())
 
-	case (intT << 4) | floatT:
-		aVal := t.i()
+	case (intT << 4) | bigT, (bigT << 4) | intT, (bigT << 4) | bigT:
+		return bigArith(op, t.big(), b.big())
+
+	case (intT << 4) | floatT, (bigT << 4) | floatT:
+		aVal := t.float()
 		bVal := b.f()
-		return NewFloat(builtinArith(op, float64(aVal), bVal)), nil
+		return NewFloat(builtinArith(op, aVal, bVal)), nil
 
-	case (floatT << 4) | intT:
+	case (floatT << 4) | intT, (floatT << 4) | bigT:
 		aVal := t.f()
-		bVal := b.i()
-		return NewFloat(builtinArith(op, aVal, float64(bVal))), nil
+		bVal := b.float()
+		return NewFloat(builtinArith(op, aVal, bVal)), nil
 
 	case (floatT << 4) | floatT:
 		aVal := t.f()
@@ -262,6 +631,20 @@ func (t Type) Arith(op bytecode.OpCode, b Type) (Type, error) {
 		bVal := b.a()
 		return NewArray(append(slices.Clone(aVal), bVal...)), nil
 
+	case (mapT << 4) | mapT:
+		if op != bytecode.ADD {
+			return Nil, ErrType
+		}
+
+		d := t.m().clone()
+		bVal := b.m()
+		for i, k := range bVal.keys {
+			if err := d.put(k, bVal.values[i]); err != nil {
+				return Nil, err
+			}
+		}
+		return Type{typ: mapT, ptr: unsafe.Pointer(d)}, nil
+
 	default:
 		if t.typ == nilT || b.typ == nilT {
 			return Nil, ErrNil
@@ -278,8 +661,15 @@ func (t Type) Mod(b Type) (Type, error) {
 		aVal := t.i()
 		bVal := b.i()
 
+		if bVal == 0 {
+			return Nil, ErrZeroDiv
+		}
+
 		return NewInt(aVal % bVal), nil
 
+	case (intT << 4) | bigT, (bigT << 4) | intT, (bigT << 4) | bigT:
+		return bigArith(bytecode.MOD, t.big(), b.big())
+
 	default:
 		if t.typ == nilT || b.typ == nilT {
 			return Nil, ErrNil
@@ -299,6 +689,9 @@ func (t Type) Relational(op bytecode.OpCode, b Type) (Type, error) {
 
 		return NewBool(builtinRelational(op, aVal, bVal)), nil
 
+	case (intT << 4) | bigT, (bigT << 4) | intT, (bigT << 4) | bigT:
+		return NewBool(builtinRelational(op, t.big().Cmp(b.big()), 0)), nil
+
 	case (intT << 4) | floatT:
 		aVal := t.i()
 		bVal := b.f()
@@ -309,6 +702,14 @@ func (t Type) Relational(op bytecode.OpCode, b Type) (Type, error) {
 		bVal := b.i()
 		return NewBool(builtinRelational(op, aVal, float64(bVal))), nil
 
+	case (bigT << 4) | floatT:
+		c, ok := cmpBigFloat(t.n(), b.f())
+		return NewBool(ok && builtinRelational(op, c, 0)), nil
+
+	case (floatT << 4) | bigT:
+		c, ok := cmpBigFloat(b.n(), t.f())
+		return NewBool(ok && builtinRelational(op, 0, c)), nil
+
 	case (floatT << 4) | floatT:
 		aVal := t.f()
 		bVal := b.f()
@@ -338,6 +739,12 @@ func (t Type) Logic(op bytecode.OpCode, b Type) (Type, error) {
 		}
 		return NewInt(int(aVal)), nil
 
+	case (intT << 4) | bigT, (bigT << 4) | intT, (bigT << 4) | bigT:
+		if op == bytecode.AND {
+			return normalize(new(big.Int).And(t.big(), b.big())), nil
+		}
+		return normalize(new(big.Int).Or(t.big(), b.big())), nil
+
 	case (boolT << 4) | boolT:
 		aVal := t.morph
 		bVal := b.morph
@@ -363,15 +770,39 @@ func (t Type) Shift(op bytecode.OpCode, b Type) (Type, error) {
 
 	switch (t.typ)<<4 | b.typ {
 	case (intT << 4) | intT:
-		aVal := t.morph
-		bVal := b.morph
+		aVal := t.i()
+		bVal := b.i()
 
-		if op == bytecode.LSH {
-			aVal <<= bVal
-		} else {
-			aVal >>= bVal
+		if bVal < 0 {
+			return Nil, ErrType
+		}
+
+		if op == bytecode.RSH {
+			return NewInt(aVal >> bVal), nil
+		}
+
+		if r := aVal << bVal; r>>bVal == aVal {
+			return NewInt(r), nil
+		}
+		if l, _ := t.BitLen(); bVal > MaxShiftBits-l {
+			return Nil, ErrShift
+		}
+		return normalize(new(big.Int).Lsh(t.big(), uint(bVal))), nil
+
+	case (bigT << 4) | intT:
+		bVal := b.i()
+
+		if bVal < 0 {
+			return Nil, ErrType
 		}
-		return NewInt(int(aVal)), nil
+
+		if op == bytecode.RSH {
+			return normalize(new(big.Int).Rsh(t.n(), uint(bVal))), nil
+		}
+		if bVal > MaxShiftBits-t.n().BitLen() {
+			return Nil, ErrShift
+		}
+		return normalize(new(big.Int).Lsh(t.n(), uint(bVal))), nil
 
 	default:
 		if t.typ == nilT || b.typ == nilT {
@@ -387,6 +818,8 @@ func (t Type) Flip() (Type, error) {
 	switch t.typ {
 	case intT:
 		return NewInt(int(^t.morph)), nil
+	case bigT:
+		return normalize(new(big.Int).Not(t.n())), nil
 	case nilT:
 		return Nil, ErrNil
 	default:
@@ -413,11 +846,29 @@ func (t Type) Index(b ...Type) (Type, error) {
 		panic("Index incorrectly called")
 	}
 
+	if t.typ == mapT {
+		if len(b) != 1 {
+			return Nil, ErrType
+		}
+
+		if _, err := b[0].key(); err != nil {
+			return Nil, err
+		}
+
+		v, ok := t.m().get(b[0])
+		if !ok {
+			return Nil, ErrIndex
+		}
+		return v, nil
+	}
+
 	iix := [2]int{}
 	for i, t := range b {
 		switch t.typ {
 		case intT:
 			iix[i] = t.i()
+		case bigT:
+			return Nil, ErrIndex
 		case nilT:
 			return Nil, ErrNil
 		default:
@@ -495,6 +946,10 @@ func (t Type) Len() (Type, error) {
 		i := len(s)
 		return NewInt(i), nil
 
+	case mapT:
+		i := len(t.m().keys)
+		return NewInt(i), nil
+
 	case nilT:
 		return Nil, ErrNil
 
@@ -518,6 +973,9 @@ func (t *Type) StrictEq(b Type) bool {
 
 		return aVal == bVal
 
+	case (bigT << 4) | bigT:
+		return t.n().Cmp(b.n()) == 0
+
 	case (floatT << 4) | floatT:
 		aVal := t.f()
 		bVal := b.f()
@@ -551,7 +1009,32 @@ func (t *Type) StrictEq(b Type) bool {
 		}
 		return true
 
-	case (nilT << 4) | nilT, (functionT << 4) | functionT:
+	case (mapT << 4) | mapT:
+		aVal := t.m()
+		bVal := b.m()
+
+		if len(aVal.keys) != len(bVal.keys) {
+			return false
+		}
+
+		for i, k := range aVal.keys {
+			v, ok := bVal.get(k)
+			if !ok || !aVal.values[i].StrictEq(v) {
+				return false
+			}
+		}
+		return true
+
+	case (errorT << 4) | errorT:
+		aVal := t.e()
+		bVal := b.e()
+
+		return aVal.Kind == bVal.Kind && aVal.Message == bVal.Message && aVal.Payload.StrictEq(bVal.Payload)
+
+	case (moduleT << 4) | moduleT:
+		return t.ptr == b.ptr
+
+	case (nilT << 4) | nilT, (functionT << 4) | functionT, (functionT << 4) | nativeT, (nativeT << 4) | functionT, (nativeT << 4) | nativeT:
 		return true
 
 	default:
@@ -580,6 +1063,14 @@ func (t *Type) WeakEq(b Type) (bool, error) {
 
 		return aVal == float64(bVal), nil
 
+	case (bigT << 4) | floatT:
+		c, ok := cmpBigFloat(t.n(), b.f())
+		return ok && c == 0, nil
+
+	case (floatT << 4) | bigT:
+		c, ok := cmpBigFloat(b.n(), t.f())
+		return ok && c == 0, nil
+
 	case (arrayT << 4) | arrayT:
 		aVal := *(*[]Type)(t.ptr)
 		bVal := *(*[]Type)(b.ptr)
@@ -596,7 +1087,27 @@ func (t *Type) WeakEq(b Type) (bool, error) {
 		}
 		return true, nil
 
-	case (functionT << 4) | functionT:
+	case (mapT << 4) | mapT:
+		aVal := t.m()
+		bVal := b.m()
+
+		if len(aVal.keys) != len(bVal.keys) {
+			return false, nil
+		}
+
+		for i, k := range aVal.keys {
+			v, ok := bVal.get(k)
+			if !ok {
+				return false, nil
+			}
+			r, err := aVal.values[i].WeakEq(v)
+			if !r {
+				return false, err
+			}
+		}
+		return true, nil
+
+	case (functionT << 4) | functionT, (functionT << 4) | nativeT, (nativeT << 4) | functionT, (nativeT << 4) | nativeT:
 		return false, nil
 
 	default:
@@ -619,6 +1130,78 @@ func (t Type) Eq(op bytecode.OpCode, b Type) (Type, error) {
 	return NewBool(r), nil
 }
 
+// intArith is int arithmetics. It returns ok false if the result overflows.
+func intArith(op bytecode.OpCode, a, b int) (int, bool) {
+	switch op {
+	case bytecode.ADD:
+		r := a + b
+		return r, (a^r)&(b^r) >= 0
+	case bytecode.SUB:
+		r := a - b
+		return r, (a^b)&(a^r) >= 0
+	case bytecode.MUL:
+		if a == 0 || b == 0 {
+			return 0, true
+		}
+		r := a * b
+		return r, r/b == a && !(a == -1 && b == math.MinInt) && !(b == -1 && a == math.MinInt)
+	case bytecode.DIV:
+		return a / b, !(a == math.MinInt && b == -1)
+	}
+	panic("unknown operator")
+}
+
+// bigArith is arbitrary-precision integer arithmetics, +, -, *, /, %.
+func bigArith(op bytecode.OpCode, a, b *big.Int) (Type, error) {
+	r := new(big.Int)
+
+	switch op {
+	case bytecode.ADD:
+		r.Add(a, b)
+	case bytecode.SUB:
+		r.Sub(a, b)
+	case bytecode.MUL:
+		r.Mul(a, b)
+	case bytecode.DIV, bytecode.MOD:
+		if b.Sign() == 0 {
+			return Nil, ErrZeroDiv
+		}
+		if op == bytecode.DIV {
+			r.Quo(a, b)
+		} else {
+			r.Rem(a, b)
+		}
+	default:
+		panic("unknown operator")
+	}
+	return normalize(r), nil
+}
+
+// big promotes an integer value to *big.Int. The result must not be modified.
+func (t Type) big() *big.Int {
+	if t.typ == bigT {
+		return t.n()
+	}
+	return big.NewInt(int64(t.i()))
+}
+
+// float converts an integer value to float64.
+func (t Type) float() float64 {
+	if t.typ == bigT {
+		f, _ := new(big.Float).SetInt(t.n()).Float64()
+		return f
+	}
+	return float64(t.i())
+}
+
+// cmpBigFloat compares a and b exactly. It returns ok false if b is NaN.
+func cmpBigFloat(a *big.Int, b float64) (int, bool) {
+	if math.IsNaN(b) {
+		return 0, false
+	}
+	return new(big.Float).SetInt(a).Cmp(big.NewFloat(b)), true
+}
+
 func builtinArith[t int | float64](op bytecode.OpCode, a, b t) t {
 	switch op {
 	case bytecode.ADD:
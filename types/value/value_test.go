@@ -2,10 +2,12 @@ package value_test
 
 import (
 	"math"
+	"math/big"
 	"testing"
 
 	"github.com/paulsonkoly/calc/types/bytecode"
 	"github.com/paulsonkoly/calc/types/value"
+	"github.com/paulsonkoly/calc/types/value/valuetest"
 )
 
 type TestDatum struct {
@@ -17,6 +19,8 @@ type TestDatum struct {
 
 var emptyFunc = value.NewFunction(0, nil, 0, 0)
 
+var abMap = valuetest.MustMap([]value.Type{value.NewString("a"), value.NewString("b")}, []value.Type{value.NewInt(1), value.NewInt(2)})
+
 var testData = []TestDatum{
 	{"Arithmetics int + int", func() (value.Type, error) { return value.NewInt(1).Arith(bytecode.ADD, value.NewInt(2)) }, value.NewInt(3), nil},
 	{"Arithmetics int - int", func() (value.Type, error) { return value.NewInt(1).Arith(bytecode.SUB, value.NewInt(2)) }, value.NewInt(-1), nil},
@@ -59,6 +63,14 @@ var testData = []TestDatum{
 		value.ErrType,
 	},
 
+	{"Arithmetics map + map",
+		func() (value.Type, error) {
+			return abMap.Arith(bytecode.ADD, valuetest.MustMap([]value.Type{value.NewString("b")}, []value.Type{value.NewInt(3)}))
+		},
+		valuetest.MustMap([]value.Type{value.NewString("a"), value.NewString("b")}, []value.Type{value.NewInt(1), value.NewInt(3)}), nil,
+	},
+	{"Arithmetics map - map", func() (value.Type, error) { return abMap.Arith(bytecode.SUB, abMap) }, value.Nil, value.ErrType},
+
 	{"Arithmetics bool + bool", func() (value.Type, error) { return value.NewBool(true).Arith(bytecode.ADD, value.NewBool(true)) }, value.Nil, value.ErrType},
 	{"Arithmetics function + function", func() (value.Type, error) { return emptyFunc.Arith(bytecode.ADD, emptyFunc) }, value.Nil, value.ErrType},
 	{"Arithmetics int + nil", func() (value.Type, error) { return value.NewInt(1).Arith(bytecode.ADD, value.Nil) }, value.Nil, value.ErrNil},
@@ -221,6 +233,19 @@ var testData = []TestDatum{
 		value.NewArray([]value.Type{}),
 		nil,
 	},
+	{"Index map[string]", func() (value.Type, error) { return abMap.Index(value.NewString("b")) }, value.NewInt(2), nil},
+	{"Index map[string] missing", func() (value.Type, error) { return abMap.Index(value.NewString("c")) }, value.Nil, value.ErrIndex},
+	{"Index map[array]", func() (value.Type, error) { return abMap.Index(value.NewArray([]value.Type{})) }, value.Nil, value.ErrType},
+	{"Index map[nil]", func() (value.Type, error) { return abMap.Index(value.Nil) }, value.Nil, value.ErrNil},
+	{"Index map[int:int]", func() (value.Type, error) { return abMap.Index(value.NewInt(0), value.NewInt(1)) }, value.Nil, value.ErrType},
+	{"Index map[int] int and float keys differ",
+		func() (value.Type, error) {
+			return valuetest.MustMap([]value.Type{value.NewFloat(1)}, []value.Type{value.NewInt(1)}).Index(value.NewInt(1))
+		},
+		value.Nil,
+		value.ErrIndex,
+	},
+
 	{"Index string[bool]", func() (value.Type, error) { return value.NewString("ab").Index(value.NewBool(true)) }, value.Nil, value.ErrType},
 
 	{"Len string", func() (value.Type, error) { return value.NewString("a").Len() }, value.NewInt(1), nil},
@@ -230,6 +255,8 @@ var testData = []TestDatum{
 		nil,
 	},
 
+	{"Len map", abMap.Len, value.NewInt(2), nil},
+
 	{"Len int", func() (value.Type, error) { return value.NewInt(1).Len() }, value.Nil, value.ErrType},
 	{"Len float", func() (value.Type, error) { return value.NewFloat(1.0).Len() }, value.Nil, value.ErrType},
 	{"Len bool", func() (value.Type, error) { return value.NewBool(true).Len() }, value.Nil, value.ErrType},
@@ -249,6 +276,23 @@ var testData = []TestDatum{
 	{"Equality string == string", func() (value.Type, error) { return value.NewString("a").Eq(bytecode.EQ, value.NewString("a")) }, value.NewBool(true), nil},
 	{"Equality string != string", func() (value.Type, error) { return value.NewString("a").Eq(bytecode.NE, value.NewString("b")) }, value.NewBool(true), nil},
 
+	{"Equality error == error",
+		func() (value.Type, error) {
+			a := value.NewError("error", "a", value.NewInt(1))
+			return a.Eq(bytecode.EQ, value.NewError("error", "a", value.NewInt(1)))
+		},
+		value.NewBool(true),
+		nil,
+	},
+	{"Equality error != error",
+		func() (value.Type, error) {
+			a := value.NewError("error", "a", value.NewInt(1))
+			return a.Eq(bytecode.NE, value.NewError("type", "a", value.NewInt(1)))
+		},
+		value.NewBool(true),
+		nil,
+	},
+
 	{"Equality array == array",
 		func() (value.Type, error) {
 			a := value.NewArray([]value.Type{value.NewInt(1)})
@@ -259,6 +303,22 @@ var testData = []TestDatum{
 		nil,
 	},
 
+	{"Equality map == map",
+		func() (value.Type, error) {
+			b := valuetest.MustMap([]value.Type{value.NewString("b"), value.NewString("a")}, []value.Type{value.NewFloat(2.0), value.NewInt(1)})
+			return abMap.Eq(bytecode.EQ, b)
+		},
+		value.NewBool(true),
+		nil,
+	},
+	{"Equality map != map",
+		func() (value.Type, error) {
+			return abMap.Eq(bytecode.NE, valuetest.MustMap([]value.Type{value.NewString("a")}, []value.Type{value.NewInt(1)}))
+		},
+		value.NewBool(true),
+		nil,
+	},
+
 	{"Equality bool == bool", func() (value.Type, error) { return value.NewBool(true).Eq(bytecode.EQ, value.NewBool(true)) }, value.NewBool(true), nil},
 	{"Equality bool != bool", func() (value.Type, error) { return value.NewBool(true).Eq(bytecode.NE, value.NewBool(false)) }, value.NewBool(true), nil},
 
@@ -275,6 +335,38 @@ var testData = []TestDatum{
 	}, value.NewBool(true), nil},
 
 	{"Equality nil == int", func() (value.Type, error) { return value.Nil.Eq(bytecode.EQ, value.NewInt(1)) }, value.Nil, value.ErrNil},
+
+	{"Arithmetics int + int overflow", func() (value.Type, error) { return value.NewInt(math.MaxInt).Arith(bytecode.ADD, value.NewInt(1)) }, bigPow(63), nil},
+	{"Arithmetics int - int overflow", func() (value.Type, error) { return value.NewInt(math.MinInt).Arith(bytecode.SUB, value.NewInt(1)) }, bigNeg(bigPow(63), 1), nil},
+	{"Arithmetics int * int overflow", func() (value.Type, error) { return value.NewInt(math.MinInt).Arith(bytecode.MUL, value.NewInt(-1)) }, bigPow(63), nil},
+	{"Arithmetics int / int overflow", func() (value.Type, error) { return value.NewInt(math.MinInt).Arith(bytecode.DIV, value.NewInt(-1)) }, bigPow(63), nil},
+	{"Arithmetics big - int demotes", func() (value.Type, error) { return bigPow(63).Arith(bytecode.SUB, value.NewInt(1)) }, value.NewInt(math.MaxInt), nil},
+	{"Arithmetics big / big", func() (value.Type, error) { return bigPow(100).Arith(bytecode.DIV, bigPow(90)) }, value.NewInt(1024), nil},
+	{"Arithmetics big / 0", func() (value.Type, error) { return bigPow(100).Arith(bytecode.DIV, value.NewInt(0)) }, value.Nil, value.ErrZeroDiv},
+	{"Arithmetics big + float", func() (value.Type, error) { return bigPow(64).Arith(bytecode.ADD, value.NewFloat(1)) }, value.NewFloat(math.Pow(2, 64) + 1), nil},
+	{"Mod big % int", func() (value.Type, error) { return bigPow(70).Mod(value.NewInt(1000)) }, value.NewInt(424), nil},
+	{"Mod int % 0", func() (value.Type, error) { return value.NewInt(1).Mod(value.NewInt(0)) }, value.Nil, value.ErrZeroDiv},
+	{"Shift int << int overflow", func() (value.Type, error) { return value.NewInt(1).Shift(bytecode.LSH, value.NewInt(64)) }, bigPow(64), nil},
+	{"Shift big >> int", func() (value.Type, error) { return bigPow(64).Shift(bytecode.RSH, value.NewInt(60)) }, value.NewInt(16), nil},
+	{"Shift negative int >> int", func() (value.Type, error) { return value.NewInt(-8).Shift(bytecode.RSH, value.NewInt(1)) }, value.NewInt(-4), nil},
+	{"Shift int << int too large", func() (value.Type, error) { return value.NewInt(1).Shift(bytecode.LSH, value.NewInt(1<<62)) }, value.Nil, value.ErrShift},
+	{"Shift big << int too large", func() (value.Type, error) { return bigPow(64).Shift(bytecode.LSH, value.NewInt(value.MaxShiftBits)) }, value.Nil, value.ErrShift},
+	{"Relational int < big", func() (value.Type, error) { return value.NewInt(math.MaxInt).Relational(bytecode.LT, bigPow(63)) }, value.NewBool(true), nil},
+	{"Relational float < big", func() (value.Type, error) { return value.NewFloat(1e19).Relational(bytecode.LT, bigPow(64)) }, value.NewBool(true), nil},
+	{"Relational NaN < big", func() (value.Type, error) { return value.NewFloat(math.NaN()).Relational(bytecode.LT, bigPow(64)) }, value.NewBool(false), nil},
+	{"Equality big == float", func() (value.Type, error) { return bigPow(64).Eq(bytecode.EQ, value.NewFloat(math.Pow(2, 64))) }, value.NewBool(true), nil},
+	{"Equality big == big", func() (value.Type, error) { return bigPow(64).Eq(bytecode.EQ, bigPow(64)) }, value.NewBool(true), nil},
+	{"Equality big != int", func() (value.Type, error) { return bigPow(64).Eq(bytecode.NE, value.NewInt(0)) }, value.NewBool(true), nil},
+	{"Flip big", func() (value.Type, error) { return bigPow(64).Flip() }, bigNeg(bigPow(64), 1), nil},
+}
+
+func bigPow(n uint) value.Type {
+	return value.NewBigInt(new(big.Int).Lsh(big.NewInt(1), n))
+}
+
+func bigNeg(t value.Type, sub int64) value.Type {
+	n, _ := t.ToBigInt()
+	return value.NewBigInt(n.Neg(n).Sub(n, big.NewInt(sub)))
 }
 
 func TestValue(t *testing.T) {
@@ -286,3 +378,25 @@ func TestValue(t *testing.T) {
 		})
 	}
 }
+
+func TestDisplay(t *testing.T) {
+	tests := []struct {
+		value    value.Type
+		expected string
+	}{
+		{value.NewInt(1), "1"},
+		{value.NewString("abc"), `"abc"`},
+		{value.NewString("a\tb\nc"), `"a\tb\nc"`},
+		{value.NewString(`a"b\c`), `"a\"b\\c"`},
+		{value.NewString("\x00\x7f\xff"), `"\x00\x7f\xff"`},
+		{value.NewString("\u00e9\u200b"), "\"\u00e9\\u{200b}\""},
+		{value.NewArray([]value.Type{value.NewString("a"), value.NewInt(1)}), `["a", 1]`},
+		{valuetest.MustMap([]value.Type{value.NewString("1"), value.NewInt(1)}, []value.Type{value.NewInt(1), value.NewString("x")}), `{"1": 1, 1: "x"}`},
+	}
+
+	for _, test := range tests {
+		if actual := test.value.Display(); actual != test.expected {
+			t.Errorf("Expected %s, got %s", test.expected, actual)
+		}
+	}
+}
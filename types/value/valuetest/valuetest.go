@@ -0,0 +1,13 @@
+// Package valuetest contains helpers for tests creating values.
+package valuetest
+
+import "github.com/paulsonkoly/calc/types/value"
+
+// MustMap is value.NewMap panicking on error.
+func MustMap(keys, values []value.Type) value.Type {
+	m, err := value.NewMap(keys, values)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
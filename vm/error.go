@@ -0,0 +1,157 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/paulsonkoly/calc/memory"
+	"github.com/paulsonkoly/calc/types/bytecode"
+	"github.com/paulsonkoly/calc/types/dbginfo"
+	"github.com/paulsonkoly/calc/types/value"
+)
+
+// windowSize is the number of instructions shown before and after the failing
+// instruction.
+const windowSize = 3
+
+// RuntimeError is an uncaught runtime error, with the state of the virtual
+// machine at the point of the error.
+type RuntimeError struct {
+	Err      error         // Err is the underlying error
+	Kind     string        // Kind is the error kind, as seen by the error values
+	Value    value.Type    // Value is the error value
+	IP       int           // IP is the address of the failing instruction
+	Instr    bytecode.Type // Instr is the failing instruction
+	Values   []value.Type  // Values are the operands of the failing instruction
+	Code     []Instruction // Code is the code around the failing instruction
+	Contexts []Context     // Contexts are the active memory contexts, innermost first
+	Loc      *dbginfo.Loc  // Loc is the source location of the failing instruction, nil if unknown
+}
+
+// Instruction is an instruction at an address.
+type Instruction struct {
+	IP    int
+	Instr bytecode.Type
+}
+
+// Context is the call stack of a memory context.
+type Context struct {
+	ID    string  // ID identifies the memory context
+	Calls []Frame // Calls are the function calls, innermost first
+	Err   error   // Err is the reason the call stack is incomplete, nil if complete
+}
+
+// Frame is a function call on the call stack.
+type Frame struct {
+	memory.Call
+	Loc *dbginfo.Loc // Loc is the source location of the call, nil if unknown
+}
+
+func (e *RuntimeError) Error() string {
+	if e.Loc != nil {
+		return fmt.Sprintf("%v: %v", e.Loc.Pos, e.Err)
+	}
+	return e.Err.Error()
+}
+
+func (e *RuntimeError) Unwrap() error { return e.Err }
+
+// Dump writes the error report with the disassembly around the failing
+// instruction and the stack of each memory context to w.
+func (e *RuntimeError) Dump(w io.Writer) {
+	fmt.Fprintf(w, "RUNTIME ERROR : %v\n", e.Err)
+	if e.Loc != nil {
+		fmt.Fprintf(w, "at %v\n", e.Loc.Pos)
+		fmt.Fprintln(w, e.Loc.Text)
+		fmt.Fprintln(w, e.Loc.Caret())
+	}
+
+	args := ""
+	sep := ""
+	for _, v := range e.Values {
+		args += sep + v.Abbrev()
+		sep = ", "
+	}
+
+	for _, c := range e.Code {
+		if c.IP == e.IP {
+			fmt.Fprintf(w, "--> %d: %v; %s\n", c.IP, c.Instr, args)
+		} else {
+			fmt.Fprintf(w, "    %d: %v\n", c.IP, c.Instr)
+		}
+	}
+
+	for _, ctx := range e.Contexts {
+		fmt.Fprintf(w, "memory context %s\n", ctx.ID)
+		fmt.Fprintln(w, "= stack =============================================")
+		for _, c := range ctx.Calls {
+			args := ""
+			sep := ""
+			for i, v := range c.Args {
+				args += fmt.Sprintf("%sarg[%d]: %s", sep, i, v.Abbrev())
+				sep = " "
+			}
+			fmt.Fprintf(w, "IP: %d %s() args: %s", c.IP, c.Name, args)
+			if c.Loc != nil {
+				fmt.Fprintf(w, " at %v", c.Loc.Pos)
+			}
+			fmt.Fprintln(w)
+			if c.Elided > 0 {
+				fmt.Fprintf(w, "... tail calls elided: %d\n", c.Elided)
+			}
+		}
+		if ctx.Err != nil {
+			fmt.Fprintf(w, "%v. giving up\n", ctx.Err)
+			continue
+		}
+		fmt.Fprintln(w, "=====================================================")
+	}
+}
+
+// runtimeError is the RuntimeError of the uncaught fault f.
+func (vm *Type) runtimeError(f *fault) *RuntimeError {
+	cs := *vm.CR.CS
+
+	e := &RuntimeError{Err: f.err, Value: f.val, IP: f.ip, Values: f.values}
+	if d, ok := f.val.ToError(); ok {
+		e.Kind = d.Kind
+	}
+	if f.ip < len(cs) {
+		e.Instr = cs[f.ip]
+	}
+	e.Loc = vm.lookup(f.ip)
+
+	start, end := max(0, f.ip-windowSize), min(len(cs), f.ip+windowSize)
+	for i, c := range cs[start:end] {
+		e.Code = append(e.Code, Instruction{IP: i + start, Instr: c})
+	}
+
+	e.Contexts = vm.contexts(f.ctx)
+
+	return e
+}
+
+// contexts are the call stacks of ctx and its parents, innermost first.
+func (vm *Type) contexts(ctx *context) []Context {
+	r := []Context{}
+	for ; ctx != nil; ctx = ctx.parent {
+		calls, err := ctx.m.CallStack(vm.CR.Dbg)
+		frames := make([]Frame, len(calls))
+		for i, c := range calls {
+			frames[i] = Frame{Call: c, Loc: vm.lookup(c.IP)}
+		}
+		r = append(r, Context{ID: ctx.id(), Calls: frames, Err: err})
+	}
+	return r
+}
+
+// lookup is the source location of the instruction at ip, nil if unknown.
+func (vm *Type) lookup(ip int) *dbginfo.Loc {
+	if vm.CR.Lines == nil {
+		return nil
+	}
+	if loc, ok := vm.CR.Lines.Lookup(ip); ok {
+		return &loc
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/paulsonkoly/calc/types/bytecode"
+	"github.com/paulsonkoly/calc/types/dbginfo"
+	"github.com/paulsonkoly/calc/types/value"
+)
+
+// Hook is called by the virtual machine before executing each instruction,
+// for debugging and tracing. The hook can inspect the state of the virtual
+// machine, and holds up the execution until it returns.
+type Hook interface {
+	Step(s State)
+}
+
+// Stopper is implemented by hooks that are notified when the virtual machine
+// stops running, before returning to the caller.
+type Stopper interface {
+	Stop()
+}
+
+// WithHook adds the hook h to the virtual machine. The output written by the
+// code so far is flushed before calling the hooks.
+func WithHook(h Hook) Option {
+	return func(vm *Type) {
+		vm.hooks = append(vm.hooks, h)
+		vm.checked = true
+	}
+}
+
+// State is the state of the virtual machine before executing an instruction.
+// It is only valid while the hook is called.
+type State struct {
+	IP    int           // IP is the address of the instruction
+	Instr bytecode.Type // Instr is the instruction
+	Tmp   value.Type    // Tmp is the temp register
+	vm    *Type
+	ctx   *context
+}
+
+// step calls the hooks with the state before executing instr at ip in ctx. It
+// returns ErrStopped if a hook stopped the program.
+func (vm *Type) step(ctx *context, ip int, instr bytecode.Type, tmp value.Type) error {
+	_ = vm.out.Flush()
+
+	s := State{IP: ip, Instr: instr, Tmp: tmp, vm: vm, ctx: ctx}
+	for _, h := range vm.hooks {
+		h.Step(s)
+	}
+
+	if vm.stopped {
+		vm.stopped = false
+		return ErrStopped
+	}
+	return nil
+}
+
+// stop notifies the hooks implementing Stopper.
+func (vm *Type) stop() {
+	for _, h := range vm.hooks {
+		if s, ok := h.(Stopper); ok {
+			s.Stop()
+		}
+	}
+}
+
+// Stop stops the program before executing the instruction. The run returns
+// ErrStopped to the caller.
+func (s State) Stop() { s.vm.stopped = true }
+
+// Loc is the source location of the instruction, nil if unknown.
+func (s State) Loc() *dbginfo.Loc { return s.vm.lookup(s.IP) }
+
+// LocAt is the source location of the instruction at ip, nil if unknown.
+func (s State) LocAt(ip int) *dbginfo.Loc { return s.vm.lookup(ip) }
+
+// Call describes the called function if the instruction is a function call.
+func (s State) Call() (dbginfo.Call, bool) {
+	if op := s.Instr.OpCode(); op != bytecode.CALL && op != bytecode.TAIL {
+		return dbginfo.Call{}, false
+	}
+	call, ok := (*s.vm.CR.Dbg)[s.IP]
+	return call, ok
+}
+
+// Func is the name of the innermost called function, as it was called, empty
+// outside of function calls.
+func (s State) Func() string {
+	ip, ok := s.CallSite()
+	if !ok {
+		return ""
+	}
+	return (*s.vm.CR.Dbg)[ip].Name
+}
+
+// CallSite is the address of the call of the innermost function call of the
+// memory context, or of the tail call that replaced it. It returns false
+// outside of function calls.
+func (s State) CallSite() (int, bool) { return s.ctx.m.CallSite() }
+
+// Operand is the value of the srcsel operand as the instruction fetches it,
+// without fetching it. It returns false for immediate operands, unused
+// operands and destinations.
+func (s State) Operand(srcsel int) (value.Type, bool) {
+	src, addr := s.src(srcsel)
+	if srcsel == 1 && s.Instr.OpCode() == bytecode.MOV {
+		return value.Nil, false
+	}
+
+	switch src {
+	case bytecode.AddrStck:
+		// the operands are fetched in the order of src0, src1, src2
+		n := 0
+		for i := range srcsel {
+			if prev, _ := s.src(i); prev == bytecode.AddrStck {
+				n++
+			}
+		}
+		return s.ctx.m.Peek(n)
+	case bytecode.AddrTmp:
+		return s.Tmp, true
+	case bytecode.AddrDS, bytecode.AddrCls, bytecode.AddrLcl, bytecode.AddrGbl:
+		return s.vm.fetch(src, addr, s.ctx.m, s.vm.CR.DS), true
+	}
+	return value.Nil, false
+}
+
+func (s State) src(srcsel int) (uint64, int) {
+	switch srcsel {
+	case 0:
+		return s.Instr.Src0(), s.Instr.Src0Addr()
+	case 1:
+		return s.Instr.Src1(), s.Instr.Src1Addr()
+	default:
+		return s.Instr.Src2(), s.Instr.Src2Addr()
+	}
+}
+
+// SP is the stack pointer of the memory context.
+func (s State) SP() int { return s.ctx.m.SP() }
+
+// Scopes are the lexical scopes enclosing the instruction, innermost first.
+func (s State) Scopes() []dbginfo.Scope {
+	if s.vm.CR.Scopes == nil {
+		return nil
+	}
+	return s.vm.CR.Scopes.Lookup(s.IP)
+}
+
+// Contexts identify the memory context executing the instruction, followed by
+// its parent contexts.
+func (s State) Contexts() []string {
+	ids := []string{}
+	for ctx := s.ctx; ctx != nil; ctx = ctx.parent {
+		ids = append(ids, ctx.id())
+	}
+	return ids
+}
+
+// Depth is the number of call frames in the memory context.
+func (s State) Depth() int { return s.ctx.m.CallDepth() }
+
+// Local is the local variable at frame index ix of the innermost call frame.
+// It returns false if there is no call frame.
+func (s State) Local(ix int) (value.Type, bool) {
+	if s.Depth() < 1 {
+		return value.Nil, false
+	}
+	return s.ctx.m.LookUpLocal(ix), true
+}
+
+// Closure is the local variable at frame index ix of the depth-th enclosing
+// lexical scope.
+func (s State) Closure(depth, ix int) value.Type { return s.ctx.m.LookUpClosure(depth, ix) }
+
+// Global is the global variable name, as seen by the running code.
+func (s State) Global(name string) value.Type { return s.ctx.m.LookUpGlobal(name) }
+
+// CallSites appends the addresses of the active function calls to buf,
+// innermost first, following the memory context to its parents.
+func (s State) CallSites(buf []int) []int {
+	for ctx := s.ctx; ctx != nil; ctx = ctx.parent {
+		n := len(buf)
+		buf = ctx.m.CallSites(buf)
+		// a child context starts with a copy of the frame it was created from
+		if ctx.parent != nil && ctx.parent.m.CallDepth() > 0 && len(buf) > n {
+			buf = buf[:len(buf)-1]
+		}
+	}
+	return buf
+}
+
+// Backtrace is the call stacks of the active memory contexts, innermost first.
+func (s State) Backtrace() []Context { return s.vm.contexts(s.ctx) }
+
+// id identifies ctx.
+func (ctx *context) id() string { return fmt.Sprintf("%08p", ctx) }
@@ -0,0 +1,118 @@
+package vm
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+
+	"github.com/paulsonkoly/calc/memory"
+	"github.com/paulsonkoly/calc/types/value"
+)
+
+// Limit errors.
+var (
+	ErrInstructionLimit = errors.New("instruction limit exceeded")
+	ErrSizeLimit        = errors.New("size limit exceeded")
+	ErrCanceled         = errors.New("evaluation canceled")
+)
+
+// pollInterval is the number of instructions executed between checking the
+// context for cancellation.
+const pollInterval = 1024
+
+// Limits are the execution limits of the virtual machine, for running
+// untrusted code. Zero means no limit.
+//
+// The instruction limit applies to each run, the code of a statement or a
+// function called from Go. The instruction limit and the cancellation of the
+// context are raised as errors, but as the code can't continue the error
+// handlers can't recover from them. The errors of the other limits can be
+// caught.
+type Limits struct {
+	Instructions int // Instructions is the number of instructions executed in a run
+	Depth        int // Depth is the call depth in a memory context
+	Stack        int // Stack is the stack size of a memory context in values
+	Size         int // Size is the length of the strings, arrays and maps created
+}
+
+// WithLimits sets the execution limits.
+func WithLimits(l Limits) Option {
+	return func(vm *Type) {
+		vm.limits = l
+		vm.main.m.SetLimits(l.Depth, l.Stack)
+		vm.limited = vm.limits != Limits{} || vm.ctx != nil
+		vm.checked = vm.limited || vm.hooks != nil
+	}
+}
+
+// SetContext sets the context the code runs in. The code is stopped with an
+// error when the context is done.
+func (vm *Type) SetContext(ctx gocontext.Context) {
+	vm.ctx = nil
+	if ctx.Done() != nil {
+		vm.ctx = ctx
+	}
+	vm.limited = vm.limits != Limits{} || vm.ctx != nil
+	vm.checked = vm.limited || vm.hooks != nil
+}
+
+// limit checks the limits before executing an instruction in memory m.
+func (vm *Type) limit(m *memory.Type) error {
+	vm.instrs++
+	if vm.limits.Instructions > 0 && vm.instrs > vm.limits.Instructions {
+		return ErrInstructionLimit
+	}
+
+	if vm.limits.Stack > 0 && m.SP() > vm.limits.Stack {
+		return memory.ErrStackLimit
+	}
+
+	if vm.ctx != nil && vm.canceled == nil && vm.instrs%pollInterval == 1 {
+		if err := vm.ctx.Err(); err != nil {
+			vm.canceled = fmt.Errorf("%w: %w", ErrCanceled, err)
+		}
+	}
+	return vm.canceled
+}
+
+// maxShiftBits is the largest bit length of the result of a left shift without
+// a size limit.
+const maxShiftBits = value.MaxShiftBits
+
+// shiftSized checks the bit length of the result of shifting a left by b
+// against the size limit, or against maxShiftBits without a size limit. The
+// check happens before the shift, that could run out of time or memory.
+func (vm *Type) shiftSized(a, b value.Type) error {
+	n, ok := b.ToInt()
+	if !ok {
+		return nil
+	}
+	l, ok := a.BitLen()
+	if !ok || l == 0 {
+		return nil
+	}
+
+	limit, err := maxShiftBits, value.ErrShift
+	if vm.limits.Size > 0 {
+		limit, err = vm.limits.Size, ErrSizeLimit
+	}
+	if n > limit-l {
+		return err
+	}
+	return nil
+}
+
+// sized checks the size of v against the size limit.
+func (vm *Type) sized(v value.Type) error {
+	if vm.limits.Size < 1 {
+		return nil
+	}
+	l, err := v.Len()
+	if err != nil {
+		return nil
+	}
+	if n, _ := l.ToInt(); n > vm.limits.Size {
+		return ErrSizeLimit
+	}
+	return nil
+}
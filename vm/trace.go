@@ -0,0 +1,54 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// TraceFilter selects the traced instructions.
+type TraceFilter struct {
+	Func string // Func is the name of the traced function, empty for all code
+	From int    // From is the first traced address
+	To   int    // To is the end of the traced addresses, exclusive, 0 for no limit
+}
+
+// traces determines whether the instruction at s is traced.
+func (f TraceFilter) traces(s State) bool {
+	if s.IP < f.From || (f.To > 0 && s.IP >= f.To) {
+		return false
+	}
+	return f.Func == "" || s.Func() == f.Func
+}
+
+// tracer is a hook logging the executed instructions.
+type tracer struct {
+	w      io.Writer
+	filter TraceFilter
+}
+
+// WithTrace logs the instructions selected by filter to w before executing
+// them. A line of the log has the address of the instruction, the memory
+// context, the instruction, the values of its operands from src2 to src0, in
+// the order the instruction prints them, the temp register, the stack pointer
+// and the call depth.
+func WithTrace(w io.Writer, filter TraceFilter) Option {
+	return WithHook(tracer{w: w, filter: filter})
+}
+
+// Step implements Hook.
+func (t tracer) Step(s State) {
+	if !t.filter.traces(s) {
+		return
+	}
+
+	ops := []string{}
+	for srcsel := 2; srcsel >= 0; srcsel-- {
+		if v, ok := s.Operand(srcsel); ok {
+			ops = append(ops, v.Abbrev())
+		}
+	}
+
+	fmt.Fprintf(t.w, "%8d | %s | %v| %s | tmp %s | sp %d | depth %d\n",
+		s.IP, s.ctx.id(), s.Instr, strings.Join(ops, " "), s.Tmp.Abbrev(), s.SP(), s.Depth())
+}
@@ -6,10 +6,10 @@ import (
 	"container/list"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"slices"
-	"strconv"
 
 	"github.com/paulsonkoly/calc/memory"
 	"github.com/paulsonkoly/calc/types/bytecode"
@@ -22,8 +22,42 @@ import (
 var (
 	ErrConversion = errors.New("conversion error")
 	ErrArity      = errors.New("arity mismatch")
+	ErrRaise      = errors.New("uncaught error")
+
+	// ErrStopped is the error of a program stopped before the end of its code.
+	// The code can't catch it, and it isn't reported as a runtime error.
+	ErrStopped = errors.New("program stopped")
 )
 
+// ExitError is the error of a program ended by exit, with the exit status.
+// It is an ErrStopped.
+type ExitError struct {
+	Status int // Status is the exit status, 255 if exit was called with a non integer
+}
+
+func (e *ExitError) Error() string { return fmt.Sprintf("exit status %d", e.Status) }
+
+func (e *ExitError) Unwrap() error { return ErrStopped }
+
+// kinds are the error kinds of the runtime errors, as seen by the error values.
+var kinds = [...]struct {
+	err  error
+	kind string
+}{
+	{value.ErrNil, "nil"},
+	{value.ErrType, "type"},
+	{value.ErrZeroDiv, "zero division"},
+	{value.ErrIndex, "index"},
+	{value.ErrShift, "shift"},
+	{ErrArity, "arity"},
+	{ErrConversion, "conversion"},
+	{ErrInstructionLimit, "instruction limit"},
+	{memory.ErrDepthLimit, "depth limit"},
+	{memory.ErrStackLimit, "stack limit"},
+	{ErrSizeLimit, "size limit"},
+	{ErrCanceled, "canceled"},
+}
+
 const (
 	minAllocContexts = 16
 )
@@ -33,25 +67,164 @@ type context struct {
 	m        *memory.Type                  // variables
 	parent   *context                      // parent context
 	children *intmap.Map[uint64, *context] // child contexts
+	handlers []handler                     // error handlers of the enclosing try blocks
+}
+
+// handler is an installed error handler.
+type handler struct {
+	ip    int // ip is the start of the catch block
+	ctxID int // ctxID is the first child context created in the try block
+	depth int // depth is the call depth of the try block
+	sp    int // sp is the stack pointer at the start of the try block
+}
+
+// fault is a raised error, unwinding the contexts until it's caught.
+type fault struct {
+	ctx    *context     // ctx is the context raising the error
+	ip     int          // ip is the address of the raising instruction
+	err    error        // err is the error reported if the fault is not caught
+	val    value.Type   // val is the error value passed to the catch block
+	values []value.Type // values are the operands of the raising instruction
 }
 
 type Type struct {
-	main *context        // main context
-	CR   compresult.Type // cr is the compilation result
+	main   *context        // main context
+	CR     compresult.Type // cr is the compilation result
+	in     *bufio.Reader   // in is where read reads from
+	out    *bufio.Writer   // out is where write writes to
+	errOut io.Writer       // errOut is where runtime errors are reported
+	hooks  []Hook          // hooks are called before executing each instruction
+
+	limits   Limits                   // limits are the execution limits
+	limited  bool                     // limited is set if there are limits to check
+	stopped  bool                     // stopped is set when a hook stopped the program
+	checked  bool                     // checked is set if there are hooks or limits, the instructions are checked before executing them
+	ctx      interface{ Err() error } // ctx is the context the code runs in, nil if it's never done
+	instrs   int                      // instrs is the number of instructions executed in the run
+	canceled error                    // canceled is the error of the context once done
 }
 
+// Option is a virtual machine option.
+type Option func(*Type)
+
+// WithIn sets the reader read reads from. The default is stdin.
+func WithIn(r io.Reader) Option { return func(vm *Type) { vm.in = bufio.NewReader(r) } }
+
+// WithOut sets the writer write writes to. The default is stdout. The output is
+// buffered, and flushed when the virtual machine stops running or reads input.
+func WithOut(w io.Writer) Option { return func(vm *Type) { vm.out = bufio.NewWriter(w) } }
+
+// WithErrOut sets the writer runtime errors are reported to. The default is
+// stdout.
+func WithErrOut(w io.Writer) Option { return func(vm *Type) { vm.errOut = w } }
+
 // New creates a new virtual machine using memory from m and code and data from cr.
-func New(m *memory.Type, cr compresult.Type) *Type {
+func New(m *memory.Type, cr compresult.Type, opts ...Option) *Type {
 	contexts := intmap.New[uint64, *context](minAllocContexts)
 	main := context{m: m, children: contexts}
-	return &Type{main: &main, CR: cr}
+	vm := &Type{
+		main:   &main,
+		CR:     cr,
+		in:     bufio.NewReader(os.Stdin),
+		out:    bufio.NewWriter(os.Stdout),
+		errOut: os.Stdout,
+	}
+	for _, opt := range opts {
+		opt(vm)
+	}
+	return vm
 }
 
+// ErrOut is the writer runtime errors are reported to.
+func (vm *Type) ErrOut() io.Writer { return vm.errOut }
+
 // Run executes the run loop.
-// nolint:maintidx // the only thing we care about here is making it faster
 func (vm *Type) Run(retResult bool) (value.Type, error) {
 	ctxp := vm.main
+	freeList := list.New()
+	vm.instrs = 0
+	vm.canceled = nil
+
+	if vm.hooks != nil {
+		defer vm.stop()
+	}
+
+	for {
+		v, f := vm.run(ctxp, freeList, retResult)
+		if f == nil {
+			if err := vm.out.Flush(); err != nil {
+				return value.Nil, fmt.Errorf("write error %w", err)
+			}
+			return v, nil
+		}
+
+		if ctxp = vm.catch(f, freeList); ctxp == nil {
+			// the output written before the error precedes the error report
+			_ = vm.out.Flush()
+			return vm.fail(f)
+		}
+	}
+}
+
+// SetIP sets the address the next run starts at, skipping the code before it
+// not run yet.
+func (vm *Type) SetIP(ip int) { vm.main.ip = ip }
+
+// Call calls the function fn with args, and returns its result.
+//
+// It must not be called while the virtual machine is running.
+func (vm *Type) Call(fn value.Type, args ...value.Type) (value.Type, error) {
+	f, ok := fn.ToFunction()
+	if !ok {
+		return value.Nil, value.ErrType
+	}
+
+	if f.ParamCnt != len(args) {
+		return value.Nil, ErrArity
+	}
+
+	if f.Native != nil {
+		return f.Native.Fn(args)
+	}
+
+	m := vm.main.m
+	for _, arg := range args {
+		m.Push(arg)
+	}
+	if err := m.PushFrame(len(args), f.LocalCnt); err != nil {
+		m.PopN(len(args))
+		return value.Nil, err
+	}
+	m.PushClosure(f.Env)
+	// returning to the end of the code finishes the run with the result on the stack
+	m.Push(value.NewInt(len(*vm.CR.CS) - 1))
+
+	vm.main.ip = f.Node
+
+	return vm.Run(true)
+}
 
+// check calls the hooks and checks the limits before executing instr at ip
+// in ctxp with memory m.
+func (vm *Type) check(ctxp *context, m *memory.Type, ip int, instr bytecode.Type, tmp value.Type) error {
+	if vm.hooks != nil {
+		if err := vm.step(ctxp, ip, instr, tmp); err != nil {
+			return err
+		}
+	}
+
+	// the module frame is pushed and popped regardless of the limits, so a
+	// module failing to load leaves the global frame of the importer in place
+	if opCode := instr.OpCode(); vm.limited && opCode != bytecode.MODULE && opCode != bytecode.ENDMODULE {
+		return vm.limit(m)
+	}
+	return nil
+}
+
+// run executes the run loop from ctxp until the code finishes or an error is
+// raised.
+// nolint:maintidx // the only thing we care about here is making it faster
+func (vm *Type) run(ctxp *context, freeList *list.List, retResult bool) (value.Type, *fault) {
 	m := ctxp.m
 	ip := ctxp.ip
 	ds := vm.CR.DS
@@ -62,13 +235,15 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 
 	var err error
 
-	freeList := list.New()
-
 	for ip < len(*cs) {
 		instr := (*cs)[ip]
 
-		// TODO allow tracing flag
-		// fmt.Printf("%8d | %8p | %v\n", ip, ctxp, instr)
+		// a single test keeps the instructions fast without hooks and limits
+		if vm.checked {
+			if err := vm.check(ctxp, m, ip, instr, tmp); err != nil {
+				return ctxp.fault(ip, err)
+			}
+		}
 
 		opCode := instr.OpCode()
 
@@ -78,8 +253,11 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 			src1 := vm.fetch(instr.Src1(), instr.Src1Addr(), m, ds)
 
 			val, err := src1.Arith(opCode, src0)
+			if err == nil {
+				err = vm.sized(val)
+			}
 			if err != nil {
-				return vm.dumpStack(ctxp, ip, err, src1, src0)
+				return ctxp.fault(ip, err, src1, src0)
 			}
 
 			m.Push(val)
@@ -88,8 +266,11 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 			src0 := vm.fetch(instr.Src0(), instr.Src0Addr(), m, ds)
 
 			tmp, err = tmp.Arith(opCode-bytecode.ADDTMP+bytecode.ADD, src0)
+			if err == nil {
+				err = vm.sized(tmp)
+			}
 			if err != nil {
-				return vm.dumpStack(ctxp, ip, err, src0)
+				return ctxp.fault(ip, err, src0)
 			}
 
 		case bytecode.INC:
@@ -97,7 +278,7 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 
 			val, err := src0.Arith(bytecode.ADD, value.NewInt(1))
 			if err != nil {
-				return vm.dumpStack(ctxp, ip, err, src0)
+				return ctxp.fault(ip, err, src0)
 			}
 			src0T := instr.Src0()
 
@@ -121,7 +302,7 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 
 			val, err := src1.Mod(src0)
 			if err != nil {
-				return vm.dumpStack(ctxp, ip, err, src1, src0)
+				return ctxp.fault(ip, err, src1, src0)
 			}
 
 			m.Push(val)
@@ -131,7 +312,7 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 
 			tmp, err = tmp.Mod(src0)
 			if err != nil {
-				return vm.dumpStack(ctxp, ip, err, src0)
+				return ctxp.fault(ip, err, src0)
 			}
 
 		case bytecode.AND, bytecode.OR:
@@ -140,7 +321,7 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 
 			val, err := src1.Logic(opCode, src0)
 			if err != nil {
-				return vm.dumpStack(ctxp, ip, err, src1, src0)
+				return ctxp.fault(ip, err, src1, src0)
 			}
 
 			m.Push(val)
@@ -150,16 +331,23 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 
 			tmp, err = tmp.Logic(opCode-bytecode.ANDTMP+bytecode.AND, src0)
 			if err != nil {
-				return vm.dumpStack(ctxp, ip, err, src0)
+				return ctxp.fault(ip, err, src0)
 			}
 
 		case bytecode.LSH, bytecode.RSH:
 			src0 := vm.fetch(instr.Src0(), instr.Src0Addr(), m, ds)
 			src1 := vm.fetch(instr.Src1(), instr.Src1Addr(), m, ds)
 
-			val, err := src1.Shift(opCode, src0)
+			var val value.Type
+			var err error
+			if opCode == bytecode.LSH {
+				err = vm.shiftSized(src1, src0)
+			}
+			if err == nil {
+				val, err = src1.Shift(opCode, src0)
+			}
 			if err != nil {
-				return vm.dumpStack(ctxp, ip, err, src1, src0)
+				return ctxp.fault(ip, err, src1, src0)
 			}
 
 			m.Push(val)
@@ -167,16 +355,22 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 		case bytecode.LSHTMP, bytecode.RSHTMP:
 			src0 := vm.fetch(instr.Src0(), instr.Src0Addr(), m, ds)
 
-			tmp, err = tmp.Shift(opCode-bytecode.LSHTMP+bytecode.LSH, src0)
+			var err error
+			if opCode == bytecode.LSHTMP {
+				err = vm.shiftSized(tmp, src0)
+			}
+			if err == nil {
+				tmp, err = tmp.Shift(opCode-bytecode.LSHTMP+bytecode.LSH, src0)
+			}
 			if err != nil {
-				return vm.dumpStack(ctxp, ip, err, src0)
+				return ctxp.fault(ip, err, src0)
 			}
 
 		case bytecode.NOT:
 			src0 := vm.fetch(instr.Src0(), instr.Src0Addr(), m, ds)
 			val, err := src0.Not()
 			if err != nil {
-				return vm.dumpStack(ctxp, ip, err, src0)
+				return ctxp.fault(ip, err, src0)
 			}
 
 			m.Push(val)
@@ -184,14 +378,14 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 		case bytecode.NOTTMP:
 			tmp, err = tmp.Not()
 			if err != nil {
-				return vm.dumpStack(ctxp, ip, err)
+				return ctxp.fault(ip, err)
 			}
 
 		case bytecode.FLIP:
 			src0 := vm.fetch(instr.Src0(), instr.Src0Addr(), m, ds)
 			val, err := src0.Flip()
 			if err != nil {
-				return vm.dumpStack(ctxp, ip, err, src0)
+				return ctxp.fault(ip, err, src0)
 			}
 
 			m.Push(val)
@@ -199,7 +393,7 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 		case bytecode.FLIPTMP:
 			tmp, err = tmp.Flip()
 			if err != nil {
-				return vm.dumpStack(ctxp, ip, err)
+				return ctxp.fault(ip, err)
 			}
 
 		case bytecode.LT, bytecode.GT, bytecode.LE, bytecode.GE:
@@ -208,7 +402,7 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 
 			val, err := src1.Relational(opCode, src0)
 			if err != nil {
-				return vm.dumpStack(ctxp, ip, err, src1, src0)
+				return ctxp.fault(ip, err, src1, src0)
 			}
 
 			m.Push(val)
@@ -218,7 +412,7 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 
 			tmp, err = tmp.Relational(opCode-bytecode.LTTMP+bytecode.LT, src0)
 			if err != nil {
-				return vm.dumpStack(ctxp, ip, err, src0)
+				return ctxp.fault(ip, err, src0)
 			}
 
 		case bytecode.EQ, bytecode.NE:
@@ -227,7 +421,7 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 
 			val, err := src1.Eq(opCode, src0)
 			if err != nil {
-				return vm.dumpStack(ctxp, ip, err, src1, src0)
+				return ctxp.fault(ip, err, src1, src0)
 			}
 
 			m.Push(val)
@@ -237,7 +431,7 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 
 			tmp, err = tmp.Eq(opCode-bytecode.EQTMP+bytecode.EQ, src0)
 			if err != nil {
-				return vm.dumpStack(ctxp, ip, err, src0)
+				return ctxp.fault(ip, err, src0)
 			}
 
 		case bytecode.LEN:
@@ -245,7 +439,7 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 
 			val, err := src0.Len()
 			if err != nil {
-				return vm.dumpStack(ctxp, ip, err, src0)
+				return ctxp.fault(ip, err, src0)
 			}
 
 			m.Push(val)
@@ -253,7 +447,7 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 		case bytecode.LENTMP:
 			tmp, err = tmp.Len()
 			if err != nil {
-				return vm.dumpStack(ctxp, ip, err)
+				return ctxp.fault(ip, err)
 			}
 
 		case bytecode.IX1:
@@ -262,7 +456,7 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 
 			val, err := src1.Index(src0)
 			if err != nil {
-				return vm.dumpStack(ctxp, ip, err, src1, src0)
+				return ctxp.fault(ip, err, src1, src0)
 			}
 
 			m.Push(val)
@@ -274,7 +468,7 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 
 			val, err := src2.Index(src1, src0)
 			if err != nil {
-				return vm.dumpStack(ctxp, ip, err, src2, src1, src0)
+				return ctxp.fault(ip, err, src2, src1, src0)
 			}
 
 			m.Push(val)
@@ -291,7 +485,7 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 			b, ok := src0.ToBool()
 
 			if !ok {
-				return vm.dumpStack(ctxp, ip, value.ErrType, src0)
+				return ctxp.fault(ip, value.ErrType, src0)
 			}
 			if (opCode == bytecode.JMPF && !b) || (opCode == bytecode.JMPT && b) {
 				ip += src1Imm - 1
@@ -316,7 +510,7 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 			}
 
 			if val.IsNil() {
-				return vm.dumpStack(ctxp, ip, value.ErrNil, val)
+				return ctxp.fault(ip, value.ErrNil, val)
 			}
 
 			src1T := instr.Src1()
@@ -346,34 +540,90 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 				log.Panicf("cannot convert value to array\n %8d | %v\n", ip, instr)
 			}
 
+			if vm.limits.Size > 0 && len(slc) >= vm.limits.Size {
+				return ctxp.fault(ip, ErrSizeLimit, ary, val)
+			}
+
 			slc = slices.Clone(slc)
 			slc = append(slc, val)
 
 			val = value.NewArray(slc)
 			m.Push(val)
 
+		case bytecode.MAP:
+			val := vm.fetch(instr.Src0(), instr.Src0Addr(), m, ds)
+			key := vm.fetch(instr.Src1(), instr.Src1Addr(), m, ds)
+			mp := vm.fetch(instr.Src2(), instr.Src2Addr(), m, ds)
+
+			// the map of the literal is copied from the data segment by the first
+			// entry, the following entries insert into the copy on the stack
+			var nmp value.Type
+			var err error
+			if src2 := instr.Src2(); src2 == bytecode.AddrStck || src2 == bytecode.AddrTmp {
+				nmp, err = mp, mp.Insert(key, val)
+			} else {
+				nmp, err = mp.Put(key, val)
+			}
+			if err == nil {
+				err = vm.sized(nmp)
+			}
+			if err != nil {
+				return ctxp.fault(ip, err, mp, key, val)
+			}
+
+			m.Push(nmp)
+
 		case bytecode.FUNC:
 			val := vm.fetch(instr.Src0(), instr.Src0Addr(), m, ds)
-			frame := m.Top()
-			val.SetFrame(&frame)
+			val.SetEnv(m.Env())
 			m.Push(val)
 
-		case bytecode.CALL:
+		case bytecode.CALL, bytecode.TAIL:
 			f := vm.fetch(instr.Src0(), instr.Src0Addr(), m, ds)
 			args := instr.Src1Addr()
 
 			fVal, ok := f.ToFunction()
 
 			if !ok {
-				return vm.dumpStack(ctxp, ip, value.ErrType, f)
+				return ctxp.fault(ip, value.ErrType, f)
 			}
 
 			if fVal.ParamCnt != args {
-				return vm.dumpStack(ctxp, ip, ErrArity, f)
+				return ctxp.fault(ip, ErrArity, f)
 			}
 
-			m.PushFrame(args, fVal.LocalCnt)
-			m.PushClosure(*fVal.Frame)
+			if fVal.Native != nil {
+				argv := m.PopN(args)
+				val, err := fVal.Native.Fn(argv)
+				if err == nil {
+					err = vm.sized(val)
+				}
+				if err != nil {
+					return ctxp.fault(ip, err, argv...)
+				}
+
+				m.Push(val)
+				break
+			}
+
+			// a tail call reuses the frame of the current call, and returns where it
+			// would return
+			if nip := m.IP(); opCode == bytecode.TAIL && nip != nil {
+				lip := *nip
+				if err := m.ReplaceFrame(ip, args, fVal.LocalCnt); err != nil {
+					return ctxp.fault(ip, err, f)
+				}
+				m.PushClosure(fVal.Env)
+				m.Push(lip)
+
+				ip = fVal.Node - 1
+				break
+			}
+
+			if err := m.PushFrame(args, fVal.LocalCnt); err != nil {
+				return ctxp.fault(ip, err, f)
+			}
+			m.PushClosure(fVal.Env)
 			m.Push(value.NewInt(ip))
 
 			ip = fVal.Node - 1
@@ -381,12 +631,6 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 		case bytecode.RET:
 			val := vm.fetch(instr.Src0(), instr.Src0Addr(), m, ds)
 
-			f, ok := val.ToFunction()
-			if ok && f.Frame != nil {
-				frame := slices.Clone(*f.Frame)
-				val.SetFrame(&frame)
-			}
-
 			nip := m.IP()
 			if nip == nil {
 				m.ResetSP()
@@ -421,6 +665,7 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 				m = m.Clone(childCtx.m)
 				childCtx.m = m
 				childCtx.parent = ctxp
+				childCtx.handlers = childCtx.handlers[:0]
 			} else {
 				m = m.Clone(nil)
 				childCtx = &context{m: m, parent: ctxp, children: intmap.New[uint64, *context](minAllocContexts)}
@@ -486,51 +731,99 @@ func (vm *Type) Run(retResult bool) (value.Type, error) {
 				m.Push(tmp)
 			}
 
+		case bytecode.TRY:
+			ctxp.handlers = append(ctxp.handlers,
+				handler{ip: ip + instr.Src0Addr(), ctxID: instr.Src1Addr(), depth: m.CallDepth(), sp: m.SP()})
+
+		case bytecode.UNTRY:
+			ctxp.handlers = ctxp.handlers[:len(ctxp.handlers)-instr.Src0Addr()]
+
+		case bytecode.RAISE:
+			val := vm.fetch(instr.Src0(), instr.Src0Addr(), m, ds)
+
+			errVal := val
+			if _, ok := val.ToError(); !ok {
+				errVal = newError(val)
+			}
+
+			return value.Nil, &fault{ctx: ctxp, ip: ip, err: uncaught(errVal), val: errVal, values: []value.Type{val}}
+
 		case bytecode.READ:
-			b := bufio.NewReader(os.Stdin)
-			line, err := b.ReadString('\n')
+			// prompts written before reading are visible to the user
+			if err := vm.out.Flush(); err != nil {
+				return ctxp.fault(ip, fmt.Errorf("write error %w", err))
+			}
+			line, err := vm.in.ReadString('\n')
 			if err != nil {
-				return vm.dumpStack(ctxp, ip, fmt.Errorf("read error %w", err))
+				return ctxp.fault(ip, fmt.Errorf("read error %w", err))
+			}
+			val := value.NewString(line)
+			if err := vm.sized(val); err != nil {
+				return ctxp.fault(ip, err)
 			}
-			m.Push(value.NewString(line))
+			m.Push(val)
 
 		case bytecode.WRITE:
 			val := vm.fetch(instr.Src0(), instr.Src0Addr(), m, ds)
-			fmt.Print(val)
+			fmt.Fprint(vm.out, val)
 			m.Push(value.Nil)
 
-		case bytecode.ATON:
+		case bytecode.EXIT:
 			val := vm.fetch(instr.Src0(), instr.Src0Addr(), m, ds)
-
-			sv, ok := val.ToString()
+			i, ok := val.ToInt()
 			if !ok {
-				return vm.dumpStack(ctxp, ip, value.ErrType, val)
+				i = 255
 			}
+			return ctxp.fault(ip, &ExitError{Status: i}, val)
 
-			if v, err := strconv.Atoi(string(sv)); err == nil {
-				m.Push(value.NewInt(v))
-				break
-			}
+		case bytecode.KEYS:
+			val := vm.fetch(instr.Src0(), instr.Src0Addr(), m, ds)
 
-			if v, err := strconv.ParseFloat(string(sv), 64); err == nil {
-				m.Push(value.NewFloat(v))
-				break
+			keys, err := val.Keys()
+			if err != nil {
+				return ctxp.fault(ip, err, val)
 			}
 
-			return vm.dumpStack(ctxp, ip, ErrConversion, val)
+			m.Push(keys)
 
-		case bytecode.TOA:
+		case bytecode.ERROR:
 			val := vm.fetch(instr.Src0(), instr.Src0Addr(), m, ds)
-			val = value.NewString(val.String())
-			m.Push(val)
+			m.Push(newError(val))
 
-		case bytecode.EXIT:
-			val := vm.fetch(instr.Src0(), instr.Src0Addr(), m, ds)
-			i, ok := val.ToInt()
+		case bytecode.MODULE:
+			path := vm.fetch(instr.Src0(), instr.Src0Addr(), m, ds)
+			name := vm.fetch(instr.Src1(), instr.Src1Addr(), m, ds)
+
+			m.PushModule(path.String(), value.NewModule(name.String()))
+
+		case bytecode.ENDMODULE:
+			m.PopModule()
+
+		case bytecode.IMPORT:
+			path := vm.fetch(instr.Src0(), instr.Src0Addr(), m, ds)
+
+			module, ok := m.Module(path.String())
+			if !ok {
+				log.Panicf("module %s not loaded\n %8d | %v\n", path, ip, instr)
+			}
+
+			m.Push(module)
+
+		case bytecode.MEMBER:
+			name := vm.fetch(instr.Src0(), instr.Src0Addr(), m, ds)
+			src1 := vm.fetch(instr.Src1(), instr.Src1Addr(), m, ds)
+
+			module, ok := src1.ToModule()
+			if !ok {
+				return ctxp.fault(ip, value.ErrType, src1, name)
+			}
+
+			val, ok := module.Globals[name.String()]
 			if !ok {
-				os.Exit(255)
+				return ctxp.fault(ip, value.ErrIndex, src1, name)
 			}
-			os.Exit(i)
+
+			m.Push(val)
 
 		default:
 			log.Panicf("unknown opcode: %v\n %8d | %v\n", opCode, ip, instr)
@@ -555,7 +848,7 @@ func (vm *Type) fetch(src uint64, addr int, m *memory.Type, ds *[]value.Type) va
 	case bytecode.AddrDS:
 		return (*ds)[addr]
 	case bytecode.AddrCls:
-		return m.LookUpClosure(addr)
+		return m.LookUpClosure(bytecode.DecodeCls(addr))
 	case bytecode.AddrLcl:
 		return m.LookUpLocal(addr)
 	case bytecode.AddrGbl:
@@ -570,43 +863,120 @@ func (vm *Type) fetch(src uint64, addr int, m *memory.Type, ds *[]value.Type) va
 	panic("unreachable code")
 }
 
-func (vm *Type) dumpStack(ctx *context, ip int, err error, values ...value.Type) (value.Type, error) {
-	fmt.Printf("RUNTIME ERROR : %v\n", err)
+// fail reports the uncaught fault f, and resets the state for the next run.
+// Stopping the program is not reported.
+func (vm *Type) fail(f *fault) (value.Type, error) {
+	err := f.err
+	if !errors.Is(err, ErrStopped) {
+		rErr := vm.runtimeError(f)
+		rErr.Dump(vm.errOut)
+		err = rErr
+	}
+
+	// reset state for the next run
+	vm.main.m.Reset()
+	vm.main.ip = len(*vm.CR.CS)
+	vm.main.children.Clear()
+	vm.main.handlers = vm.main.handlers[:0]
 
-	args := ""
-	sep := ""
-	for _, v := range values {
-		args += sep + v.Abbrev()
-		sep = ", "
+	return value.Nil, err
+}
+
+// fault raises err in ctx at ip. The operands of the raising instruction are
+// values.
+func (ctx *context) fault(ip int, err error, values ...value.Type) (value.Type, *fault) {
+	val := value.NewError(kind(err), err.Error(), value.Nil)
+	return value.Nil, &fault{ctx: ctx, ip: ip, err: err, val: val, values: values}
+}
+
+// catch finds the innermost handler of f, unwinding the contexts and the
+// memory of the handler to the state at the start of the try block. It returns
+// the context to continue with, or nil if the error is not caught.
+//
+// The instruction limit, the cancellation and stopping the program are not
+// caught, the code can't continue after them, and the error is reported where
+// it was raised.
+func (vm *Type) catch(f *fault, freeList *list.List) *context {
+	if errors.Is(f.err, ErrInstructionLimit) || errors.Is(f.err, ErrCanceled) || errors.Is(f.err, ErrStopped) {
+		return nil
+	}
+
+	ctxp := f.ctx
+	for ctxp != nil && len(ctxp.handlers) < 1 {
+		ctxp = ctxp.parent
 	}
 
-	start, end := max(0, ip-3), min(len(*vm.CR.CS), ip+3)
+	if ctxp == nil {
+		return nil
+	}
+
+	h := ctxp.handlers[len(ctxp.handlers)-1]
+	ctxp.handlers = ctxp.handlers[:len(ctxp.handlers)-1]
+
+	// destroy the contexts created in the try block
+	hshs := []uint64{}
+	ctxp.children.ForEach(func(hsh uint64, _ *context) bool {
+		if depth, id := unhashContext(hsh); depth > h.depth || (depth == h.depth && id >= h.ctxID) {
+			hshs = append(hshs, hsh)
+		}
+		return true
+	})
 
-	for i, v := range (*vm.CR.CS)[start:end] {
-		if i+start == ip {
-			fmt.Printf("--> %d: %v; %s\n", i+start, v, args)
-		} else {
-			fmt.Printf("    %d: %v\n", i+start, v)
+	for _, hsh := range hshs {
+		if child, ok := ctxp.children.Get(hsh); ok {
+			deleteContext(child, freeList)
+			ctxp.children.Del(hsh)
 		}
 	}
 
-	for ; ctx != nil; ctx = ctx.parent {
-		fmt.Printf("memory context %08p\n", ctx)
-		m := ctx.m
-		m.DumpStack(vm.CR.Dbg)
+	ctxp.m.Unwind(h.depth, h.sp)
+	ctxp.m.Push(f.val)
+	ctxp.ip = h.ip
+
+	return ctxp
+}
+
+// newError is the error value of v. Strings are the error message, other
+// values are converted to string.
+func newError(v value.Type) value.Type {
+	msg, ok := v.ToString()
+	if !ok {
+		msg = v.String()
 	}
-	// reset state for the next run
-	vm.main.m.Reset()
-	vm.main.ip = len(*vm.CR.CS)
-	vm.main.children.Clear()
+	return value.NewError("error", msg, v)
+}
 
-	return value.Nil, err
+// kind is the error kind of err.
+func kind(err error) string {
+	for _, k := range kinds {
+		if errors.Is(err, k.err) {
+			return k.kind
+		}
+	}
+	return "runtime"
+}
+
+// uncaught is the error returned for the error value v if it's not caught.
+// Runtime errors that were caught and raised again return the original error.
+func uncaught(v value.Type) error {
+	e, _ := v.ToError()
+	for _, k := range kinds {
+		if e.Kind == k.kind {
+			return k.err
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrRaise, e.Message)
 }
 
 func hashContext(m *memory.Type, id int) uint64 {
 	return (uint64(m.CallDepth()) << 15) ^ uint64(id)
 }
 
+// unhashContext is the call depth and the context id of a context hash.
+func unhashContext(hsh uint64) (int, int) {
+	return int(hsh >> 15), int(hsh & (1<<15 - 1))
+}
+
 func deleteContext(ctxp *context, freeList *list.List) {
 	ctxp.children.ForEach(func(_ uint64, child *context) bool {
 		deleteContext(child, freeList)